@@ -0,0 +1,1382 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// To run directly from source:
+// $ go run ./cmd/scanner path/to/nv-kernel.o_binary output-dir
+//
+// To make a reusable binary:
+// $ go build ./cmd/scanner
+// $ ./scanner path/to/nv-kernel.o_binary output-dir
+//
+// Flags go before the positional arguments:
+// $ ./scanner -chipset gk107 path/to/nv-kernel.o_binary output-dir
+// $ ./scanner -q -out output-dir path/to/nv-kernel.o_binary
+//
+// Or, naming the command, which is how the other commands are run:
+// $ ./scanner scan path/to/nv-kernel.o_binary output-dir
+//
+// Or a whole driver, picking how to extract it by its version:
+// $ ./scanner NVIDIA-Linux-x86_64-390.48.run output-dir
+//
+// Or every object and firmware file in an extracted one:
+// $ ./scanner -input-dir NVIDIA-Linux-x86_64-535.54.03 output-dir
+//
+// To scan several objects at once, each into a directory under output-dir:
+// $ ./scanner -jobs 4 -out output-dir 390.48/nv-kernel.o_binary 410.57/nv-kernel.o_binary
+//
+// To recover the firmware from a memory dump or core file:
+// $ ./scanner -dump memory.bin output-dir
+//
+// To see what would be extracted, without writing anything:
+// $ ./scanner list path/to/nv-kernel.o_binary
+//
+// To split up a netlist archive that was extracted some other way:
+// $ ./scanner unpack NET_IMG_07.bin output-dir
+//
+// And to put one back together, e.g. after patching an entry:
+// $ ./scanner pack output-dir/NET_IMG_07 NET_IMG_07.bin
+//
+// To check an earlier extraction against fingerprints recorded from
+// a good one:
+// $ ./scanner verify -fingerprints good.json -driver-version 390.48 output-dir
+//
+// To compare two extractions, each an output directory or an object:
+// $ ./scanner diff old-output-dir path/to/new/nv-kernel.o_binary
+//
+// To scan a directory of .run packages and/or extracted drivers:
+// $ ./scanner batch [-db blobs.sqlite] [-cache dir] drivers-dir output-root
+//
+// To find which of the drivers batch recorded have a firmware file:
+// $ ./scanner which -db blobs.sqlite nouveau/nv84_xuc103
+//
+// To extract the firmware of an old driver, as extract_firmware.py did:
+// $ ./scanner legacy NVIDIA-Linux-x86-340.108 output-dir
+//
+// To download a driver from NVIDIA and extract its firmware:
+// $ ./scanner fetch 390.48 output-dir
+//
+// To take the falcon ucode out of a VBIOS dump:
+// $ ./scanner vbios vbios.rom output-dir
+//
+// To split up the nvgpu firmware of a Jetson (L4T) BSP:
+// $ ./scanner tegra Jetson_Linux_R35.4.1_aarch64.tbz2 output-dir
+//
+// To find which blobs hold a register address, string or bytes:
+// $ ./scanner grep -reg 0x409800 NVIDIA-Linux-x86_64-390.48.run
+//
+// To check the firmware installed for a GPU against a driver:
+// $ ./scanner check -chipset gk107 NVIDIA-Linux-x86_64-390.48.run /lib/firmware
+//
+// To extract just the firmware nouveau couldn't find:
+// $ dmesg | ./scanner dmesg NVIDIA-Linux-x86_64-390.48.run /lib/firmware
+//
+// To run scans for HTTP clients, who upload an object or name a driver:
+// $ ./scanner serve -listen :8080 -root /srv/drivers
+//
+// To check that the build works, on an object it makes up itself:
+// $ ./scanner selftest
+//
+// Tested on 387.34, 390.48 and 410.57 blobs. Should work on a wider range.
+
+package main
+
+import "archive/tar"
+import "context"
+import "errors"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "os/signal"
+import "path"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "sync"
+import "syscall"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/eluscan"
+import "github.com/envytools/firmware/pkg/extract"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// The scanner does a few related jobs, each its own command. With
+// no command name, the arguments are for scan.
+type command struct {
+	Name, Args, Help string
+	Run func(flags *flag.FlagSet, args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"scan", "[flags] nv-kernel.o_binary|- output-dir",
+			"extract the firmware from a driver object", scanMain},
+		{"list", "[flags] nv-kernel.o_binary|-",
+			"list what scan would extract, without writing anything",
+			listMain},
+		{"unpack", "[flags] netlist-file output-dir",
+			"split a netlist archive on its own, like a NET_IMG file, into its entries",
+			unpackMain},
+		{"pack", "unpacked-dir netlist-file",
+			"put an unpacked netlist archive back together", packMain},
+		{"verify", "[flags] -fingerprints file -driver-version version output-dir",
+			"check an output directory against a driver version's fingerprints",
+			verifyMain},
+		{"diff", "old new",
+			"compare two extractions, each an output directory or an object",
+			diffMain},
+		{"batch", "[flags] drivers-dir output-root",
+			"scan every driver package or extracted driver in a directory",
+			batchMain},
+		{"which", "-db blobs.sqlite file|type|sha256",
+			"list the drivers in a batch database that have a firmware file, and where",
+			whichMain},
+		{"legacy", "[flags] NVIDIA-Linux-x86-version output-dir",
+			"extract firmware from an old (319.x to 340.x) driver, as extract_firmware.py did, " +
+			"or the context programs of a pre-Fermi one",
+			legacyMain},
+		{"fetch", "[flags] version output-dir",
+			"download a driver from NVIDIA, check it, and extract its firmware",
+			fetchMain},
+		{"vbios", "[flags] vbios.rom output-dir",
+			"split a VBIOS image into its ROM images and falcon ucode",
+			vbiosMain},
+		{"tegra", "[flags] l4t-firmware-dir|bsp-tarball output-dir",
+			"split up the nvgpu firmware files of a Jetson Linux for Tegra release",
+			tegraMain},
+		{"grep", "[flags] -hex|-reg|-string pattern driver|nv-kernel.o_binary|output-dir",
+			"search the decompressed blobs for bytes, a register address or a string",
+			grepMain},
+		{"check", "[flags] -chipset name driver|nv-kernel.o_binary firmware-dir",
+			"check installed nouveau firmware against what a driver has",
+			checkMain},
+		{"dmesg", "[flags] driver|nv-kernel.o_binary output-dir",
+			"extract only the firmware a kernel log says nouveau failed to load",
+			dmesgMain},
+		{"serve", "[-listen addr] [-root dir [-packages]] [-jobs n]",
+			"run scans for HTTP clients, replying with a tarball or the manifest",
+			serveMain},
+		{"selftest", "[-v]",
+			"scan a small made-up object and check the results, to see that the build works",
+			selftestMain},
+	}
+}
+
+func usage() {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage: %s [command] [flags] args...\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", c.Name, c.Help)
+	}
+	fmt.Fprintf(w, "\nWithout a command, scan is assumed. Run \"%s command -h\" for a command's flags.\n", os.Args[0])
+}
+
+func newFlags(c command) *flag.FlagSet {
+	flags := flag.NewFlagSet(c.Name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], c.Name, c.Args)
+		fmt.Fprintf(os.Stderr, "\n%s\n", c.Help)
+		var any bool
+		flags.VisitAll(func(*flag.Flag) { any = true })
+		if any {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// Complain about how the command was run, and exit
+func usageError(flags *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n\n", os.Args[0], fmt.Sprintf(format, args...))
+	flags.Usage()
+	os.Exit(2)
+}
+
+// Where the config file is looked for if -config isn't given
+const configHelp = "$XDG_CONFIG_HOME/envytools/scanner.toml"
+
+func defaultConfig() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(dir, "envytools", "scanner.toml")
+}
+
+// Read the config file, and use its defaults for the flags that
+// weren't given. Without -config, the default one is only read if
+// it's there.
+func loadConfig(flags *flag.FlagSet, fname string) {
+	if fname == "" {
+		fname = defaultConfig()
+		if _, err := os.Stat(fname); fname == "" || err != nil {
+			return
+		}
+	}
+	c, err := extract.LoadConfig(fname)
+	fatal(err)
+	c.Apply()
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range c.Defaults {
+		// Defaults for other commands' flags are left for them
+		if flags.Lookup(name) == nil || given[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			fatal(fmt.Errorf("%s: %s: %v", fname, name, err))
+		}
+	}
+}
+
+// A context that is cancelled by the first interrupt, for commands
+// that can wrap up what they have done so far. Another one kills the
+// program as usual.
+func interruptible() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		cancel()
+	}()
+	return ctx
+}
+
+func fatal(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	}
+
+	name := "scan"
+	for _, c := range commands {
+		if c.Name == args[0] {
+			name, args = args[0], args[1:]
+			break
+		}
+	}
+	for _, c := range commands {
+		if c.Name == name {
+			c.Run(newFlags(c), args)
+		}
+	}
+}
+
+// $ ./scanner legacy NVIDIA-Linux-x86-340.108 output-dir
+func legacyMain(flags *flag.FlagSet, args []string) {
+	version := flags.String("driver-version", "",
+		"driver version, if the directory isn't named after it")
+	kernelFile := flags.String("kernel", "",
+		"kernel object, instead of kernel/nv-kernel.o in the driver")
+	userFile := flags.String("cuvid", "",
+		"libnvcuvid, instead of libnvcuvid.so.<version> in the driver")
+	manifest := flags.Bool("manifest", true,
+		"write manifest.json describing all extracted files")
+	signaturesFile := flags.String("archive-signatures", "",
+		"JSON file of PGRAPH archive signatures to tell chipsets apart by")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need an extracted driver and an output directory")
+	}
+	if *signaturesFile != "" {
+		fatal(netlist.LoadArchiveSignatures(*signaturesFile))
+	}
+	driver := flags.Arg(0)
+	if *version == "" {
+		if m := legacyDirRe.FindStringSubmatch(path.Base(path.Clean(driver))); m != nil {
+			*version = m[1]
+		}
+	}
+	if *kernelFile == "" {
+		*kernelFile = path.Join(driver, "kernel", "nv-kernel.o")
+		// Drivers before 1.0-9xxx have it with the rest of the
+		// module source
+		if _, err := os.Stat(*kernelFile); os.IsNotExist(err) {
+			*kernelFile = path.Join(driver, "usr", "src", "nv", "nv-kernel.o")
+		}
+	}
+	kernel, err := ioutil.ReadFile(*kernelFile)
+	fatal(err)
+	if *version == "" {
+		*version = eluscan.DriverVersion(kernel)
+	}
+	if *userFile == "" {
+		*userFile = path.Join(driver, "libnvcuvid.so." + *version)
+	}
+	user, err := ioutil.ReadFile(*userFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v, skipping the user-space firmware\n",
+			os.Args[0], err)
+	}
+
+	p := &extract.Processor{Destdir: flags.Arg(1), Source: *kernelFile,
+		Version: *version}
+	fatal(p.Legacy(kernel, user))
+	if *manifest {
+		fatal(p.WriteManifest())
+	}
+}
+
+var legacyDirRe = regexp.MustCompile(`^NVIDIA-Linux-[^-]+-([0-9]+\.[0-9]+(\.[0-9]+)?)(-pkg[0-9])?$`)
+
+// $ ./scanner fetch 390.48 output-dir
+func fetchMain(flags *flag.FlagSet, args []string) {
+	arch := flags.String("arch", "x86_64", "driver architecture: x86, x86_64 or aarch64")
+	sum := flags.String("sha256", "",
+		"sha256 of the .run package, instead of the one published with it")
+	mirrors := flags.String("mirror", "",
+		"comma-separated base URLs to download from, instead of " +
+		strings.Join(extract.DefaultOptions().Mirrors, ", "))
+	keep := flags.String("keep", "", "keep the .run package as this file")
+	extractOnly := flags.Bool("extract-only", false,
+		"only extract the package into output-dir, without scanning it")
+	opts := extract.DefaultOptions()
+	flags.StringVar(&opts.CacheDir, "cache", "",
+		"keep downloaded and extracted drivers in this directory, and reuse them")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a driver version and an output directory")
+	}
+	version, destdir := flags.Arg(0), flags.Arg(1)
+	if *mirrors != "" {
+		opts.Mirrors = strings.Split(*mirrors, ",")
+	}
+
+	// Keep the package's name, which the scan takes the version from
+	run := *keep
+	if run == "" {
+		run = extract.CachedRun(opts.CacheDir, version, *arch)
+	}
+	tmp := ""
+	if run == "" {
+		var err error
+		tmp, err = ioutil.TempDir("", "scanner-fetch")
+		fatal(err)
+		defer os.RemoveAll(tmp)
+		run = path.Join(tmp, extract.RunName(version, *arch))
+	}
+	ctx := interruptible()
+	err := extract.Fetch(ctx, version, *arch, *sum, run, &opts)
+	if err == nil && *extractOnly {
+		err = extract.ExtractRun(ctx, run, destdir, &opts)
+	} else if err == nil {
+		p := &extract.Processor{Destdir: destdir, Version: version, Options: &opts}
+		if err = p.ScanDriver(ctx, run); err == nil {
+			err = p.WriteManifest()
+		}
+		if err == nil {
+			err = p.WriteUnknown()
+		}
+		if err == nil && opts.LogLevel >= extract.LogInfo {
+			err = p.Summary(opts.LogOut)
+		}
+	}
+	if err != nil {
+		// Exiting skips the deferred cleanup
+		if tmp != "" {
+			os.RemoveAll(tmp)
+		}
+		fatal(err)
+	}
+}
+
+// $ ./scanner vbios vbios.rom output-dir
+func vbiosMain(flags *flag.FlagSet, args []string) {
+	manifest := flags.Bool("manifest", true,
+		"write manifest.json describing all extracted files")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a VBIOS image and an output directory")
+	}
+	input := flags.Arg(0)
+	data, err := ioutil.ReadFile(input)
+	fatal(err)
+	p := &extract.Processor{Destdir: flags.Arg(1), Source: input}
+	if err := p.ProcessVBIOS(data); err != nil {
+		fatal(fmt.Errorf("%s: %v", input, err))
+	}
+	if *manifest {
+		fatal(p.WriteManifest())
+	}
+}
+
+// $ ./scanner tegra Jetson_Linux_R35.4.1_aarch64.tbz2 output-dir
+func tegraMain(flags *flag.FlagSet, args []string) {
+	nameTable := flags.String("names", "",
+		"region name table to use for the netlist images (gk20a, ga10b)")
+	decode := flags.String("decode", "",
+		"also write the record list regions out as text or json")
+	manifest := flags.Bool("manifest", true,
+		"write manifest.json describing all extracted files")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a firmware directory or BSP tarball and an output directory")
+	}
+	if *nameTable != "" && netlist.NameTables[*nameTable] == nil {
+		usageError(flags, "unknown region name table %q", *nameTable)
+	}
+	if *decode != "" && *decode != "text" && *decode != "json" {
+		usageError(flags, "unknown -decode format %q", *decode)
+	}
+	p := &extract.Processor{Destdir: flags.Arg(1), Source: flags.Arg(0),
+		NameTable: *nameTable, Decode: *decode}
+	fatal(p.ScanTegra(interruptible(), flags.Arg(0)))
+	if *manifest {
+		fatal(p.WriteManifest())
+	}
+}
+
+// $ ./scanner grep -reg 0x409800 NVIDIA-Linux-x86_64-390.48.run
+func grepMain(flags *flag.FlagSet, args []string) {
+	hexPattern := flags.String("hex", "",
+		"bytes to look for, in hex, e.g. \"de10 0000\"")
+	reg := flags.String("reg", "",
+		"32-bit register address to look for, e.g. 0x409800")
+	str := flags.String("string", "",
+		"string to look for")
+	align := flags.Int("align", 0,
+		"only report matches at multiples of this (default 4 for -reg, 1 otherwise)")
+	version := flags.String("driver-version", "",
+		"driver version, if it can't be found in the driver")
+	dump := flags.Bool("dump", false,
+		"the input is a raw memory dump, as for scan -dump")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usageError(flags, "need a driver, object or output directory to search")
+	}
+	var kind, value string
+	for _, f := range []struct{ kind, value string }{
+		{"hex", *hexPattern}, {"reg", *reg}, {"string", *str},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if kind != "" {
+			usageError(flags, "only one of -hex, -reg and -string can be given")
+		}
+		kind, value = f.kind, f.value
+	}
+	if kind == "" {
+		usageError(flags, "need a pattern: -hex, -reg or -string")
+	}
+	pattern, err := extract.GrepPattern(kind, value)
+	if err != nil {
+		usageError(flags, "%v", err)
+	}
+	if *align == 0 {
+		*align = 1
+		if kind == "reg" {
+			*align = 4
+		}
+	}
+
+	// The matches are the output, so the progress goes to stderr
+	opts := extract.DefaultOptions()
+	opts.LogOut = os.Stderr
+	matches := 0
+	p := &extract.Processor{Version: *version, Dump: *dump, Options: &opts}
+	fatal(p.Grep(interruptible(), flags.Arg(0), pattern, *align, func(m extract.Match) {
+		fmt.Printf("%s:0x%x\n", m.Path, m.Offset)
+		matches++
+	}))
+	if matches == 0 {
+		os.Exit(1)
+	}
+}
+
+// $ ./scanner check -chipset gk107 NVIDIA-Linux-x86_64-390.48.run /lib/firmware
+func checkMain(flags *flag.FlagSet, args []string) {
+	chipsetName := flags.String("chipset", "",
+		"chipset whose firmware to check, e.g. gk107 or nve7")
+	version := flags.String("driver-version", "",
+		"driver version, if it can't be found in the driver")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a driver or object and a firmware directory")
+	}
+	if *chipsetName == "" {
+		usageError(flags, "-chipset is needed to know which files to check")
+	}
+	chipset, err := netlist.LookupChipset(*chipsetName)
+	fatal(err)
+
+	driver := flags.Arg(0)
+	p := &extract.Processor{Chipset: chipset, Version: *version}
+	problems, notes, err := p.CheckInstalled(interruptible(), driver, flags.Arg(1))
+	fatal(err)
+	for _, note := range notes {
+		fmt.Println(note)
+	}
+	if p.Version != "" {
+		driver = p.Version
+	}
+	reportVerify(driver, problems)
+}
+
+// $ dmesg | ./scanner dmesg NVIDIA-Linux-x86_64-390.48.run /lib/firmware
+func dmesgMain(flags *flag.FlagSet, args []string) {
+	logFile := flags.String("log", "-",
+		"kernel log to read the missing files from, - for stdin")
+	chipsetName := flags.String("chipset", "",
+		"chipset the files are for, if their names don't say")
+	version := flags.String("driver-version", "",
+		"driver version, if it can't be found in the driver")
+	signaturesFile := flags.String("archive-signatures", "",
+		"JSON file of PGRAPH archive signatures to tell chipsets apart by")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a driver or object and an output directory")
+	}
+	if *signaturesFile != "" {
+		fatal(netlist.LoadArchiveSignatures(*signaturesFile))
+	}
+
+	in := os.Stdin
+	if *logFile != "-" {
+		var err error
+		in, err = os.Open(*logFile)
+		fatal(err)
+		defer in.Close()
+	}
+	missing, err := extract.MissingFirmware(in)
+	fatal(err)
+	if len(missing) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no missing nouveau firmware in the log\n", os.Args[0])
+		return
+	}
+
+	chipset := extract.FirmwareChipset(missing)
+	if *chipsetName != "" {
+		chipset, err = netlist.LookupChipset(*chipsetName)
+		fatal(err)
+	}
+	if chipset == nil {
+		usageError(flags, "can't tell the chipset from %s, give it with -chipset", missing[0])
+	}
+
+	p := &extract.Processor{Chipset: chipset, Version: *version}
+	notFound, err := p.ExtractMissing(interruptible(), flags.Arg(0), missing,
+		flags.Arg(1))
+	fatal(err)
+	for _, name := range notFound {
+		fmt.Fprintf(os.Stderr, "%s: not found in %s\n", name, flags.Arg(0))
+	}
+	if len(notFound) != 0 {
+		os.Exit(1)
+	}
+}
+
+// $ ./scanner serve -listen :8080 -root /srv/drivers
+func serveMain(flags *flag.FlagSet, args []string) {
+	listen := flags.String("listen", "localhost:8080",
+		"address to listen on")
+	root := flags.String("root", "",
+		"directory that scans can name inputs under with ?path=; without it only uploads are taken")
+	jobs := flags.Int("jobs", 1,
+		"how many scans to run at once")
+	packages := flags.Bool("packages", false,
+		"extract .run, .exe and .cab packages under -root, which runs them or 7z; uploaded packages are never taken")
+	maxUpload := flags.Int64("max-upload", extract.DefaultMaxUpload,
+		"the most bytes an uploaded object may be")
+	opts := extract.DefaultOptions()
+	flags.StringVar(&opts.CacheDir, "cache", "",
+		"keep the drivers extracted from .run packages in this directory, and reuse them")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "serve takes no arguments")
+	}
+	if *root != "" {
+		info, err := os.Stat(*root)
+		fatal(err)
+		if !info.IsDir() {
+			usageError(flags, "-root has to be a directory")
+		}
+	}
+
+	server := &http.Server{Addr: *listen,
+		Handler: &extract.Server{Root: *root, Jobs: *jobs, Packages: *packages,
+			MaxUpload: *maxUpload, Options: &opts}}
+	ctx := interruptible()
+	go func() {
+		<-ctx.Done()
+		// Let the scans under way finish
+		server.Shutdown(context.Background())
+	}()
+	fmt.Fprintf(os.Stderr, "%s: listening on %s\n", os.Args[0], *listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		fatal(err)
+	}
+}
+
+// $ ./scanner selftest
+func selftestMain(flags *flag.FlagSet, args []string) {
+	verbose := flags.Bool("v", false, "also print what the scan found")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usageError(flags, "selftest takes no arguments")
+	}
+	opts := extract.DefaultOptions()
+	if !*verbose {
+		opts.LogLevel = extract.LogWarn
+	}
+	fatal(extract.SelfTest(interruptible(), os.Stdout, &opts))
+}
+
+// $ ./scanner batch [-db blobs.sqlite] [-cache dir] drivers-dir output-root
+func batchMain(flags *flag.FlagSet, args []string) {
+	db := flags.String("db", "",
+		"record all blobs in this SQLite database")
+	opts := extract.DefaultOptions()
+	flags.StringVar(&opts.CacheDir, "cache", "",
+		"keep the drivers extracted from .run packages in this directory, and reuse them")
+	flags.IntVar(&opts.Jobs, "jobs", 1,
+		"how many drivers to extract at once")
+	restart := flags.Bool("restart", false,
+		"scan every driver again, instead of skipping those an earlier run finished")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a drivers directory and an output root")
+	}
+	if *db != "" {
+		fatal(extract.CheckSQLite())
+	}
+	opts.Restart = *restart
+	fatal(extract.BatchContext(interruptible(), flags.Arg(0), flags.Arg(1), *db, &opts))
+}
+
+// $ ./scanner which -db blobs.sqlite nouveau/nv84_xuc103
+func whichMain(flags *flag.FlagSet, args []string) {
+	db := flags.String("db", "",
+		"SQLite database batch -db recorded the drivers in")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usageError(flags, "need a file name, type or sha256 to look for")
+	}
+	if *db == "" {
+		usageError(flags, "-db is needed to know which drivers there are")
+	}
+	fatal(extract.CheckSQLite())
+	matches, err := extract.QueryDB(*db, flags.Arg(0))
+	fatal(err)
+	if len(matches) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: %s isn't in any driver in %s\n", os.Args[0],
+			flags.Arg(0), *db)
+		os.Exit(1)
+	}
+	for _, m := range matches {
+		where := m.Source
+		if where == "" {
+			where = "the driver"
+		}
+		fmt.Printf("%s: %s (%s, %d bytes, sha256 %.12s) from %s at 0x%x\n",
+			m.Version, m.Path, m.Type, m.Size, m.SHA256, where, m.Offset)
+	}
+}
+
+// $ ./scanner diff old new
+func diffMain(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need two extractions to compare")
+	}
+	opts := extract.DefaultOptions()
+	differ, err := extract.Diff(os.Stdout, flags.Arg(0), flags.Arg(1), &opts)
+	fatal(err)
+	if differ {
+		os.Exit(1)
+	}
+}
+
+// $ ./scanner list [-list-format json] path/to/nv-kernel.o_binary
+func listMain(flags *flag.FlagSet, args []string) {
+	scanMain(flags, append([]string{"-list"}, args...))
+}
+
+// $ ./scanner unpack NET_IMG_07.bin output-dir
+func unpackMain(flags *flag.FlagSet, args []string) {
+	nameTable := flags.String("names", "",
+		"region name table to use (gk20a, ga10b)")
+	rawScalars := flags.Bool("raw-scalars", false,
+		"also write single-number regions like majorv out as files")
+	decode := flags.String("decode", "",
+		"also write the record list regions out as text or json")
+	manifest := flags.Bool("manifest", true,
+		"write manifest.json describing all extracted files")
+	config := flags.String("config", "",
+		"config file with region names, blobs and flag defaults, instead of " + configHelp)
+	flags.Parse(args)
+	loadConfig(flags, *config)
+	if flags.NArg() != 2 {
+		usageError(flags, "need a netlist file and an output directory")
+	}
+	if *nameTable != "" && netlist.NameTables[*nameTable] == nil {
+		usageError(flags, "unknown region name table %q", *nameTable)
+	}
+	if *decode != "" && *decode != "text" && *decode != "json" {
+		usageError(flags, "unknown -decode format %q", *decode)
+	}
+
+	input := flags.Arg(0)
+	data, err := ioutil.ReadFile(input)
+	fatal(err)
+
+	// The archive may still be compressed the way the driver has it
+	origin := extract.Origin{CompressedSize: len(data)}
+	if _, _, _, err := netlist.ParseArchive(data, nil); errors.Is(err, netlist.ErrNotArchive) {
+		if raw, used, codec, derr := eluscan.Decompress(data, nil); derr == nil {
+			data, origin.CompressedSize, origin.Codec = raw, used, codec
+		}
+	}
+	p := &extract.Processor{Destdir: flags.Arg(1), Source: input,
+		NameTable: *nameTable, RawScalars: *rawScalars, Decode: *decode}
+	if err := p.ProcessArchive(data, origin); err != nil {
+		fatal(fmt.Errorf("%s: %v", input, err))
+	}
+	if *manifest {
+		fatal(p.WriteManifest())
+	}
+}
+
+// $ ./scanner pack output-dir/NET_IMG_07 NET_IMG_07.bin
+func packMain(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usageError(flags, "need an unpacked archive directory and a file to write")
+	}
+	data, err := netlist.Pack(flags.Arg(0))
+	fatal(err)
+	fatal(ioutil.WriteFile(flags.Arg(1), data, os.FileMode(0666)))
+}
+
+// $ ./scanner verify -fingerprints good.json -driver-version 390.48 output-dir
+func verifyMain(flags *flag.FlagSet, args []string) {
+	version := flags.String("driver-version", "",
+		"driver version whose fingerprints to check against")
+	fingerprintsFile := flags.String("fingerprints", "",
+		"JSON file of fingerprints recorded with -record-fingerprints")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usageError(flags, "need an output directory to verify")
+	}
+	if *version == "" {
+		usageError(flags, "-driver-version is needed to pick the fingerprints")
+	}
+	if *fingerprintsFile == "" {
+		usageError(flags, "-fingerprints is needed, as none come with the scanner")
+	}
+	fatal(extract.LoadFingerprints(*fingerprintsFile))
+	sums, err := extract.SumDir(flags.Arg(0))
+	fatal(err)
+	files := make(map[string]string)
+	for name, sum := range sums {
+		files[name] = sum.SHA256
+	}
+	problems, err := extract.VerifyFiles(*version, files)
+	fatal(err)
+	reportVerify(*version, problems)
+}
+
+func reportVerify(version string, problems []string) {
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) != 0 {
+		fmt.Printf("Verification against %s failed\n", version)
+		os.Exit(1)
+	}
+	fmt.Printf("Verified against %s\n", version)
+}
+
+// $ ./scanner [scan] [flags] path/to/nv-kernel.o_binary output-dir
+// Scan several inputs at once, each into a directory of its own under
+// destdir: the base name of the input, or its whole path with the
+// slashes swapped out when two inputs share a base name. What each one
+// logs is prefixed with its name, and the summaries come out as each
+// input is done.
+func scanMany(inputs []string, destdir string, jobs int,
+	newProcessor func(input, destdir string) *extract.Processor,
+	isDriver func(input string) bool, manifest bool, db string) {
+	bases := make(map[string]int)
+	for _, input := range inputs {
+		bases[filepath.Base(input)]++
+	}
+	procs := make([]*extract.Processor, len(inputs))
+	for i, input := range inputs {
+		name := filepath.Base(input)
+		if bases[name] > 1 {
+			name = strings.Replace(strings.Trim(filepath.ToSlash(input), "/"), "/", "_", -1)
+		}
+		procs[i] = newProcessor(input, filepath.Join(destdir, name))
+		procs[i].LogPrefix = input + ": "
+	}
+
+	var mu sync.Mutex
+	err := extract.RunJobs(interruptible(), len(inputs), jobs,
+		func(ctx context.Context, i int) error {
+			p := procs[i]
+			var err error
+			if isDriver(inputs[i]) {
+				err = p.ScanDriver(ctx, inputs[i])
+			} else {
+				err = p.ScanObjectContext(ctx, inputs[i])
+			}
+			if err != nil && !errors.Is(err, context.Canceled) {
+				return fmt.Errorf("%s: %v", inputs[i], err)
+			}
+			// Whatever was written is worth keeping track of, even
+			// if the scan was cut short
+			var werr error
+			if manifest {
+				werr = p.WriteManifest()
+			}
+			if uerr := p.WriteUnknown(); werr == nil {
+				werr = uerr
+			}
+			if err != nil {
+				return err
+			}
+			if werr != nil {
+				return fmt.Errorf("%s: %v", inputs[i], werr)
+			}
+			if err := p.Tidy(); err != nil {
+				return fmt.Errorf("%s: %v", inputs[i], err)
+			}
+			if p.Options.LogLevel >= extract.LogInfo {
+				mu.Lock()
+				defer mu.Unlock()
+				fmt.Fprintf(p.Options.LogOut, "%s:\n", inputs[i])
+				return p.Summary(p.Options.LogOut)
+			}
+			return nil
+		})
+	fatal(err)
+	if db != "" {
+		for _, p := range procs {
+			fatal(p.RecordDB(db))
+		}
+	}
+}
+
+func scanMain(flags *flag.FlagSet, args []string) {
+	nouveau := flags.Bool("nouveau", false,
+		"also write GR ctxsw firmware with nouveau's fuc names")
+	manifest := flags.Bool("manifest", true,
+		"write manifest.json describing all extracted files")
+	sidecars := flags.Bool("meta", false,
+		"write a .meta.json next to each extracted file")
+	knownFile := flags.String("known", "",
+		"JSON file of additional known blob hashes")
+	verify := flags.Bool("verify", false,
+		"check the extracted files against the driver version's fingerprints from -fingerprints")
+	fingerprintsFile := flags.String("fingerprints", "",
+		"JSON file of fingerprints recorded with -record-fingerprints, for -verify")
+	record := flags.String("record-fingerprints", "",
+		"add this run's files to a fingerprints JSON file")
+	signaturesFile := flags.String("archive-signatures", "",
+		"JSON file of PGRAPH archive signatures to tell chipsets apart by")
+	recordSignatures := flags.String("record-archive-signatures", "",
+		"add the signatures of the PGRAPH archives this run named to a JSON file")
+	version := flags.String("driver-version", "",
+		"driver version, if it can't be found in the object")
+	dedup := flags.String("dedup", "",
+		"write repeated blobs as a hardlink, symlink, or only into the manifest")
+	db := flags.String("db", "",
+		"record all blobs in this SQLite database")
+	nameTable := flags.String("names", "",
+		"region name table to use for all archives (gk20a, ga10b)")
+	rawScalars := flags.Bool("raw-scalars", false,
+		"also write single-number regions like majorv out as files")
+	decode := flags.Bool("decode", false,
+		"also write bundle, method, ctx load and ctxreg lists out as text")
+	decodeFormat := flags.String("decode-format", "text",
+		"format for -decode: text or json")
+	rnndbFile := flags.String("rnndb", "",
+		"envytools rnndb root.xml to name registers with in -decode output")
+	regNamesFile := flags.String("regnames", "",
+		"file of \"0xaddress NAME\" lines to name registers with in -decode output")
+	chipsetName := flags.String("chipset", "",
+		"chipset to name nouveau files for when an archive's own can't be told, e.g. gk107 or nve7")
+	opts := extract.DefaultOptions()
+	flags.Int64Var(&opts.MaxBlobSize, "max-blob-size", opts.MaxBlobSize,
+		"skip blobs that decompress to more than this many bytes (0 for no limit)")
+	maxTotal := flags.Int64("max-total-size", 16 << 30,
+		"stop decompressing after this many bytes in total (0 for no limit)")
+	flags.Int64Var(&opts.StreamSize, "stream-size", opts.StreamSize,
+		"decompress blobs bigger than this straight to disk (0 for never)")
+	start := flags.Int64("start", 0,
+		"only scan gaps starting at or after this rodata offset")
+	end := flags.Int64("end", 0,
+		"only scan gaps starting before this rodata offset")
+	fileOffsets := flags.Bool("file-offsets", false,
+		"take -start and -end as offsets in the file rather than in rodata")
+	out := flags.String("out", "",
+		"output directory, instead of giving it after the input")
+	outputFormat := flags.String("output-format", "dir",
+		"write a \"dir\"ectory tree, or a \"tar\" file (- for stdout) in its place")
+	sortTar := flags.Bool("sort-tar", !extract.SourceDate.IsZero(),
+		"write the tarball's members in order of name, all at the end (the default with SOURCE_DATE_EPOCH)")
+	only := flags.String("only", "",
+		"only extract these categories, e.g. gr,video (" +
+		strings.Join(classify.CategoryNames, ", ") + ")")
+	exclude := flags.String("exclude", "",
+		"leave out these categories")
+	diagnostics := flags.String("diagnostics", "",
+		"write why gaps and blobs were passed over to this JSON file")
+	whence := flags.String("whence", "",
+		"write a linux-firmware WHENCE entry for the nouveau files to this file")
+	emitC := flags.Bool("emit-c", false,
+		"also write each file as a C header with a byte array, as e.g. whole_000.h")
+	byteSwap := flags.Int("byteswap", 0,
+		"write files with the bytes of each word of this size (2, 4 or 8) reversed")
+	byteSwapOnly := flags.String("byteswap-only", "",
+		"only byte-swap the files of these categories")
+	emitHex := flags.String("emit-hex", "",
+		"also write each file as Intel HEX or S-records: ihex or srec")
+	hexBase := flags.Uint64("hex-base", 0,
+		"address -emit-hex puts the files at")
+	hexDataBase := flags.Uint64("hex-data-base", 0,
+		"address -emit-hex puts falcon data segments (fuc409d, fecs_data, ...) at")
+	keepCompressed := flags.Bool("keep-compressed", false,
+		"also write out each blob's compressed data, as e.g. whole_000.deflate")
+	naming := flags.String("naming", "order",
+		"name unrecognised blobs and archives by the \"order\" found in, their \"hash\" or \"offset\"")
+	flat := flags.Bool("flat", false,
+		"write every file into the output directory itself, as e.g. net52_fecs_inst")
+	byOffset := flags.Bool("name-by-offset", false,
+		"same as -naming offset, for names like blob_0x6954e4.bin")
+	strict := flags.Bool("strict", false,
+		"stop at the first thing in the input that isn't as expected")
+	lenient := flags.Bool("lenient", false,
+		"keep whatever can be recovered, and only report the rest")
+	list := flags.Bool("list", false,
+		"only list what would be extracted, without writing anything")
+	listFormat := flags.String("list-format", "text",
+		"format for -list: text or json")
+	verbose := flags.Bool("v", false, "also print what was tried (-log-level debug)")
+	quiet := flags.Bool("q", false, "only print errors (-log-level error)")
+	flags.StringVar(&opts.LogFormat, "log-format", "text",
+		"how to log: text, or json for an object per line with each file, archive and skipped gap")
+	level := flags.String("log-level", "info",
+		"how much to print: error, warn, info or debug")
+	workers := flags.Int("j", 0,
+		"decompress this many gaps at once (default one per CPU)")
+	noQuirks := flags.Bool("no-quirks", false,
+		"don't apply the quirks known for the driver version")
+	noSymbols := flags.Bool("no-symbols", false,
+		"go by the relocations alone, even where symbols say where blobs are")
+	dump := flags.Bool("dump", false,
+		"the input is a raw memory dump, to search for firmware without relocations")
+	flags.Int64Var(&opts.MinGap, "min-gap", opts.MinGap,
+		"skip gaps between references shorter than this many bytes")
+	flags.IntVar(&opts.DeflateSlack, "deflate-slack", opts.DeflateSlack,
+		"only take a deflate stream that ends this near the end of its gap, or -1 for any")
+	flags.IntVar(&opts.MinBlobSize, "min-blob", opts.MinBlobSize,
+		"skip decompressed blobs smaller than this many bytes")
+	flags.Float64Var(&opts.MinEntropy, "min-entropy", 0,
+		"skip decompressed blobs with less entropy than this, in bits per byte (0 to 8)")
+	flags.IntVar(&opts.Archives.MinSize, "min-archive", opts.Archives.MinSize,
+		"only take data of at least this many bytes for a netlist archive")
+	flags.IntVar(&opts.Archives.MaxEntries, "max-archive-entries", opts.Archives.MaxEntries,
+		"only take data with at most this many entries for a netlist archive")
+	incremental := flags.Bool("incremental", true,
+		"leave files that already hold what would be written alone, keeping their mtimes")
+	force := flags.Bool("force", false,
+		"write into an output directory that isn't empty or an earlier scan's")
+	clean := flags.Bool("clean", false,
+		"remove whatever in the output directory this scan didn't write, once it's done")
+	jobs := flags.Int("jobs", 1,
+		"with several inputs and -out, scan this many of them at once")
+	strategy := flags.String("strategy", "auto",
+		"for a whole driver, how to extract it: auto (by version), " +
+		strings.Join(extract.Strategies, ", "))
+	inputDir := flags.String("input-dir", "",
+		"scan every kernel object and firmware .bin file in this extracted driver")
+	flags.StringVar(&opts.CacheDir, "cache", "",
+		"for a .run package, keep the extracted driver in this directory, and reuse it")
+	config := flags.String("config", "",
+		"config file with region names, blobs and flag defaults, instead of " + configHelp)
+	flags.Parse(args)
+	loadConfig(flags, *config)
+
+	var ok bool
+	if opts.LogLevel, ok = extract.LogLevels[*level]; !ok {
+		usageError(flags, "unknown -log-level %q", *level)
+	}
+	switch {
+	case opts.MinGap < 1, opts.MinBlobSize < 0, opts.Archives.MinSize < 8,
+		opts.Archives.MaxEntries < 1:
+		usageError(flags, "-min-gap, -min-blob, -min-archive and -max-archive-entries " +
+			"need to be positive")
+	case opts.MinEntropy < 0 || opts.MinEntropy > 8:
+		usageError(flags, "-min-entropy is in bits per byte, from 0 to 8")
+	}
+	if opts.LogFormat != "text" && opts.LogFormat != "json" {
+		usageError(flags, "unknown -log-format %q", opts.LogFormat)
+	}
+	switch {
+	case *verbose && *quiet:
+		usageError(flags, "-v and -q don't go together")
+	case *verbose:
+		opts.LogLevel = extract.LogDebug
+	case *quiet:
+		opts.LogLevel = extract.LogError
+	}
+
+	if *byOffset {
+		if *naming != "order" && *naming != "offset" {
+			usageError(flags, "-name-by-offset and -naming %s don't go together", *naming)
+		}
+		*naming = "offset"
+	}
+	switch *naming {
+	case "order":
+		*naming = ""
+	case "hash", "offset":
+	default:
+		usageError(flags, "unknown -naming scheme %q", *naming)
+	}
+
+	mode := ""
+	switch {
+	case *strict && *lenient:
+		usageError(flags, "-strict and -lenient don't go together")
+	case *strict:
+		mode = "strict"
+	case *lenient:
+		mode = "lenient"
+	}
+
+	onlyCats, err := classify.ParseCategories(*only)
+	if err != nil {
+		usageError(flags, "-only: %v", err)
+	}
+	excludeCats, err := classify.ParseCategories(*exclude)
+	if err != nil {
+		usageError(flags, "-exclude: %v", err)
+	}
+	if *outputFormat != "dir" && *outputFormat != "tar" {
+		usageError(flags, "unknown -output-format %q", *outputFormat)
+	}
+	if (*force || *clean) && (*outputFormat != "dir" || *list) {
+		usageError(flags, "-force and -clean are for writing into an output directory")
+	}
+	swapCats, err := classify.ParseCategories(*byteSwapOnly)
+	if err != nil {
+		usageError(flags, "-byteswap-only: %v", err)
+	}
+	if *byteSwap != 0 && !extract.ByteSwapWidths[*byteSwap] {
+		usageError(flags, "-byteswap takes a word size of 2, 4 or 8 bytes")
+	}
+	if _, ok := extract.HexFormats[*emitHex]; *emitHex != "" && !ok {
+		usageError(flags, "unknown -emit-hex format %q", *emitHex)
+	}
+	if *hexBase >= 1 << 32 || *hexDataBase >= 1 << 32 {
+		usageError(flags, "-hex-base and -hex-data-base need to be 32-bit addresses")
+	}
+	if *listFormat != "text" && *listFormat != "json" {
+		usageError(flags, "unknown -list-format %q", *listFormat)
+	}
+	if *list {
+		opts.LogOut = os.Stderr
+	}
+
+	// -input-dir is the input, ahead of the output directory
+	positional := flags.Args()
+	if *inputDir != "" {
+		positional = append([]string{*inputDir}, positional...)
+	}
+	kernel_f := ""
+	if len(positional) != 0 {
+		kernel_f = positional[0]
+	}
+	destdir := *out
+	many := false
+	switch {
+	case len(positional) == 0:
+		usageError(flags, "no input object given")
+	case *list && len(positional) == 1:
+		// Nothing gets written anywhere
+	case destdir == "" && len(positional) == 2:
+		destdir = positional[1]
+	case destdir == "" && len(positional) == 1:
+		usageError(flags, "no output directory given")
+	case destdir != "" && len(positional) > 1:
+		// Each input gets a directory of its own under -out
+		many = true
+	case len(positional) > 2:
+		usageError(flags, "too many arguments")
+	}
+	if *inputDir != "" {
+		switch {
+		case many:
+			usageError(flags, "-input-dir is for a single driver")
+		case *dump:
+			usageError(flags, "-input-dir and -dump don't go together")
+		case *strategy != "auto":
+			usageError(flags, "-input-dir scans everything, whatever the -strategy")
+		}
+		if info, err := os.Stat(*inputDir); err != nil || !info.IsDir() {
+			usageError(flags, "-input-dir needs an extracted driver directory")
+		}
+	}
+	if *db != "" {
+		fatal(extract.CheckSQLite())
+	}
+	if *verify && *fingerprintsFile == "" {
+		usageError(flags, "-verify needs -fingerprints, as none come with the scanner")
+	}
+	if many {
+		switch {
+		case *list, *outputFormat != "dir":
+			usageError(flags, "several inputs can only be scanned into directories")
+		case *diagnostics != "", *whence != "", *record != "", *recordSignatures != "", *verify:
+			usageError(flags, "-diagnostics, -whence, -record-fingerprints, " +
+				"-record-signatures and -verify are for a single input")
+		}
+	}
+	// A whole driver, a .run package or an extracted one, is
+	// extracted the way its version calls for
+	isDriver := func(input string) bool {
+		if *dump || input == "-" {
+			return false
+		}
+		info, err := os.Stat(input)
+		fatal(err)
+		return extract.IsPackage(input) || info.IsDir()
+	}
+	inputs := positional[:1]
+	if many {
+		inputs = positional
+	}
+	driver := false
+	for _, input := range inputs {
+		if many && input == "-" {
+			usageError(flags, "stdin can't be one of several inputs")
+		}
+		driver = driver || isDriver(input)
+	}
+	switch *strategy {
+	case "auto":
+		*strategy = ""
+	case "legacy", "scan", "gsp":
+		if !driver {
+			usageError(flags, "-strategy is for a driver package or directory")
+		}
+	default:
+		usageError(flags, "unknown -strategy %q", *strategy)
+	}
+
+	if *knownFile != "" {
+		fatal(classify.LoadKnownBlobs(*knownFile))
+	}
+	if *fingerprintsFile != "" {
+		fatal(extract.LoadFingerprints(*fingerprintsFile))
+	}
+	if *signaturesFile != "" {
+		fatal(netlist.LoadArchiveSignatures(*signaturesFile))
+	}
+
+	switch *dedup {
+	case "", "hardlink", "symlink", "manifest":
+	default:
+		usageError(flags, "unknown -dedup mode %q", *dedup)
+	}
+
+	if *nameTable != "" && netlist.NameTables[*nameTable] == nil {
+		usageError(flags, "unknown region name table %q", *nameTable)
+	}
+
+	decodeAs := ""
+	if *decode {
+		if *decodeFormat != "text" && *decodeFormat != "json" {
+			usageError(flags, "unknown -decode-format %q", *decodeFormat)
+		}
+		decodeAs = *decodeFormat
+	}
+
+	regNames := make(map[uint32]string)
+	if *rnndbFile != "" {
+		var err error
+		regNames, err = netlist.LoadRnnDB(*rnndbFile)
+		fatal(err)
+	}
+	if *regNamesFile != "" {
+		extra, err := netlist.LoadRegNames(*regNamesFile)
+		fatal(err)
+		for addr, name := range extra {
+			regNames[addr] = name
+		}
+	}
+
+	var chipset *netlist.Chipset
+	if *chipsetName != "" {
+		var err error
+		chipset, err = netlist.LookupChipset(*chipsetName)
+		fatal(err)
+		*nouveau = true
+	}
+
+	newProcessor := func(input, destdir string) *extract.Processor {
+		// Files of something else would get mixed in with the new
+		// ones, and never noticed
+		if !*list && !*force && !*clean && *outputFormat == "dir" {
+			if err := extract.CheckOutputDir(destdir); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v; -force writes into it anyway, " +
+					"-clean removes what this scan doesn't write\n", os.Args[0], err)
+				os.Exit(1)
+			}
+		}
+		source := input
+		switch {
+		case source == "-":
+			source = "stdin"
+		case isDriver(input):
+			// The kernel object, once it's found
+			source = ""
+		}
+		return &extract.Processor{Destdir: destdir, Source: source, Version: *version,
+			Nouveau: *nouveau, Chipset: chipset, Sidecars: *sidecars,
+			Dedup: *dedup, NameTable: *nameTable, RawScalars: *rawScalars,
+			Decode: decodeAs, RegNames: regNames, MaxTotal: *maxTotal, Workers: *workers,
+			Start: *start, End: *end, FileOffsets: *fileOffsets, DryRun: *list,
+			Only: onlyCats, Exclude: excludeCats, Mode: mode, Naming: *naming,
+			KeepCompressed: *keepCompressed, EmitC: *emitC,
+			HexFormat: *emitHex, HexBase: uint32(*hexBase),
+			HexDataBase: uint32(*hexDataBase), NoQuirks: *noQuirks, Strategy: *strategy,
+			NoSymbols: *noSymbols,
+			Dump: *dump, Incremental: *incremental, ByteSwap: *byteSwap,
+			ByteSwapOnly: swapCats, Flat: *flat, Clean: *clean, Options: &opts}
+	}
+	if many {
+		scanMany(inputs, destdir, *jobs, newProcessor, isDriver, *manifest, *db)
+		return
+	}
+	p := newProcessor(kernel_f, destdir)
+
+	// A tarball is written as the scan goes, with big blobs only
+	// decompressed into a temporary directory on the way. Sorted, it
+	// is only written at the end.
+	var tarFile *os.File
+	var tw *tar.Writer
+	var sorted *extract.SortedTarFS
+	if *outputFormat == "tar" && !*list {
+		var err error
+		tarFile = os.Stdout
+		if destdir == "-" {
+			opts.LogOut = os.Stderr
+		} else if tarFile, err = os.Create(destdir); err != nil {
+			fatal(err)
+		}
+		tw = tar.NewWriter(tarFile)
+		p.Output = extract.TarFS{Writer: tw}
+		if *sortTar {
+			sorted, err = extract.NewSortedTarFS(tw, "")
+			fatal(err)
+			p.Output = sorted
+		}
+		p.Destdir, err = ioutil.TempDir("", "scanner-tar")
+		fatal(err)
+	}
+	switch {
+	case *inputDir != "":
+		err = p.ScanTree(interruptible(), kernel_f)
+	case driver:
+		err = p.ScanDriver(interruptible(), kernel_f)
+	default:
+		err = p.ScanObjectContext(interruptible(), kernel_f)
+	}
+	if tw != nil {
+		os.RemoveAll(p.Destdir)
+	}
+	if errors.Is(err, context.Canceled) && !*list {
+		// Finish off what was written, so that it can be used
+		if *manifest {
+			if err := p.WriteManifest(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			}
+		}
+		if sorted != nil {
+			sorted.Flush()
+		}
+		if tw != nil {
+			tw.Close()
+			tarFile.Close()
+		}
+	}
+	fatal(err)
+	if *list {
+		fatal(p.List(os.Stdout, *listFormat))
+	} else {
+		if *manifest {
+			fatal(p.WriteManifest())
+		}
+		fatal(p.WriteUnknown())
+		fatal(p.Tidy())
+	}
+	if sorted != nil {
+		fatal(sorted.Flush())
+	}
+	if tw != nil {
+		fatal(tw.Close())
+		fatal(tarFile.Close())
+	}
+
+	if *diagnostics != "" {
+		fatal(p.WriteDiagnostics(*diagnostics))
+	}
+	if *whence != "" {
+		fatal(p.WriteWhence(*whence))
+	}
+	if *record != "" {
+		fatal(p.RecordFingerprints(*record))
+	}
+	if *recordSignatures != "" {
+		fatal(p.RecordArchiveSignatures(*recordSignatures))
+	}
+	if *db != "" {
+		fatal(p.RecordDB(*db))
+	}
+	if opts.LogLevel >= extract.LogInfo {
+		fatal(p.Summary(opts.LogOut))
+	}
+	if *verify {
+		problems, err := p.Verify()
+		fatal(err)
+		reportVerify(p.Version, problems)
+	}
+}
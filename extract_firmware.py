@@ -20,6 +20,9 @@
 # ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
 # OTHER DEALINGS IN THE SOFTWARE.
 
+# This script is no longer maintained. "scanner legacy" does the same
+# extraction, see the README.
+
 from __future__ import print_function
 
 import itertools
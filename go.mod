@@ -0,0 +1,3 @@
+module github.com/envytools/firmware
+
+go 1.18
@@ -0,0 +1,116 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package classify
+
+import "bytes"
+import "math"
+
+// What can be told about a blob that couldn't be named, for whoever
+// has to work out what it is
+type Analysis struct {
+	// Bits per byte: close to 8 is encrypted, falcon code is
+	// around 6, register lists much less
+	Entropy float64 `json:"entropy"`
+	// How many runs of printable ASCII there are, and the first few
+	// of them
+	StringCount int `json:"string_count"`
+	Strings []string `json:"strings,omitempty"`
+	// Where known magics turn up in it
+	Magics []MagicHit `json:"magics,omitempty"`
+}
+
+type MagicHit struct {
+	Name string `json:"name"`
+	Offset int `json:"offset"`
+}
+
+// The magics worth pointing out. Those with Align set are only looked
+// for at multiples of it, being too short to mean much anywhere else.
+var analysisMagics = []struct {
+	Name string
+	Magic []byte
+	Align int
+}{
+	{"hs_bin_header", []byte("\xde\x10\x00\x00"), 4},
+	{"elf", []byte("\x7fELF"), 4},
+	{"gzip", []byte("\x1f\x8b\x08"), 1},
+	{"zstd", []byte("\x28\xb5\x2f\xfd"), 1},
+	{"xz", []byte("\xfd7zXZ\x00"), 1},
+	{"lz4", []byte("\x04\x22\x4d\x18"), 1},
+	{"pci_rom", []byte("PCIR"), 4},
+	{"bit_table", []byte("\xff\xb8BIT\x00"), 1},
+}
+
+const (
+	// Shorter runs of printable bytes turn up in code all the time
+	minStringLength = 8
+	// How many strings, and how many hits of each magic, to keep
+	keepStrings = 10
+	keepMagics = 8
+	maxStringLength = 64
+)
+
+// Look through a blob for what might say what it is: how random it is,
+// the strings in it, and any magics of known formats.
+func Analyze(data []byte) *Analysis {
+	a := &Analysis{}
+	if len(data) != 0 {
+		a.Entropy = math.Round(Entropy(data) * 1000) / 1000
+	}
+
+	start := -1
+	for i := 0; i <= len(data); i++ {
+		if i < len(data) && data[i] >= 0x20 && data[i] < 0x7f {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i - start >= minStringLength {
+			a.StringCount++
+			if len(a.Strings) < keepStrings {
+				s := data[start:i]
+				if len(s) > maxStringLength {
+					s = s[:maxStringLength]
+				}
+				a.Strings = append(a.Strings, string(s))
+			}
+		}
+		start = -1
+	}
+
+	for _, m := range analysisMagics {
+		hits := 0
+		for off := 0; hits < keepMagics; {
+			i := bytes.Index(data[off:], m.Magic)
+			if i < 0 {
+				break
+			}
+			off += i
+			if off % m.Align == 0 {
+				a.Magics = append(a.Magics, MagicHit{m.Name, off})
+				hits++
+			}
+			off++
+		}
+	}
+	return a
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package classify
+
+import "fmt"
+import "strings"
+
+// The kinds of firmware that -only and -exclude pick from
+var CategoryNames = []string{"gr", "video", "pmu", "gsp", "sec2", "acr",
+	"disp", "nvlink", "vgpu", "other", "unknown"}
+
+// Names of engines and files, and the category of firmware each starts
+var categoryPrefixes = []struct {
+	Prefix, Category string
+}{
+	{"fecs", "gr"}, {"gpccs", "gr"}, {"gr", "gr"}, {"ctxprog", "gr"},
+	{"ctxvals", "gr"},
+	{"bsp", "video"}, {"vp", "video"}, {"msvld", "video"},
+	{"mspdec", "video"}, {"msppp", "video"}, {"nvdec", "video"},
+	{"nvenc", "video"}, {"msenc", "video"}, {"nvjpg", "video"},
+	{"ofa", "video"},
+	{"pmu", "pmu"}, {"gsp", "gsp"}, {"sec2", "sec2"},
+	{"acr", "acr"}, {"wpr", "acr"}, {"ls_", "acr"}, {"hs_", "acr"},
+	{"dpu", "disp"}, {"disp", "disp"},
+	{"minion", "nvlink"},
+	{"vgpu", "vgpu"},
+}
+
+// Which category a type of blob or an engine name is in. Netlist
+// archives are all gr.
+func Category(name string) string {
+	name = strings.ToLower(name)
+	for _, c := range categoryPrefixes {
+		if strings.HasPrefix(name, c.Prefix) {
+			return c.Category
+		}
+	}
+	if name == "unknown" || name == "" {
+		return "unknown"
+	}
+	return "other"
+}
+
+// Parse a comma separated list of categories
+func ParseCategories(list string) (map[string]bool, error) {
+	cats := make(map[string]bool)
+	if list == "" {
+		return cats, nil
+	}
+	for _, cat := range strings.Split(list, ",") {
+		cat = strings.TrimSpace(cat)
+		known := false
+		for _, name := range CategoryNames {
+			known = known || name == cat
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown category %q, expected one of %s",
+				cat, strings.Join(CategoryNames, ","))
+		}
+		cats[cat] = true
+	}
+	return cats, nil
+}
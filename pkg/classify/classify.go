@@ -0,0 +1,355 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package classify
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "strings"
+
+// Heavy-secure ucode is wrapped in the same headers that nouveau
+// parses out of linux-firmware (see nvfw/fw.h and nvfw/hs.h there).
+const binMagic = 0x10de
+
+type BinHeader struct {
+	Magic, Version, Size, HeaderOffset, DataOffset, DataSize uint32
+}
+type HSHeader struct {
+	SigDbgOffset, SigDbgSize, SigProdOffset, SigProdSize uint32
+	PatchLoc, PatchSig, HdrOffset, HdrSize uint32
+}
+type HSLoadHeader struct {
+	NonSecCodeOff, NonSecCodeSize, DataDmaBase, DataSize, NumApps uint32
+}
+
+// Returns true if the off/size pair lies entirely within a buffer of
+// the given length.
+func inBounds(off, size uint32, length int) bool {
+	return uint64(off) + uint64(size) <= uint64(length)
+}
+
+// Look for a HS ucode image: a bin header pointing at a HS header,
+// whose signature blocks and load header all fit in the data.
+func ParseHS(data []byte) (bin BinHeader, hs HSHeader, load HSLoadHeader, ok bool) {
+	r := bytes.NewReader(data)
+	if binary.Read(r, binary.LittleEndian, &bin) != nil ||
+		bin.Magic != binMagic || bin.Size > uint32(len(data)) ||
+		!inBounds(bin.HeaderOffset, 32, len(data)) ||
+		!inBounds(bin.DataOffset, bin.DataSize, len(data)) {
+		return
+	}
+	r = bytes.NewReader(data[bin.HeaderOffset:])
+	if binary.Read(r, binary.LittleEndian, &hs) != nil ||
+		!inBounds(hs.SigDbgOffset, hs.SigDbgSize, len(data)) ||
+		!inBounds(hs.SigProdOffset, hs.SigProdSize, len(data)) ||
+		!inBounds(hs.HdrOffset, 20, len(data)) {
+		return
+	}
+	// A signed image has at least one signature block
+	if hs.SigDbgSize == 0 && hs.SigProdSize == 0 {
+		return
+	}
+	r = bytes.NewReader(data[hs.HdrOffset:])
+	if binary.Read(r, binary.LittleEndian, &load) != nil ||
+		load.NumApps == 0 || load.NumApps > 16 ||
+		load.NonSecCodeSize > bin.DataSize {
+		return
+	}
+	ok = true
+	return
+}
+
+// Pick a name for a HS image. There is nothing in the headers that
+// says what the ucode is for, so go by what it contains: the ACR
+// unload ucode is much smaller than the load one, and the SEC2 ucode
+// is the only one that carries several secure apps.
+func hsName(bin BinHeader, load HSLoadHeader) string {
+	switch {
+	case load.NumApps > 1:
+		return "sec2"
+	case bin.DataSize < 0x2000:
+		return "acr_unload"
+	}
+	return "acr_load"
+}
+
+// The video engine firmware of VP2-VP5 era chips has no header. These
+// were worked out for extract_firmware.py: a blob is identified by the
+// bytes it starts with, and told apart from its siblings by its size.
+var vp3Prefix = []byte("\xf1\x07\x00")
+var vp4Prefix = []byte("\xf1\x97\x00\x42\xcf\x99")
+
+var videoFirmware = []struct {
+	Prefix []byte
+	Size int
+	Engine, Gen string
+}{
+	{[]byte("\xcd\xab\x55\xee\x44\x46"), 0x16f3c, "bsp", "vp2"},
+	{[]byte("\xcd\xab\x55\xee\x44\x7c"), 0x1ae6c, "vp", "vp2"},
+	{vp3Prefix, 0xac00, "msvld", "vp3"},
+	{vp3Prefix, 0xa500, "mspdec", "vp3"},
+	{vp3Prefix, 0x3800, "msppp", "vp3"},
+	{vp4Prefix, 0x10200, "msvld", "vp4"},
+	{vp4Prefix, 0xc600, "mspdec", "vp4"},
+	{vp4Prefix, 0x3f00, "msppp", "vp4"},
+	{vp4Prefix, 0x10d00, "msvld", "vp42"},
+	{vp4Prefix, 0xd300, "mspdec", "vp42"},
+	{vp4Prefix, 0x4100, "msppp", "vp42"},
+	{vp4Prefix, 0x11c00, "msvld", "vp5"},
+	{vp4Prefix, 0xdd00, "mspdec", "vp5"},
+}
+
+// Newer falcon firmware starts with a descriptor (nvfw_ls_desc in
+// nouveau) that has the build date and application version.
+type LSDesc struct {
+	DescriptorSize, ImageSize, ToolsVersion, AppVersion uint32
+	Date [64]byte
+	BootloaderStartOffset, BootloaderSize uint32
+	BootloaderImemOffset, BootloaderEntryPoint uint32
+	AppStartOffset, AppSize, AppImemOffset, AppImemEntry uint32
+	AppDmemOffset uint32
+	AppResidentCodeOffset, AppResidentCodeSize uint32
+	AppResidentDataOffset, AppResidentDataSize uint32
+	NbOverlays uint32
+}
+
+func ParseLSDesc(data []byte) (desc LSDesc, ok bool) {
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &desc)
+	if err != nil || desc.DescriptorSize < 0x80 ||
+		desc.DescriptorSize > 0x1000 || desc.DescriptorSize % 4 != 0 ||
+		desc.ImageSize == 0 || desc.AppSize > desc.ImageSize {
+		return
+	}
+	// The date is a NUL-terminated string, e.g. "Mar 23 2018"
+	date := cString(desc.Date[:])
+	if len(date) < 8 {
+		return
+	}
+	for _, c := range []byte(date) {
+		if c < 0x20 || c > 0x7e {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Engines whose firmware tends to name itself in its strings
+var engineStrings = []string{"nvdec", "nvenc", "msenc", "nvjpg", "pmu"}
+
+// How long a NUL-terminated run of printable bytes has to be to be
+// taken for a string. A few letters of an engine name turn up in
+// random and compressed data all the time; a whole string with it in
+// doesn't.
+const minEngineString = 6
+
+// The first engine named in a string in data, or "". The name has to
+// be a word of its own in the string, as in "PMU: init" or
+// "nvdec_app", followed by nothing but digits at most, and the string
+// has to be NUL-terminated.
+func EngineString(data []byte) string {
+	found := ""
+	best := len(engineStrings)
+	start := -1
+	for i, c := range data {
+		if c >= 0x20 && c < 0x7f {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if c == 0 && start >= 0 && i - start >= minEngineString {
+			for _, word := range strings.FieldsFunc(strings.ToLower(string(data[start:i])), notAlnum) {
+				word = strings.TrimRight(word, "0123456789")
+				for n, engine := range engineStrings[:best] {
+					if word == engine {
+						found, best = engine, n
+						break
+					}
+				}
+			}
+			if best == 0 {
+				break
+			}
+		}
+		start = -1
+	}
+	return found
+}
+
+func notAlnum(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+}
+
+func Engine(data []byte) (name, note string) {
+	for _, v := range videoFirmware {
+		if len(data) == v.Size && bytes.HasPrefix(data, v.Prefix) {
+			return v.Engine + "_" + v.Gen,
+				fmt.Sprintf("%s firmware (%s)", v.Engine, v.Gen)
+		}
+	}
+
+	desc, isDesc := ParseLSDesc(data)
+	if engine := EngineString(data); engine != "" {
+		note = engine + " firmware"
+		if isDesc {
+			note += fmt.Sprintf(" (app version %d, built %s)",
+				desc.AppVersion, cString(desc.Date[:]))
+		}
+		return engine, note
+	}
+	if isDesc {
+		return "falcon", fmt.Sprintf("falcon firmware (app version %d, built %s)",
+			desc.AppVersion, cString(desc.Date[:]))
+	}
+	return
+}
+
+// Try to work out what a blob is. Returns the base name to save it
+// under and a description, or "" if nothing is known about it.
+func Identify(data []byte) (name, note string) {
+	if bin, hs, load, ok := ParseHS(data); ok {
+		return hsName(bin, load),
+			fmt.Sprintf("HS ucode, signed (prod 0x%x bytes, dbg 0x%x bytes)",
+				hs.SigProdSize, hs.SigDbgSize)
+	}
+	return Engine(data)
+}
+
+// Light-secure falcon ucode comes with a signature (lsf_signature in
+// nouveau) holding the prod and debug keys for the falcon it is for.
+// The v1 layout adds a dependency map and key derivation data.
+type LSSignature struct {
+	ProdKeys [2][16]byte
+	DbgKeys [2][16]byte
+	ProdPresent, DbgPresent uint32
+	FalconId uint32
+}
+
+const lsSignatureSize = 76
+const lsSignatureV1Size = 192
+
+// Falcon ids as used by the ACR
+var FalconNames = map[uint32]string{
+	0: "pmu",
+	1: "gsplite",
+	2: "fecs",
+	3: "gpccs",
+	4: "nvdec",
+	7: "sec2",
+	10: "minion",
+}
+
+func ParseLSSignature(data []byte) (sig LSSignature, ok bool) {
+	if len(data) != lsSignatureSize && len(data) != lsSignatureV1Size {
+		return
+	}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &sig)
+	if sig.ProdPresent > 1 || sig.DbgPresent > 1 ||
+		sig.ProdPresent + sig.DbgPresent == 0 ||
+		FalconNames[sig.FalconId] == "" {
+		return
+	}
+	ok = true
+	return
+}
+
+// An ACR image starts with a table of the LS falcons it carries (the
+// WPR header), each pointing at an LSB header that says where in the
+// image its ucode is. Newer images have a v1 table, with a bin_version
+// before the status, and v1 signatures in the LSB headers.
+type WPRHeader struct {
+	FalconId, LSBOffset, BootstrapOwner, LazyBootstrap, Status uint32
+}
+type WPRHeaderV1 struct {
+	FalconId, LSBOffset, BootstrapOwner, LazyBootstrap, BinVersion, Status uint32
+}
+type LSBTail struct {
+	UcodeOff, UcodeSize, DataSize, BLCodeSize uint32
+	BLImemOff, BLDataOff, BLDataSize uint32
+	AppCodeOff, AppCodeSize, AppDataOff, AppDataSize uint32
+	Flags uint32
+}
+
+const wprFalconInvalid = 0xffffffff
+
+type LSFalcon struct {
+	FalconId uint32
+	Signature []byte
+	LSB LSBTail
+}
+
+// Parse the WPR header table and LSB headers of an ACR image, trying
+// both header versions.
+func ParseWPR(data []byte) ([]LSFalcon, bool) {
+	if falcons, ok := parseWPR(data, 20, lsSignatureSize); ok {
+		return falcons, true
+	}
+	return parseWPR(data, 24, lsSignatureV1Size)
+}
+
+func parseWPR(data []byte, headerSize int, sigSize int) (falcons []LSFalcon, ok bool) {
+	r := bytes.NewReader(data)
+	for i := 0; ; i++ {
+		var hdr WPRHeaderV1
+		var err error
+		if headerSize == 20 {
+			var v0 WPRHeader
+			err = binary.Read(r, binary.LittleEndian, &v0)
+			hdr = WPRHeaderV1{v0.FalconId, v0.LSBOffset,
+				v0.BootstrapOwner, v0.LazyBootstrap, 0, v0.Status}
+		} else {
+			err = binary.Read(r, binary.LittleEndian, &hdr)
+		}
+		if err != nil || i >= len(FalconNames) {
+			return nil, false
+		}
+		if hdr.FalconId == wprFalconInvalid {
+			break
+		}
+		// The LSB headers come after the table
+		if FalconNames[hdr.FalconId] == "" ||
+			FalconNames[hdr.BootstrapOwner] == "" ||
+			hdr.LSBOffset < uint32(headerSize * (i + 1)) ||
+			!inBounds(hdr.LSBOffset, uint32(sigSize + 48), len(data)) {
+			return nil, false
+		}
+
+		f := LSFalcon{FalconId: hdr.FalconId}
+		f.Signature = data[hdr.LSBOffset:int(hdr.LSBOffset) + sigSize]
+		binary.Read(bytes.NewReader(data[int(hdr.LSBOffset) + sigSize:]),
+			binary.LittleEndian, &f.LSB)
+		end := uint64(f.LSB.UcodeOff) + uint64(f.LSB.UcodeSize) +
+			uint64(f.LSB.DataSize)
+		if end > uint64(len(data)) {
+			return nil, false
+		}
+		falcons = append(falcons, f)
+	}
+	return falcons, len(falcons) != 0
+}
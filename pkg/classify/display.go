@@ -0,0 +1,75 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package classify
+
+import "fmt"
+import "strings"
+
+// Display falcon ucode, for the DPU of Maxwell and Pascal and the
+// falcon in PDISP since, is a falcon or HS image like any other, with
+// nothing in its headers to say what it's for. The code that loads it
+// is what gives it away: its symbols and sections have disp (pdisp,
+// kdisp, nvdisplay) or dpu in their names.
+
+// Words with disp in them that have nothing to do with the display
+var notDisplay = []string{"dispatch", "dispose", "displace"}
+
+// Whether a symbol or section name is the display code's
+func displayName(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.Contains(lower, "dpu") {
+		return true
+	}
+	for _, word := range notDisplay {
+		lower = strings.Replace(lower, word, "", -1)
+	}
+	return strings.Contains(lower, "disp")
+}
+
+// Whether the display code references a blob, and which of its
+// references said so
+func DisplayContext(context []string) (where string, ok bool) {
+	for _, name := range context {
+		if displayName(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Tell display falcon ucode from other falcon ucode by what references
+// it: a HS image, or one starting with a falcon descriptor. Returns
+// what to say about it.
+func DisplayFirmware(data []byte, context []string) (note string, ok bool) {
+	where, ok := DisplayContext(context)
+	if !ok {
+		return "", false
+	}
+	if _, hs, _, isHS := ParseHS(data); isHS {
+		return fmt.Sprintf("display falcon (PDISP) ucode, HS signed (prod 0x%x bytes, dbg 0x%x bytes), loaded from %s",
+			hs.SigProdSize, hs.SigDbgSize, where), true
+	}
+	if desc, isDesc := ParseLSDesc(data); isDesc {
+		return fmt.Sprintf("display falcon (PDISP) ucode (app version %d, built %s), loaded from %s",
+			desc.AppVersion, cString(desc.Date[:]), where), true
+	}
+	return "", false
+}
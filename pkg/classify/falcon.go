@@ -0,0 +1,117 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package classify
+
+import "bytes"
+import "encoding/binary"
+
+// Falcon ucode that Identify doesn't recognize often still has its
+// descriptor in it somewhere: behind a bin header that isn't a HS one
+// (nvgpu's gk20a/gm20b images), or after something prepended to it.
+// The descriptor says where the bootloader, code and data are in the
+// image that follows it, so the blob can be split up along those.
+type FalconImage struct {
+	// Where the descriptor and the image it describes start
+	DescOffset, ImageOffset int
+	Desc LSDesc
+	// Whether a bin header pointed at the descriptor
+	BinHeader bool
+}
+
+// The parts of a falcon image, as found by FindFalcon
+type FalconPart struct {
+	Name string
+	Data []byte
+}
+
+// Falcon IMEM is loaded in 256 byte pages, and the descriptors that
+// don't come right at the start are aligned to them
+const falconPage = 0x100
+
+// Look for a falcon ucode descriptor past the start of data. One at
+// the very start is Identify's to find.
+func FindFalcon(data []byte) (FalconImage, bool) {
+	if len(data) >= 24 && binary.LittleEndian.Uint32(data) == binMagic {
+		var bin BinHeader
+		binary.Read(bytes.NewReader(data), binary.LittleEndian, &bin)
+		if bin.HeaderOffset != 0 && inBounds(bin.HeaderOffset, 0x80, len(data)) &&
+			inBounds(bin.DataOffset, 0, len(data)) {
+			if desc, ok := ParseLSDesc(data[bin.HeaderOffset:]); ok {
+				img := FalconImage{int(bin.HeaderOffset), int(bin.DataOffset), desc, true}
+				if img.fits(len(data)) {
+					return img, true
+				}
+			}
+		}
+	}
+	for off := falconPage; off + 0x80 <= len(data); off += falconPage {
+		desc, ok := ParseLSDesc(data[off:])
+		if !ok {
+			continue
+		}
+		img := FalconImage{off, off + int(desc.DescriptorSize), desc, false}
+		if img.fits(len(data)) {
+			return img, true
+		}
+	}
+	return FalconImage{}, false
+}
+
+// Whether everything the descriptor points at is within the data
+func (img FalconImage) fits(length int) bool {
+	for _, part := range img.ranges() {
+		if part[1] == 0 {
+			continue
+		}
+		if part[0] < 0 || img.ImageOffset + part[0] + part[1] > length {
+			return false
+		}
+	}
+	return img.Desc.BootloaderSize + img.Desc.AppResidentCodeSize != 0
+}
+
+// The offset and size of each part in the image: the bootloader, and
+// the application's resident code and data
+func (img FalconImage) ranges() [3][2]int {
+	d := img.Desc
+	// Added up as ints, so that offsets near the top of 32 bits
+	// can't wrap around into the image
+	return [3][2]int{
+		{int(d.BootloaderStartOffset), int(d.BootloaderSize)},
+		{int(d.AppStartOffset) + int(d.AppResidentCodeOffset), int(d.AppResidentCodeSize)},
+		{int(d.AppStartOffset) + int(d.AppResidentDataOffset), int(d.AppResidentDataSize)},
+	}
+}
+
+// Split the image up into its bootloader, code and data. Parts that
+// are empty are left out.
+func (img FalconImage) Parts(data []byte) []FalconPart {
+	var parts []FalconPart
+	for i, r := range img.ranges() {
+		if r[1] == 0 {
+			continue
+		}
+		start := img.ImageOffset + r[0]
+		parts = append(parts, FalconPart{[]string{"bootloader", "code", "data"}[i],
+			data[start:start+r[1]]})
+	}
+	return parts
+}
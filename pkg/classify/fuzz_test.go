@@ -0,0 +1,110 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package classify
+
+import "bytes"
+import "encoding/binary"
+import "testing"
+
+func testLSDesc() LSDesc {
+	desc := LSDesc{
+		DescriptorSize: 0xa0,
+		ImageSize: 0x700,
+		AppVersion: 1,
+		BootloaderSize: 0x100,
+		AppStartOffset: 0x100,
+		AppSize: 0x600,
+		AppResidentCodeSize: 0x400,
+		AppResidentDataOffset: 0x400,
+		AppResidentDataSize: 0x200,
+	}
+	copy(desc.Date[:], "Jan 01 2018")
+	return desc
+}
+
+// A falcon image the way nvgpu ships them: a bin header that isn't a
+// HS one, pointing at a ucode descriptor, then the image
+func testFalcon() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, BinHeader{Magic: binMagic,
+		Version: 1, Size: 0x800, HeaderOffset: 0x20, DataOffset: 0x100,
+		DataSize: 0x700})
+	buf.Write(make([]byte, 0x20 - buf.Len()))
+	binary.Write(&buf, binary.LittleEndian, testLSDesc())
+	buf.Write(make([]byte, 0x100 - buf.Len()))
+	buf.Write(bytes.Repeat([]byte{0xf1, 0x07, 0x00, 0x42}, 0x700 / 4))
+	return buf.Bytes()
+}
+
+// The same descriptor, with something prepended to it
+func testPrefixedFalcon() []byte {
+	var buf bytes.Buffer
+	buf.Write(bytes.Repeat([]byte{0x5a}, falconPage))
+	binary.Write(&buf, binary.LittleEndian, testLSDesc())
+	buf.Write(make([]byte, falconPage + 0xa0 - buf.Len()))
+	buf.Write(bytes.Repeat([]byte{0xf1, 0x07, 0x00, 0x42}, 0x700 / 4))
+	return buf.Bytes()
+}
+
+// A HS image: a bin header, then the HS header, its load header and
+// a signature block
+func testHS() []byte {
+	data := make([]byte, 0x400)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, BinHeader{Magic: binMagic,
+		Version: 1, Size: 0x400, HeaderOffset: 0x20, DataOffset: 0x100,
+		DataSize: 0x300})
+	copy(data, buf.Bytes())
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, HSHeader{SigDbgOffset: 0x80,
+		SigDbgSize: 0x10, SigProdOffset: 0x90, SigProdSize: 0x10,
+		HdrOffset: 0x40, HdrSize: 0x14})
+	copy(data[0x20:], buf.Bytes())
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, HSLoadHeader{NonSecCodeSize: 0x100,
+		DataDmaBase: 0x200, DataSize: 0x100, NumApps: 1})
+	copy(data[0x40:], buf.Bytes())
+	return data
+}
+
+// The falcon ucode descriptors and headers that are looked for in any
+// blob:
+// $ go test -fuzz=FuzzFalcon -fuzzminimizetime=1s ./pkg/classify
+// The parts FindFalcon splits an image into have to be in the data.
+func FuzzFalcon(f *testing.F) {
+	f.Add(testFalcon())
+	f.Add(testPrefixedFalcon())
+	f.Add(testHS())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Identify(data)
+		Protection(data)
+		img, ok := FindFalcon(data)
+		if !ok {
+			return
+		}
+		for _, part := range img.Parts(data) {
+			if len(part.Data) == 0 {
+				t.Fatalf("empty %s part at 0x%x", part.Name, img.ImageOffset)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package classify identifies firmware blobs by their contents: the
+// known-blob list, HS and LS headers, WPR images, video firmware and
+// the category names the filters work with.
+package classify
+
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "math"
+import "strings"
+
+// Firmware identified by its sha256. Name is what to save it as,
+// Engine what runs it, and FirstSeen the oldest driver version it was
+// found in.
+type KnownBlob struct {
+	Name string `json:"name"`
+	Engine string `json:"engine"`
+	FirstSeen string `json:"first_seen"`
+}
+
+// Hashes of blobs that have been identified for certain, checked
+// against what nouveau and linux-firmware use. None come with the
+// scanner yet: -known loads them from a JSON file of this shape, and
+// a config file's blobs add to them.
+var Known = make(map[string]KnownBlob)
+
+// Blobs that can be told apart by their size alone, from a config
+// file. Only used for blobs whose hash isn't known.
+var KnownSizes = make(map[int]KnownBlob)
+
+// Look a blob up by its hash, and then by its size
+func Lookup(hash string, size int) (KnownBlob, bool) {
+	if k, ok := Known[hash]; ok {
+		return k, true
+	}
+	k, ok := KnownSizes[size]
+	return k, ok
+}
+
+func HashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func LoadKnownBlobs(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var extra map[string]KnownBlob
+	if err = json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	for hash, k := range extra {
+		Known[strings.ToLower(hash)] = k
+	}
+	return nil
+}
+
+// Shannon entropy in bits per byte
+func Entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c != 0 {
+			f := float64(c) / float64(len(data))
+			e -= f * math.Log2(f)
+		}
+	}
+	return e
+}
+
+// Falcon code and register lists are far from random. Anything that
+// comes close to 8 bits per byte is encrypted (or compressed, which
+// the scan would have undone).
+const encryptedEntropy = 7.9
+
+// Say whether data is encrypted or signed, or "" if it's plain
+func Protection(data []byte) string {
+	if _, _, _, ok := ParseHS(data); ok {
+		return "signed"
+	}
+	if len(data) >= 256 && Entropy(data) > encryptedEntropy {
+		return "encrypted"
+	}
+	return ""
+}
+
+// Engines whose names turn up in the symbols and sections of the code
+// that uses their firmware. The vGPU manager's ucode comes first, since
+// its symbols also name the engines it runs on.
+var contextEngines = []string{
+	"vgpu", "msenc", "nvenc", "nvdec", "nvjpg", "ofa", "msvld", "mspdec",
+	"msppp", "sec2", "gsp", "pmu", "fecs", "gpccs", "acr", "dpu",
+	"disp", "minion",
+}
+
+// Guess the engine that consumes a blob from what references it
+func ContextEngine(context []string) (engine, where string) {
+	for _, name := range context {
+		lower := strings.ToLower(name)
+		for _, engine := range contextEngines {
+			if strings.Contains(lower, engine) {
+				// Not when it's in dispatch and the like
+				if engine == "disp" && !displayName(name) {
+					continue
+				}
+				return engine, name
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,641 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bytes"
+import "compress/flate"
+import "compress/gzip"
+import "compress/zlib"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "os/exec"
+import "strings"
+import "sync"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// A compression format that blobs may be stored in. Sniff says whether
+// data looks like it starts with this format (nil to always try), and
+// Decompress returns the decompressed data along with how much of the
+// input it used.
+type codec struct {
+	Name string
+	Sniff func(data []byte) bool
+	// Codecs either decompress into memory, up to limit bytes unless
+	// it's 0, or write what they Decompress to w, so that large blobs
+	// can go straight to a file.
+	Decompress func(data []byte, limit int64) ([]byte, int, error)
+	Stream func(data []byte, w io.Writer) (int, error)
+}
+
+// Tried in order. Formats with a header come first, since they can be
+// ruled out quickly; headerless deflate is tried on everything.
+var codecs = []codec{
+	{"zstd", sniffZstd, nil, decompressZstd},
+	{"lz4", sniffLZ4Frame, decompressLZ4Frame, nil},
+	{"xz", sniffXz, nil, decompressXz},
+	{"lzma", sniffLzma, nil, decompressLzma},
+	{"gzip", sniffGzip, nil, gunzip},
+	{"zlib", sniffZlib, nil, unzlib},
+	{"deflate", sniffDeflate, nil, inflate},
+	{"lz4-block", sniffLZ4Block, decompressLZ4Block, nil},
+}
+
+func lookupCodec(name string) *codec {
+	for i := range codecs {
+		if codecs[i].Name == name {
+			return &codecs[i]
+		}
+	}
+	return nil
+}
+
+// How a scan decodes what it finds. Each scan has its own, so that
+// scans running at once can be set up differently. A nil *Options
+// stands for DefaultOptions.
+type Options struct {
+	// The most a single blob may decompress to, so that a corrupt or
+	// hostile input can't run the machine out of memory. 0 means no
+	// limit.
+	MaxBlobSize int64
+	// Blobs bigger than this, such as GSP images, are decompressed
+	// straight into their file instead of into memory. 0 means never.
+	StreamSize int64
+	// Gaps shorter than this are too short to hold anything worth
+	// decoding. Lowering it finds more small blobs, and more garbage.
+	MinGap int64
+	// How near the end of its gap a headerless deflate stream has to
+	// end for it to be believed. Garbage inflates for a while and
+	// then hits a final block often enough, and what comes out of
+	// that is junk; real streams run up to the next reference, give
+	// or take padding, or up to the next stream. Negative takes any
+	// stream that inflates, for the most recall.
+	DeflateSlack int
+	// What is taken for a netlist archive stored as it is
+	Archives netlist.Limits
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxBlobSize: 1 << 30,
+		StreamSize: 64 << 20,
+		MinGap: 32,
+		DeflateSlack: 16,
+		Archives: netlist.DefaultLimits(),
+	}
+}
+
+var defaultOptions = DefaultOptions()
+
+func (o *Options) orDefault() *Options {
+	if o == nil {
+		return &defaultOptions
+	}
+	return o
+}
+
+// Decompress a gap with the first codec that accepts it. Data in a
+// format whose decompressor isn't installed fails with a
+// *MissingToolError, with used saying how long it is.
+func Decompress(gap []byte, opts *Options) (data []byte, used int, name string, err error) {
+	opts = opts.orDefault()
+	var failures []string
+	for _, c := range codecs {
+		if c.Sniff != nil && !c.Sniff(gap) {
+			continue
+		}
+		if c.Stream != nil {
+			limit, over := opts.memoryLimit()
+			var buf bytes.Buffer
+			used, err = c.Stream(gap, &limitWriter{&buf, limit, over})
+			data = buf.Bytes()
+		} else {
+			data, used, err = c.Decompress(gap, opts.MaxBlobSize)
+		}
+		// Data with the magic of a codec that can't be tried
+		// isn't anything else either
+		var missing *MissingToolError
+		if err == nil || errors.Is(err, ErrTooLarge) ||
+			errors.Is(err, ErrStream) || errors.As(err, &missing) {
+			return data, used, c.Name, err
+		}
+		failures = append(failures, err.Error())
+	}
+	err = fmt.Errorf("no codec accepted the data")
+	if failures != nil {
+		err = fmt.Errorf("nothing decompressed: %s", strings.Join(failures, "; "))
+	}
+	return
+}
+
+var ErrTooLarge = errors.New("decompressed data over the size limit")
+
+var ErrStream = errors.New("decompressed data too large to keep in memory")
+
+// How much may be decompressed into memory, and the error for going
+// over that
+func (o *Options) memoryLimit() (int64, error) {
+	if o.StreamSize > 0 && (o.MaxBlobSize <= 0 || o.StreamSize < o.MaxBlobSize) {
+		return o.StreamSize, ErrStream
+	}
+	return o.MaxBlobSize, ErrTooLarge
+}
+
+// Fails with err once more than limit bytes have been written,
+// unless limit is 0.
+type limitWriter struct {
+	w io.Writer
+	limit int64
+	err error
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.limit > 0 {
+		if int64(len(b)) > l.limit {
+			return 0, l.err
+		}
+		l.limit -= int64(len(b))
+	}
+	return l.w.Write(b)
+}
+
+// Most gaps aren't deflate at all, and setting up a flate reader for
+// each of them is most of the time a scan takes. So first check that
+// the first block header makes sense: not the reserved block type, a
+// stored block's length matching its complement, and a dynamic
+// block's code length code being a complete prefix code with table
+// sizes in range.
+func sniffDeflate(data []byte) bool {
+	if len(data) < 5 {
+		return false
+	}
+	var bits uint64
+	for i := 0; i < 5; i++ {
+		bits |= uint64(data[i]) << uint(8 * i)
+	}
+	get := func(n uint) uint64 {
+		v := bits & (1 << n - 1)
+		bits >>= n
+		return v
+	}
+	get(1)	// BFINAL
+	switch get(2) {
+	case 0:
+		return data[1] == ^data[3] && data[2] == ^data[4]
+	case 1:
+		return true
+	case 3:
+		return false
+	}
+	hlit, hdist, hclen := get(5), get(5), get(4) + 4
+	if hlit > 29 || hdist > 29 || len(data) < int(17 + hclen * 3 + 7) / 8 {
+		return false
+	}
+	// The code length code lengths straddle the 5 bytes read so far
+	pos := uint(17)
+	left := 1 << 7
+	count := 0
+	for i := uint64(0); i < hclen; i++ {
+		b := pos / 8
+		v := uint(data[b])
+		if b + 1 < uint(len(data)) {
+			v |= uint(data[b+1]) << 8
+		}
+		l := (v >> (pos % 8)) & 7
+		pos += 3
+		if l != 0 {
+			left -= 1 << (7 - l)
+			count++
+		}
+	}
+	return left == 0 || (count == 1 && left == 1 << 6)
+}
+
+func inflate(gap []byte, w io.Writer) (int, error) {
+	// flate reads exactly as much as it needs from a bytes.Reader,
+	// so what's left shows where the stream ended.
+	r := bytes.NewReader(gap)
+	_, err := io.Copy(w, flate.NewReader(r))
+	return len(gap) - r.Len(), err
+}
+
+// Older drivers wrap some of the deflate streams in a zlib or gzip
+// header, which raw inflate takes for a broken block.
+func sniffGzip(data []byte) bool {
+	return len(data) >= 18 && data[0] == 0x1f && data[1] == 0x8b &&
+		data[2] == 8
+}
+
+func gunzip(gap []byte, w io.Writer) (int, error) {
+	r := bytes.NewReader(gap)
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	z.Multistream(false)
+	_, err = io.Copy(w, z)
+	return len(gap) - r.Len(), err
+}
+
+func sniffZlib(data []byte) bool {
+	return len(data) >= 6 && data[0] & 0x0f == 8 && data[0] >> 4 <= 7 &&
+		(uint(data[0]) << 8 | uint(data[1])) % 31 == 0
+}
+
+func unzlib(gap []byte, w io.Writer) (int, error) {
+	r := bytes.NewReader(gap)
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(w, z)
+	return len(gap) - r.Len(), err
+}
+
+// Run an external decompressor over data. Go has no zstd or xz
+// decoder of its own, and these tools are everywhere anyway.
+var missingTools = make(map[string]bool)
+var missingToolsLock sync.Mutex
+
+// Data in a format whose decompressor isn't installed. It is left
+// undecoded, so what it holds is missing from the scan.
+type MissingToolError struct {
+	Tool string
+}
+
+func (e *MissingToolError) Error() string {
+	return e.Tool + " not found"
+}
+
+func (e *MissingToolError) Unwrap() error {
+	return exec.ErrNotFound
+}
+
+func runFilter(input []byte, w io.Writer, name string, args ...string) error {
+	missingToolsLock.Lock()
+	missing := missingTools[name]
+	missingToolsLock.Unlock()
+	if missing {
+		return &MissingToolError{name}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		missingToolsLock.Lock()
+		missingTools[name] = true
+		missingToolsLock.Unlock()
+		return &MissingToolError{name}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, stdout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+var zstdMagic = []byte("\x28\xb5\x2f\xfd")
+
+func sniffZstd(data []byte) bool {
+	return bytes.HasPrefix(data, zstdMagic)
+}
+
+// Work out the length of a zstd frame from its headers, without
+// decompressing it, so that only the frame is handed to zstd and not
+// whatever follows in rodata.
+func zstdFrameSize(data []byte) (int, bool) {
+	if len(data) < 5 || !sniffZstd(data) {
+		return 0, false
+	}
+	fhd := data[4]
+	if fhd & 0x08 != 0 {
+		// Reserved bit
+		return 0, false
+	}
+	singleSegment := fhd & 0x20 != 0
+	off := 5
+	if !singleSegment {
+		off++	// Window descriptor
+	}
+	off += []int{0, 1, 2, 4}[fhd & 3]			// Dictionary id
+	fcs := []int{0, 2, 4, 8}[fhd >> 6]	// Frame content size
+	if fcs == 0 && singleSegment {
+		fcs = 1
+	}
+	off += fcs
+
+	// Then come the blocks, each with a 3-byte header
+	for {
+		if off + 3 > len(data) {
+			return 0, false
+		}
+		hdr := int(data[off]) | int(data[off+1]) << 8 | int(data[off+2]) << 16
+		off += 3
+		size := hdr >> 3
+		switch (hdr >> 1) & 3 {
+		case 1:	// RLE: a single byte, repeated
+			size = 1
+		case 3:
+			return 0, false
+		}
+		off += size
+		if off > len(data) {
+			return 0, false
+		}
+		if hdr & 1 != 0 {
+			break
+		}
+	}
+	if fhd & 0x04 != 0 {
+		off += 4	// Content checksum
+	}
+	if off > len(data) {
+		return 0, false
+	}
+	return off, true
+}
+
+func decompressZstd(gap []byte, w io.Writer) (int, error) {
+	size, ok := zstdFrameSize(gap)
+	if !ok {
+		return 0, fmt.Errorf("bad zstd frame")
+	}
+	return size, runFilter(gap[:size], w, "zstd", "-dcq")
+}
+
+var xzMagic = []byte("\xfd7zXZ\x00")
+
+func sniffXz(data []byte) bool {
+	return bytes.HasPrefix(data, xzMagic)
+}
+
+// An xz stream ends with a footer that repeats the stream flags from
+// the header and finishes with "YZ", and the whole stream is a
+// multiple of 4 bytes long.
+func xzStreamSize(data []byte) (int, bool) {
+	if len(data) < 24 {
+		return 0, false
+	}
+	flags := data[6:8]
+	for off := 12 + 10; off + 2 <= len(data); off += 4 {
+		if data[off] == 'Y' && data[off+1] == 'Z' &&
+			bytes.Equal(data[off-2:off], flags) {
+			return off + 2, true
+		}
+	}
+	return 0, false
+}
+
+func decompressXz(gap []byte, w io.Writer) (int, error) {
+	size, ok := xzStreamSize(gap)
+	if !ok {
+		return 0, fmt.Errorf("xz: no stream footer")
+	}
+	return size, runFilter(gap[:size], w, "xz", "-dcq", "--format=xz")
+}
+
+// The legacy .lzma format has no magic, just the coder properties,
+// dictionary size and uncompressed size. Only take the common values:
+// lc/lp/pb of at most 8/4/4, a dictionary of 4KiB or more that is a
+// power of two (or 1.5 times one), and a sane or unknown size. The
+// range coder's first byte after that is always 0.
+func sniffLzma(data []byte) bool {
+	if len(data) < 14 || data[0] >= 9 * 5 * 5 || data[13] != 0 {
+		return false
+	}
+	dict := binary.LittleEndian.Uint32(data[1:])
+	if dict < 4096 || (dict & (dict - 1) != 0 &&
+		(dict / 3) & (dict / 3 - 1) != 0) {
+		return false
+	}
+	size := binary.LittleEndian.Uint64(data[5:])
+	return size == ^uint64(0) || size < 1 << 32
+}
+
+// The end of a .lzma stream can only be found by decoding it, so it
+// is decoded here rather than by xz, which doesn't say where it was.
+func decompressLzma(gap []byte, w io.Writer) (int, error) {
+	return lzmaStream(gap, w)
+}
+
+var lz4Magic = []byte("\x04\x22\x4d\x18")
+
+func sniffLZ4Frame(data []byte) bool {
+	return bytes.HasPrefix(data, lz4Magic)
+}
+
+// Decode one LZ4 block onto the end of out. Matches may reach back
+// into earlier blocks. With padded set, a run of zero bytes after the
+// last literals is taken to be padding rather than a broken sequence.
+// Going over limit bytes in all fails with ErrTooLarge.
+func lz4Block(in, out []byte, padded bool, limit int64) ([]byte, int, error) {
+	i := 0
+	for i < len(in) {
+		token := in[i]
+		i++
+
+		// Literal length, with 15 meaning more bytes follow
+		n, ok := lz4Length(in, &i, int(token >> 4))
+		if !ok {
+			return nil, 0, fmt.Errorf("lz4: truncated length")
+		}
+		if i + n > len(in) {
+			return nil, 0, fmt.Errorf("lz4: truncated literals")
+		}
+		out = append(out, in[i:i+n]...)
+		i += n
+
+		// The last sequence is literals only
+		if i == len(in) {
+			break
+		}
+		if padded && len(in) - i < 16 &&
+			bytes.Count(in[i:], []byte{0}) == len(in) - i {
+			break
+		}
+
+		if i + 2 > len(in) {
+			return nil, 0, fmt.Errorf("lz4: truncated offset")
+		}
+		offset := int(in[i]) | int(in[i+1]) << 8
+		i += 2
+		if offset == 0 || offset > len(out) {
+			return nil, 0, fmt.Errorf("lz4: bad offset %d", offset)
+		}
+		m, ok := lz4Length(in, &i, int(token & 15))
+		if !ok {
+			return nil, 0, fmt.Errorf("lz4: truncated length")
+		}
+		m += 4
+		if limit > 0 && int64(len(out) + m) > limit {
+			return nil, 0, ErrTooLarge
+		}
+		// Matches can overlap what they produce, so copy bytewise
+		start := len(out) - offset
+		for j := 0; j < m; j++ {
+			out = append(out, out[start+j])
+		}
+	}
+	return out, i, nil
+}
+
+// Firmware doesn't compress to less than this fraction of its size,
+// but a few runs of long matches out of garbage easily do
+const lz4BlockRatio = 64
+
+// How many sequences at the start of a bare LZ4 block to look over
+const lz4SniffSequences = 4
+
+// A bare LZ4 block has no magic, but its first sequences have to make
+// sense: literals to start with, since there's nothing yet for a
+// match to copy, matches only reaching back into what came before
+// them, and nothing expanding out of all proportion. Random data
+// rarely gets through the first few, which saves decoding it.
+func sniffLZ4Block(data []byte) bool {
+	i, size := 0, 0
+	for seq := 0; seq < lz4SniffSequences && i < len(data); seq++ {
+		token := data[i]
+		i++
+		n, ok := lz4Length(data, &i, int(token >> 4))
+		if !ok || (seq == 0 && n == 0) || i + n > len(data) {
+			return false
+		}
+		i += n
+		size += n
+		if i == len(data) {
+			return true
+		}
+		if i + 2 > len(data) {
+			return false
+		}
+		offset := int(data[i]) | int(data[i+1]) << 8
+		i += 2
+		m, ok := lz4Length(data, &i, int(token & 15))
+		if !ok || offset == 0 || offset > size {
+			return false
+		}
+		size += m + 4
+		if size > lz4BlockRatio * i {
+			return false
+		}
+	}
+	return true
+}
+
+// Read the rest of an LZ4 length that starts out as n from data[*i:]
+func lz4Length(data []byte, i *int, n int) (int, bool) {
+	if n != 15 {
+		return n, true
+	}
+	for {
+		if *i >= len(data) {
+			return 0, false
+		}
+		n += int(data[*i])
+		*i++
+		if data[*i-1] != 255 {
+			return n, true
+		}
+	}
+}
+
+// A bare LZ4 block has no header at all, so only believe it if it
+// decodes cleanly to the end of the gap and expands, but not by more
+// than real firmware would.
+func decompressLZ4Block(gap []byte, limit int64) ([]byte, int, error) {
+	data, used, err := lz4Block(gap, nil, true, limit)
+	switch {
+	case err != nil:
+	case len(data) <= len(gap):
+		err = fmt.Errorf("lz4: block doesn't expand")
+	case len(data) > lz4BlockRatio * used:
+		err = fmt.Errorf("lz4: block expands %d times, too much for firmware",
+			len(data) / used)
+	}
+	return data, used, err
+}
+
+func decompressLZ4Frame(gap []byte, limit int64) ([]byte, int, error) {
+	if len(gap) < 7 {
+		return nil, 0, fmt.Errorf("lz4: truncated frame")
+	}
+	flg := gap[4]
+	if flg >> 6 != 1 {
+		return nil, 0, fmt.Errorf("lz4: unknown frame version")
+	}
+	off := 6
+	if flg & 0x08 != 0 {
+		off += 8	// Content size
+	}
+	if flg & 0x01 != 0 {
+		off += 4	// Dictionary id
+	}
+	off++	// Header checksum
+
+	var out []byte
+	for {
+		if off + 4 > len(gap) {
+			return nil, 0, fmt.Errorf("lz4: truncated frame")
+		}
+		size := binary.LittleEndian.Uint32(gap[off:])
+		off += 4
+		if size == 0 {
+			break
+		}
+		stored := size & 0x80000000 != 0
+		size &= 0x7fffffff
+		if uint64(off) + uint64(size) > uint64(len(gap)) {
+			return nil, 0, fmt.Errorf("lz4: truncated block")
+		}
+		block := gap[off:off+int(size)]
+		if stored {
+			if limit > 0 && int64(len(out) + len(block)) > limit {
+				return nil, 0, ErrTooLarge
+			}
+			out = append(out, block...)
+		} else {
+			var err error
+			out, _, err = lz4Block(block, out, false, limit)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		off += int(size)
+		if flg & 0x10 != 0 {
+			off += 4	// Block checksum
+		}
+	}
+	if flg & 0x04 != 0 {
+		off += 4	// Content checksum
+	}
+	if off > len(gap) {
+		return nil, 0, fmt.Errorf("lz4: truncated frame")
+	}
+	return out, off, nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bytes"
+import "errors"
+import "io/ioutil"
+import "os/exec"
+import "path/filepath"
+import "testing"
+
+// testdata/firmware.bin compressed with each codec, by the tool it is
+// decompressed with, if any
+var codecFixtures = []struct {
+	file, codec, tool string
+	// Whatever follows the stream in its gap. A bare LZ4 block has
+	// to run to the end of its gap.
+	trailer bool
+}{
+	{"firmware.zst", "zstd", "zstd", true},
+	{"firmware.lz4", "lz4", "", true},
+	{"firmware.xz", "xz", "xz", true},
+	{"firmware.lzma", "lzma", "", true},
+	{"firmware.gz", "gzip", "", true},
+	{"firmware.zlib", "zlib", "", true},
+	{"firmware.deflate", "deflate", "", true},
+	{"firmware.lz4block", "lz4-block", "", false},
+}
+
+var trailer = bytes.Repeat([]byte{0xa5, 0x5a, 0x3c, 0xc3}, 16)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	want := readFixture(t, "firmware.bin")
+	for _, f := range codecFixtures {
+		t.Run(f.codec, func(t *testing.T) {
+			if _, err := exec.LookPath(f.tool); f.tool != "" && err != nil {
+				t.Skipf("%s not installed", f.tool)
+			}
+			stream := readFixture(t, f.file)
+			gap := stream
+			if f.trailer {
+				gap = append(append([]byte{}, stream...), trailer...)
+			}
+			data, used, name, err := Decompress(gap, nil)
+			switch {
+			case err != nil:
+				t.Fatalf("%s: %v", f.file, err)
+			case name != f.codec:
+				t.Errorf("%s: decoded as %s", f.file, name)
+			case used != len(stream):
+				t.Errorf("%s: used %d bytes of a %d byte stream", f.file, used,
+					len(stream))
+			case !bytes.Equal(data, want):
+				t.Errorf("%s: decoded to the wrong %d bytes", f.file, len(data))
+			}
+		})
+	}
+}
+
+// Each codec has to fail cleanly on a stream cut short
+func TestDecompressTruncated(t *testing.T) {
+	for _, f := range codecFixtures {
+		t.Run(f.codec, func(t *testing.T) {
+			if _, err := exec.LookPath(f.tool); f.tool != "" && err != nil {
+				t.Skipf("%s not installed", f.tool)
+			}
+			if !f.trailer {
+				t.Skip("a bare LZ4 block may end after any literals")
+			}
+			stream := readFixture(t, f.file)
+			gap := stream[:len(stream)/2]
+			if data, _, name, err := Decompress(gap, nil); err == nil && name == f.codec {
+				t.Errorf("%s: half a stream decoded to %d bytes", f.file, len(data))
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for _, f := range codecFixtures {
+		t.Run(f.codec, func(t *testing.T) {
+			if _, err := exec.LookPath(f.tool); f.tool != "" && err != nil {
+				t.Skipf("%s not installed", f.tool)
+			}
+			opts := DefaultOptions()
+			opts.MaxBlobSize, opts.StreamSize = 4096, 0
+			_, _, _, err := Decompress(readFixture(t, f.file), &opts)
+			if !errors.Is(err, ErrTooLarge) {
+				t.Errorf("%s: %v, not over the size limit", f.file, err)
+			}
+		})
+	}
+}
+
+func TestMissingTool(t *testing.T) {
+	err := runFilter(nil, ioutil.Discard, "no-such-decompressor")
+	var missing *MissingToolError
+	if !errors.As(err, &missing) || missing.Tool != "no-such-decompressor" {
+		t.Fatalf("got %v, not a MissingToolError", err)
+	}
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("%v isn't exec.ErrNotFound", err)
+	}
+}
+
+// A .lzma stream only says where it ends once decoded, and whatever
+// follows it in the gap has to be found all the same
+func TestDecodeGapAfterLzma(t *testing.T) {
+	want := readFixture(t, "firmware.bin")
+	lzma := readFixture(t, "firmware.lzma")
+	gz := readFixture(t, "firmware.gz")
+	rodata := append([]byte{}, lzma...)
+	for len(rodata) % 16 != 0 {
+		rodata = append(rodata, 0)
+	}
+	second := len(rodata)
+	rodata = append(rodata, gz...)
+	blobs := DecodeGap(rodata, 0, int64(len(rodata)), "", nil)
+	if len(blobs) != 2 {
+		t.Fatalf("found %d blobs, not 2: %+v", len(blobs), blobs)
+	}
+	for i, b := range []struct {
+		offset int64
+		codec string
+	}{{0, "lzma"}, {int64(second), "gzip"}} {
+		if blobs[i].Offset != b.offset || blobs[i].Codec != b.codec ||
+			!bytes.Equal(blobs[i].Data, want) {
+			t.Errorf("blob %d is %s at 0x%x, not %s at 0x%x", i, blobs[i].Codec,
+				blobs[i].Offset, b.codec, b.offset)
+		}
+	}
+}
+
+// A stream whose tool is missing is reported, and what follows it is
+// still found
+func TestDecodeGapMissingTool(t *testing.T) {
+	missingToolsLock.Lock()
+	was := missingTools["zstd"]
+	missingTools["zstd"] = true
+	missingToolsLock.Unlock()
+	defer func() {
+		missingToolsLock.Lock()
+		missingTools["zstd"] = was
+		missingToolsLock.Unlock()
+	}()
+
+	zst := readFixture(t, "firmware.zst")
+	rodata := append([]byte{}, zst...)
+	for len(rodata) % 16 != 0 {
+		rodata = append(rodata, 0)
+	}
+	rodata = append(rodata, readFixture(t, "firmware.gz")...)
+	blobs := DecodeGap(rodata, 0, int64(len(rodata)), "", nil)
+	if len(blobs) != 2 {
+		t.Fatalf("found %d blobs, not 2: %+v", len(blobs), blobs)
+	}
+	if blobs[0].Missing != "zstd" || blobs[0].Used != len(zst) || blobs[0].Data != nil {
+		t.Errorf("zstd stream: missing %q, used %d, %d bytes of data", blobs[0].Missing,
+			blobs[0].Used, len(blobs[0].Data))
+	}
+	if blobs[1].Codec != "gzip" {
+		t.Errorf("the stream after it is %s, not gzip", blobs[1].Codec)
+	}
+}
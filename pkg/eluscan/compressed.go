@@ -0,0 +1,110 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bytes"
+import "compress/zlib"
+import "debug/elf"
+import "encoding/binary"
+import "fmt"
+import "io"
+
+// Objects that went through a toolchain compressing their sections
+// have SHF_COMPRESSED set on them, .rodata and the relocations for it
+// included: each starts with a header giving the format and the size
+// of what it decompresses to. debug/elf only decompresses sections
+// that aren't loaded at run time, and not zstd on older Go, so the
+// rest is done here from the raw bytes in the file. Offsets into a
+// section, in relocations and symbols, are into what it decompresses
+// to, so they need nothing done to them.
+
+// Compression formats of a section header, from the ELF gABI
+const (
+	compressZlib = 1
+	compressZstd = 2
+)
+
+// Whether a section is stored compressed, so that offsets into it
+// aren't offsets into the file
+func Compressed(s *elf.Section) bool {
+	return s.Flags & elf.SHF_COMPRESSED != 0
+}
+
+// Read a section's contents, decompressed if it's compressed, up to
+// opts.MaxBlobSize. r is the file f was read from.
+func SectionData(f *elf.File, r io.ReaderAt, s *elf.Section, opts *Options) ([]byte, error) {
+	opts = opts.orDefault()
+	if !Compressed(s) {
+		return s.Data()
+	}
+	raw := make([]byte, s.FileSize)
+	if _, err := r.ReadAt(raw, int64(s.Offset)); err != nil {
+		return nil, err
+	}
+	var typ uint32
+	var size uint64
+	var hdrSize int
+	switch f.Class {
+	case elf.ELFCLASS32:
+		var ch elf.Chdr32
+		hdrSize = binary.Size(ch)
+		if len(raw) < hdrSize {
+			return nil, fmt.Errorf("%s: compressed, but too short for the header", s.Name)
+		}
+		binary.Read(bytes.NewReader(raw), f.ByteOrder, &ch)
+		typ, size = ch.Type, uint64(ch.Size)
+	default:
+		var ch elf.Chdr64
+		hdrSize = binary.Size(ch)
+		if len(raw) < hdrSize {
+			return nil, fmt.Errorf("%s: compressed, but too short for the header", s.Name)
+		}
+		binary.Read(bytes.NewReader(raw), f.ByteOrder, &ch)
+		typ, size = ch.Type, ch.Size
+	}
+	if opts.MaxBlobSize > 0 && size > uint64(opts.MaxBlobSize) {
+		return nil, fmt.Errorf("%s: decompresses to 0x%x bytes, over the size limit",
+			s.Name, size)
+	}
+
+	var out bytes.Buffer
+	switch typ {
+	case compressZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(raw[hdrSize:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Name, err)
+		}
+		if _, err := io.Copy(&out, io.LimitReader(zr, int64(size))); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Name, err)
+		}
+	case compressZstd:
+		if err := runFilter(raw[hdrSize:], &out, "zstd", "-dcq"); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown compression format %d", s.Name, typ)
+	}
+	if uint64(out.Len()) != size {
+		return nil, fmt.Errorf("%s: decompressed to 0x%x bytes instead of 0x%x",
+			s.Name, out.Len(), size)
+	}
+	return out.Bytes(), nil
+}
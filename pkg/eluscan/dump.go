@@ -0,0 +1,193 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bufio"
+import "bytes"
+import "compress/flate"
+import "debug/elf"
+import "encoding/binary"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// A memory dump has no relocations to say where the firmware starts,
+// so it's found by what it looks like: the magic of the compression
+// formats that have one (all but .lzma), the headers of stored HS
+// images and netlist archives, and deflate streams that inflate to
+// something sizable.
+// Each one is decoded as it's found to see where it ends, so that
+// nothing inside it is taken for a stream of its own.
+
+// How much a headerless deflate stream in a dump has to inflate to
+// before it's believed. Random data passes for a few bytes of deflate
+// often enough.
+var MinDumpInflate = 4096
+
+// Read a memory dump, and work out which parts of it hold memory: the
+// PT_LOAD segments of an ELF core file, or the whole of a raw dump.
+func ReadDump(fname string) (data []byte, ranges [][2]int64, err error) {
+	if fname == "-" {
+		data, err = ioutil.ReadAll(bufio.NewReader(os.Stdin))
+	} else {
+		data, err = ioutil.ReadFile(fname)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if f, err := elf.NewFile(bytes.NewReader(data)); err == nil && f.Type == elf.ET_CORE {
+		for _, prog := range f.Progs {
+			end := prog.Off + prog.Filesz
+			if prog.Type != elf.PT_LOAD || prog.Filesz == 0 || end > uint64(len(data)) {
+				continue
+			}
+			ranges = append(ranges, [2]int64{int64(prog.Off), int64(end)})
+		}
+		return data, ranges, nil
+	}
+	return data, [][2]int64{{0, int64(len(data))}}, nil
+}
+
+// Whether the start of a file is that of an ELF core file
+func IsCore(head []byte) bool {
+	if len(head) < 18 || !bytes.HasPrefix(head, []byte(elf.ELFMAG)) {
+		return false
+	}
+	if head[elf.EI_DATA] == byte(elf.ELFDATA2MSB) {
+		return binary.BigEndian.Uint16(head[16:]) == uint16(elf.ET_CORE)
+	}
+	return binary.LittleEndian.Uint16(head[16:]) == uint16(elf.ET_CORE)
+}
+
+// Find the streams in the ranges of a dump, returned as gaps that run
+// from the start of each to its end. Formats with a header are looked
+// for at every word, headerless deflate only every 16 bytes. Closing
+// stop ends it early.
+func DumpStreams(data []byte, ranges [][2]int64, opts *Options, stop <-chan struct{}) [][2]int64 {
+	opts = opts.orDefault()
+	var gaps [][2]int64
+	inflater := flate.NewReader(bytes.NewReader(nil))
+	for _, r := range ranges {
+		for off := (r[0] + 3) &^ 3; off + 32 <= r[1]; {
+			if off & 0xfffff == 0 {
+				select {
+				case <-stop:
+					return gaps
+				default:
+				}
+			}
+			n := opts.streamLength(data[off:r[1]], off & 15 == 0, inflater)
+			if n <= 0 {
+				off += 4
+				continue
+			}
+			gaps = append(gaps, [2]int64{off, off + int64(n)})
+			off = (off + int64(n) + 3) &^ 3
+		}
+	}
+	return gaps
+}
+
+// How long the stream at the start of data is, or 0 if there doesn't
+// seem to be one
+func (o *Options) streamLength(data []byte, tryDeflate bool, inflater io.ReadCloser) int {
+	for i := range codecs {
+		c := &codecs[i]
+		// .lzma and bare LZ4 blocks have no magic, and small words
+		// in memory pass for their start all the time
+		if c.Sniff == nil || c.Name == "deflate" || c.Name == "lzma" ||
+			c.Name == "lz4-block" || !c.Sniff(data) {
+			continue
+		}
+		if c.Stream != nil {
+			// Only where it ends matters, not what it holds
+			w := &countWriter{}
+			used, err := c.Stream(data, w)
+			var missing *MissingToolError
+			if (err == nil && w.n > 0) || (errors.As(err, &missing) && used > 0) {
+				return used
+			}
+		} else if out, used, err := c.Decompress(data, o.MaxBlobSize); err == nil && len(out) > 0 {
+			return used
+		}
+	}
+	// The bin header starts with 0x10de, NVIDIA's PCI vendor id
+	if binary.LittleEndian.Uint32(data) == 0x10de {
+		if bin, _, _, ok := classify.ParseHS(data); ok && bin.Size != 0 {
+			return int(bin.Size)
+		}
+	}
+	if n := archiveLength(data, &o.Archives); n != 0 {
+		return n
+	}
+	if tryDeflate && sniffDeflate(data) {
+		r := bytes.NewReader(data)
+		inflater.(flate.Resetter).Reset(r, nil)
+		w := &countWriter{}
+		_, err := io.Copy(w, inflater)
+		used := len(data) - r.Len()
+		// Random data passes for stored blocks once in a while,
+		// but those don't come out any bigger
+		if err == nil && w.n >= int64(MinDumpInflate) && w.n > int64(used) {
+			return used
+		}
+	}
+	return 0
+}
+
+// How far the entries of a netlist archive at the start of data reach,
+// or 0 if there's no archive there. A cheap look at the header comes
+// first, since most words aren't the start of one.
+func archiveLength(data []byte, lim *netlist.Limits) int {
+	if len(data) < lim.MinSize || binary.LittleEndian.Uint32(data) > 15 {
+		return 0
+	}
+	if count := binary.LittleEndian.Uint32(data[4:]); count == 0 || count > uint32(lim.MaxEntries) {
+		return 0
+	}
+	if !netlist.LooksLikeArchive(data, lim) {
+		return 0
+	}
+	_, entries, _, err := netlist.ParseArchive(data, lim)
+	if err != nil {
+		return 0
+	}
+	var end int
+	for _, e := range entries {
+		if n := int(e.Offset) + int(e.Length); n > end {
+			end = n
+		}
+	}
+	return end
+}
+
+// Counts what is written to it, and throws it away
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
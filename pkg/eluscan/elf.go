@@ -0,0 +1,363 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package eluscan finds the firmware stored in the .rodata of an
+// nv-kernel.o_binary.
+//
+// Premise is to parse the relocations table to look for offests into
+// rodata, where the firmware is stored. We assume that rodata is
+// reasonably well-packed, and try to process the data in between
+// relocations.
+//
+// The assumption is that the data is deflated (but without
+// headers). This applies both to the netlist archives, as well as the
+// video/pmu/etc firmware which is stored "raw".
+package eluscan
+
+import "bufio"
+import "bytes"
+import "debug/elf"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "sort"
+
+// A relocation pointing into the scanned section: the offset it points
+// at, and the symbol whose data or code holds the reference.
+type Reference struct {
+	Addend int64
+	Symbol string
+	// The section the reference is in
+	Section string
+}
+
+// Finds the symbol at an address in a section, for naming where
+// references come from.
+type symbolIndex map[elf.SectionIndex][]elf.Symbol
+
+func newSymbolIndex(symbols []elf.Symbol) symbolIndex {
+	idx := make(symbolIndex)
+	for _, sym := range symbols {
+		switch elf.SymType(sym.Info & 0xf) {
+		case elf.STT_SECTION, elf.STT_FILE:
+			continue
+		}
+		idx[sym.Section] = append(idx[sym.Section], sym)
+	}
+	for _, syms := range idx {
+		sort.Slice(syms, func (a, b int) bool {
+			return syms[a].Value < syms[b].Value
+		})
+	}
+	return idx
+}
+
+// Returns the name of the closest symbol at or before off, with the
+// offset into it if it doesn't start there.
+func (idx symbolIndex) lookup(section elf.SectionIndex, off uint64) string {
+	syms := idx[section]
+	i := sort.Search(len(syms), func (i int) bool {
+		return syms[i].Value > off
+	})
+	if i == 0 {
+		return ""
+	}
+	sym := syms[i-1]
+	if sym.Value == off {
+		return sym.Name
+	}
+	return fmt.Sprintf("%s+0x%x", sym.Name, off - sym.Value)
+}
+
+// Collect the references into a section from every relocation
+// section, e.g. from code in .text as well as from tables in .rodata.
+func ParseAllReferences(f *elf.File, r io.ReaderAt, section string) (refs []Reference, err error) {
+	target := f.Section(section)
+	symbols, idx, err := relocationSymbols(f)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_RELA {
+			continue
+		}
+		err = eachReference(f, r, s, nil, symbols, idx, func(to *elf.Section, ref Reference) {
+			if to == target {
+				refs = append(refs, ref)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Collect the references into section from the relocations in
+// relSection. r is the file f was read from.
+func ParseRelocations(f *elf.File, r io.ReaderAt, relSection, section string) (refs []Reference, err error) {
+	relsS := f.Section(relSection)
+	if relsS == nil {
+		return
+	}
+	target := f.Section(section)
+	symbols, idx, err := relocationSymbols(f)
+	if err != nil {
+		return nil, err
+	}
+	err = eachReference(f, r, relsS, nil, symbols, idx, func(to *elf.Section, ref Reference) {
+		if to == target {
+			refs = append(refs, ref)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// The symbols relocations refer to, and an index of them for naming
+// where the references come from. Fails with elf.ErrNoSymbols for an
+// object that has been stripped of them.
+func relocationSymbols(f *elf.File) ([]elf.Symbol, symbolIndex, error) {
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, nil, err
+	}
+	return symbols, newSymbolIndex(symbols), nil
+}
+
+// Go through the relocations in relsS, handing each one that points
+// into a section to found, with the section and the offset into it.
+// Most point at a section's symbol with the offset as the addend,
+// but ones at a symbol of its own are just as much a reference to
+// wherever it is. Fails before calling found if relsS can't be read.
+func eachReference(f *elf.File, r io.ReaderAt, relsS *elf.Section, opts *Options, symbols []elf.Symbol, idx symbolIndex, found func(*elf.Section, Reference)) error {
+	rels, err := SectionData(f, r, relsS, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", relsS.Name, err)
+	}
+	if len(rels) % 24 != 0 {
+		return fmt.Errorf("%s: unexpected length 0x%x", relsS.Name, len(rels))
+	}
+
+	// The section being relocated is where the references come
+	// from
+	var siteSection string
+	if int(relsS.Info) < len(f.Sections) {
+		siteSection = f.Sections[relsS.Info].Name
+	}
+
+	// Borrowed from the debug/elf relocation processing logic
+	b := bytes.NewReader(rels)
+  	var rela elf.Rela64
+	for b.Len() > 0 {
+		// Can't fail, with the length checked
+		binary.Read(b, f.ByteOrder, &rela)
+
+		symNo := rela.Info >> 32
+		if symNo == 0 || int(symNo) > len(symbols) {
+			continue
+		}
+		sym := &symbols[symNo-1]
+		if sym.Section == elf.SHN_UNDEF || int(sym.Section) >= len(f.Sections) {
+			// Nothing in this object, or not in a section
+			continue
+		}
+		to := f.Sections[sym.Section]
+		off := rela.Addend
+		switch elf.SymType(sym.Info & 0xf) {
+		case elf.STT_SECTION:
+		case elf.STT_OBJECT, elf.STT_NOTYPE:
+			off += int64(sym.Value - to.Addr)
+		default:
+			continue
+		}
+
+		site := idx.lookup(elf.SectionIndex(relsS.Info), rela.Off)
+		found(to, Reference{off, site, siteSection})
+	}
+	return nil
+}
+
+// A sized object symbol in the scanned section, from Start to End.
+// Where the symbols weren't stripped or obfuscated, their names say
+// what each firmware array is, and their sizes where it ends.
+type Span struct {
+	Name string
+	Start, End int64
+}
+
+// Obfuscated symbols, like _nv012345rm, say nothing about what they
+// hold
+var obfuscatedRe = regexp.MustCompile(`^_nv[0-9]+rm$`)
+
+// Collect the object symbols in a section that are big enough to hold
+// a blob and have a name that means something, in order. Ones that
+// overlap an earlier one are left out.
+func SymbolSpans(f *elf.File, section string, opts *Options) (spans []Span) {
+	opts = opts.orDefault()
+	s := f.Section(section)
+	symbols, err := f.Symbols()
+	if s == nil || err != nil {
+		return
+	}
+	for _, sym := range symbols {
+		if elf.SymType(sym.Info & 0xf) != elf.STT_OBJECT ||
+			int(sym.Section) >= len(f.Sections) || f.Sections[sym.Section] != s ||
+			int64(sym.Size) < opts.MinGap || obfuscatedRe.MatchString(sym.Name) {
+			continue
+		}
+		// Symbols in objects that have been linked hold addresses
+		start := int64(sym.Value - s.Addr)
+		end := start + int64(sym.Size)
+		if start < 0 || end > int64(s.Size) {
+			continue
+		}
+		spans = append(spans, Span{sym.Name, start, end})
+	}
+	sort.SliceStable(spans, func (a, b int) bool {
+		return spans[a].Start < spans[b].Start
+	})
+	var kept []Span
+	for _, span := range spans {
+		if len(kept) == 0 || span.Start >= kept[len(kept)-1].End {
+			kept = append(kept, span)
+		}
+	}
+	return kept
+}
+
+// Work out the gaps between the relocation targets in rodata, which
+// is size bytes long, that are worth trying to decode. We assume the
+// targets are tightly packed, so each gap runs from one to the next.
+// Only gaps starting in [start, end) are kept; end <= 0 means the end
+// of rodata. Gaps shorter than opts.MinGap are left out.
+func FindGaps(refs []Reference, size, start, end int64, opts *Options) [][2]int64 {
+	return FindSymbolGaps(refs, nil, size, start, end, opts)
+}
+
+// Same as FindGaps, with each of spans a gap of its own: relocations
+// into the middle of one are passed over, and the gaps around it stop
+// where it starts and start where it ends.
+func FindSymbolGaps(refs []Reference, spans []Span, size, start, end int64, opts *Options) [][2]int64 {
+	opts = opts.orDefault()
+	var offsets []int64
+	seen := make(map[int64]bool)
+	inside := func(off int64) bool {
+		for _, s := range spans {
+			if off > s.Start && off < s.End {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(off int64) {
+		if !seen[off] && !inside(off) {
+			seen[off] = true
+			offsets = append(offsets, off)
+		}
+	}
+	for _, ref := range refs {
+		add(ref.Addend)
+	}
+	for _, s := range spans {
+		add(s.Start)
+		add(s.End)
+	}
+	if !seen[size] {
+		offsets = append(offsets, size)
+	}
+
+	sort.Slice(offsets, func (a, b int) bool {
+		return offsets[a] < offsets[b]
+	})
+	if end <= 0 || end > size {
+		end = size
+	}
+
+	var gaps [][2]int64
+	for i, off := range offsets {
+		var prev int64
+		if i > 0 {
+			prev = offsets[i - 1]
+		}
+		// Check that there's enough data between sequential offsets
+		if off - prev < opts.MinGap {
+			continue
+		}
+		// Only gaps starting in the window asked for
+		if prev < start || prev >= end {
+			continue
+		}
+		gaps = append(gaps, [2]int64{prev, off})
+	}
+	return gaps
+}
+
+var versionRe = regexp.MustCompile(`Kernel Module +([0-9]+\.[0-9]+(\.[0-9]+)?)`)
+
+// Driver builds carry their version in a few strings, e.g.
+// "NVIDIA UNIX x86_64 Kernel Module  390.48  Thu Mar 22 00:42:57 PDT 2018"
+func DriverVersion(rodata []byte) string {
+	m := versionRe.FindSubmatch(rodata)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
+
+// Open an object file, or read one from stdin for "-". The ELF parser
+// needs to seek around, so stdin is copied to a temporary file first.
+// The file is returned too, for SectionData, and has to be closed once
+// done with.
+func OpenObject(fname string) (*elf.File, *os.File, error) {
+	if fname != "-" {
+		file, err := os.Open(fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		f, err := elf.NewFile(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return f, file, nil
+	}
+	tmp, err := ioutil.TempFile("", "scanner-stdin")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Nothing else needs the name
+	os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, bufio.NewReader(os.Stdin)); err != nil {
+		tmp.Close()
+		return nil, nil, err
+	}
+	f, err := elf.NewFile(tmp)
+	if err != nil {
+		tmp.Close()
+		return nil, nil, err
+	}
+	return f, tmp, nil
+}
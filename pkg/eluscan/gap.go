@@ -0,0 +1,377 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bufio"
+import "bytes"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "runtime"
+import "sync"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// How far into a large gap to look for a blob that doesn't start
+// right at the relocation: every word for the first few, then every
+// 16 bytes.
+const (
+	retryGapSize = 1024
+	retryWords = 64
+	retryLimit = 4096
+)
+
+// What Decompress made of the data at an offset
+type decoded struct {
+	offset int64
+	data []byte
+	used int
+	codec string
+	err error
+}
+
+func (o *Options) decodeAt(rodata []byte, start, end int64) *decoded {
+	data, used, codec, err := Decompress(rodata[start:end], o)
+	return &decoded{start, data, used, codec, err}
+}
+
+// Whether a headerless deflate stream at rodata[start:], which used
+// the first used bytes of a gap running to end, ended where it should
+// have: close enough to the end, with nothing but zeros after it, or
+// right before something else that decodes. What was decoded after
+// it is returned too, for DecodeGap to carry on with rather than
+// decoding it again.
+func (o *Options) consumed(rodata []byte, start int64, used int, end int64) (bool, *decoded) {
+	if o.DeflateSlack < 0 {
+		return true, nil
+	}
+	next := start + int64(used)
+	rest := rodata[next:end]
+	if len(rest) <= o.DeflateSlack || len(bytes.TrimLeft(rest, "\x00")) == 0 {
+		return true, nil
+	}
+	// Skip the padding up to the next stream, as DecodeGap does
+	for ; next < end && next % 16 != 0 && rodata[next] == 0; next++ {
+	}
+	if end - next < o.MinGap {
+		return false, nil
+	}
+	d := o.decodeAt(rodata, next, end)
+	if d.err == nil || errors.Is(d.err, ErrStream) {
+		return true, d
+	}
+	return o.stored(rodata[next:end]) != nil, d
+}
+
+// Find the first aligned offset past the start of a gap where
+// something decompresses or looks like stored firmware.
+func (o *Options) retryGap(gap []byte) (int64, bool) {
+	if len(gap) < retryGapSize {
+		return 0, false
+	}
+	for off := 4; off < retryLimit && int64(len(gap) - off) >= o.MinGap; {
+		_, _, _, err := Decompress(gap[off:], o)
+		if err == nil || errors.Is(err, ErrStream) {
+			return int64(off), true
+		}
+		if o.stored(gap[off:]) != nil {
+			return int64(off), true
+		}
+		if off < retryWords {
+			off += 4
+		} else {
+			off += 16
+		}
+	}
+	return 0, false
+}
+
+// Pick out uncompressed firmware by its structure: a HS bin header, a
+// LS descriptor, a WPR header table or a netlist archive header with
+// a sane entry table. Returns the blob, or nil if the gap looks like
+// nothing in particular.
+func (o *Options) stored(gap []byte) []byte {
+	if bin, _, _, ok := classify.ParseHS(gap); ok {
+		if bin.Size != 0 {
+			return gap[:bin.Size]
+		}
+		return gap
+	}
+	if _, ok := classify.ParseLSDesc(gap); ok {
+		return gap
+	}
+	if _, ok := classify.ParseWPR(gap); ok {
+		return gap
+	}
+	if len(gap) >= o.Archives.MinSize && netlist.LooksLikeArchive(gap, &o.Archives) {
+		return gap
+	}
+	return nil
+}
+
+// A blob found in a gap, or why one had to be skipped
+type Blob struct {
+	Offset int64
+	Used int
+	Codec string
+	Data []byte
+	Size int64
+	Skip string
+	// Why nothing could be found at Offset, when nothing was
+	Why string
+	// The decompressor the stream at Offset needed, when it isn't
+	// installed. Used is how long the stream is.
+	Missing string
+	// Big blobs are streamed into this file instead, unless it's a
+	// dry run, with their hash and the start of them in Data.
+	Streamed bool
+	File, Hash string
+}
+
+// How much of a streamed blob to keep in memory to tell what it is
+const streamPrefix = 1 << 20
+
+// Keeps the first few bytes written to it, and counts the rest
+type prefixWriter struct {
+	data []byte
+	size int64
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.size += int64(len(b))
+	if n := streamPrefix - len(w.data); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.data = append(w.data, b[:n]...)
+	}
+	return len(b), nil
+}
+
+// Decompress a blob into a file in dir, hashing it on the way.
+func (o *Options) streamBlob(gap []byte, offset int64, c *codec, dir string) (b Blob, err error) {
+	b = Blob{Offset: offset, Codec: c.Name, Streamed: true}
+	var f *os.File
+	var buf *bufio.Writer
+	out := ioutil.Discard
+	if dir != "" {
+		b.File = path.Join(dir, fmt.Sprintf(".partial_%x", offset))
+		f, err = os.OpenFile(b.File, os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+			os.FileMode(0666))
+		if err != nil {
+			return
+		}
+		buf = bufio.NewWriterSize(f, 1 << 20)
+		out = buf
+	}
+	hash := sha256.New()
+	prefix := &prefixWriter{}
+	w := &limitWriter{io.MultiWriter(out, hash, prefix), o.MaxBlobSize, ErrTooLarge}
+	b.Used, err = c.Stream(gap, w)
+	if f != nil {
+		if err == nil {
+			err = buf.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(b.File)
+		}
+	}
+	if err != nil {
+		return
+	}
+	b.Data = prefix.data
+	b.Size = prefix.size
+	b.Hash = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+// Decode gaps on a pool of workers, and send what each one held on
+// the returned channel in the order of the gaps. Only a few gaps per
+// worker are let ahead of the one being waited for, to bound memory.
+// Closing stop ends it early, without leaving any files behind.
+// Streamed blobs go into files in dir, as for DecodeGap. Workers <= 0
+// means one per CPU.
+func DecodeGaps(rodata []byte, gaps [][2]int64, workers int, dir string, opts *Options, stop <-chan struct{}) <-chan []Blob {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	results := make([]chan []Blob, len(gaps))
+	for i := range results {
+		results[i] = make(chan []Blob, 1)
+	}
+	window := make(chan struct{}, 4 * workers)
+	work := make(chan int)
+	go func() {
+		defer close(work)
+		for i := range gaps {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			work <- i
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] <- DecodeGap(rodata, gaps[i][0], gaps[i][1], dir, opts)
+			}
+		}()
+	}
+
+	out := make(chan []Blob)
+	go func() {
+		defer close(out)
+		for _, result := range results {
+			select {
+			case blobs := <-result:
+				select {
+				case out <- blobs:
+					<-window
+					continue
+				case <-stop:
+					Discard(blobs)
+				}
+			case <-stop:
+			}
+			// Stopped early: wait for the gaps being worked on,
+			// and remove the files of what won't be used
+			wg.Wait()
+			for _, result := range results {
+				select {
+				case blobs := <-result:
+					Discard(blobs)
+				default:
+				}
+			}
+			return
+		}
+	}()
+	return out
+}
+
+// Remove the files of streamed blobs that won't be used after all
+func Discard(blobs []Blob) {
+	for _, b := range blobs {
+		if b.File != "" {
+			os.Remove(b.File)
+		}
+	}
+}
+
+// Find whatever is in rodata[start:end]. A gap can hold several
+// streams back to back with only one relocation pointing at the
+// first, so carry on from where each stream ended. Blobs too big for
+// memory are decompressed into a file in dir, or only hashed if dir
+// is "". What is tried and kept is as opts says.
+func DecodeGap(rodata []byte, start, end int64, dir string, opts *Options) (blobs []Blob) {
+	opts = opts.orDefault()
+	var next *decoded
+	for end - start >= opts.MinGap {
+		// Attempt to decompress, with basic flate algorithm
+		// (underlying deflate/gzip) if nothing else fits, unless
+		// checking the last stream already did
+		d := next
+		if d == nil || d.offset != start {
+			d = opts.decodeAt(rodata, start, end)
+		}
+		next = nil
+		used, codec, err := d.used, d.codec, d.err
+		b := Blob{Offset: start, Used: used, Codec: codec,
+			Data: d.data, Size: int64(len(d.data))}
+		if errors.Is(err, ErrStream) {
+			b, err = opts.streamBlob(rodata[start:end], start, lookupCodec(codec), dir)
+		}
+		if errors.Is(err, ErrTooLarge) {
+			// There's no telling where the stream ends, so give
+			// up on the rest of the gap
+			return append(blobs, Blob{Offset: start, Codec: codec,
+				Skip: fmt.Sprintf("Skipping %s Data: over %d bytes decompressed",
+					codec, opts.MaxBlobSize)})
+		}
+		if err != nil && b.Streamed {
+			return append(blobs, Blob{Offset: start, Codec: codec,
+				Skip: fmt.Sprintf("Skipping %s Data: %v", codec, err)})
+		}
+		var missing *MissingToolError
+		if errors.As(err, &missing) {
+			// Nothing can be made of the stream, but it's
+			// there, and its headers say where it ends
+			b = Blob{Offset: start, Used: used, Codec: codec,
+				Missing: missing.Tool, Why: err.Error()}
+			err = nil
+		}
+		if err == nil && codec == "deflate" {
+			var ok bool
+			if ok, next = opts.consumed(rodata, start, b.Used, end); !ok {
+				err = fmt.Errorf("deflate stream ends 0x%x bytes before the end of the gap",
+					end - start - int64(b.Used))
+				Discard([]Blob{b})
+				b = Blob{Offset: start, Codec: codec}
+			}
+		}
+		if err != nil {
+			// Some firmware isn't compressed at all
+			b.Data, b.Codec = opts.stored(rodata[start:end]), "stored"
+			b.Used, b.Size = len(b.Data), int64(len(b.Data))
+		}
+		if b.Data == nil && b.Missing == "" {
+			// The blob may come after a few words of length or
+			// id that nothing relocates, so look a little further
+			// in
+			skip, ok := opts.retryGap(rodata[start:end])
+			if !ok {
+				why := "decompressed to nothing"
+				if err != nil {
+					why = err.Error()
+				}
+				return append(blobs, Blob{Offset: start,
+					Codec: codec, Why: why})
+			}
+			start += skip
+			continue
+		}
+
+		blobs = append(blobs, b)
+		if b.Used <= 0 {
+			return
+		}
+		start += int64(b.Used)
+
+		// Skip any padding up to the next stream
+		for start < end && start % 16 != 0 && rodata[start] == 0 {
+			start++
+		}
+	}
+	return
+}
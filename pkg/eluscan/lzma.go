@@ -0,0 +1,396 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "encoding/binary"
+import "errors"
+import "io"
+
+// A decoder for the legacy .lzma format, as in the LZMA SDK's
+// LzmaSpec.cpp. xz can decode it too, but only decoding says where a
+// stream ends, and xz doesn't tell how much of its input it used, so
+// whatever came after a stream in a gap would be lost.
+
+var errLzmaData = errors.New("lzma: corrupt data")
+var errLzmaTruncated = errors.New("lzma: truncated stream")
+
+const (
+	lzmaProbBits = 11
+	lzmaProbInit = 1 << (lzmaProbBits - 1)
+	lzmaStates = 12
+	lzmaPosBitsMax = 4
+	lzmaLenStates = 4
+	lzmaAlignBits = 4
+	lzmaEndPosModel = 14
+	lzmaFullDistances = 1 << (lzmaEndPosModel >> 1)
+	lzmaMatchMinLen = 2
+)
+
+type lzmaProb uint16
+
+func newProbs(n int) []lzmaProb {
+	probs := make([]lzmaProb, n)
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+	return probs
+}
+
+type rangeDecoder struct {
+	in []byte
+	pos int
+	rng, code uint32
+	// Set once it has read past the end of in
+	short bool
+}
+
+func (rc *rangeDecoder) next() byte {
+	if rc.pos >= len(rc.in) {
+		rc.short = true
+		return 0
+	}
+	rc.pos++
+	return rc.in[rc.pos-1]
+}
+
+func (rc *rangeDecoder) init() bool {
+	rc.rng = 0xffffffff
+	if rc.next() != 0 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		rc.code = rc.code << 8 | uint32(rc.next())
+	}
+	return rc.code != rc.rng
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1 << 24 {
+		rc.rng <<= 8
+		rc.code = rc.code << 8 | uint32(rc.next())
+	}
+}
+
+func (rc *rangeDecoder) direct(bits int) uint32 {
+	var res uint32
+	for ; bits > 0; bits-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		rc.normalize()
+		res = res << 1 + t + 1
+	}
+	return res
+}
+
+func (rc *rangeDecoder) bit(p *lzmaProb) uint32 {
+	bound := (rc.rng >> lzmaProbBits) * uint32(*p)
+	var bit uint32
+	if rc.code < bound {
+		*p += ((1 << lzmaProbBits) - *p) >> 5
+		rc.rng = bound
+	} else {
+		*p -= *p >> 5
+		rc.code -= bound
+		rc.rng -= bound
+		bit = 1
+	}
+	rc.normalize()
+	return bit
+}
+
+func (rc *rangeDecoder) tree(probs []lzmaProb, bits int) uint32 {
+	m := uint32(1)
+	for i := 0; i < bits; i++ {
+		m = m << 1 + rc.bit(&probs[m])
+	}
+	return m - 1 << uint(bits)
+}
+
+func (rc *rangeDecoder) reverseTree(probs []lzmaProb, bits int) uint32 {
+	m, sym := uint32(1), uint32(0)
+	for i := 0; i < bits; i++ {
+		bit := rc.bit(&probs[m])
+		m = m << 1 + bit
+		sym |= bit << uint(i)
+	}
+	return sym
+}
+
+type lzmaLenDecoder struct {
+	choice, choice2 lzmaProb
+	low, mid [1 << lzmaPosBitsMax][]lzmaProb
+	high []lzmaProb
+}
+
+func newLenDecoder() *lzmaLenDecoder {
+	d := &lzmaLenDecoder{choice: lzmaProbInit, choice2: lzmaProbInit,
+		high: newProbs(1 << 8)}
+	for i := range d.low {
+		d.low[i] = newProbs(1 << 3)
+		d.mid[i] = newProbs(1 << 3)
+	}
+	return d
+}
+
+func (d *lzmaLenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&d.choice) == 0 {
+		return rc.tree(d.low[posState], 3)
+	}
+	if rc.bit(&d.choice2) == 0 {
+		return 8 + rc.tree(d.mid[posState], 3)
+	}
+	return 16 + rc.tree(d.high, 8)
+}
+
+// The dictionary: the last size bytes decoded, which matches copy
+// from. It only grows as far as it has to, and goes out to w each
+// time it wraps around.
+type lzmaWindow struct {
+	buf []byte
+	size, pos int
+	full bool
+	total int64
+	w io.Writer
+	err error
+}
+
+func (win *lzmaWindow) put(b byte) {
+	if win.full {
+		win.buf[win.pos] = b
+	} else {
+		win.buf = append(win.buf, b)
+	}
+	win.pos++
+	win.total++
+	if win.pos == win.size {
+		win.flush()
+		win.pos, win.full = 0, true
+	}
+}
+
+// The byte dist back, 1 being the last one
+func (win *lzmaWindow) get(dist uint32) byte {
+	i := win.pos - int(dist)
+	if i < 0 {
+		i += win.size
+	}
+	return win.buf[i]
+}
+
+func (win *lzmaWindow) flush() {
+	if win.err == nil {
+		_, win.err = win.w.Write(win.buf[:win.pos])
+	}
+}
+
+// Decode a .lzma stream at the start of data to w, returning how many
+// bytes of data it took up.
+func lzmaStream(data []byte, w io.Writer) (int, error) {
+	if len(data) < 13 {
+		return 0, errLzmaTruncated
+	}
+	d := uint32(data[0])
+	if d >= 9 * 5 * 5 {
+		return 0, errLzmaData
+	}
+	lc, lp, pb := d % 9, d / 9 % 5, d / 45
+	dictSize := binary.LittleEndian.Uint32(data[1:])
+	if dictSize < 4096 {
+		dictSize = 4096
+	}
+	unpackSize := binary.LittleEndian.Uint64(data[5:])
+	sized := unpackSize != ^uint64(0)
+	if sized && unpackSize < uint64(dictSize) {
+		// No match can reach back further than the stream
+		dictSize = uint32(unpackSize)
+		if dictSize == 0 {
+			dictSize = 1
+		}
+	}
+
+	rc := &rangeDecoder{in: data[13:]}
+	if !rc.init() {
+		return 0, errLzmaData
+	}
+	win := &lzmaWindow{size: int(dictSize), w: w}
+	literals := newProbs(0x300 << (lc + lp))
+	posSlot := make([][]lzmaProb, lzmaLenStates)
+	for i := range posSlot {
+		posSlot[i] = newProbs(1 << 6)
+	}
+	posProbs := newProbs(1 + lzmaFullDistances - lzmaEndPosModel)
+	align := newProbs(1 << lzmaAlignBits)
+	isMatch := newProbs(lzmaStates << lzmaPosBitsMax)
+	isRep := newProbs(lzmaStates)
+	isRepG0 := newProbs(lzmaStates)
+	isRepG1 := newProbs(lzmaStates)
+	isRepG2 := newProbs(lzmaStates)
+	isRep0Long := newProbs(lzmaStates << lzmaPosBitsMax)
+	lenDecoder, repLenDecoder := newLenDecoder(), newLenDecoder()
+	var rep0, rep1, rep2, rep3 uint32
+	state := uint32(0)
+
+	used := func() int { return 13 + rc.pos }
+	finish := func() (int, error) {
+		win.flush()
+		return used(), win.err
+	}
+	for {
+		if rc.short {
+			return used(), errLzmaTruncated
+		}
+		if win.err != nil {
+			return used(), win.err
+		}
+		if sized && unpackSize == 0 && rc.code == 0 {
+			// Done, with no end marker
+			return finish()
+		}
+		posState := uint32(win.total) & (1 << pb - 1)
+		if rc.bit(&isMatch[state << lzmaPosBitsMax + posState]) == 0 {
+			if sized && unpackSize == 0 {
+				return used(), errLzmaData
+			}
+			var prev uint32
+			if win.total > 0 {
+				prev = uint32(win.get(1))
+			}
+			litState := (uint32(win.total) & (1 << lp - 1)) << lc + prev >> (8 - lc)
+			probs := literals[0x300 * litState:]
+			sym := uint32(1)
+			if state >= 7 {
+				match := uint32(win.get(rep0 + 1))
+				for sym < 0x100 {
+					matchBit := match >> 7 & 1
+					match <<= 1
+					bit := rc.bit(&probs[(1 + matchBit) << 8 + sym])
+					sym = sym << 1 | bit
+					if matchBit != bit {
+						break
+					}
+				}
+			}
+			for sym < 0x100 {
+				sym = sym << 1 | rc.bit(&probs[sym])
+			}
+			win.put(byte(sym))
+			unpackSize--
+			switch {
+			case state < 4:
+				state = 0
+			case state < 10:
+				state -= 3
+			default:
+				state -= 6
+			}
+			continue
+		}
+
+		var n uint32
+		if rc.bit(&isRep[state]) != 0 {
+			if (sized && unpackSize == 0) || win.total == 0 {
+				return used(), errLzmaData
+			}
+			if rc.bit(&isRepG0[state]) == 0 {
+				if rc.bit(&isRep0Long[state << lzmaPosBitsMax + posState]) == 0 {
+					// A single byte from rep0
+					if state < 7 {
+						state = 9
+					} else {
+						state = 11
+					}
+					win.put(win.get(rep0 + 1))
+					unpackSize--
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&isRepG1[state]) == 0 {
+					dist = rep1
+				} else {
+					if rc.bit(&isRepG2[state]) == 0 {
+						dist = rep2
+					} else {
+						dist = rep3
+						rep3 = rep2
+					}
+					rep2 = rep1
+				}
+				rep1 = rep0
+				rep0 = dist
+			}
+			n = repLenDecoder.decode(rc, posState)
+			if state < 7 {
+				state = 8
+			} else {
+				state = 11
+			}
+		} else {
+			rep3, rep2, rep1 = rep2, rep1, rep0
+			n = lenDecoder.decode(rc, posState)
+			if state < 7 {
+				state = 7
+			} else {
+				state = 10
+			}
+			rep0 = lzmaDistance(rc, n, posSlot, posProbs, align)
+			if rep0 == 0xffffffff {
+				// The end marker
+				if rc.code != 0 || rc.short {
+					return used(), errLzmaData
+				}
+				return finish()
+			}
+			if (sized && unpackSize == 0) || rep0 >= dictSize ||
+				int64(rep0) >= win.total {
+				return used(), errLzmaData
+			}
+		}
+		n += lzmaMatchMinLen
+		if sized && uint64(n) > unpackSize {
+			return used(), errLzmaData
+		}
+		for i := uint32(0); i < n; i++ {
+			win.put(win.get(rep0 + 1))
+		}
+		unpackSize -= uint64(n)
+	}
+}
+
+func lzmaDistance(rc *rangeDecoder, n uint32, posSlot [][]lzmaProb, posProbs, align []lzmaProb) uint32 {
+	lenState := n
+	if lenState > lzmaLenStates - 1 {
+		lenState = lzmaLenStates - 1
+	}
+	slot := rc.tree(posSlot[lenState], 6)
+	if slot < 4 {
+		return slot
+	}
+	bits := int(slot >> 1) - 1
+	dist := (2 | slot & 1) << uint(bits)
+	if slot < lzmaEndPosModel {
+		return dist + rc.reverseTree(posProbs[dist - slot:], bits)
+	}
+	dist += rc.direct(bits - lzmaAlignBits) << lzmaAlignBits
+	return dist + rc.reverseTree(align, lzmaAlignBits)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "bytes"
+import "debug/pe"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "regexp"
+import "unicode/utf16"
+
+// The Windows driver, nvlddmkm.sys, is a PE image rather than an ELF
+// object. It has no symbols or relocations against sections, but it
+// does have base relocations: the places holding absolute addresses,
+// which the loader fixes up. The ones that point into .rdata play the
+// part of the ELF relocations into .rodata.
+
+// The section the firmware is in, with its offset in the file, and
+// the references into it
+type PESection struct {
+	Data []byte
+	Offset int64
+	Refs []Reference
+}
+
+// Whether a file is a PE image, going by its first bytes
+func IsPE(head []byte) bool {
+	return len(head) >= 2 && head[0] == 'M' && head[1] == 'Z'
+}
+
+// Read .rdata out of a PE image, and find the references into it from
+// the base relocations. The section that holds each reference is
+// recorded, as there are no symbols to name it by.
+func ReadPE(fname string) (*PESection, error) {
+	f, err := pe.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var imageBase uint64
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		imageBase = uint64(oh.ImageBase)
+	case *pe.OptionalHeader32:
+		imageBase = uint64(oh.ImageBase)
+	default:
+		return nil, fmt.Errorf("%s: no optional header", fname)
+	}
+	rdata := f.Section(".rdata")
+	if rdata == nil {
+		return nil, fmt.Errorf("%s: no .rdata section", fname)
+	}
+	data, err := rdata.Data()
+	if err != nil {
+		return nil, err
+	}
+	// Past VirtualSize is only the file's padding
+	if rdata.VirtualSize != 0 && int(rdata.VirtualSize) < len(data) {
+		data = data[:rdata.VirtualSize]
+	}
+	s := &PESection{Data: data, Offset: int64(rdata.Offset)}
+
+	reloc := f.Section(".reloc")
+	if reloc == nil {
+		return s, nil
+	}
+	relocs, err := reloc.Data()
+	if err != nil {
+		return nil, err
+	}
+	if int(reloc.VirtualSize) < len(relocs) {
+		relocs = relocs[:reloc.VirtualSize]
+	}
+
+	// Blocks of a page address and 16-bit entries: 4 bits of type
+	// and 12 of offset in the page
+	for len(relocs) >= 8 {
+		page := binary.LittleEndian.Uint32(relocs)
+		size := binary.LittleEndian.Uint32(relocs[4:])
+		if size < 8 || int(size) > len(relocs) {
+			break
+		}
+		for i := 8; i + 2 <= int(size); i += 2 {
+			entry := binary.LittleEndian.Uint16(relocs[i:])
+			var width int
+			switch entry >> 12 {
+			case 3: // HIGHLOW
+				width = 4
+			case 10: // DIR64
+				width = 8
+			default:
+				continue
+			}
+			rva := page + uint32(entry & 0xfff)
+			site := sectionAt(f, rva)
+			if site == nil {
+				continue
+			}
+			value, ok := readAddress(site, rva, width)
+			if !ok || value < imageBase {
+				continue
+			}
+			target := value - imageBase - uint64(rdata.VirtualAddress)
+			if target >= uint64(len(data)) {
+				continue
+			}
+			s.Refs = append(s.Refs, Reference{int64(target), "", site.Name})
+		}
+		relocs = relocs[size:]
+	}
+	return s, nil
+}
+
+// The section an address in the image falls in
+func sectionAt(f *pe.File, rva uint32) *pe.Section {
+	for _, s := range f.Sections {
+		if rva >= s.VirtualAddress && rva - s.VirtualAddress < s.VirtualSize {
+			return s
+		}
+	}
+	return nil
+}
+
+// Read the width byte address stored at rva, in section s
+func readAddress(s *pe.Section, rva uint32, width int) (uint64, bool) {
+	buf := make([]byte, width)
+	off := int64(rva - s.VirtualAddress)
+	if off + int64(width) > int64(s.Size) {
+		return 0, false
+	}
+	if _, err := s.ReadAt(buf, off); err != nil {
+		return 0, false
+	}
+	if width == 4 {
+		return uint64(binary.LittleEndian.Uint32(buf)), true
+	}
+	return binary.LittleEndian.Uint64(buf), true
+}
+
+// Windows file versions are e.g. 31.0.15.3758, whose last five digits
+// make up the driver version, 537.58
+var fileVersionRe = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]*([0-9])\.([0-9]{4})$`)
+
+// The driver version of a Windows driver, from the FileVersion in its
+// version resource, or "" if it can't be found
+func WindowsDriverVersion(fname string) string {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return ""
+	}
+	key := utf16Bytes("FileVersion\x00")
+	i := bytes.Index(data, key)
+	if i < 0 {
+		return ""
+	}
+	// The value follows, aligned to 4 bytes in the resource
+	rest := data[i+len(key):]
+	for len(rest) >= 2 && rest[0] == 0 && rest[1] == 0 {
+		rest = rest[2:]
+	}
+	var units []uint16
+	for len(rest) >= 2 && len(units) < 32 {
+		u := binary.LittleEndian.Uint16(rest)
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+		rest = rest[2:]
+	}
+	m := fileVersionRe.FindStringSubmatch(string(utf16.Decode(units)))
+	if m == nil {
+		return ""
+	}
+	digits := m[1] + m[2]
+	return digits[:3] + "." + digits[3:]
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u >> 8))
+	}
+	return b
+}
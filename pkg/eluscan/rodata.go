@@ -0,0 +1,150 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package eluscan
+
+import "debug/elf"
+import "fmt"
+import "io"
+import "strings"
+
+// Builds with -fdata-sections don't have one .rodata: constants are
+// scattered across .rodata.str1.1, .rodata.cst16 and a .rodata.<name>
+// per symbol, each with its own .rela.rodata.<name>. They are scanned
+// as if linked together, one after the other in the order they're in
+// the object, and offsets are into that. An object with just .rodata
+// gets offsets into it, as always.
+
+// The read-only data of an object, put together from its sections
+type Rodata struct {
+	Data []byte
+	Sections []RodataSection
+	// References from the relocations for each section, which mark
+	// where blobs may start, and from anywhere at all, which help
+	// name them. Every section's start is in Refs too, so that no
+	// gap runs from one into the next.
+	Refs, All []Reference
+	// The symbols in the sections, as from SymbolSpans
+	Spans []Span
+}
+
+// Where a section's data starts in Rodata.Data
+type RodataSection struct {
+	*elf.Section
+	Base int64
+}
+
+// Whether a section holds read-only data worth scanning
+func isRodata(s *elf.Section) bool {
+	return s.Type == elf.SHT_PROGBITS &&
+		(s.Name == ".rodata" || strings.HasPrefix(s.Name, ".rodata."))
+}
+
+// Read the read-only data sections of an object, with the references
+// into them and, with symbols set, the spans of the symbols in them.
+// r is the file f was read from. If the relocations can't all be
+// read, the error is a *RelocationError.
+func ReadRodata(f *elf.File, r io.ReaderAt, symbols bool, opts *Options) (*Rodata, error) {
+	ro := &Rodata{}
+	bases := make(map[*elf.Section]int64)
+	for _, s := range f.Sections {
+		if !isRodata(s) {
+			continue
+		}
+		data, err := SectionData(f, r, s, opts)
+		if err != nil {
+			return nil, err
+		}
+		base := int64(len(ro.Data))
+		bases[s] = base
+		ro.Sections = append(ro.Sections, RodataSection{s, base})
+		ro.Data = append(ro.Data, data...)
+		ro.Refs = append(ro.Refs, Reference{Addend: base})
+		if symbols {
+			for _, span := range SymbolSpans(f, s.Name, opts) {
+				span.Start += base
+				span.End += base
+				ro.Spans = append(ro.Spans, span)
+			}
+		}
+	}
+	if len(ro.Sections) == 0 {
+		return nil, fmt.Errorf("no .rodata section")
+	}
+
+	// Each section's own relocations, .rela.rodata for .rodata,
+	// say where blobs start, and every other relocation section
+	// says what refers to them. All of them are gone through once.
+	syms, idx, err := relocationSymbols(f)
+	if err != nil {
+		return ro, &RelocationError{NoSymbols: true, Errs: []error{err}}
+	}
+	var relErr RelocationError
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_RELA {
+			continue
+		}
+		// Pointer tables in rodata, which is what .rela.rodata
+		// holds the relocations for
+		partner := false
+		if int(s.Info) < len(f.Sections) {
+			relocated := f.Sections[s.Info]
+			_, ok := bases[relocated]
+			partner = ok && s.Name == ".rela" + relocated.Name
+		}
+		err := eachReference(f, r, s, opts, syms, idx, func(to *elf.Section, ref Reference) {
+			base, ok := bases[to]
+			if !ok {
+				return
+			}
+			ref.Addend += base
+			ro.All = append(ro.All, ref)
+			if partner {
+				ro.Refs = append(ro.Refs, ref)
+			}
+		})
+		if err != nil {
+			relErr.Errs = append(relErr.Errs, err)
+		}
+	}
+	if len(relErr.Errs) != 0 {
+		return ro, &relErr
+	}
+	return ro, nil
+}
+
+// Relocations ReadRodata couldn't read: relocation sections that make
+// no sense, or no symbol table for any of them to refer to. The data
+// is still returned along with it, with whatever references the rest
+// of the relocations give, for those who would rather scan it that
+// way than not at all.
+type RelocationError struct {
+	// The object has no symbols, so there are no references at all
+	NoSymbols bool
+	Errs []error
+}
+
+func (e *RelocationError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,576 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bufio"
+import "bytes"
+import "context"
+import "encoding/csv"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// The object with the firmware in it, in an extracted driver, Linux
+// or Windows
+var kernelObjects = []string{"nv-kernel.o_binary", "nv-kernel.o", "nvlddmkm.sys"}
+
+func findKernelObject(dir string) string {
+	var found string
+	filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil || found != "" {
+			return err
+		}
+		for _, name := range kernelObjects {
+			if info.Name() == name && info.Mode().IsRegular() {
+				found = fname
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+// Drivers of the same version end up in the same directory, and only
+// one of them may be moving its output there at a time. The journal
+// is written under it too.
+var batchRename sync.Mutex
+
+// A batch run keeps a journal in the output root, a line of JSON for
+// each driver it's done with, so that a run that was interrupted or
+// died can be started over without scanning those again.
+const batchJournal = "batch-journal.jsonl"
+
+// A driver a batch run is done with. Size and ModTime tell whether the
+// input is still the one that was scanned. Output is the directory in
+// the output root it went into, or empty if it wasn't a driver.
+type JournalEntry struct {
+	Input string `json:"input"`
+	Size int64 `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Version string `json:"version,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// Read the journal in an output root, by input. A line cut short by
+// the run dying as it wrote it is left out.
+func readJournal(outroot string) map[string]JournalEntry {
+	journal := make(map[string]JournalEntry)
+	f, err := os.Open(path.Join(outroot, batchJournal))
+	if err != nil {
+		return journal
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.Input != "" {
+			journal[e.Input] = e
+		}
+	}
+	return journal
+}
+
+// Add a driver to the journal, making sure it's on disk before going on
+func appendJournal(outroot string, e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(outroot, batchJournal),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The journal entry for a driver as it is now
+func journalEntry(driver string, info os.FileInfo) JournalEntry {
+	return JournalEntry{Input: path.Base(driver), Size: info.Size(),
+		ModTime: info.ModTime().UTC()}
+}
+
+// What an earlier batch run made of a driver, if the journal has it
+// and neither the driver nor its output has gone since: a Processor
+// with the version and manifest it wrote, or nil if it wasn't a
+// driver. ok is false if the driver needs scanning.
+func resumeOne(journal map[string]JournalEntry, driver, outroot string, opts *Options) (p *Processor, ok bool) {
+	info, err := os.Stat(driver)
+	if err != nil {
+		return nil, false
+	}
+	e, found := journal[path.Base(driver)]
+	now := journalEntry(driver, info)
+	if !found || e.Size != now.Size || !e.ModTime.Equal(now.ModTime) {
+		return nil, false
+	}
+	if e.Output == "" {
+		return nil, true
+	}
+	p = &Processor{Destdir: path.Join(outroot, e.Output), Version: e.Version,
+		Options: opts}
+	data, err := ioutil.ReadFile(path.Join(p.Destdir, "manifest.json"))
+	if err != nil || json.Unmarshal(data, &p.Manifest) != nil {
+		return nil, false
+	}
+	p.infof("%s: done by an earlier run, %d files in %s\n", driver,
+		len(p.Manifest), p.Destdir)
+	return p, true
+}
+
+// Run fn for each of n inputs, on up to jobs goroutines at once. Once
+// one of them fails, the ctx handed to the others is cancelled and the
+// inputs not yet started are left out. Returns the first error.
+func RunJobs(ctx context.Context, n, jobs int, fn func(ctx context.Context, i int) error) error {
+	if jobs <= 0 {
+		jobs = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var first error
+	slots := make(chan struct{}, jobs)
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			if err := fn(ctx, i); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
+
+// Scan one driver given as a .run package or an extracted directory
+// into outroot/<version>, by way of outroot/<name>.scanning-NNN, which
+// is where it stays if the scan is stopped or fails. Returns nil if
+// there's nothing to scan.
+// produced has the output directories this run has already written,
+// and the driver each was for, which are never replaced: a second
+// driver of the same version goes into <version>_<name> instead.
+func batchOne(ctx context.Context, driver, outroot string, produced map[string]string, opts *Options) (*Processor, error) {
+	name := path.Base(driver)
+	info, err := os.Stat(driver)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() && !IsPackage(name) {
+		return nil, nil
+	}
+	entry := journalEntry(driver, info)
+
+	// Scanned into a directory of its own, which nothing else can be
+	// moved over, until the version is known
+	scandir, err := ioutil.TempDir(outroot, name + ".scanning-")
+	if err != nil {
+		return nil, err
+	}
+	p := &Processor{Destdir: scandir, Options: opts}
+	// Each driver's messages start with its name when there's more
+	// than one being scanned
+	if p.opts().Jobs > 1 {
+		p.LogPrefix = name + ": "
+	}
+	if err := p.ScanDriver(ctx, driver); err != nil {
+		if ctx.Err() != nil {
+			// Keep a record of what was written before stopping
+			if err := p.WriteManifest(); err != nil {
+				p.warnf("%s: %v\n", driver, err)
+			}
+			p.infof("%s: %d files written to %s before stopping\n",
+				driver, len(p.Manifest), p.Destdir)
+			return nil, err
+		}
+		if _, ok := err.(*NotDriverError); ok {
+			p.warnf("%v, skipping\n", err)
+			os.RemoveAll(scandir)
+			batchRename.Lock()
+			defer batchRename.Unlock()
+			return nil, appendJournal(outroot, entry)
+		}
+		return nil, err
+	}
+	if p.Version == "" {
+		p.Version = name
+	}
+	// Now that the version is known, use it for the directory name.
+	// GRID and vGPU drivers come in the same versions as the regular
+	// ones, so those keep their variant.
+	if p.Variant != "" {
+		p.Version += "-" + p.Variant
+	}
+	final := path.Join(outroot, p.Version)
+	batchRename.Lock()
+	defer batchRename.Unlock()
+	if other, ok := produced[final]; ok {
+		final = path.Join(outroot, p.Version + "_" + name)
+		p.warnf("%s: %s already went into %s, writing %s instead\n", driver, other,
+			path.Join(outroot, p.Version), final)
+	}
+	produced[final] = driver
+	// Whatever is there is from an earlier run, as every directory
+	// this one writes into is in produced or is a scan's own
+	os.RemoveAll(final)
+	if err := os.Rename(p.Destdir, final); err != nil {
+		return nil, err
+	}
+	p.Destdir = final
+	if err := p.WriteManifest(); err != nil {
+		return nil, err
+	}
+	p.infof("%s: %d files from driver %s\n", driver, len(p.Manifest), p.Version)
+	entry.Version, entry.Output = p.Version, path.Base(final)
+	return p, appendJournal(outroot, entry)
+}
+
+// Scan every driver in a directory, each either a .run package or an
+// already extracted directory, into its own output directory named
+// after the driver version. Then write out which files turned up in
+// which versions.
+func Batch(indir, outroot, db string) error {
+	return BatchContext(context.Background(), indir, outroot, db, nil)
+}
+
+// Same as Batch, stopping once ctx is done. The drivers scanned by
+// then are in the coverage matrix, and the ones being scanned keep
+// what was written of them. Drivers are scanned with opts, which may
+// be nil as for a Processor, its Jobs of them at once; the coverage
+// matrix and database still go in the drivers' order. Unless Restart
+// is set, drivers an earlier run into outroot finished are taken from
+// its output rather than scanned again.
+func BatchContext(ctx context.Context, indir, outroot, db string, opts *Options) error {
+	dirents, err := ioutil.ReadDir(indir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outroot, 0777); err != nil {
+		return err
+	}
+	// A package and the directory it was extracted into would be
+	// scanned into the same place
+	stems := make(map[string]string)
+	for _, d := range dirents {
+		name := d.Name()
+		if !d.IsDir() && !IsPackage(name) {
+			continue
+		}
+		stem := name
+		if !d.IsDir() {
+			stem = strings.TrimSuffix(name, path.Ext(name))
+		}
+		if other, ok := stems[stem]; ok {
+			return fmt.Errorf("%s and %s in %s are the same driver; keep only one of them",
+				other, name, indir)
+		}
+		stems[stem] = name
+	}
+
+	journal := make(map[string]JournalEntry)
+	if !opts.orDefault().Restart {
+		journal = readJournal(outroot)
+	}
+	// What earlier runs finished is settled before anything is
+	// scanned, so that no scan moves its output over theirs
+	produced := make(map[string]string)
+	done := make([]*Processor, len(dirents))
+	resumed := make([]bool, len(dirents))
+	for i, d := range dirents {
+		driver := path.Join(indir, d.Name())
+		if done[i], resumed[i] = resumeOne(journal, driver, outroot, opts); done[i] != nil {
+			produced[done[i].Destdir] = driver
+		}
+	}
+	err = RunJobs(ctx, len(dirents), opts.orDefault().Jobs, func(ctx context.Context, i int) error {
+		if resumed[i] {
+			return nil
+		}
+		driver := path.Join(indir, dirents[i].Name())
+		p, err := batchOne(ctx, driver, outroot, produced, opts)
+		done[i] = p
+		return err
+	})
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	var versions []string
+	coverage := make(map[string]map[string]string)
+	for _, p := range done {
+		if p == nil {
+			continue
+		}
+		if db != "" {
+			if err := p.RecordDB(db); err != nil {
+				return err
+			}
+		}
+
+		// Named after the output directory, which tells apart
+		// drivers of the same version
+		version := path.Base(p.Destdir)
+		versions = append(versions, version)
+		for _, e := range p.Manifest {
+			if coverage[e.Path] == nil {
+				coverage[e.Path] = make(map[string]string)
+			}
+			coverage[e.Path][version] = e.SHA256
+		}
+	}
+	if cerr := writeCoverage(path.Join(outroot, "coverage.csv"), versions, coverage); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Write a matrix of file by driver version. Each cell has the start of
+// the file's hash in that version, so that changes stand out too.
+func writeCoverage(fname string, versions []string, coverage map[string]map[string]string) error {
+	var files []string
+	for name := range coverage {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(append([]string{"file"}, versions...))
+	for _, name := range files {
+		row := []string{name}
+		for _, version := range versions {
+			hash := coverage[name][version]
+			if len(hash) > 12 {
+				hash = hash[:12]
+			}
+			row = append(row, hash)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, buf.Bytes(), os.FileMode(0666))
+}
+
+// -db goes through the sqlite3 shell, so that there's no need for a
+// database driver. Its .param binds the values, which needs 3.32.
+const sqliteMinor = 32
+
+// Check that the sqlite3 shell -db needs is there, and new enough
+func CheckSQLite() error {
+	out, err := exec.Command("sqlite3", "-version").Output()
+	if err != nil {
+		return fmt.Errorf("-db needs the sqlite3 command, 3.%d or newer: %v",
+			sqliteMinor, err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(out), "%d.%d", &major, &minor); err != nil ||
+		major < 3 || (major == 3 && minor < sqliteMinor) {
+		return fmt.Errorf("-db needs sqlite3 3.%d or newer, not %s", sqliteMinor,
+			strings.TrimSpace(strings.SplitN(string(out), " ", 2)[0]))
+	}
+	return nil
+}
+
+// Bind a parameter of a sqlite3 shell script. Strings go in as hex
+// blobs, which nothing in them can break out of, and are cast back to
+// text where they are used.
+func sqlParam(script *bytes.Buffer, name string, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(script, ".param set :%s X'%x'\n", name, v)
+	default:
+		fmt.Fprintf(script, ".param set :%s %d\n", name, v)
+	}
+}
+
+// Run a sqlite3 shell script on a database, returning what it printed
+func runSQLite(db string, script *bytes.Buffer, args ...string) ([]byte, error) {
+	cmd := exec.Command("sqlite3", append(append([]string{"-bail"}, args...), db)...)
+	cmd.Stdin = script
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 %s: %v\n%s", db, err, stderr.Bytes())
+	}
+	return out, nil
+}
+
+// Record every blob of an extraction in a SQLite database, for keeping
+// track of firmware across driver versions
+func (p *Processor) RecordDB(db string) error {
+	var script bytes.Buffer
+	script.WriteString(`CREATE TABLE IF NOT EXISTS blobs (
+	sha256 TEXT NOT NULL,
+	type TEXT,
+	path TEXT NOT NULL,
+	archive TEXT,
+	driver_version TEXT NOT NULL,
+	source TEXT,
+	offset INTEGER,
+	compressed_size INTEGER,
+	size INTEGER,
+	UNIQUE(driver_version, path)
+);
+CREATE INDEX IF NOT EXISTS blobs_sha256 ON blobs(sha256);
+BEGIN;
+`)
+	sqlParam(&script, "version", p.Version)
+	for _, e := range p.Manifest {
+		sqlParam(&script, "sha256", e.SHA256)
+		sqlParam(&script, "type", e.Type)
+		sqlParam(&script, "path", e.Path)
+		sqlParam(&script, "archive", e.Archive)
+		sqlParam(&script, "source", e.Source)
+		sqlParam(&script, "offset", e.Offset)
+		sqlParam(&script, "compressed", e.CompressedSize)
+		sqlParam(&script, "size", e.Size)
+		script.WriteString("INSERT OR REPLACE INTO blobs VALUES (" +
+			"CAST(:sha256 AS TEXT), CAST(:type AS TEXT), CAST(:path AS TEXT), " +
+			"CAST(:archive AS TEXT), CAST(:version AS TEXT), CAST(:source AS TEXT), " +
+			":offset, :compressed, :size);\n")
+	}
+	script.WriteString("COMMIT;\n")
+	_, err := runSQLite(db, &script)
+	return err
+}
+
+// A file in a driver recorded in a database by RecordDB
+type DBMatch struct {
+	Version, Path, SHA256, Type, Archive, Source string
+	Offset int64
+	Size int
+}
+
+var sha256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Escape v for a LIKE pattern, with \
+func likeEscape(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "%", `\%`, -1)
+	return strings.Replace(v, "_", `\_`, -1)
+}
+
+// Look up which drivers in a database have a file, by its path in the
+// output (the whole of it, or the end after a /), its type, like
+// fecs_inst or gsp_ga102, or its sha256. The nouveau/ or nvidia/ at
+// the start of a nouveau firmware path may be left out in the
+// database. The matches are in order of driver version.
+func QueryDB(db, name string) ([]DBMatch, error) {
+	var script bytes.Buffer
+	var where []string
+	if sha256Re.MatchString(strings.ToLower(name)) {
+		sqlParam(&script, "sha256", strings.ToLower(name))
+		where = append(where, "sha256 = CAST(:sha256 AS TEXT)")
+	} else {
+		names := []string{name}
+		for _, top := range []string{"nouveau/", "nvidia/"} {
+			if strings.HasPrefix(name, top) {
+				names = append(names, strings.TrimPrefix(name, top))
+			}
+		}
+		for i, n := range names {
+			sqlParam(&script, fmt.Sprintf("name%d", i), n)
+			sqlParam(&script, fmt.Sprintf("like%d", i), "%/" + likeEscape(n))
+			where = append(where, fmt.Sprintf("path = CAST(:name%d AS TEXT)", i),
+				fmt.Sprintf(`path LIKE CAST(:like%d AS TEXT) ESCAPE '\'`, i),
+				fmt.Sprintf("type = CAST(:name%d AS TEXT)", i))
+		}
+	}
+	script.WriteString("SELECT driver_version, path, sha256, type, archive, source, " +
+		"offset, size FROM blobs WHERE " + strings.Join(where, " OR ") + ";\n")
+	out, err := runSQLite(db, &script, "-readonly", "-batch", "-noheader",
+		"-separator", "\x1f")
+	if err != nil {
+		return nil, err
+	}
+	var matches []DBMatch
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) != 8 {
+			continue
+		}
+		m := DBMatch{Version: f[0], Path: f[1], SHA256: f[2], Type: f[3],
+			Archive: f[4], Source: f[5]}
+		m.Offset, _ = strconv.ParseInt(f[6], 10, 64)
+		m.Size, _ = strconv.Atoi(f[7])
+		matches = append(matches, m)
+	}
+	sort.SliceStable(matches, func (i, j int) bool {
+		if matches[i].Version != matches[j].Version {
+			return versionLess(matches[i].Version, matches[j].Version)
+		}
+		return matches[i].Path < matches[j].Path
+	})
+	return matches, nil
+}
+
+// Whether driver version a comes before b, going by the numbers in
+// them, so that 96.43 comes before 390.48
+func versionLess(a, b string) bool {
+	as, bs := strings.FieldsFunc(a, isVersionSep), strings.FieldsFunc(b, isVersionSep)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			return an < bn
+		case (aerr != nil || berr != nil) && as[i] != bs[i]:
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+func isVersionSep(r rune) bool {
+	return r == '.' || r == '-'
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "github.com/envytools/firmware/pkg/classify"
+
+// Falcon IMEM uploads and some test rigs want the firmware as words of
+// the other endianness. With ByteSwap set, the files of the categories
+// in ByteSwapOnly (or all of them) are written with the bytes of each
+// word of that many bytes reversed, and the manifest says so. The hash
+// recorded is still that of the blob as it was found, which is what
+// tells it apart across drivers.
+
+// Word sizes ByteSwap can be
+var ByteSwapWidths = map[int]bool{2: true, 4: true, 8: true}
+
+// How many bytes to a word for files of typ, or 0 to leave them as is
+func (p *Processor) byteSwap(typ string) int {
+	if p.ByteSwap == 0 || typ == "compressed" {
+		return 0
+	}
+	if len(p.ByteSwapOnly) != 0 && !p.ByteSwapOnly[classify.Category(typ)] {
+		return 0
+	}
+	return p.ByteSwap
+}
+
+// A copy of data with the bytes of each word of width bytes reversed.
+// Bytes past the last whole word are left as they are.
+func byteSwapped(data []byte, width int) []byte {
+	out := append([]byte(nil), data...)
+	for i := 0; i + width <= len(out); i += width {
+		word := out[i:i+width]
+		for a, b := 0, width - 1; a < b; a, b = a + 1, b - 1 {
+			word[a], word[b] = word[b], word[a]
+		}
+	}
+	return out
+}
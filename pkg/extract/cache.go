@@ -0,0 +1,157 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+
+// A cache directory keeps downloaded .run packages and the drivers
+// extracted from them between runs. Packages go in runs/, checked
+// against the sha256 recorded next to them when they were downloaded,
+// and extracted drivers in drivers/<package>-<hash>, keyed by the
+// start of the package's sha256 so that a changed package isn't
+// mistaken for the old one.
+
+// Where Fetch keeps a driver version's package in cache, or "" when
+// there's no cache
+func CachedRun(cache, version, arch string) string {
+	if cache == "" {
+		return ""
+	}
+	return path.Join(cache, "runs", RunName(version, arch))
+}
+
+func hashFile(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Check a cached package against sum, or if that's "" against the sum
+// recorded when it was downloaded
+func checkCached(fname, sum string) error {
+	want := strings.ToLower(sum)
+	if want == "" {
+		recorded, err := ioutil.ReadFile(fname + ".sha256")
+		if err != nil {
+			return err
+		}
+		want = strings.TrimSpace(string(recorded))
+	}
+	got, err := hashFile(fname)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("%s: sha256 %s, expected %s", fname, got, want)
+	}
+	return nil
+}
+
+// Make fname the same file as the one in the cache, copying it if the
+// two are on different filesystems
+func linkCached(cached, fname string) error {
+	os.Remove(fname)
+	if os.Link(cached, fname) == nil {
+		return nil
+	}
+	in, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Fetch through the cache: a package that's there and still matches is
+// used as it is, and one that isn't is downloaded into it first.
+func (p *Processor) fetchCached(ctx context.Context, cache, version, arch, sum, fname string) error {
+	cached := CachedRun(cache, version, arch)
+	if err := checkCached(cached, sum); err == nil {
+		p.infof("Using %s from the cache\n", cached)
+	} else {
+		if !os.IsNotExist(err) {
+			p.warnf("%v, downloading it again\n", err)
+		}
+		if err := os.MkdirAll(path.Dir(cached), os.FileMode(0777)); err != nil {
+			return err
+		}
+		got, err := p.fetch(ctx, version, arch, sum, cached)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(cached + ".sha256", []byte(got + "\n"),
+			os.FileMode(0666)); err != nil {
+			return err
+		}
+	}
+	if fname == cached {
+		return nil
+	}
+	return linkCached(cached, fname)
+}
+
+// Extract a package into the cache, unless it already is there
+func (p *Processor) unpackCached(ctx context.Context, cache, run string) (string, error) {
+	sum, err := hashFile(run)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(path.Base(run), path.Ext(run))
+	dir := path.Join(cache, "drivers", name + "-" + sum[:16])
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		p.infof("%s: using the extracted driver in %s\n", run, dir)
+		return dir, nil
+	}
+	if err := os.MkdirAll(path.Dir(dir), os.FileMode(0777)); err != nil {
+		return "", err
+	}
+	// Only a complete extraction ends up under its final name
+	part := dir + ".part"
+	os.RemoveAll(part)
+	if err := p.extractPackage(ctx, run, part); err != nil {
+		os.RemoveAll(part)
+		return "", err
+	}
+	return dir, os.Rename(part, dir)
+}
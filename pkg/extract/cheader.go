@@ -0,0 +1,69 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "strings"
+
+// A C identifier for a file, from its whole path so that entries of
+// different archives don't clash: NET_IMG_07/fecs_inst becomes
+// net_img_07_fecs_inst
+func cIdentifier(name string) string {
+	var id strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			id.WriteRune(c)
+		} else {
+			id.WriteByte('_')
+		}
+	}
+	if s := id.String(); s != "" && (s[0] < '0' || s[0] > '9') {
+		return s
+	}
+	return "fw_" + id.String()
+}
+
+// Write a file out as a C header too, for -emit-c: a byte array with
+// a constant for its size, inside an include guard
+func (p *Processor) writeCHeader(name string, data []byte, hash string) error {
+	id := cIdentifier(name)
+	upper := strings.ToUpper(id)
+	var h bytes.Buffer
+	fmt.Fprintf(&h, "/* %s", name)
+	if p.Version != "" {
+		fmt.Fprintf(&h, ", from the NVIDIA %s driver", p.Version)
+	}
+	fmt.Fprintf(&h, "\n * sha256 %s\n */\n\n", hash)
+	fmt.Fprintf(&h, "#ifndef %s_H\n#define %s_H\n\n", upper, upper)
+	fmt.Fprintf(&h, "#define %s_SIZE %d\n\n", upper, len(data))
+	fmt.Fprintf(&h, "static const unsigned char %s[%s_SIZE] = {", id, upper)
+	for i, b := range data {
+		if i % 12 == 0 {
+			h.WriteString("\n\t")
+		} else {
+			h.WriteByte(' ')
+		}
+		fmt.Fprintf(&h, "0x%02x,", b)
+	}
+	fmt.Fprintf(&h, "\n};\n\n#endif /* %s_H */\n", upper)
+	return p.writeFile(name + ".h", h.Bytes())
+}
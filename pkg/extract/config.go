@@ -0,0 +1,211 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// Settings read from a config file, for drivers newer than the
+// built-in tables.
+type Config struct {
+	// Region names to add or replace, by name table and then id. A
+	// table that doesn't exist yet starts out as a copy of gk20a.
+	Names map[string]map[int]string
+	// Blobs to name, by hash or else by size
+	Blobs []ConfigBlob
+	// Values for command line flags that aren't given, by flag name
+	Defaults map[string]string
+}
+
+type ConfigBlob struct {
+	SHA256 string
+	Size int
+	classify.KnownBlob
+}
+
+// Read a config file. It is written in a small part of TOML: tables,
+// arrays of tables, and keys with string, integer or boolean values.
+//
+//	[names.gk20a]
+//	45 = "sw_veid_bundle_init"
+//
+//	[[blob]]
+//	sha256 = "0123..."   # or size = 0x1234
+//	name = "gsp_ga102"
+//	engine = "gsp"
+//
+//	[defaults]
+//	naming = "hash"
+//	j = 4
+func LoadConfig(fname string) (*Config, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	c := &Config{Names: make(map[string]map[int]string),
+		Defaults: make(map[string]string)}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fail := func(format string, args ...interface{}) (*Config, error) {
+			return nil, fmt.Errorf("%s:%d: %s", fname, n, fmt.Sprintf(format, args...))
+		}
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		switch {
+		case line == "":
+			continue
+		case line == "[[blob]]":
+			section = "blob"
+			c.Blobs = append(c.Blobs, ConfigBlob{})
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1:len(line) - 1])
+			if table := strings.TrimPrefix(section, "names."); table != section {
+				if c.Names[table] == nil {
+					c.Names[table] = make(map[int]string)
+				}
+			} else if section != "defaults" {
+				return fail("unknown table [%s]", section)
+			}
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fail("expected key = value")
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		value, err := configValue(strings.TrimSpace(line[eq + 1:]))
+		if err != nil {
+			return fail("%s: %v", key, err)
+		}
+		switch {
+		case section == "defaults":
+			c.Defaults[key] = value
+		case section == "blob":
+			b := &c.Blobs[len(c.Blobs) - 1]
+			switch key {
+			case "sha256":
+				b.SHA256 = strings.ToLower(value)
+			case "size":
+				size, err := strconv.ParseInt(value, 0, 0)
+				if err != nil || size <= 0 {
+					return fail("bad size %q", value)
+				}
+				b.Size = int(size)
+			case "name":
+				b.Name = value
+			case "engine":
+				b.Engine = value
+			case "first_seen":
+				b.FirstSeen = value
+			default:
+				return fail("unknown blob key %q", key)
+			}
+		case strings.HasPrefix(section, "names."):
+			id, err := strconv.ParseInt(key, 0, 0)
+			if err != nil {
+				return fail("region id %q isn't a number", key)
+			}
+			c.Names[strings.TrimPrefix(section, "names.")][int(id)] = value
+		default:
+			return fail("%s outside of a table", key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, b := range c.Blobs {
+		if b.Name == "" || (b.SHA256 == "" && b.Size == 0) {
+			return nil, fmt.Errorf("%s: blob %d needs a name, and a sha256 or size",
+				fname, i + 1)
+		}
+	}
+	return c, nil
+}
+
+// Cut a # comment off a line, unless it's in a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Turn a value into the string a flag would be set to
+func configValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") && len(v) >= 2:
+		return v[1:len(v) - 1], nil
+	case v == "true" || v == "false":
+		return v, nil
+	}
+	n := strings.Replace(v, "_", "", -1)
+	if _, err := strconv.ParseInt(n, 0, 64); err == nil {
+		return n, nil
+	}
+	if _, err := strconv.ParseFloat(n, 64); err == nil {
+		return n, nil
+	}
+	return "", fmt.Errorf("can't make sense of %q", v)
+}
+
+// Put the names and blobs into the tables the scan uses
+func (c *Config) Apply() {
+	for table, regions := range c.Names {
+		names := netlist.NameTables[table]
+		if names == nil {
+			names = make(map[int]string)
+			for id, name := range netlist.NameTables["gk20a"] {
+				names[id] = name
+			}
+			netlist.NameTables[table] = names
+		}
+		for id, name := range regions {
+			names[id] = name
+		}
+	}
+	for _, b := range c.Blobs {
+		if b.SHA256 != "" {
+			classify.Known[b.SHA256] = b.KnownBlob
+		} else {
+			classify.KnownSizes[b.Size] = b.KnownBlob
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "encoding/binary"
+import "fmt"
+
+// Drivers from before Fermi (the 96.xx to 173.xx branches and their
+// like) have no falcons for PGRAPH to run: context switching is done
+// by a context program, ctxprog, for the PGRAPH microsequencer of NV40
+// and NV50 chips, and the initial context comes from a list of values
+// to put in it, ctxvals. Both are in the kernel object as plain arrays
+// of words, one of each per chipset. Before nouveau could make its
+// own, it loaded them as nvXX.ctxprog and nvXX.ctxvals.
+
+// The ctxprog opcodes, in the top bits of the low 24 of each word, as
+// nouveau's ctxnv40.c has them. The top byte is always clear.
+var ctxprogOpcodes = map[uint32]bool{
+	0x1: true, // CP_CTX
+	0x2: true, // CP_LOAD_SR
+	0x4: true, // CP_BRA
+	0x5: true, // CP_WAIT
+	0x6: true, // CP_NEWCTX, CP_END and the other single commands
+	0x7: true, // CP_SET
+	0x8: true, // CP_XFER
+	0x9: true, // CP_DISABLE
+	0xc: true, // CP_SEEK
+}
+
+const (
+	ctxprogEnd = 0x0060000c
+	ctxprogNewCtx = 0x00600004
+	// The microsequencer has room for this many instructions
+	maxCtxprogLength = 512
+	// Shorter runs of words that look like instructions aren't
+	// worth believing
+	minCtxprogLength = 16
+	// The offsets of ctxvals are words into the context, which is
+	// less than this many
+	maxCtxvalsOffset = 0x40000
+	minCtxvals = 4
+
+	// The signatures of nouveau's containers, "NVCP" and "NVCV"
+	ctxprogSignature = 0x5043564e
+	ctxvalsSignature = 0x5643564e
+)
+
+func isCtxprogWord(w uint32) bool {
+	return w >> 24 == 0 && ctxprogOpcodes[w >> 20 & 0xf]
+}
+
+// A context program in a kernel object, and the values that go with
+// it, as words
+type ctxprog struct {
+	offset int
+	prog []uint32
+	// Offset and value pairs, and where they start, or nil if none
+	// were found after the program
+	valsOffset int
+	vals [][2]uint32
+}
+
+// Find the context programs in a kernel object: aligned runs of words
+// that are all ctxprog instructions, among them CP_NEWCTX and CP_END.
+// The ctxvals are taken to follow, after a word or two of padding at
+// most, as pairs with rising offsets.
+func findCtxprogs(data []byte) []ctxprog {
+	var found []ctxprog
+	word := func(off int) uint32 {
+		return binary.LittleEndian.Uint32(data[off:])
+	}
+	for off := 0; off + 4 <= len(data); off += 4 {
+		if !isCtxprogWord(word(off)) {
+			continue
+		}
+		end := off
+		hasEnd, hasNewCtx := false, false
+		for ; end + 4 <= len(data) && isCtxprogWord(word(end)); end += 4 {
+			hasEnd = hasEnd || word(end) == ctxprogEnd
+			hasNewCtx = hasNewCtx || word(end) == ctxprogNewCtx
+		}
+		n := (end - off) / 4
+		if !hasEnd || !hasNewCtx || n < minCtxprogLength || n > maxCtxprogLength {
+			off = end
+			continue
+		}
+		c := ctxprog{offset: off}
+		for i := off; i < end; i += 4 {
+			c.prog = append(c.prog, word(i))
+		}
+		c.valsOffset, c.vals = findCtxvals(data, end)
+		found = append(found, c)
+		off = end
+		if c.vals != nil {
+			off = c.valsOffset + len(c.vals) * 8
+		}
+		off -= 4
+	}
+	return found
+}
+
+// Look for ctxvals at or just after off
+func findCtxvals(data []byte, off int) (int, [][2]uint32) {
+	for skip := 0; skip <= 8; skip += 4 {
+		start := off + skip
+		var vals [][2]uint32
+		for i := start; i + 8 <= len(data); i += 8 {
+			o := binary.LittleEndian.Uint32(data[i:])
+			v := binary.LittleEndian.Uint32(data[i+4:])
+			if o >= maxCtxvalsOffset || len(vals) != 0 && o <= vals[len(vals) - 1][0] {
+				break
+			}
+			vals = append(vals, [2]uint32{o, v})
+		}
+		if len(vals) >= minCtxvals {
+			return start, vals
+		}
+	}
+	return 0, nil
+}
+
+// The program in nouveau's ctxprog container: the signature, a
+// version byte of 0, the number of instructions as 16 bits, and the
+// instructions
+func (c ctxprog) progFile() []byte {
+	out := make([]byte, 7 + 4 * len(c.prog))
+	binary.LittleEndian.PutUint32(out, ctxprogSignature)
+	binary.LittleEndian.PutUint16(out[5:], uint16(len(c.prog)))
+	for i, w := range c.prog {
+		binary.LittleEndian.PutUint32(out[7 + 4 * i:], w)
+	}
+	return out
+}
+
+// The values in nouveau's ctxvals container: the signature, a version
+// byte of 0, the number of pairs as 32 bits, and the pairs
+func (c ctxprog) valsFile() []byte {
+	out := make([]byte, 9 + 8 * len(c.vals))
+	binary.LittleEndian.PutUint32(out, ctxvalsSignature)
+	binary.LittleEndian.PutUint32(out[5:], uint32(len(c.vals)))
+	for i, v := range c.vals {
+		binary.LittleEndian.PutUint32(out[9 + 8 * i:], v[0])
+		binary.LittleEndian.PutUint32(out[13 + 8 * i:], v[1])
+	}
+	return out
+}
+
+// Write out the context programs and values of a pre-Fermi kernel
+// object, named after the chipset the CtxprogOrder quirk has for each
+// in turn, or ctxprogN if it has none.
+func (p *Processor) legacyCtxprogs(kernel []byte) {
+	var names []string
+	if q := LookupQuirk(p.Version); q != nil {
+		names = q.CtxprogOrder
+	}
+	progs := findCtxprogs(kernel)
+	if len(progs) == 0 {
+		p.warnf("No PGRAPH context programs found.\n")
+	}
+	for i, c := range progs {
+		prefix := fmt.Sprintf("ctxprog%d", i)
+		if i < len(names) {
+			prefix = names[i]
+		}
+		origin := Origin{Offset: int64(c.offset), CompressedSize: 4 * len(c.prog),
+			Codec: "stored"}
+		p.emit(prefix + ".ctxprog", c.progFile(), origin, "ctxprog", "")
+		if c.vals == nil {
+			p.infof("%s: %d instructions, no ctxvals after them\n", prefix,
+				len(c.prog))
+			continue
+		}
+		origin = Origin{Offset: int64(c.valsOffset), CompressedSize: 8 * len(c.vals),
+			Codec: "stored"}
+		p.emit(prefix + ".ctxvals", c.valsFile(), origin, "ctxvals", "")
+		p.infof("%s: %d instructions, %d ctxvals\n", prefix, len(c.prog),
+			len(c.vals))
+	}
+	if names != nil && len(progs) != len(names) {
+		p.warnf("Unexpected quantity of context programs, names likely wrong.\n")
+	}
+}
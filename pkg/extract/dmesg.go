@@ -0,0 +1,156 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bufio"
+import "context"
+import "io"
+import "io/ioutil"
+import "os"
+import "regexp"
+import "strings"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// How the kernel reports firmware it couldn't load, as of
+// request_firmware's warning and the older firmware_class message
+var missingFirmwareRes = []*regexp.Regexp{
+	regexp.MustCompile(`Direct firmware load for (\S+) failed`),
+	regexp.MustCompile(`firmware: failed to load (\S+)`),
+}
+
+// Find the nouveau firmware files a kernel log says are missing, in
+// the order they first turn up
+func MissingFirmware(r io.Reader) ([]string, error) {
+	var missing []string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1 << 20)
+	for s.Scan() {
+		for _, re := range missingFirmwareRes {
+			m := re.FindStringSubmatch(s.Text())
+			if m == nil {
+				continue
+			}
+			name := strings.TrimSuffix(m[1], ".")
+			if seen[name] || !strings.HasPrefix(name, "nouveau/") &&
+				!strings.HasPrefix(name, "nvidia/") {
+				continue
+			}
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+	return missing, s.Err()
+}
+
+// The chipset firmware files are for, from the first name that says:
+// nvidia/<codename>/... or nouveau/nvXX_...
+func FirmwareChipset(names []string) *netlist.Chipset {
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		if len(parts) < 2 {
+			continue
+		}
+		chip := parts[1]
+		if parts[0] == "nouveau" {
+			chip = strings.SplitN(chip, "_", 2)[0]
+		}
+		if c, err := netlist.LookupChipset(chip); err == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// Extract only the missing firmware files out of a driver, given as
+// a .run package or an extracted directory, or out of an object, into
+// destdir under the names they are missing as. Chipset has to be set
+// for the nouveau names to come out, and archive entries are only
+// taken from the archive found to be for it, by its signature or the
+// quirks' order; an archive whose chipset can't be told isn't used
+// at all. Returns the files that weren't found.
+func (p *Processor) ExtractMissing(ctx context.Context, input string, missing []string, destdir string) ([]string, error) {
+	tmp, err := ioutil.TempDir("", "scanner-dmesg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	p.Destdir = tmp
+	p.Nouveau = true
+	if p.Chipset != nil && p.Chipset.Signed() {
+		p.warnf("%s's GR firmware is signed, and only comes from linux-firmware\n",
+			p.Chipset.Codename)
+	}
+
+	found := make(map[string]bool)
+	hashes := make(map[string]string)
+	unidentified := make(map[string]bool)
+	out := DirFS(destdir)
+	p.Visit = func(b Blob) error {
+		for _, name := range missing {
+			if b.Path != name && !strings.HasSuffix(b.Path, "/" + name) {
+				continue
+			}
+			if b.Archive != "" {
+				c := p.archiveChipset(b.Archive)
+				if c == nil {
+					p.debugf("%s: can't tell which chipset %s is for, not using it\n",
+						name, b.Archive)
+					unidentified[b.Archive] = true
+					continue
+				}
+				if p.Chipset == nil || c.Id != p.Chipset.Id {
+					continue
+				}
+			}
+			if found[name] {
+				if hashes[name] != b.SHA256 {
+					p.warnf("%s: %s differs from the copy already written, " +
+						"keeping the first\n", name, b.Path)
+				}
+				continue
+			}
+			p.infof("%s: from %s\n", name, b.Path)
+			if err := out.WriteFile(name, b.Data, int64(b.Size)); err != nil {
+				return err
+			}
+			found[name], hashes[name] = true, b.SHA256
+			return nil
+		}
+		return nil
+	}
+	defer func() { p.Visit = nil }()
+
+	if err := p.scanInput(ctx, input); err != nil {
+		return nil, err
+	}
+	var notFound []string
+	for _, name := range missing {
+		if !found[name] {
+			notFound = append(notFound, name)
+		}
+	}
+	if notFound != nil && len(unidentified) != 0 {
+		p.warnf("%d archives couldn't be told apart by chipset; " +
+			"-archive-signatures may help\n", len(unidentified))
+	}
+	return notFound, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "reflect"
+import "strings"
+import "testing"
+
+func TestMissingFirmware(t *testing.T) {
+	tests := []struct {
+		name string
+		log []string
+		want []string
+	}{
+		{"direct load", []string{
+			"[   12.345678] nouveau 0000:01:00.0: Direct firmware load for nouveau/nve7_fuc409c failed with error -2",
+		}, []string{"nouveau/nve7_fuc409c"}},
+		{"firmware_class", []string{
+			"[    3.141592] nouveau 0000:01:00.0: firmware: failed to load nouveau/nve7_fuc409d (-2)",
+		}, []string{"nouveau/nve7_fuc409d"}},
+		{"trailing dot", []string{
+			"[    3.141592] nouveau 0000:01:00.0: firmware: failed to load nvidia/gp102/gr/fecs_inst.bin.",
+		}, []string{"nvidia/gp102/gr/fecs_inst.bin"}},
+		{"other drivers", []string{
+			"[    2.718281] i915 0000:00:02.0: Direct firmware load for i915/skl_dmc_ver1_27.bin failed with error -2",
+			"[    2.718282] radeon 0000:02:00.0: firmware: failed to load radeon/R600_rlc.bin (-2)",
+			"[    2.718283] iwlwifi 0000:03:00.0: Direct firmware load for nouveau-like.ucode failed with error -2",
+		}, nil},
+		{"duplicates", []string{
+			"[   12.000001] nouveau 0000:01:00.0: Direct firmware load for nouveau/nvc0_fuc409c failed with error -2",
+			"[   12.000002] nouveau 0000:01:00.0: Direct firmware load for nouveau/nvc0_fuc41ac failed with error -2",
+			"[   12.000003] nouveau 0000:01:00.0: firmware: failed to load nouveau/nvc0_fuc409c (-2)",
+			"[   12.000004] nouveau 0000:01:00.0: Direct firmware load for nouveau/nvc0_fuc409c failed with error -2",
+		}, []string{"nouveau/nvc0_fuc409c", "nouveau/nvc0_fuc41ac"}},
+		{"nothing missing", []string{
+			"[    0.000000] Linux version 6.1.0",
+			"[    4.000000] nouveau 0000:01:00.0: DRM: VRAM: 2048 MiB",
+		}, nil},
+	}
+	for _, test := range tests {
+		got, err := MissingFirmware(strings.NewReader(strings.Join(test.log, "\n") + "\n"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFirmwareChipset(t *testing.T) {
+	tests := []struct {
+		names []string
+		want string
+	}{
+		{[]string{"nouveau/nve7_fuc409c"}, "gk107"},
+		{[]string{"nouveau/nvc0_fuc41ac"}, "gf100"},
+		{[]string{"nvidia/gp102/gr/fecs_inst.bin"}, "gp102"},
+		{[]string{"nvidia/tu102/gr/sw_ctx.bin"}, "tu102"},
+		// The first name that says wins, after any that don't
+		{[]string{"nouveau/fuc409c", "nvidia/bogus/gr/fecs.bin",
+			"nouveau/nv137_fuc409c", "nvidia/gm200/gr/fecs_inst.bin"}, "gp107"},
+		{[]string{"fecs_inst.bin", "nouveau/nvzz_fuc409c", "nvidia/gx999/gr/sw_ctx.bin"}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if c := FirmwareChipset(test.names); c != nil {
+			got = c.Codename
+		}
+		if got != test.want {
+			t.Errorf("%q: got chipset %q, want %q", test.names, got, test.want)
+		}
+	}
+}
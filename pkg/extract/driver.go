@@ -0,0 +1,408 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "context"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "os/exec"
+import "path"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+import "github.com/envytools/firmware/pkg/eluscan"
+
+// Where the firmware is depends on the driver release. Up to 340.x it
+// is at known places in the objects and in gzipped archives, which the
+// legacy extraction knows about. After that the relocation scan finds
+// it. From 465 on there's the GSP firmware as well, shipped in files
+// of its own next to the objects.
+var strategies = []struct {
+	From int
+	Strategy string
+}{
+	{0, "legacy"},
+	{343, "scan"},
+	{465, "gsp"},
+}
+
+// The ways of extracting a driver, for checking a choice made by hand
+var Strategies = []string{"legacy", "scan", "gsp"}
+
+// Pick how to extract the firmware of a driver version. Versions that
+// can't be made out are scanned.
+func StrategyFor(version string) string {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return "scan"
+	}
+	strategy := "scan"
+	for _, s := range strategies {
+		if major >= s.From {
+			strategy = s.Strategy
+		}
+	}
+	return strategy
+}
+
+// The version at the end of the name of a .run or of the directory it
+// extracts to, e.g. NVIDIA-Linux-x86_64-390.48, and for GRID and vGPU
+// packages the variant after it, e.g. NVIDIA-Linux-x86_64-470.63-vgpu-kvm.
+// Old packages end in -pkg0 to -pkg2, e.g. NVIDIA-Linux-x86-96.43.23-pkg1.
+var driverNameRe = regexp.MustCompile(`-([0-9]+\.[0-9]+(\.[0-9]+)?)(-(grid|vgpu[a-z0-9-]*))?(-pkg[0-9])?(\.run)?$`)
+
+// The variant of a GRID or vGPU driver going by its name, like "grid"
+// or "vgpu-kvm", or "" for a regular driver
+func DriverVariant(driver string) string {
+	if m := driverNameRe.FindStringSubmatch(path.Base(path.Clean(driver))); m != nil {
+		return m[4]
+	}
+	return ""
+}
+
+// Windows packages are named after the version first, e.g.
+// 537.58-desktop-win10-win11-64bit-international-dch-whql.exe
+var windowsNameRe = regexp.MustCompile(`^([0-9]+\.[0-9]+)-.*\.(exe|cab)$`)
+
+// CUDA toolkit runfiles carry a driver, whose version comes after the
+// toolkit's, e.g. cuda_12.2.0_535.54.03_linux.run
+var cudaNameRe = regexp.MustCompile(`^cuda_[0-9.]+_([0-9]+\.[0-9]+(\.[0-9]+)?)_linux.*\.run$`)
+
+// makeself puts the package's label in its header
+var runLabelRe = regexp.MustCompile(`(?m)^label="[^"]* ([0-9]+\.[0-9]+(\.[0-9]+)?)"`)
+var cudaLabelRe = regexp.MustCompile(`(?m)^label="[^"]*CUDA`)
+
+// The start of a .run package, where makeself's settings are
+func runHeader(run string) []byte {
+	f, err := os.Open(run)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 16384)
+	n, _ := f.Read(head)
+	return head[:n]
+}
+
+// Whether a .run package is a CUDA toolkit runfile, going by its name
+// or its label
+func IsCUDARun(run string) bool {
+	return cudaNameRe.MatchString(path.Base(run)) ||
+		cudaLabelRe.Match(runHeader(run))
+}
+
+// Work out the version of a driver given as a .run package or an
+// extracted directory: from its name, from the .run's header, or else
+// from the kernel object in it. Returns "" if none of them tell.
+func DriverVersion(driver, kernel string) string {
+	if m := driverNameRe.FindStringSubmatch(path.Base(path.Clean(driver))); m != nil {
+		return m[1]
+	}
+	if m := windowsNameRe.FindStringSubmatch(path.Base(driver)); m != nil {
+		return m[1]
+	}
+	if m := cudaNameRe.FindStringSubmatch(path.Base(driver)); m != nil {
+		return m[1]
+	}
+	// A CUDA runfile's label has the toolkit's version
+	if strings.HasSuffix(driver, ".run") && !IsCUDARun(driver) {
+		if m := runLabelRe.FindSubmatch(runHeader(driver)); m != nil {
+			return string(m[1])
+		}
+	}
+	if kernel == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(kernel)
+	if err != nil {
+		return ""
+	}
+	if eluscan.IsPE(data) {
+		return eluscan.WindowsDriverVersion(kernel)
+	}
+	return eluscan.DriverVersion(data)
+}
+
+// Whether a file is a driver package that ScanDriver can extract: a
+// .run package, or a Windows installer (.exe) or cabinet (.cab)
+func IsPackage(name string) bool {
+	switch path.Ext(name) {
+	case ".run", ".exe", ".cab":
+		return true
+	}
+	return false
+}
+
+// What ScanDriver returns when there's no driver to extract: the .run
+// package won't extract, or there's no kernel object in it
+type NotDriverError struct {
+	Driver, Why string
+}
+
+func (e *NotDriverError) Error() string {
+	return e.Driver + ": " + e.Why
+}
+
+// Extract a .run package into dir. .run packages are makeself
+// archives, which know how to extract themselves. A CUDA runfile holds
+// the driver's .run in another layer, e.g. builds/NVIDIA-Linux-x86_64-
+// 535.54.03.run, which is extracted next to it in turn.
+func ExtractRun(ctx context.Context, run, dir string, opts *Options) error {
+	p := &Processor{Options: opts}
+	return p.extractRun(ctx, run, dir)
+}
+
+func (p *Processor) extractRun(ctx context.Context, run, dir string) error {
+	if IsCUDARun(run) {
+		return p.extractCUDARun(ctx, run, dir)
+	}
+	cmd := exec.CommandContext(ctx, "sh", run, "--extract-only", "--target", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &NotDriverError{run,
+			fmt.Sprintf("failed to extract: %v\n%s", err, out)}
+	}
+	return nil
+}
+
+// CUDA's makeself is the stock one, without --extract-only
+func (p *Processor) extractCUDARun(ctx context.Context, run, dir string) error {
+	cmd := exec.CommandContext(ctx, "sh", run, "--noexec", "--target", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &NotDriverError{run,
+			fmt.Sprintf("failed to extract: %v\n%s", err, out)}
+	}
+	nested := findFiles(dir, "NVIDIA-Linux-*.run")
+	if len(nested) == 0 {
+		return &NotDriverError{run, "no driver in the CUDA runfile"}
+	}
+	inner := nested[0]
+	p.infof("%s: extracting the driver in it, %s\n", run, path.Base(inner))
+	if err := p.extractRun(ctx, inner, strings.TrimSuffix(inner, ".run")); err != nil {
+		return err
+	}
+	// Nothing needs the driver's package once it's extracted
+	return os.Remove(inner)
+}
+
+// Extract a Windows driver package into dir with 7z, which knows both
+// the self-extracting installers and cabinets. Older packages have the
+// kernel driver compressed on its own as nvlddmkm.sy_, which is
+// expanded next to it.
+func ExtractWindows(ctx context.Context, pkg, dir string) error {
+	if err := run7z(ctx, pkg, dir); err != nil {
+		return err
+	}
+	for _, packed := range findFiles(dir, "nvlddmkm.sy_") {
+		if err := run7z(ctx, packed, path.Dir(packed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func run7z(ctx context.Context, archive, dir string) error {
+	if _, err := exec.LookPath("7z"); err != nil {
+		return fmt.Errorf("%s: 7z is needed to extract Windows packages: %v",
+			archive, err)
+	}
+	cmd := exec.CommandContext(ctx, "7z", "x", "-y", "-o" + dir, archive)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &NotDriverError{archive,
+			fmt.Sprintf("failed to extract: %v\n%s", err, out)}
+	}
+	return nil
+}
+
+// Extract a package into dir the way its kind calls for
+func (p *Processor) extractPackage(ctx context.Context, pkg, dir string) error {
+	if path.Ext(pkg) == ".run" {
+		return p.extractRun(ctx, pkg, dir)
+	}
+	return ExtractWindows(ctx, pkg, dir)
+}
+
+// Extract a package into a temporary directory. The returned
+// function removes it again. With a cache directory, it is extracted
+// into the cache instead and left there.
+func (p *Processor) unpackRun(ctx context.Context, cache, run string) (string, func(), error) {
+	if cache != "" {
+		dir, err := p.unpackCached(ctx, cache, run)
+		return dir, func() {}, err
+	}
+	tmp, err := ioutil.TempDir("", "scanner-driver")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	dir := path.Join(tmp, "driver")
+	if err := p.extractPackage(ctx, run, dir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// The files under dir whose names match pattern, in order
+func findFiles(dir, pattern string) []string {
+	var found []string
+	filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ok, _ := filepath.Match(pattern, info.Name()); ok && info.Mode().IsRegular() {
+			found = append(found, fname)
+		}
+		return nil
+	})
+	sort.Strings(found)
+	return found
+}
+
+// Extract a whole driver, given as a package (see IsPackage) or an
+// extracted directory, the way its version calls for: see StrategyFor. Strategy
+// overrides the choice, and Version the version found, if set. Source
+// defaults to the kernel object.
+func (p *Processor) ScanDriver(ctx context.Context, driver string) error {
+	dir := driver
+	if IsPackage(driver) {
+		var cleanup func()
+		var err error
+		dir, cleanup, err = p.unpackRun(ctx, p.opts().CacheDir, driver)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+	kernel := findKernelObject(dir)
+	if kernel == "" {
+		return &NotDriverError{driver, "no kernel object found"}
+	}
+	if p.Source == "" {
+		p.Source = kernel
+	}
+	if p.Version == "" {
+		p.Version = DriverVersion(driver, kernel)
+	}
+	if p.Variant == "" {
+		p.Variant = DriverVariant(driver)
+	}
+	strategy := p.Strategy
+	if strategy == "" {
+		strategy = StrategyFor(p.Version)
+	}
+	switch {
+	case p.Version == "":
+		p.warnf("%s: driver version unknown, extracting with the %s strategy\n",
+			driver, strategy)
+	case p.Variant != "":
+		p.infof("%s: %s driver %s, extracting with the %s strategy\n",
+			driver, p.Variant, p.Version, strategy)
+	default:
+		p.infof("%s: driver %s, extracting with the %s strategy\n",
+			driver, p.Version, strategy)
+	}
+
+	switch strategy {
+	case "legacy":
+		kdata, err := ioutil.ReadFile(kernel)
+		if err != nil {
+			return err
+		}
+		if eluscan.IsPE(kdata) {
+			return fmt.Errorf("%s: the legacy extraction is only for Linux drivers", driver)
+		}
+		var user []byte
+		if libs := findFiles(dir, "libnvcuvid.so.*"); len(libs) != 0 {
+			if user, err = ioutil.ReadFile(libs[0]); err != nil {
+				return err
+			}
+		} else {
+			p.warnf("%s: no libnvcuvid, skipping the user-space firmware\n", driver)
+		}
+		return p.Legacy(kdata, user)
+	case "gsp":
+		if err := p.scanObject(ctx, kernel); err != nil {
+			return err
+		}
+		return p.gspFiles(dir)
+	case "scan":
+		return p.scanObject(ctx, kernel)
+	}
+	return fmt.Errorf("unknown strategy %q", strategy)
+}
+
+// Copy the GSP firmware a driver ships as files, e.g.
+// firmware/gsp_tu10x.bin
+func (p *Processor) gspFiles(dir string) error {
+	files := findFiles(dir, "gsp*.bin")
+	if len(files) == 0 {
+		p.warnf("%s: no GSP firmware files found\n", dir)
+	}
+	for _, fname := range files {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		p.gspFile(fname, data)
+	}
+	return p.err
+}
+
+// Copy one GSP firmware file
+func (p *Processor) gspFile(fname string, data []byte) {
+	origin := Origin{CompressedSize: len(data), Codec: "stored"}
+	if !p.wanted("gsp", origin) {
+		return
+	}
+	name := p.uniqueName(path.Base(fname))
+	p.infof("%s: GSP firmware from %s\n", name, fname)
+	p.emit(name, data, origin, "gsp", "")
+	// And its parts, beside it
+	if err := (gspHandler{}).split(data, strings.TrimSuffix(name, ".bin"),
+		&Sink{p, origin}); err != nil {
+		p.problem(origin, "blob", "%v", err)
+	}
+}
+
+// Scan a whole driver, a .run package or an extracted directory, with
+// ScanDriver, or else an object with ScanObjectContext
+func (p *Processor) scanInput(ctx context.Context, input string) error {
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	if !p.Dump && (info.IsDir() || IsPackage(input)) {
+		return p.ScanDriver(ctx, input)
+	}
+	return p.ScanObjectContext(ctx, input)
+}
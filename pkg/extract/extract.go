@@ -0,0 +1,1074 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package extract turns what eluscan finds into files: it names and
+// writes out the blobs and archives, and implements verify, diff and
+// batch on top of that.
+package extract
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+import "text/tabwriter"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/eluscan"
+import "github.com/envytools/firmware/pkg/netlist"
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// How much to print: errors, then warnings about data that had to be
+// skipped, then what was found, then what was tried.
+const (
+	LogError = iota
+	LogWarn
+	LogInfo
+	LogDebug
+)
+
+var LogLevels = map[string]int{
+	"error": LogError,
+	"warn": LogWarn,
+	"info": LogInfo,
+	"debug": LogDebug,
+}
+
+var logLevelNames = []string{"error", "warn", "info", "debug"}
+
+// Where a Processor's messages at level go: warnings to stderr,
+// everything else to its LogOut
+func (p *Processor) logOut(level int) io.Writer {
+	if level <= LogWarn {
+		return os.Stderr
+	} else if p.opts().LogOut != nil {
+		return p.opts().LogOut
+	}
+	return os.Stdout
+}
+
+func (p *Processor) logJSON(level int, fields map[string]interface{}) {
+	fields["level"] = logLevelNames[level]
+	data, err := json.Marshal(fields)
+	must(err)
+	p.logOut(level).Write(append(data, '\n'))
+}
+
+// Log a message at level, with the Processor's LogPrefix in front of
+// each line
+func (p *Processor) logf(level int, format string, args ...interface{}) {
+	if level > p.opts().LogLevel {
+		return
+	}
+	if p.opts().LogFormat == "json" {
+		p.event(level, "message", nil, format, args...)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if p.LogPrefix != "" {
+		msg = p.LogPrefix + strings.Replace(strings.TrimSuffix(msg, "\n"),
+			"\n", "\n" + p.LogPrefix, -1) + "\n"
+	}
+	io.WriteString(p.logOut(level), msg)
+}
+
+func (p *Processor) warnf(format string, args ...interface{}) {
+	p.logf(LogWarn, format, args...)
+}
+
+func (p *Processor) infof(format string, args ...interface{}) {
+	p.logf(LogInfo, format, args...)
+}
+
+func (p *Processor) debugf(format string, args ...interface{}) {
+	p.logf(LogDebug, format, args...)
+}
+
+// Log something a scan went through: as the text of format, or with
+// LogFormat "json" as an object with fields, named by event and with
+// the input it's about. With format "" it's only logged as JSON.
+func (p *Processor) event(level int, event string, fields map[string]interface{}, format string, args ...interface{}) {
+	if level > p.opts().LogLevel {
+		return
+	}
+	if p.opts().LogFormat != "json" {
+		if format != "" {
+			p.logf(level, format, args...)
+		}
+		return
+	}
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["event"] = event
+	if format != "" {
+		fields["msg"] = strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	}
+	if p.LogPrefix != "" {
+		fields["input"] = strings.TrimSuffix(p.LogPrefix, ": ")
+	}
+	if p.Source != "" {
+		fields["source"] = p.Source
+	}
+	p.logJSON(level, fields)
+}
+
+// Describes one file written out, for the manifest
+type ManifestEntry struct {
+	Path string `json:"path"`
+	Source string `json:"source"`
+	Offset int64 `json:"offset"`
+	CompressedSize int `json:"compressed_size"`
+	Codec string `json:"codec"`
+	Size int `json:"size"`
+	SHA256 string `json:"sha256"`
+	Type string `json:"type"`
+	Archive string `json:"archive,omitempty"`
+	// Whether the hash is in the known blobs table
+	Known bool `json:"known"`
+	// The first file written with the same contents, when
+	// deduplicating
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// "encrypted" or "signed" if the contents are useless without
+	// further processing
+	Protection string `json:"protection,omitempty"`
+	// Symbols that refer to where the blob came from, often the best
+	// clue about what it is
+	ReferencedBy []string `json:"referenced_by,omitempty"`
+	// The symbol it was found at the start of, which it is named
+	// after
+	Symbol string `json:"symbol,omitempty"`
+	// For blobs that couldn't be named, what's in them
+	Analysis *classify.Analysis `json:"analysis,omitempty"`
+	// The size of the words whose bytes were swapped in the file, if
+	// they were
+	ByteSwap int `json:"byteswap,omitempty"`
+}
+
+// A file found by a scan, as handed to a Scan visitor. Data has to
+// be read before the visitor returns.
+type Blob struct {
+	ManifestEntry
+	Data io.Reader
+}
+
+// Why something in the input was passed over, for -diagnostics
+type Diagnostic struct {
+	Offset int64 `json:"offset"`
+	Codec string `json:"codec,omitempty"`
+	// What was being looked at: "relocations", "gap", "tool",
+	// "limit", "archive", "blob" or "filter"
+	Stage string `json:"stage"`
+	Reason string `json:"reason"`
+}
+
+// Where in the input a blob came from
+type Origin struct {
+	Offset int64
+	CompressedSize int
+	Codec string
+	// Symbols holding references to the blob
+	ReferencedBy []string
+	// Names of the symbols and sections that reference the blob
+	Context []string
+	// The symbol the blob is at the start of, if one says what it is
+	Symbol string
+}
+
+// One scan: what it goes by and what it found. A Processor isn't safe
+// for concurrent use; scans that run at once each need their own.
+type Processor struct {
+	Destdir string
+	// The input file, as recorded in the manifest
+	Source string
+	// Driver version, found in the object if not set beforehand
+	Version string
+	// "grid" or "vgpu-..." for GRID and vGPU drivers, found in the
+	// package's name by ScanDriver if not set beforehand
+	Variant string
+	// How ScanDriver extracts a driver, one of Strategies, instead of
+	// going by its version
+	Strategy string
+	// What to go by in scanning, or nil for DefaultOptions
+	Options *Options
+	Manifest []ManifestEntry
+	// Write a .meta.json next to each file with its manifest entry
+	Sidecars bool
+	// How to write out files whose contents were already written:
+	// "hardlink", "symlink", "manifest" (only record them), or ""
+	// to write them out again.
+	Dedup string
+	written map[string]string
+	// Also write the GR ctxsw firmware under nouveau's names,
+	// for Chipset if it's set.
+	Nouveau bool
+	Chipset *netlist.Chipset
+	// Region name table to use instead of the archive's family's
+	NameTable string
+	// Also write out scalar regions as files
+	RawScalars bool
+	// Also write record list regions out as "text" or "json", with
+	// register names from RegNames
+	Decode string
+	RegNames map[uint32]string
+	// The most to decompress from the whole input, or 0 for no limit
+	MaxTotal int64
+	total int64
+	// How many gaps to decompress at once, or 0 for one per CPU
+	Workers int
+	// Also write out the compressed data each blob came from
+	KeepCompressed bool
+	// Also write each file as a C header with its contents in a byte
+	// array, as <name>.h
+	EmitC bool
+	// Also write each file as "ihex" or "srec", one of HexFormats,
+	// at HexBase, or HexDataBase for falcon data segments
+	HexFormat string
+	HexBase, HexDataBase uint32
+	// Write files with the bytes of each word of this many bytes
+	// reversed, only for the categories in ByteSwapOnly if it isn't
+	// empty
+	ByteSwap int
+	ByteSwapOnly map[string]bool
+	// Write files through this, e.g. a TarFS, instead of into
+	// Destdir. Destdir is still used for blobs being decompressed.
+	Output WriteFS
+	// How to name what can't be named after what it is: "" for the
+	// order found in, "hash" or "offset"
+	Naming string
+	// Write everything into Destdir itself, with the directories a
+	// file would go in put in front of its name
+	Flat bool
+	// Go through the whole scan without writing anything, to see
+	// what Manifest comes out
+	DryRun bool
+	// Hand each file to this instead of writing it out. Destdir is
+	// then only used for blobs being decompressed.
+	Visit func(Blob) error
+	// Categories to extract, or all if Only is empty, and ones to
+	// leave out
+	Only, Exclude map[string]bool
+	// Only scan gaps that start in [Start, End) of rodata, or of the
+	// file with FileOffsets set. End 0 means the end of rodata.
+	Start, End int64
+	FileOffsets bool
+	// Put in front of every line logged, e.g. the input's name when
+	// several are scanned at once
+	LogPrefix string
+	// Leave files in Destdir that already hold what would be written
+	// alone, and only write what is new or different
+	Incremental bool
+	// What the manifest of the run Incremental goes over again has
+	previous map[string]bool
+	// Have Tidy remove the files in Destdir this run didn't write
+	Clean bool
+	// Every file this run wrote, or found already written, by name
+	outputs map[string]bool
+	// Don't apply the Quirks for the driver version
+	NoQuirks bool
+	// Go by the relocations alone, even where symbols say where the
+	// blobs are and what they are called
+	NoSymbols bool
+	// The input is a raw memory dump, to be searched for the streams
+	// that can be recognized without relocations. ELF core files are
+	// taken as dumps without it.
+	Dump bool
+	quirk *Quirk
+	archiveCounter, wholeCounter int
+	// Archives without a netlist_num, for the quirks' ArchiveOrder
+	unnumbered int
+	// Signatures of the archives named without a netlist_num
+	signatures []netlist.ArchiveSignature
+	// The chipset each archive was found to be for, by its name, if
+	// it could be told
+	archiveChipsets map[string]string
+	nameCounters map[string]int
+	Stats Stats
+	Diagnostics []Diagnostic
+	// "strict" to stop at the first thing in the input that isn't
+	// as expected, "lenient" to carry on past anything at all, or ""
+	// to skip over what can't be used with a warning
+	Mode string
+	err error
+}
+
+// What a scan went through, for the summary at the end of it
+type Stats struct {
+	// Gaps between relocations looked at, and how many turned out
+	// to hold nothing that would decompress
+	Gaps int `json:"gaps"`
+	Failed int `json:"failed"`
+	// Blobs found in the gaps, by codec, and ones left out for
+	// being too big
+	Decoded map[string]int `json:"decoded"`
+	Skipped int `json:"skipped"`
+	Archives int `json:"archives"`
+	// Entries of archives that had to be left out
+	Partial int `json:"partial"`
+	// Files outside archives that could be named, or not
+	Classified int `json:"classified"`
+	Unknown int `json:"unknown"`
+	// Everything written, links to duplicates included
+	Files int `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// With Incremental, the files that were already there as they
+	// would be written, those that were different and new ones
+	Unchanged int `json:"unchanged,omitempty"`
+	Changed int `json:"changed,omitempty"`
+	Added int `json:"added,omitempty"`
+	// With Clean, the files Tidy removed
+	Removed int `json:"removed,omitempty"`
+	// Streams that were left undecoded, by the decompressor they
+	// needed that isn't installed
+	Missing map[string]int `json:"missing,omitempty"`
+}
+
+// Write out a file relative to the destination directory, creating
+// any directories along the way.
+func (p *Processor) writeFile(name string, data []byte) error {
+	name = p.flatName(name)
+	p.wrote(name)
+	if p.DryRun || p.Visit != nil || p.unchanged(name, data) {
+		return nil
+	}
+	return p.output().WriteFile(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// Write out a file with the same contents as an earlier one, as
+// selected by Dedup.
+func (p *Processor) writeDuplicate(name, first string) error {
+	p.wrote(name)
+	if p.DryRun || p.Visit != nil || p.unchangedLink(name, first) {
+		return nil
+	}
+	switch p.Dedup {
+	case "hardlink":
+		return p.output().Link(name, first)
+	case "symlink":
+		target, err := filepath.Rel(path.Dir(name), first)
+		if err != nil {
+			return err
+		}
+		return p.output().Symlink(name, target)
+	}
+	return nil
+}
+
+// Stop the scan at the first error writing something out, as at the
+// first one from Visit
+func (p *Processor) fail(err error) {
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+}
+
+// Move a blob decompressed into a file into place at fname
+func moveBlob(file, fname string) error {
+	if err := os.MkdirAll(path.Dir(fname), os.FileMode(0777)); err != nil {
+		return err
+	}
+	if err := os.Rename(file, fname); err != nil {
+		return err
+	}
+	return settle(fname, fileMode)
+}
+
+// Write out an extracted blob and record it in the manifest.
+func (p *Processor) emit(name string, data []byte, origin Origin, typ, archive string) {
+	name = p.flatName(name)
+	hash := classify.HashOf(data)
+	// What's written may be byte-swapped, and only a file swapped
+	// the same way can stand in for it
+	out, written := data, hash
+	swap := p.byteSwap(typ)
+	if swap != 0 {
+		out = byteSwapped(data, swap)
+		written = fmt.Sprintf("%s/swap%d", hash, swap)
+	}
+	first, dup := p.written[written]
+	if dup && p.Dedup != "" {
+		p.fail(p.writeDuplicate(name, first))
+	} else {
+		p.fail(p.writeFile(name, out))
+		p.remember(written, name)
+		first = ""
+	}
+	if p.EmitC && typ != "compressed" {
+		p.fail(p.writeCHeader(name, out, hash))
+	}
+	if p.HexFormat != "" && typ != "compressed" {
+		p.fail(p.writeHex(name, out))
+	}
+	p.record(name, hash, len(data), data, origin, typ, archive, first, swap)
+	p.visit(bytes.NewReader(out))
+}
+
+// Same as emit, for a blob that was decompressed into a file. Only
+// the start of it is in memory.
+func (p *Processor) emitFile(name string, b eluscan.Blob, origin Origin, typ string) {
+	name = p.flatName(name)
+	first, dup := p.written[b.Hash]
+	if p.EmitC {
+		p.infof("%s: too big for a C header, leaving it out\n", name)
+	}
+	if p.HexFormat != "" {
+		p.infof("%s: too big for a %s file, leaving it out\n", name, p.HexFormat)
+	}
+	if p.byteSwap(typ) != 0 {
+		p.infof("%s: too big to byte-swap, leaving it as it is\n", name)
+	}
+	if p.Visit != nil {
+		f, err := os.Open(b.File)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		if !dup || p.Dedup == "" {
+			p.remember(b.Hash, name)
+			first = ""
+		}
+		p.record(name, b.Hash, int(b.Size), b.Data, origin, typ, "", first, 0)
+		p.visit(f)
+		f.Close()
+		os.Remove(b.File)
+		return
+	}
+	p.wrote(name)
+	if dup && p.Dedup != "" {
+		os.Remove(b.File)
+		p.fail(p.writeDuplicate(name, first))
+	} else if p.Output != nil {
+		f, err := os.Open(b.File)
+		if err == nil {
+			err = p.Output.WriteFile(name, f, b.Size)
+			f.Close()
+		}
+		os.Remove(b.File)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.remember(b.Hash, name)
+		first = ""
+	} else if p.unchangedFile(name, b.Hash, b.Size) {
+		os.Remove(b.File)
+		p.remember(b.Hash, name)
+		first = ""
+	} else if !p.DryRun {
+		if err := moveBlob(b.File, path.Join(p.Destdir, name)); err != nil {
+			os.Remove(b.File)
+			p.fail(err)
+			return
+		}
+		p.remember(b.Hash, name)
+		first = ""
+	} else {
+		p.remember(b.Hash, name)
+		first = ""
+	}
+	p.record(name, b.Hash, int(b.Size), b.Data, origin, typ, "", first, 0)
+}
+
+// Hand the file just recorded to Visit, if there is one. The first
+// error it returns stops the scan.
+func (p *Processor) visit(data io.Reader) {
+	if p.Visit == nil || p.err != nil {
+		return
+	}
+	p.fail(p.Visit(Blob{p.Manifest[len(p.Manifest)-1], data}))
+}
+
+func (p *Processor) remember(hash, name string) {
+	if p.written == nil {
+		p.written = make(map[string]string)
+	}
+	p.written[hash] = name
+}
+
+// Add a written file to the manifest. data is its contents, or the
+// start of them for a streamed blob, before any byte-swapping by swap.
+func (p *Processor) record(name, hash string, size int, data []byte, origin Origin, typ, archive, first string, swap int) {
+	_, known := classify.Known[hash]
+	prot := classify.Protection(data)
+	if prot != "" && archive != "" {
+		p.infof("%s: %s\n", name, prot)
+	}
+	p.Stats.Files++
+	if first == "" {
+		p.Stats.Bytes += int64(size)
+	}
+	// What's in a blob that couldn't be named may help whoever has
+	// to work out what it is
+	var analysis *classify.Analysis
+	if archive == "" && typ != "nouveau" && typ != "compressed" {
+		if typ == "unknown" {
+			analysis = classify.Analyze(data)
+			p.debugf("%s: entropy %.2f, %d strings, %d magics\n", name,
+				analysis.Entropy, analysis.StringCount, len(analysis.Magics))
+			p.Stats.Unknown++
+		} else {
+			p.Stats.Classified++
+		}
+	}
+	p.Manifest = append(p.Manifest, ManifestEntry{
+		Path: name,
+		Source: p.Source,
+		Offset: origin.Offset,
+		CompressedSize: origin.CompressedSize,
+		Codec: origin.Codec,
+		Size: size,
+		SHA256: hash,
+		Type: typ,
+		Archive: archive,
+		Known: known,
+		DuplicateOf: first,
+		Protection: prot,
+		ReferencedBy: origin.ReferencedBy,
+		Symbol: origin.Symbol,
+		Analysis: analysis,
+		ByteSwap: swap,
+	})
+	p.event(LogInfo, "file", map[string]interface{}{"file": p.Manifest[len(p.Manifest)-1]}, "")
+	if p.Sidecars {
+		meta, err := json.MarshalIndent(p.Manifest[len(p.Manifest)-1], "", "  ")
+		must(err)
+		p.fail(p.writeFile(name + ".meta.json", append(meta, '\n')))
+	}
+}
+
+// List the blobs whose hashes aren't known yet, so that they can be
+// identified and sent in for the known blobs table. With no table to
+// go by, every blob would be listed, which says nothing.
+func (p *Processor) WriteUnknown() error {
+	if len(classify.Known) == 0 {
+		p.debugf("No known blob hashes loaded, so none are listed as unknown\n")
+		return nil
+	}
+	var list bytes.Buffer
+	count := 0
+	for _, e := range p.Manifest {
+		if !e.Known && e.Type != "nouveau" && e.Type != "compressed" {
+			fmt.Fprintf(&list, "%s %8d %s\n", e.SHA256, e.Size, e.Path)
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if err := p.writeFile("unknown.txt", list.Bytes()); err != nil {
+		return err
+	}
+	p.infof("%d files have hashes that aren't known yet, see unknown.txt. " +
+		"Please send in any you can identify.\n", count)
+	return nil
+}
+
+func (p *Processor) wanted(cat string, origin Origin) bool {
+	if (len(p.Only) != 0 && !p.Only[cat]) || p.Exclude[cat] {
+		p.diagnose(origin, "filter", "%s firmware not wanted", cat)
+		return false
+	}
+	return true
+}
+
+// Print what was (or would be) extracted, one line per file
+func (p *Processor) List(w io.Writer, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(p.Manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "offset\tcodec\tcompressed\tsize\ttype\tpath\n")
+	for _, e := range p.Manifest {
+		fmt.Fprintf(tw, "0x%08x\t%s\t%d\t%d\t%s\t%s\n", e.Offset, e.Codec,
+			e.CompressedSize, e.Size, e.Type, e.Path)
+	}
+	return tw.Flush()
+}
+
+// Print the Stats of a scan
+func (p *Processor) Summary(w io.Writer) error {
+	st := p.Stats
+	if p.opts().LogFormat == "json" {
+		data, err := json.Marshal(map[string]interface{}{"event": "summary",
+			"level": "info", "stats": st})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	var codecs []string
+	decoded := 0
+	for name, n := range st.Decoded {
+		codecs = append(codecs, fmt.Sprintf("%s %d", name, n))
+		decoded += n
+	}
+	sort.Strings(codecs)
+	written := "written"
+	if p.DryRun {
+		written = "to write"
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "gaps scanned:\t%d\n", st.Gaps)
+	fmt.Fprintf(tw, "blobs found:\t%d", decoded)
+	if len(codecs) != 0 {
+		fmt.Fprintf(tw, " (%s)", strings.Join(codecs, ", "))
+	}
+	fmt.Fprintf(tw, "\n")
+	fmt.Fprintf(tw, "gaps with nothing found:\t%d\n", st.Failed)
+	fmt.Fprintf(tw, "blobs skipped:\t%d\n", st.Skipped)
+	if len(st.Missing) != 0 {
+		var tools []string
+		undecoded := 0
+		for tool, n := range st.Missing {
+			tools = append(tools, fmt.Sprintf("%s %d", tool, n))
+			undecoded += n
+		}
+		sort.Strings(tools)
+		fmt.Fprintf(tw, "streams needing missing tools:\t%d (%s)\n", undecoded,
+			strings.Join(tools, ", "))
+	}
+	fmt.Fprintf(tw, "archives:\t%d", st.Archives)
+	if st.Partial != 0 {
+		fmt.Fprintf(tw, " (%d broken entries left out)", st.Partial)
+	}
+	fmt.Fprintf(tw, "\n")
+	fmt.Fprintf(tw, "blobs classified:\t%d\n", st.Classified)
+	fmt.Fprintf(tw, "blobs unknown:\t%d\n", st.Unknown)
+	fmt.Fprintf(tw, "files %s:\t%d, %d bytes\n", written, st.Files, st.Bytes)
+	if p.incremental() && p.rerun() {
+		fmt.Fprintf(tw, "files unchanged:\t%d (%d changed, %d new)\n", st.Unchanged,
+			st.Changed, st.Added)
+	}
+	if st.Removed != 0 {
+		fmt.Fprintf(tw, "files removed:\t%d\n", st.Removed)
+	}
+	return tw.Flush()
+}
+
+// Note down why something at origin was passed over
+func (p *Processor) diagnose(origin Origin, stage, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	p.event(LogDebug, "skipped", map[string]interface{}{"offset": origin.Offset,
+		"codec": origin.Codec, "stage": stage, "reason": reason},
+		"0x%x: %s: %s\n", origin.Offset, stage, reason)
+	p.Diagnostics = append(p.Diagnostics, Diagnostic{
+		Offset: origin.Offset,
+		Codec: origin.Codec,
+		Stage: stage,
+		Reason: reason,
+	})
+}
+
+// Something in the input that should not be there. It is skipped
+// with a warning, and in strict mode the scan stops with it.
+func (p *Processor) problem(origin Origin, stage, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	p.warnf("0x%x: %s\n", origin.Offset, reason)
+	p.diagnose(origin, stage, "%s", reason)
+	if p.Mode == "strict" && p.err == nil {
+		p.err = fmt.Errorf("0x%x: %s", origin.Offset, reason)
+	}
+}
+
+func (p *Processor) WriteDiagnostics(fname string) error {
+	data, err := json.MarshalIndent(p.Diagnostics, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, append(data, '\n'), 0666)
+}
+
+func (p *Processor) WriteManifest() error {
+	data, err := json.MarshalIndent(p.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := p.writeFile("manifest.json", append(data, '\n')); err != nil {
+		return err
+	}
+	if p.Clean {
+		// Tidy has the last word on those
+		return nil
+	}
+	for _, name := range p.stale() {
+		p.infof("%s: not extracted this time, left in place\n", name)
+	}
+	return nil
+}
+
+// Scan an object, handing each file found in it to visit with its
+// manifest entry instead of writing anything out. Scanning stops at
+// the first error visit returns, which Scan returns.
+func Scan(fname string, visit func(Blob) error) error {
+	p := &Processor{Source: fname}
+	return p.Scan(fname, visit)
+}
+
+// Same as Scan, with the settings in p. Blobs too big for memory are
+// decompressed into Destdir, or a temporary directory if it isn't set.
+func (p *Processor) Scan(fname string, visit func(Blob) error) error {
+	return p.ScanContext(context.Background(), fname, visit)
+}
+
+// Same as Scan, stopping early with ctx's error once it is done.
+func (p *Processor) ScanContext(ctx context.Context, fname string, visit func(Blob) error) error {
+	if p.DryRun {
+		return errors.New("a dry run has nothing to hand to a visitor")
+	}
+	if p.Destdir == "" {
+		dir, err := ioutil.TempDir("", "scanner")
+		if err != nil {
+			return err
+		}
+		p.Destdir = dir
+		defer func() {
+			os.RemoveAll(dir)
+			p.Destdir = ""
+		}()
+	}
+	p.Visit = visit
+	defer func() { p.Visit = nil }()
+	return p.scanObject(ctx, fname)
+}
+
+func (p *Processor) ScanObject(fname string) error {
+	return p.ScanObjectContext(context.Background(), fname)
+}
+
+// Same as ScanObject, stopping once ctx is done. Whatever was written
+// by then stays written, and is in the Manifest. The error is ctx's.
+func (p *Processor) ScanObjectContext(ctx context.Context, fname string) error {
+	return p.scanObject(ctx, fname)
+}
+
+func (p *Processor) scanObject(ctx context.Context, fname string) error {
+	if p.Dump {
+		return p.scanDump(ctx, fname)
+	}
+	if fname != "-" {
+		head := make([]byte, 18)
+		if f, err := os.Open(fname); err == nil {
+			f.Read(head)
+			f.Close()
+		}
+		if eluscan.IsPE(head) {
+			return p.scanPE(ctx, fname)
+		}
+		if eluscan.IsCore(head) {
+			return p.scanDump(ctx, fname)
+		}
+	}
+	f, file, err := eluscan.OpenObject(fname)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The data actually resides in rodata, which is one section
+	// or, from -fdata-sections builds, a lot of them. The
+	// relocations for it tell us where potentially interesting
+	// data might start. Every offset can be referenced from a
+	// number of places, including code, which helps tell what a
+	// blob is for. Objects that kept the symbols of their firmware
+	// arrays say exactly where each one is, and what it's called.
+	ro, err := eluscan.ReadRodata(f, file, !p.NoSymbols, &p.opts().Options)
+	var relErr *eluscan.RelocationError
+	if errors.As(err, &relErr) {
+		// Without symbols there is nothing to go by but where the
+		// sections start, which only -lenient settles for
+		if p.Mode == "strict" || relErr.NoSymbols && p.Mode != "lenient" {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+		for _, err := range relErr.Errs {
+			reason := fmt.Sprintf("%v, leaving out the references in it", err)
+			if relErr.NoSymbols {
+				reason = fmt.Sprintf("%v, so there are no references to go by", err)
+			}
+			p.warnf("%s: %s\n", fname, reason)
+			p.diagnose(Origin{}, "relocations", "%s", reason)
+		}
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	if len(ro.Sections) > 1 {
+		p.debugf("rodata is in %d sections, scanned one after the other\n",
+			len(ro.Sections))
+	}
+	var compressed bool
+	for _, s := range ro.Sections {
+		if eluscan.Compressed(s.Section) {
+			p.debugf("%s is compressed, 0x%x bytes to 0x%x\n", s.Name, s.FileSize,
+				s.Size)
+			compressed = true
+		}
+	}
+	// Offsets into the file only say where something is in rodata
+	// when it's all in one piece there
+	if p.FileOffsets && (compressed || len(ro.Sections) > 1) {
+		return fmt.Errorf("%s: rodata is compressed or split up, so file offsets don't map onto it",
+			fname)
+	}
+	if p.Version == "" {
+		p.Version = eluscan.DriverVersion(ro.Data)
+	}
+	return p.scanSection(ctx, fname, ro.Data, int64(ro.Sections[0].Offset), ro.Refs, ro.All,
+		ro.Spans)
+}
+
+// Scan the .rdata of a Windows driver, going by the addresses in it
+// that the base relocations fix up
+func (p *Processor) scanPE(ctx context.Context, fname string) error {
+	s, err := eluscan.ReadPE(fname)
+	if err != nil {
+		return err
+	}
+	if p.Version == "" {
+		p.Version = eluscan.WindowsDriverVersion(fname)
+	}
+	return p.scanSection(ctx, fname, s.Data, s.Offset, s.Refs, s.Refs, nil)
+}
+
+// Scan a memory dump or core file, which has no relocations, for the
+// streams that can be recognized by what they look like
+func (p *Processor) scanDump(ctx context.Context, fname string) error {
+	data, ranges, err := eluscan.ReadDump(fname)
+	if err != nil {
+		return err
+	}
+	if p.Version == "" {
+		p.Version = eluscan.DriverVersion(data)
+	}
+	gaps := eluscan.DumpStreams(data, ranges, &p.opts().Options, ctx.Done())
+	p.debugf("%d streams found in %d ranges of the dump\n", len(gaps), len(ranges))
+	return p.decodeGaps(ctx, fname, data, gaps, nil, nil, nil)
+}
+
+// Scan the section the firmware is in, which starts at offset in the
+// file, for blobs between the places refs point at, and in the spans
+// of symbols. all are the references from anywhere, which help name
+// what is found.
+func (p *Processor) scanSection(ctx context.Context, fname string, rodata []byte, offset int64, refs, all []eluscan.Reference, spans []eluscan.Span) error {
+	if !p.NoQuirks {
+		p.quirk = LookupQuirk(p.Version)
+	}
+	if p.quirk != nil {
+		p.infof("using the quirks for driver %s\n", p.quirk.Version)
+	}
+
+	referrers := make(map[int64][]string)
+	contexts := make(map[int64][]string)
+	for _, ref := range all {
+		if ref.Symbol != "" {
+			referrers[ref.Addend] = append(referrers[ref.Addend], ref.Symbol)
+		}
+		contexts[ref.Addend] = append(contexts[ref.Addend], ref.Symbol, ref.Section)
+	}
+	start, end := p.Start, p.End
+	if p.quirk != nil && start == 0 && end == 0 {
+		start, end = p.quirk.Start, p.quirk.End
+	} else if p.FileOffsets {
+		start -= offset
+		if end != 0 {
+			end -= offset
+		}
+	}
+
+	symbols := make(map[int64]string)
+	for _, span := range spans {
+		symbols[span.Start] = span.Name
+	}
+	gaps := eluscan.FindSymbolGaps(refs, spans, int64(len(rodata)), start, end,
+		&p.opts().Options)
+	p.debugf("%d relocations, %d symbols, %d gaps to scan in 0x%x bytes of rodata\n",
+		len(refs), len(spans), len(gaps), len(rodata))
+	return p.decodeGaps(ctx, fname, rodata, gaps, referrers, contexts, symbols)
+}
+
+// Decode the gaps of rodata and write out what they hold, naming it
+// with the referrers, contexts and symbols of where it starts
+func (p *Processor) decodeGaps(ctx context.Context, fname string, rodata []byte, gaps [][2]int64, referrers, contexts map[int64][]string, symbols map[int64]string) error {
+	p.Stats.Gaps += len(gaps)
+	if p.Stats.Decoded == nil {
+		p.Stats.Decoded = make(map[string]int)
+	}
+
+	// Decompressing is most of the work, so do that in parallel,
+	// but take the results in order so that names come out the
+	// same every time.
+	dir := ""
+	if !p.DryRun {
+		dir = p.Destdir
+		if err := os.MkdirAll(dir, os.FileMode(0777)); err != nil {
+			return err
+		}
+	}
+	missing := make(map[string]int)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for blobs := range eluscan.DecodeGaps(rodata, gaps, p.Workers, dir, &p.opts().Options,
+		ctx.Done()) {
+		if ctx.Err() != nil {
+			eluscan.Discard(blobs)
+			continue
+		}
+		found := false
+		for _, b := range blobs {
+			origin := Origin{b.Offset, b.Used, b.Codec,
+				referrers[b.Offset], contexts[b.Offset], symbols[b.Offset]}
+			if b.Missing != "" {
+				// Firmware the scan can't have, which it has
+				// to say so loudly
+				found = true
+				missing[b.Missing]++
+				if p.Mode == "strict" {
+					p.problem(origin, "tool", "%s", b.Why)
+					return p.err
+				}
+				p.diagnose(origin, "tool", "%s", b.Why)
+				continue
+			}
+			if b.Why != "" {
+				p.diagnose(origin, "gap", "%s", b.Why)
+				continue
+			}
+			found = true
+			if b.Skip != "" {
+				p.problem(origin, "limit", "%s", b.Skip)
+				p.Stats.Skipped++
+				continue
+			}
+			if p.MaxTotal > 0 && p.total + b.Size > p.MaxTotal {
+				p.problem(origin, "limit",
+					"Skipping %s data: over %d bytes decompressed in total",
+					b.Codec, p.MaxTotal)
+				if b.File != "" {
+					os.Remove(b.File)
+				}
+				p.Stats.Skipped++
+				continue
+			}
+			p.total += b.Size
+			p.Stats.Decoded[b.Codec]++
+			p.event(LogDebug, "blob", map[string]interface{}{"offset": b.Offset,
+				"codec": b.Codec, "compressed_size": b.Used, "size": b.Size},
+				"0x%x: %s, 0x%x bytes to 0x%x\n", b.Offset, b.Codec, b.Used, b.Size)
+
+			before := len(p.Manifest)
+			p.processBlob(b, origin)
+			if p.err == nil && p.KeepCompressed && b.Codec != "stored" {
+				p.keepCompressed(rodata[b.Offset:b.Offset + int64(b.Used)],
+					p.Manifest[before:], origin)
+			}
+			if p.err != nil {
+				return p.err
+			}
+		}
+		if !found {
+			p.Stats.Failed++
+		}
+	}
+	p.reportMissing(fname, missing)
+	if err := ctx.Err(); err != nil {
+		p.infof("%s: stopped after %d files: %v\n", fname, len(p.Manifest), err)
+		return err
+	}
+	p.checkArchiveOrder()
+	return nil
+}
+
+// Warn about the streams in fname that were left undecoded for want of
+// a decompressor, once for each, since firmware is missing from the
+// output without it
+func (p *Processor) reportMissing(fname string, missing map[string]int) {
+	var tools []string
+	for tool := range missing {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	for _, tool := range tools {
+		if p.Stats.Missing == nil {
+			p.Stats.Missing = make(map[string]int)
+		}
+		p.Stats.Missing[tool] += missing[tool]
+		p.warnf("%s: %s not found, so %d of its streams were left out; install it and scan again for them\n",
+			fname, tool, missing[tool])
+	}
+}
+
+// File name extensions for the compressed streams -keep-compressed
+// writes out
+var codecExtensions = map[string]string{
+	"zstd": ".zst",
+	"lz4": ".lz4",
+	"xz": ".xz",
+	"lzma": ".lzma",
+	"gzip": ".gz",
+	"zlib": ".zlib",
+	"deflate": ".deflate",
+	"lz4-block": ".lz4block",
+}
+
+// Write out the compressed stream a blob came from next to what it
+// decompressed to, whose manifest entries are written. An archive's
+// goes next to its directory.
+func (p *Processor) keepCompressed(raw []byte, written []ManifestEntry, origin Origin) {
+	if len(written) == 0 {
+		return
+	}
+	name := written[0].Path
+	if written[0].Archive != "" {
+		name = written[0].Archive
+	}
+	p.emit(name + codecExtensions[origin.Codec], raw, origin, "compressed", "")
+}
+
+// Work out what a blob is and write it out. In lenient mode, a panic
+// over some unexpected shape of data only loses that blob.
+func (p *Processor) processBlob(b eluscan.Blob, origin Origin) {
+	if p.Mode == "lenient" {
+		defer func() {
+			if err := recover(); err != nil {
+				p.problem(origin, "blob", "giving up on the blob: %v", err)
+			}
+		}()
+	}
+	if b.Streamed {
+		p.processStreamed(b, origin)
+	} else {
+		p.process(b.Data, origin)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "path"
+import "github.com/envytools/firmware/pkg/classify"
+
+// Split up a blob nothing else recognized if a falcon ucode descriptor
+// turns up in it, into a directory named after the engine: the whole
+// image, its bootloader, code and data, and what the descriptor says
+// in info.txt. Returns whether it was one.
+func (p *Processor) processFalcon(data []byte, origin Origin) bool {
+	img, ok := classify.FindFalcon(data)
+	if !ok {
+		return false
+	}
+	engine, where := classify.EngineString(data), "named in its strings"
+	if engine == "" {
+		var site string
+		engine, site = classify.ContextEngine(origin.Context)
+		where = "referenced from " + site
+	}
+	if engine == "" {
+		engine, where = "falcon", ""
+	}
+	if !p.wanted(classify.Category(engine), origin) {
+		return true
+	}
+
+	dir := p.blobName(engine, origin)
+	p.emit(path.Join(dir, "image"), data, origin, engine, dir)
+	for _, part := range img.Parts(data) {
+		p.emit(path.Join(dir, part.Name), part.Data, origin, "falcon_" + part.Name, dir)
+	}
+
+	d := img.Desc
+	var info bytes.Buffer
+	how := "found at"
+	if img.BinHeader {
+		how = "pointed at by a bin header, at"
+	}
+	fmt.Fprintf(&info, "descriptor: %s 0x%x\nimage: 0x%x\n", how, img.DescOffset,
+		img.ImageOffset)
+	fmt.Fprintf(&info, "app version: %d\nbuilt: %s\n", d.AppVersion,
+		bytes.TrimRight(d.Date[:], "\x00"))
+	fmt.Fprintf(&info, "bootloader: 0x%x+0x%x imem 0x%x entry 0x%x\n",
+		d.BootloaderStartOffset, d.BootloaderSize, d.BootloaderImemOffset,
+		d.BootloaderEntryPoint)
+	fmt.Fprintf(&info, "app: 0x%x+0x%x imem 0x%x entry 0x%x dmem 0x%x\n",
+		d.AppStartOffset, d.AppSize, d.AppImemOffset, d.AppImemEntry,
+		d.AppDmemOffset)
+	fmt.Fprintf(&info, "code: 0x%x+0x%x\ndata: 0x%x+0x%x\noverlays: %d\n",
+		d.AppResidentCodeOffset, d.AppResidentCodeSize,
+		d.AppResidentDataOffset, d.AppResidentDataSize, d.NbOverlays)
+	if where != "" {
+		fmt.Fprintf(&info, "engine: %s (%s)\n", engine, where)
+	}
+	p.fail(p.writeFile(path.Join(dir, "info.txt"), info.Bytes()))
+	p.infof("%s: falcon image, descriptor at 0x%x, built %s\n", dir, img.DescOffset,
+		bytes.TrimRight(d.Date[:], "\x00"))
+	return true
+}
+
+// Write out display falcon ucode as disp, with the signatures of a HS
+// image as disp_sig_prod and disp_sig_dbg, so that -only disp gets all
+// of it. Returns whether it was some.
+func (p *Processor) processDisplay(data []byte, origin Origin) bool {
+	note, ok := classify.DisplayFirmware(data, origin.Context)
+	if !ok {
+		return false
+	}
+	if !p.wanted("disp", origin) {
+		return true
+	}
+	name := p.blobName("disp", origin)
+	p.emit(name, data, origin, "disp", "")
+	p.infof("%s: %s\n", name, note)
+	if _, _, _, ok := classify.ParseHS(data); ok {
+		p.emitHSParts(name, data, origin, "disp")
+	}
+	return true
+}
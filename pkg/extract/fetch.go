@@ -0,0 +1,152 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bufio"
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "strings"
+
+// Where NVIDIA publishes its Linux drivers, the Mirrors of the
+// default Options
+var defaultMirrors = []string{
+	"https://download.nvidia.com/XFree86",
+	"https://us.download.nvidia.com/XFree86",
+}
+
+// The name of a driver version's .run package, for x86, x86_64 or
+// aarch64
+func RunName(version, arch string) string {
+	return fmt.Sprintf("NVIDIA-Linux-%s-%s.run", arch, version)
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// The sha256 NVIDIA publishes next to a package, as "<hash>  <name>"
+func publishedSum(ctx context.Context, url string) (string, error) {
+	resp, err := httpGet(ctx, url + ".sha256sum")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(io.LimitReader(resp.Body, 4096)).ReadString('\n')
+	if fields := strings.Fields(line); len(fields) != 0 {
+		return strings.ToLower(fields[0]), nil
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("%s.sha256sum: no checksum in it", url)
+	}
+	return "", err
+}
+
+// Download url into fname, checking it against sum on the way. Nothing
+// is left at fname unless it matches.
+func (p *Processor) download(ctx context.Context, url, sum, fname string) error {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	p.infof("Downloading %s\n", url)
+	part := fname + ".part"
+	f, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); err == nil && got != sum {
+		err = fmt.Errorf("%s: sha256 %s, expected %s", url, got, sum)
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, fname)
+}
+
+// Download a driver version's .run package into fname, from the first
+// of the Mirrors in opts that has it. It is checked against sum, or if
+// that's "" against the checksum published with it; without either,
+// nothing is downloaded. With a CacheDir, the package is only
+// downloaded if it isn't in the cache already.
+func Fetch(ctx context.Context, version, arch, sum, fname string, opts *Options) error {
+	p := &Processor{Options: opts}
+	if p.opts().CacheDir != "" {
+		return p.fetchCached(ctx, p.opts().CacheDir, version, arch, sum, fname)
+	}
+	_, err := p.fetch(ctx, version, arch, sum, fname)
+	return err
+}
+
+// Download a package as Fetch does, returning the sum it matched
+func (p *Processor) fetch(ctx context.Context, version, arch, sum, fname string) (string, error) {
+	var err error
+	mirrors := p.opts().Mirrors
+	if len(mirrors) == 0 {
+		mirrors = defaultMirrors
+	}
+	for _, mirror := range mirrors {
+		url := strings.TrimSuffix(mirror, "/") + "/Linux-" + arch + "/" +
+			version + "/" + RunName(version, arch)
+		want := strings.ToLower(sum)
+		if want == "" {
+			if want, err = publishedSum(ctx, url); err != nil {
+				p.warnf("%v\n", err)
+				if ctx.Err() != nil {
+					return "", ctx.Err()
+				}
+				continue
+			}
+		}
+		if err = p.download(ctx, url, want, fname); err == nil || ctx.Err() != nil {
+			return want, err
+		}
+		p.warnf("%v\n", err)
+	}
+	if sum == "" {
+		return "", fmt.Errorf("driver %s for %s: no checksum to check it against found; " +
+			"give one with -sha256", version, arch)
+	}
+	return "", fmt.Errorf("driver %s for %s: couldn't be downloaded from any mirror", version, arch)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "context"
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+// Where Grep found its pattern: the file, as named in the manifest or
+// in the output directory, and the offset in it
+type Match struct {
+	Path string
+	Offset int
+}
+
+// Turn what grep is asked to look for into bytes: "hex" bytes, spaces
+// allowed, a "reg" address as a little endian 32-bit word, the way the
+// register lists have them, or a "string" as it is.
+func GrepPattern(kind, value string) ([]byte, error) {
+	switch kind {
+	case "hex":
+		b, err := hex.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return nil, fmt.Errorf("bad hex pattern %q: %v", value, err)
+		}
+		return b, nil
+	case "reg":
+		addr, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad register address %q: %v", value, err)
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(addr))
+		return b, nil
+	case "string":
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("unknown pattern kind %q", kind)
+}
+
+// The offsets of pattern in data that are multiples of align
+func grepData(data, pattern []byte, align int) []int {
+	var offsets []int
+	for off := 0; ; off++ {
+		i := bytes.Index(data[off:], pattern)
+		if i < 0 {
+			return offsets
+		}
+		off += i
+		if align <= 1 || off % align == 0 {
+			offsets = append(offsets, off)
+		}
+	}
+}
+
+// Search everything in input for pattern, at offsets that are
+// multiples of align, handing each place it turns up to found. input
+// is an output directory (one with a manifest.json), searched file by
+// file, or else anything scan takes, whose blobs are searched as they
+// are decompressed without writing them out.
+func (p *Processor) Grep(ctx context.Context, input string, pattern []byte, align int, found func(Match)) error {
+	if len(pattern) == 0 {
+		return fmt.Errorf("empty pattern")
+	}
+	if _, err := os.Stat(path.Join(input, "manifest.json")); err == nil {
+		return grepDir(ctx, input, pattern, align, found)
+	}
+
+	tmp, err := ioutil.TempDir("", "scanner-grep")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	p.Destdir = tmp
+	p.Visit = func(b Blob) error {
+		data, err := ioutil.ReadAll(b.Data)
+		if err != nil {
+			return err
+		}
+		for _, off := range grepData(data, pattern, align) {
+			found(Match{b.Path, off})
+		}
+		return nil
+	}
+	defer func() { p.Visit = nil }()
+	return p.scanInput(ctx, input)
+}
+
+// Search the files of an output directory, leaving out the ones that
+// describe the extraction
+func grepDir(ctx context.Context, dir string, pattern []byte, align int, found func(Match)) error {
+	return filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		if name == "manifest.json" || strings.HasSuffix(name, ".meta.json") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		for _, off := range grepData(data, pattern, align) {
+			found(Match{filepath.ToSlash(name), off})
+		}
+		return nil
+	})
+}
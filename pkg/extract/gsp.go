@@ -0,0 +1,118 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "encoding/json"
+import "path"
+import "strings"
+import "github.com/envytools/firmware/pkg/gsp"
+
+func init() {
+	RegisterHandler("gsp", gspHandler{})
+}
+
+// GSP-RM images get split into their ELF sections, with those of the
+// RISC-V image in rm/, and the RISC-V bootloader and booter ucode into
+// their parts. What the headers say about each goes in info.json.
+type gspHandler struct{}
+
+func (gspHandler) Detect(data []byte) bool {
+	return gspKind(data) != ""
+}
+
+// What sort of GSP firmware data is, or "" if it's none
+func gspKind(data []byte) string {
+	if _, ok := gsp.ParseImage(data); ok {
+		return "gsp_rm"
+	}
+	if _, ok := gsp.ParseBootloader(data); ok {
+		return "gsp_bootloader"
+	}
+	if _, ok := gsp.ParseBooter(data); ok {
+		return "booter"
+	}
+	return ""
+}
+
+func (h gspHandler) Extract(data []byte, s *Sink) error {
+	kind := gspKind(data)
+	dir := s.UniqueName(kind)
+	s.Emit(path.Join(dir, "image"), data, kind, dir)
+	return h.split(data, dir, s)
+}
+
+// Write the parts of a GSP firmware file into dir, if it is one
+func (gspHandler) split(data []byte, dir string, s *Sink) error {
+	var info interface{}
+	if img, ok := gsp.ParseImage(data); ok {
+		for _, sec := range img.Sections {
+			typ := "gsp_section"
+			switch {
+			case sec.Name == ".fwimage":
+				typ = "gsp_rm"
+			case strings.HasPrefix(sec.Name, ".fwsignature_"):
+				typ = "gsp_sig"
+			}
+			s.Emit(path.Join(dir, sectionFile(sec.Name)), sec.Data(data), typ, dir)
+		}
+		for _, sec := range img.RMSections {
+			name := s.UniqueName(path.Join(dir, "rm", sectionFile(sec.Name)))
+			s.Emit(name, sec.Data(data), "gsp_rm_section", dir)
+		}
+		s.Infof("%s: GSP-RM %s, %d bytes of RISC-V image with %d sections, " +
+			"signatures for %d chip families\n", dir, img.Version, img.RM.Size,
+			len(img.RMSections), len(img.Signatures))
+		info = img
+	} else if b, ok := gsp.ParseBootloader(data); ok {
+		for _, part := range b.Parts {
+			s.Emit(path.Join(dir, part.Name), part.Data(data), "gsp_" + part.Name, dir)
+		}
+		s.Infof("%s: GSP-RM RISC-V bootloader, descriptor v%d, app version %d\n",
+			dir, b.Desc.Version, b.Desc.AppVersion)
+		info = b
+	} else if b, ok := gsp.ParseBooter(data); ok {
+		for _, part := range b.Parts {
+			s.Emit(path.Join(dir, part.Name), part.Data(data), "booter_" + part.Name, dir)
+		}
+		s.Emit(path.Join(dir, "sig_prod"), b.Signatures.Data(data), "booter_sig_prod", dir)
+		s.Infof("%s: booter ucode for engine %d, ucode id %d, %d signatures\n",
+			dir, b.EngineId, b.UcodeId, b.NumSig)
+		info = b
+	} else {
+		return nil
+	}
+	desc, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.WriteFile(path.Join(dir, "info.json"), append(desc, '\n'))
+	return nil
+}
+
+// The file an ELF section is written to: its name without the dot,
+// and with nothing in it taken for a directory
+func sectionFile(name string) string {
+	name = strings.Replace(strings.TrimPrefix(name, "."), "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		name = "unnamed"
+	}
+	return name
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "path"
+import "github.com/envytools/firmware/pkg/classify"
+
+// A container format that carries firmware of its own, such as an ACR
+// image. Each whole blob that isn't a known one is offered to the
+// registered handlers in turn, and the first that detects its format
+// takes it apart.
+type Handler interface {
+	Detect(data []byte) bool
+	Extract(data []byte, sink *Sink) error
+}
+
+type registered struct {
+	category string
+	handler Handler
+}
+
+var handlers []registered
+
+// Add a handler for blobs of a category, which -only and -exclude go
+// by. A new category is added to the ones they accept.
+func RegisterHandler(category string, h Handler) {
+	known := false
+	for _, name := range classify.CategoryNames {
+		known = known || name == category
+	}
+	if !known {
+		classify.CategoryNames = append(classify.CategoryNames, category)
+	}
+	handlers = append(handlers, registered{category, h})
+}
+
+// What a Handler writes the parts of a blob through. They are all
+// recorded as coming from where the blob came from.
+type Sink struct {
+	p *Processor
+	origin Origin
+}
+
+// Returns base the first time it is asked for, and base_N after that,
+// so that blobs of the same kind don't overwrite each other.
+func (s *Sink) UniqueName(base string) string {
+	return s.p.uniqueName(base)
+}
+
+// Write out a part and record it in the manifest with its type, and
+// the directory it is in if it's part of a container.
+func (s *Sink) Emit(name string, data []byte, typ, container string) {
+	s.p.emit(name, data, s.origin, typ, container)
+}
+
+// Write out a file that isn't firmware, such as notes about the
+// parts, without recording it in the manifest. Like failing to write
+// out a part, failing to write it stops the scan.
+func (s *Sink) WriteFile(name string, data []byte) {
+	s.p.fail(s.p.writeFile(name, data))
+}
+
+// Print a note about what was found, as with the other blobs
+func (s *Sink) Infof(format string, args ...interface{}) {
+	s.p.infof(format, args...)
+}
+
+// Offer data to the handlers. Returns whether one of them took it.
+func (p *Processor) handle(data []byte, origin Origin) bool {
+	for _, r := range handlers {
+		if !r.handler.Detect(data) {
+			continue
+		}
+		if p.wanted(r.category, origin) {
+			if err := r.handler.Extract(data, &Sink{p, origin}); err != nil {
+				p.problem(origin, "blob", "%v", err)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func init() {
+	RegisterHandler("acr", wprHandler{})
+}
+
+// ACR images get split up into the LS falcons they carry: the ucode,
+// data and signature of each, and what its LSB header says about it.
+type wprHandler struct{}
+
+func (wprHandler) Detect(data []byte) bool {
+	_, ok := classify.ParseWPR(data)
+	return ok
+}
+
+func (wprHandler) Extract(data []byte, s *Sink) error {
+	falcons, _ := classify.ParseWPR(data)
+	dir := s.UniqueName("wpr")
+	s.Emit(path.Join(dir, "image"), data, "wpr", dir)
+	var info bytes.Buffer
+	for _, f := range falcons {
+		name := classify.FalconNames[f.FalconId]
+		lsb := f.LSB
+		ucode := data[lsb.UcodeOff:lsb.UcodeOff+lsb.UcodeSize]
+		s.Emit(path.Join(dir, name + "_ucode"), ucode, "ls_ucode", dir)
+		if lsb.DataSize != 0 {
+			start := lsb.UcodeOff + lsb.UcodeSize
+			s.Emit(path.Join(dir, name + "_data"),
+				data[start:start+lsb.DataSize], "ls_data", dir)
+		}
+		s.Emit(path.Join(dir, name + "_sig"), f.Signature, "ls_sig", dir)
+		fmt.Fprintf(&info, "%s: ucode 0x%x+0x%x data 0x%x bl_code 0x%x " +
+			"bl_imem 0x%x bl_data 0x%x+0x%x app_code 0x%x+0x%x " +
+			"app_data 0x%x+0x%x flags 0x%x\n", name,
+			lsb.UcodeOff, lsb.UcodeSize, lsb.DataSize, lsb.BLCodeSize,
+			lsb.BLImemOff, lsb.BLDataOff, lsb.BLDataSize,
+			lsb.AppCodeOff, lsb.AppCodeSize, lsb.AppDataOff,
+			lsb.AppDataSize, lsb.Flags)
+	}
+	s.WriteFile(path.Join(dir, "info.txt"), info.Bytes())
+	s.Infof("%s: ACR image with %d LS falcons\n", dir, len(falcons))
+	return nil
+}
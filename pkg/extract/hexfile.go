@@ -0,0 +1,152 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "path"
+import "regexp"
+import "strings"
+
+// The formats -emit-hex writes, and the extension of each
+var HexFormats = map[string]string{
+	"ihex": ".hex",
+	"srec": ".srec",
+}
+
+// Bytes per data record, as most tools write them
+const hexRecordSize = 16
+
+// Falcon data segments, as nouveau and linux-firmware name them:
+// fuc409d, fecs_data.bin, ...
+var dataSegmentRe = regexp.MustCompile(`(^fuc[0-9a-f]+d|_data|_data\.bin)$`)
+
+// Whether a file is the data segment of a falcon program, which is
+// loaded at a base of its own
+func isDataSegment(name string) bool {
+	base := path.Base(name)
+	if i := strings.LastIndex(base, "_fuc"); i >= 0 {
+		base = base[i+1:]
+	}
+	return dataSegmentRe.MatchString(base)
+}
+
+// One Intel HEX record, with its checksum
+func ihexRecord(w *bytes.Buffer, typ byte, addr uint16, data []byte) {
+	sum := byte(len(data)) + byte(addr >> 8) + byte(addr) + typ
+	fmt.Fprintf(w, ":%02X%04X%02X", len(data), addr, typ)
+	for _, b := range data {
+		fmt.Fprintf(w, "%02X", b)
+		sum += b
+	}
+	fmt.Fprintf(w, "%02X\n", -sum)
+}
+
+// Intel HEX, with extended linear address records whenever the upper
+// 16 bits of the address change
+func encodeIHex(data []byte, base uint32) []byte {
+	var w bytes.Buffer
+	upper := uint32(0)
+	for off := 0; off < len(data); {
+		addr := base + uint32(off)
+		if addr >> 16 != upper {
+			upper = addr >> 16
+			ihexRecord(&w, 4, 0, []byte{byte(upper >> 8), byte(upper)})
+		}
+		// A record can't cross into the next 64KiB
+		n := hexRecordSize
+		if left := len(data) - off; n > left {
+			n = left
+		}
+		if room := 0x10000 - int(addr & 0xffff); n > room {
+			n = room
+		}
+		ihexRecord(&w, 0, uint16(addr), data[off:off+n])
+		off += n
+	}
+	ihexRecord(&w, 1, 0, nil)
+	return w.Bytes()
+}
+
+// One Motorola S-record with a 32-bit address, or 16-bit for S0
+func srecRecord(w *bytes.Buffer, typ int, addr uint32, data []byte) {
+	addrLen := 4
+	if typ == 0 {
+		addrLen = 2
+	}
+	count := addrLen + len(data) + 1
+	sum := byte(count)
+	fmt.Fprintf(w, "S%d%02X", typ, count)
+	for i := addrLen - 1; i >= 0; i-- {
+		b := byte(addr >> (8 * uint(i)))
+		fmt.Fprintf(w, "%02X", b)
+		sum += b
+	}
+	for _, b := range data {
+		fmt.Fprintf(w, "%02X", b)
+		sum += b
+	}
+	fmt.Fprintf(w, "%02X\n", ^sum)
+}
+
+// S-records: an S0 header with the file's name, S3 data records and
+// an S7 record pointing at the base
+func encodeSRec(name string, data []byte, base uint32) []byte {
+	var w bytes.Buffer
+	header := []byte(path.Base(name))
+	if len(header) > 64 {
+		header = header[:64]
+	}
+	srecRecord(&w, 0, 0, header)
+	for off := 0; off < len(data); off += hexRecordSize {
+		end := off + hexRecordSize
+		if end > len(data) {
+			end = len(data)
+		}
+		srecRecord(&w, 3, base + uint32(off), data[off:end])
+	}
+	srecRecord(&w, 7, base, nil)
+	return w.Bytes()
+}
+
+// Write a file out in HexFormat too, for -emit-hex, at HexBase, or
+// HexDataBase for falcon data segments
+func (p *Processor) writeHex(name string, data []byte) error {
+	base := p.HexBase
+	if isDataSegment(name) {
+		base = p.HexDataBase
+	}
+	if uint64(base) + uint64(len(data)) > 1 << 32 {
+		p.warnf("%s: doesn't fit below 4GiB at 0x%x, leaving out its %s file\n",
+			name, base, p.HexFormat)
+		return nil
+	}
+	var out []byte
+	switch p.HexFormat {
+	case "ihex":
+		out = encodeIHex(data, base)
+	case "srec":
+		out = encodeSRec(name, data, base)
+	default:
+		return nil
+	}
+	return p.writeFile(name + HexFormats[p.HexFormat], out)
+}
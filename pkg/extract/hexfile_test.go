@@ -0,0 +1,94 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "testing"
+
+// Bytes 0 to n-1
+func testCount(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// The records are what objcopy -I binary writes for the same data,
+// but for the extended linear address record, where it uses an
+// extended segment one
+func TestEncodeIHex(t *testing.T) {
+	tests := []struct {
+		name string
+		base uint32
+		want string
+	}{
+		{"at 0", 0, "" +
+			":10000000000102030405060708090A0B0C0D0E0F78\n" +
+			":0400100010111213A6\n" +
+			":00000001FF\n"},
+		{"across 0xFFFF", 0xfff8, "" +
+			":08FFF8000001020304050607E5\n" +
+			":020000040001F9\n" +
+			":0C00000008090A0B0C0D0E0F1011121352\n" +
+			":00000001FF\n"},
+		{"above 0xFFFF", 0x10000, "" +
+			":020000040001F9\n" +
+			":10000000000102030405060708090A0B0C0D0E0F78\n" +
+			":0400100010111213A6\n" +
+			":00000001FF\n"},
+	}
+	for _, test := range tests {
+		if got := string(encodeIHex(testCount(20), test.base)); got != test.want {
+			t.Errorf("%s: got\n%swant\n%s", test.name, got, test.want)
+		}
+	}
+	if got, want := string(encodeIHex(nil, 0)), ":00000001FF\n"; got != want {
+		t.Errorf("empty: got %q, want %q", got, want)
+	}
+}
+
+// The data and S7 records are what objcopy -O srec --srec-forceS3
+// writes for the same data
+func TestEncodeSRec(t *testing.T) {
+	tests := []struct {
+		name string
+		base uint32
+		want string
+	}{
+		{"at 0", 0, "" +
+			"S00C0000666563735F696E737435\n" +
+			"S31500000000000102030405060708090A0B0C0D0E0F72\n" +
+			"S3090000001010111213A0\n" +
+			"S70500000000FA\n"},
+		{"across 0xFFFF", 0xfff8, "" +
+			"S00C0000666563735F696E737435\n" +
+			"S3150000FFF8000102030405060708090A0B0C0D0E0F7B\n" +
+			"S3090001000810111213A7\n" +
+			"S7050000FFF803\n"},
+	}
+	for _, test := range tests {
+		got := string(encodeSRec("gr/fecs_inst", testCount(20), test.base))
+		if got != test.want {
+			t.Errorf("%s: got\n%swant\n%s", test.name, got, test.want)
+		}
+	}
+}
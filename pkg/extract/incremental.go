@@ -0,0 +1,241 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+
+// Scanning again into the same directory, as when working on the
+// scanner or rebuilding firmware packages from it, rewrites every file
+// by default. With Incremental set, a file that already holds what
+// would be written is left alone, so its mtime stays the same and
+// whatever builds on the output has nothing to redo. Only files that
+// are new or different get written, and when there was an earlier run
+// to compare with, they are logged as such.
+
+// Whether an incremental run can skip writing name, because the file
+// already holds data. Counts it as unchanged, changed or new.
+func (p *Processor) unchanged(name string, data []byte) bool {
+	if !p.incremental() {
+		return false
+	}
+	old, err := ioutil.ReadFile(path.Join(p.Destdir, name))
+	return p.compared(name, err, err == nil && bytes.Equal(old, data))
+}
+
+// Same as unchanged, for a blob that was decompressed into a file and
+// is known by its hash
+func (p *Processor) unchangedFile(name string, hash string, size int64) bool {
+	if !p.incremental() {
+		return false
+	}
+	fname := path.Join(p.Destdir, name)
+	info, err := os.Lstat(fname)
+	same := false
+	if err == nil && info.Mode().IsRegular() && info.Size() == size {
+		old, err := hashFile(fname)
+		same = err == nil && old == hash
+	}
+	return p.compared(name, err, same)
+}
+
+// Same as unchanged, for a duplicate written as a link to first
+func (p *Processor) unchangedLink(name, first string) bool {
+	if !p.incremental() {
+		return false
+	}
+	fname := path.Join(p.Destdir, name)
+	info, err := os.Lstat(fname)
+	same := false
+	if err == nil {
+		switch p.Dedup {
+		case "hardlink":
+			orig, err := os.Stat(path.Join(p.Destdir, first))
+			same = err == nil && os.SameFile(info, orig)
+		case "symlink":
+			target, err := os.Readlink(fname)
+			want, _ := filepath.Rel(path.Dir(name), first)
+			same = err == nil && target == want
+		}
+	}
+	return p.compared(name, err, same)
+}
+
+func (p *Processor) incremental() bool {
+	return p.Incremental && p.Output == nil && !p.DryRun && p.Visit == nil
+}
+
+// Count what comparing with the earlier run's file turned up. err is
+// from looking for that file.
+func (p *Processor) compared(name string, err error, same bool) bool {
+	if p.previous == nil {
+		p.loadPrevious()
+	}
+	switch {
+	case same:
+		p.Stats.Unchanged++
+	case err == nil:
+		p.Stats.Changed++
+		if p.rerun() {
+			p.infof("%s: changed\n", name)
+		} else {
+			// Not from an earlier scan, so it's worth saying
+			p.infof("%s: replaced\n", name)
+		}
+	default:
+		p.Stats.Added++
+		if p.rerun() {
+			p.infof("%s: new\n", name)
+		}
+	}
+	return same
+}
+
+// Whether there was an earlier run into Destdir
+func (p *Processor) rerun() bool {
+	return len(p.previous) != 0
+}
+
+// Note down what the earlier run's manifest has, to tell what it
+// wrote that this one didn't
+func (p *Processor) loadPrevious() {
+	p.previous = make(map[string]bool)
+	data, err := ioutil.ReadFile(path.Join(p.Destdir, "manifest.json"))
+	if err != nil {
+		return
+	}
+	var entries []ManifestEntry
+	if json.Unmarshal(data, &entries) != nil {
+		return
+	}
+	for _, e := range entries {
+		p.previous[e.Path] = true
+	}
+}
+
+// The files in the manifest of the run an incremental one went over
+// again that it didn't write this time. They are left in place.
+func (p *Processor) Stale() []string {
+	return p.stale()
+}
+
+func (p *Processor) stale() []string {
+	current := make(map[string]bool)
+	for _, e := range p.Manifest {
+		current[e.Path] = true
+	}
+	var stale []string
+	for name := range p.previous {
+		if !current[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Note down that name is part of this run's output
+func (p *Processor) wrote(name string) {
+	if p.outputs == nil {
+		p.outputs = make(map[string]bool)
+	}
+	p.outputs[name] = true
+}
+
+// Whether dir is fit to scan into without -force or -clean: missing,
+// empty, or holding an earlier scan's output, with its manifest.json,
+// for Incremental to go over again
+func CheckOutputDir(dir string) error {
+	dirents, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(dirents) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(path.Join(dir, "manifest.json")); err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s isn't empty, and isn't the output of an earlier scan", dir)
+}
+
+// With Clean, remove every file in Destdir this run didn't write or
+// find already written, and the directories that leaves empty, each
+// logged as it goes. Call it once everything has been written. Returns
+// the first error removing something; the rest are still tried.
+func (p *Processor) Tidy() error {
+	if !p.Clean || p.DryRun || p.Output != nil || p.Destdir == "" {
+		return nil
+	}
+	var first error
+	fail := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	var dirs []string
+	err := filepath.Walk(p.Destdir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.Destdir, fname)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		switch {
+		case name == ".":
+		case info.IsDir():
+			dirs = append(dirs, fname)
+		case !p.outputs[name]:
+			if err := os.Remove(fname); err != nil {
+				fail(err)
+				break
+			}
+			p.Stats.Removed++
+			p.infof("%s: removed, not written this time\n", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Deepest first, so that a directory's own directories are gone
+	// by the time it's tried. Ones with anything left in them stay.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirents, err := ioutil.ReadDir(dirs[i]); err == nil && len(dirents) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				fail(err)
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// Unpack the self test's archive into dir as scan -incremental would,
+// with -clean if clean is set
+func testIncremental(t *testing.T, dir string, data []byte, clean bool) *Processor {
+	opts := DefaultOptions()
+	opts.LogLevel = LogError
+	p := &Processor{Destdir: dir, Incremental: true, Clean: clean, Options: &opts}
+	if err := p.ProcessArchive(data, Origin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Tidy(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Each file under dir, with its mtime
+func testMtimes(t *testing.T, dir string) map[string]time.Time {
+	mtimes := make(map[string]time.Time)
+	err := filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, fname)
+			mtimes[filepath.ToSlash(rel)] = info.ModTime()
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mtimes
+}
+
+// Set every file under dir back to long ago, so that a rewrite shows
+// without waiting for the clock to tick over
+func testAge(t *testing.T, dir string) time.Time {
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name := range testMtimes(t, dir) {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return old
+}
+
+func TestIncremental(t *testing.T) {
+	dir := t.TempDir()
+	data := selfTestArchive()
+	p := testIncremental(t, dir, data, false)
+	if p.Stats.Added == 0 || p.Stats.Unchanged != 0 || p.Stats.Changed != 0 {
+		t.Fatalf("first run: %d added, %d unchanged, %d changed; want all added",
+			p.Stats.Added, p.Stats.Unchanged, p.Stats.Changed)
+	}
+	written := p.Stats.Added
+
+	// The same again leaves every file alone
+	old := testAge(t, dir)
+	p = testIncremental(t, dir, data, false)
+	if p.Stats.Unchanged != written || p.Stats.Changed != 0 || p.Stats.Added != 0 {
+		t.Errorf("identical run: %d unchanged, %d changed, %d added; want %d unchanged",
+			p.Stats.Unchanged, p.Stats.Changed, p.Stats.Added, written)
+	}
+	for name, mtime := range testMtimes(t, dir) {
+		if !mtime.Equal(old) {
+			t.Errorf("identical run: %s rewritten", name)
+		}
+	}
+
+	// A blob that changed is written again, and only that and the
+	// manifest with its hash in it
+	changed := append([]byte(nil), data...)
+	changed[0x101] ^= 0xff
+	old = testAge(t, dir)
+	p = testIncremental(t, dir, changed, false)
+	if p.Stats.Changed != 2 || p.Stats.Unchanged != written - 2 {
+		t.Errorf("changed run: %d changed, %d unchanged; want 2 and %d",
+			p.Stats.Changed, p.Stats.Unchanged, written - 2)
+	}
+	for name, mtime := range testMtimes(t, dir) {
+		rewritten := !mtime.Equal(old)
+		want := name == "fecs_data" || name == "manifest.json"
+		if rewritten != want {
+			t.Errorf("changed run: %s rewritten %v, want %v", name, rewritten, want)
+		}
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "fecs_data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1] != changed[0x101] {
+		t.Errorf("changed run: fecs_data still holds the old data")
+	}
+
+	// A file the scan doesn't write stays, unless it cleans up, which
+	// takes the directory it leaves empty too
+	stray := filepath.Join(dir, "old", "stray")
+	if err := os.Mkdir(filepath.Dir(stray), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(stray, []byte("stray\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p = testIncremental(t, dir, changed, false)
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("run without Clean: %v", err)
+	}
+	p = testIncremental(t, dir, changed, true)
+	if _, err := os.Stat(filepath.Dir(stray)); !os.IsNotExist(err) {
+		t.Errorf("run with Clean: stray file's directory left, %v", err)
+	}
+	if p.Stats.Removed != 1 {
+		t.Errorf("run with Clean: %d removed, want 1", p.Stats.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "fecs_data")); err != nil {
+		t.Errorf("run with Clean: %v", err)
+	}
+}
+
+func TestCheckOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := CheckOutputDir(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("missing directory: %v", err)
+	}
+	if err := CheckOutputDir(dir); err != nil {
+		t.Errorf("empty directory: %v", err)
+	}
+	other := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(other, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckOutputDir(dir); err == nil {
+		t.Errorf("directory with something else in it: no error")
+	}
+	// An earlier scan's output is fine, whatever else is in it
+	testIncremental(t, dir, selfTestArchive(), false)
+	if err := CheckOutputDir(dir); err != nil {
+		t.Errorf("earlier scan's output: %v", err)
+	}
+	if err := CheckOutputDir(other); err == nil {
+		t.Errorf("a file: no error")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "context"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// One archive's version of a nouveau firmware file
+type nouveauFile struct {
+	Archive string
+	Data []byte
+}
+
+// Where a chipset's nouveau files go in the firmware directory
+func (p *Processor) nouveauPrefix() string {
+	return path.Join("nouveau", p.Chipset.Name()) + "_"
+}
+
+// Check the nouveau firmware installed in a firmware directory, like
+// /lib/firmware, against what the driver (or object) has for Chipset.
+// Returns a line for each file that is missing, differs from all of
+// the driver's copies, is a truncated copy, or isn't in the driver.
+// Only the files that differ or are truncated are problems; the rest
+// are notes.
+func (p *Processor) CheckInstalled(ctx context.Context, input, fwdir string) (problems, notes []string, err error) {
+	if p.Chipset == nil {
+		return nil, nil, fmt.Errorf("no chipset to check the firmware of")
+	}
+	if p.Chipset.Signed() {
+		return nil, nil, fmt.Errorf("%s's GR firmware is signed, and only comes from linux-firmware",
+			p.Chipset.Codename)
+	}
+	tmp, err := ioutil.TempDir("", "scanner-check")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmp)
+	p.Destdir = tmp
+	p.Nouveau = true
+
+	// Every archive writes the nouveau files under its own directory
+	prefix := p.nouveauPrefix()
+	expected := make(map[string][]nouveauFile)
+	p.Visit = func(b Blob) error {
+		if b.Type != "nouveau" {
+			return nil
+		}
+		name := b.Path
+		if i := strings.Index(name, "/" + prefix); i >= 0 {
+			name = name[i+1:]
+		} else if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		data, err := ioutil.ReadAll(b.Data)
+		if err != nil {
+			return err
+		}
+		expected[name] = append(expected[name], nouveauFile{b.Archive, data})
+		return nil
+	}
+	defer func() { p.Visit = nil }()
+	if err := p.scanInput(ctx, input); err != nil {
+		return nil, nil, err
+	}
+	if len(expected) == 0 {
+		return nil, nil, fmt.Errorf("%s: no %s firmware found", input, p.Chipset.Codename)
+	}
+
+	installed, _ := filepath.Glob(path.Join(fwdir, prefix) + "*")
+	seen := make(map[string]bool)
+	for _, fname := range installed {
+		name, err := filepath.Rel(fwdir, fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = filepath.ToSlash(name)
+		seen[name] = true
+		files, ok := expected[name]
+		if !ok {
+			notes = append(notes, "not in the driver: " + name)
+			continue
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if problem := checkNouveauFile(name, data, files); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for name := range expected {
+		if !seen[name] {
+			notes = append(notes, "not installed: " + name)
+		}
+	}
+	sort.Strings(problems)
+	sort.Strings(notes)
+	return problems, notes, nil
+}
+
+// What's wrong with an installed file, given the driver's copies, or
+// "" if it is one of them
+func checkNouveauFile(name string, data []byte, files []nouveauFile) string {
+	for _, f := range files {
+		if bytes.Equal(data, f.Data) {
+			return ""
+		}
+	}
+	for _, f := range files {
+		// Code is padded, so a cut short file may end in zeroes
+		// the driver's copy doesn't have
+		trimmed := bytes.TrimRight(data, "\x00")
+		if len(data) < len(f.Data) && bytes.HasPrefix(f.Data, trimmed) {
+			return fmt.Sprintf("truncated: %s (%d bytes, %s has %d)",
+				name, len(data), archiveLabel(f.Archive), len(f.Data))
+		}
+	}
+	var sizes []string
+	for _, f := range files {
+		sizes = append(sizes, fmt.Sprintf("%s %d bytes",
+			archiveLabel(f.Archive), len(f.Data)))
+	}
+	return fmt.Sprintf("differs: %s (%d bytes; %s)", name, len(data),
+		strings.Join(sizes, ", "))
+}
+
+func archiveLabel(archive string) string {
+	if archive == "" {
+		return "the driver"
+	}
+	return archive
+}
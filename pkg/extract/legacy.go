@@ -0,0 +1,452 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "compress/flate"
+import "compress/zlib"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "strconv"
+import "strings"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// The driver versions extract_firmware.py was tested against, which
+// produce the same binaries. The firmware changes fairly rarely, and
+// when it does, the starts of it remain the same, but the sizes can be
+// different.
+var legacyVersions = []string{"319.17", "319.23", "319.32", "325.08",
+	"325.15", "340.32", "340.108"}
+
+// Branches before this one only have PGRAPH context programs, from
+// before there were falcons, and no video firmware
+const legacyCtxprogBefore = 180
+
+// What nouveau calls the GR falcon code and data in an archive, by id
+var legacyArchiveFiles = map[int32]string{
+	0: "fuc409d",
+	1: "fuc409c",
+	2: "fuc41ad",
+	3: "fuc41ac",
+}
+
+// Video firmware in an old driver, found by how it starts and cut to
+// a fixed length. Some starts are shared, and which blob it is is told
+// by a byte further in.
+type legacyBlob struct {
+	name string
+	// In libnvcuvid rather than the kernel object
+	user bool
+	start []byte
+	length int
+	// Whether the blob at i is this one. Drivers before 330 have
+	// some of the telling bytes a little earlier.
+	pred func(data []byte, i int, old bool) bool
+	links []string
+}
+
+var (
+	vp2KernelPrefix = []byte("\xcd\xab\x55\xee\x44")
+	vp2UserPrefix = []byte("\xce\xab\x55\xee\x20\x00\x00\xd0\x00\x00\x00\xd0")
+	vp4KernelPrefix = []byte("\xf1\x97\x00\x42\xcf\x99")
+	vp3UserPrefix = []byte("\x64\x00\xf0\x20\x64\x00\xf1\x20\x64\x00\xf2\x20")
+	vp3VC1Prefix = []byte("\x43\x00\x00\x34\x43\x00\x00\x34")
+)
+
+// Chipsets to link each blob to, since the fuc loader expects
+// nvXX_fucXXX files
+var (
+	vp2Chips = []string{"nv84"} // there are more, but no need for more symlinks
+	vp3Chips = []string{"nv98", "nvaa", "nvac"}
+	vp40Chips = []string{"nva3", "nva5", "nva8", "nvaf"} // nvaf is 4.1, but same fw
+	vp42Chips = []string{"nvc0", "nvc1", "nvc3", "nvc4", "nvc8", "nvce", "nvcf"}
+	vp5Chips = []string{"nvd7", "nvd9", "nve4", "nve6", "nve7", "nvf0", "nvf1",
+		"nv106", "nv108"}
+)
+
+func legacyLinks(chips []string, tail string) []string {
+	var links []string
+	for _, chip := range chips {
+		links = append(links, chip + "_" + tail)
+	}
+	return links
+}
+
+// Whether data[off] is b
+func at(data []byte, off int, b byte) bool {
+	return off >= 0 && off < len(data) && data[off] == b
+}
+
+// 340 has these further in than 325. 330 is a guess at the cutoff.
+func vp3Offset(old bool) int {
+	if old {
+		return 2287
+	}
+	return 2286
+}
+
+func vp5Offset(old bool) int {
+	if old {
+		return 0xb3
+	}
+	return 0xb7
+}
+
+func atFixed(off int, b byte) func([]byte, int, bool) bool {
+	return func(data []byte, i int, old bool) bool {
+		return at(data, i + off, b)
+	}
+}
+
+func atVP3(b byte) func([]byte, int, bool) bool {
+	return func(data []byte, i int, old bool) bool {
+		return at(data, i + vp3Offset(old), b)
+	}
+}
+
+func atVP5(b byte) func([]byte, int, bool) bool {
+	return func(data []byte, i int, old bool) bool {
+		return at(data, i + vp5Offset(old), b)
+	}
+}
+
+func atBoth(off1 int, b1 byte, off2 int, b2 byte) func([]byte, int, bool) bool {
+	return func(data []byte, i int, old bool) bool {
+		return at(data, i + off1, b1) && at(data, i + off2, b2)
+	}
+}
+
+func prefixed(prefix []byte, b ...byte) []byte {
+	return append(append([]byte(nil), prefix...), b...)
+}
+
+var legacyBlobs = []legacyBlob{
+	// VP2 kernel xuc
+	{name: "nv84_bsp", start: prefixed(vp2KernelPrefix, 0x46), length: 0x16f3c,
+		links: legacyLinks(vp2Chips, "xuc103")},
+	{name: "nv84_vp", start: prefixed(vp2KernelPrefix, 0x7c), length: 0x1ae6c,
+		links: legacyLinks(vp2Chips, "xuc00f")},
+
+	// VP3 kernel fuc
+	{name: "nv98_bsp", start: []byte("\xf1\x07\x00\x10\xf1\x03\x00\x00"),
+		length: 0xac00, pred: atVP3(0x8e), links: legacyLinks(vp3Chips, "fuc084")},
+	{name: "nv98_vp", start: []byte("\xf1\x07\x00\x10\xf1\x03\x00\x00"),
+		length: 0xa500, pred: atVP3(0x95), links: legacyLinks(vp3Chips, "fuc085")},
+	{name: "nv98_ppp", start: []byte("\xf1\x07\x00\x08\xf1\x03\x00\x00"),
+		length: 0x3800, pred: atVP3(0x30), links: legacyLinks(vp3Chips, "fuc086")},
+
+	// VP4.0 kernel fuc
+	{name: "nva3_bsp", start: vp4KernelPrefix, length: 0x10200,
+		pred: atFixed(8 * 11 + 1, 0xcf), links: legacyLinks(vp40Chips, "fuc084")},
+	{name: "nva3_vp", start: vp4KernelPrefix, length: 0xc600,
+		pred: atFixed(8 * 11 + 1, 0x9e), links: legacyLinks(vp40Chips, "fuc085")},
+	{name: "nva3_ppp", start: vp4KernelPrefix, length: 0x3f00,
+		pred: atFixed(8 * 11 + 1, 0x36), links: legacyLinks(vp40Chips, "fuc086")},
+
+	// VP4.2 kernel fuc
+	{name: "nvc0_bsp", start: vp4KernelPrefix, length: 0x10d00,
+		pred: atFixed(0x59, 0xd8), links: legacyLinks(vp42Chips, "fuc084")},
+	{name: "nvc0_vp", start: vp4KernelPrefix, length: 0xd300,
+		pred: atFixed(0x59, 0xa5), links: legacyLinks(vp42Chips, "fuc085")},
+	{name: "nvc0_ppp", start: vp4KernelPrefix, length: 0x4100,
+		pred: atFixed(0x59, 0x38),
+		links: append(legacyLinks(vp42Chips, "fuc086"), legacyLinks(vp5Chips, "fuc086")...)},
+
+	// VP5 kernel fuc
+	{name: "nve0_bsp", start: vp4KernelPrefix, length: 0x11c00,
+		pred: atVP5(0x27), links: legacyLinks(vp5Chips, "fuc084")},
+	{name: "nve0_vp", start: vp4KernelPrefix, length: 0xdd00,
+		pred: atVP5(0x0a), links: legacyLinks(vp5Chips, "fuc085")},
+
+	// VP2 user xuc
+	{name: "nv84_bsp-h264", user: true, start: prefixed(vp2UserPrefix, 0x88), length: 0xd9d0},
+	{name: "nv84_vp-h264-1", user: true, start: prefixed(vp2UserPrefix, 0x3c), length: 0x1f334},
+	{name: "nv84_vp-h264-2", user: true, start: prefixed(vp2UserPrefix, 0x04), length: 0x1bffc},
+	{name: "nv84_vp-mpeg12", user: true, start: prefixed(vp2UserPrefix, 0x4c), length: 0x22084},
+	{name: "nv84_vp-vc1-1", user: true, start: prefixed(vp2UserPrefix, 0x7c), length: 0x2cd24},
+	{name: "nv84_vp-vc1-2", user: true, start: prefixed(vp2UserPrefix, 0xa4), length: 0x1535c},
+	{name: "nv84_vp-vc1-3", user: true, start: prefixed(vp2UserPrefix, 0x34), length: 0x133bc},
+
+	// VP3 user vuc
+	{name: "vuc-vp3-mpeg12-0", user: true, start: vp3UserPrefix, length: 0xb00,
+		pred: atBoth(11 * 8, 0x4a, 228, 0x43)},
+	{name: "vuc-vp3-h264-0", user: true, start: vp3UserPrefix, length: 0x1600,
+		pred: atBoth(11 * 8 + 1, 0xff, 225, 0x81)},
+	{name: "vuc-vp3-vc1-0", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x1d00, pred: atFixed(11 * 8 + 1, 0xf4)},
+	{name: "vuc-vp3-vc1-1", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x2100, pred: atFixed(11 * 8 + 1, 0x34)},
+	{name: "vuc-vp3-vc1-2", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x2300, pred: atFixed(11 * 8 + 1, 0x98)},
+
+	// VP4.x user vuc
+	{name: "vuc-vp4-mpeg12-0", user: true, start: vp3UserPrefix, length: 0xc00,
+		pred: atBoth(11 * 8, 0x4a, 228, 0x44), links: []string{"vuc-mpeg12-0"}},
+	{name: "vuc-vp4-h264-0", user: true, start: vp3UserPrefix, length: 0x1900,
+		pred: atBoth(11 * 8 + 1, 0xff, 225, 0x8c), links: []string{"vuc-h264-0"}},
+	{name: "vuc-vp4-mpeg4-0", user: true, start: vp3UserPrefix, length: 0x1d00,
+		pred: atBoth(61, 0x30, 6923, 0x00), links: []string{"vuc-mpeg4-0"}},
+	{name: "vuc-vp4-mpeg4-1", user: true, start: vp3UserPrefix, length: 0x1d00,
+		pred: atBoth(61, 0x30, 6923, 0x20), links: []string{"vuc-mpeg4-1"}},
+	{name: "vuc-vp4-vc1-0", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x1d00, pred: atFixed(11 * 8 + 1, 0xb4), links: []string{"vuc-vc1-0"}},
+	{name: "vuc-vp4-vc1-1", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x2100, pred: atFixed(11 * 8 + 1, 0x08), links: []string{"vuc-vc1-1"}},
+	{name: "vuc-vp4-vc1-2", user: true, start: prefixed(vp3VC1Prefix, vp3UserPrefix...),
+		length: 0x2100, pred: atFixed(11 * 8 + 1, 0x6c), links: []string{"vuc-vc1-2"}},
+}
+
+// Extract firmware the way extract_firmware.py did, for the drivers of
+// its time (319.x to 340.x): the video firmware at fixed sizes from
+// where it starts, from the kernel object and libnvcuvid (user, which
+// may be nil), and the GR firmware from the gzipped netlist archives,
+// as nvXX_fucXXXX files. Which chipset each archive is for comes from
+// the ArchiveOrder quirk for p.Version. Drivers from before Fermi only
+// get their context programs taken out, see ctxprog.go.
+func (p *Processor) Legacy(kernel, user []byte) error {
+	major, _ := strconv.Atoi(strings.SplitN(p.Version, ".", 2)[0])
+	if major != 0 && major < legacyCtxprogBefore {
+		p.legacyCtxprogs(kernel)
+		return p.err
+	}
+	tested := false
+	for _, v := range legacyVersions {
+		tested = tested || v == p.Version
+	}
+	if !tested {
+		p.warnf("not tested with driver %q, double-check the sizes\n", p.Version)
+	}
+	old := major != 0 && major < 330
+
+	gzips := legacyGzips(kernel)
+	for _, b := range legacyBlobs {
+		data := kernel
+		if b.user {
+			data = user
+		}
+		i := legacyFind(data, b, old)
+		var wrapped *legacyGzip
+		if i < 0 && !b.user {
+			wrapped, data, i = legacyFindWrapped(gzips, b, old)
+		}
+		if i < 0 {
+			p.infof("Firmware %s not found, ignoring.\n", b.name)
+			continue
+		}
+		end := i + b.length
+		if end > len(data) {
+			end = len(data)
+		}
+		origin := Origin{Offset: int64(i), CompressedSize: end - i,
+			Codec: "stored"}
+		if wrapped != nil {
+			origin = Origin{Offset: int64(wrapped.start),
+				CompressedSize: wrapped.end - wrapped.start, Codec: "gzip"}
+			p.infof("%s: from the zlib stream in the gzip blob at 0x%x\n",
+				b.name, wrapped.start)
+		}
+		p.emit(b.name, data[i:end], origin, b.name, "")
+		if p.DryRun || p.Visit != nil {
+			continue
+		}
+		for _, link := range b.links {
+			p.wrote(link)
+			p.fail(p.output().Symlink(link, b.name))
+		}
+	}
+	p.legacyArchives(gzips)
+	return p.err
+}
+
+// Where blob b starts in data, or -1
+func legacyFind(data []byte, b legacyBlob, old bool) int {
+	for off := 0; off < len(data); {
+		i := bytes.Index(data[off:], b.start)
+		if i < 0 {
+			return -1
+		}
+		i += off
+		if b.pred == nil || b.pred(data, i, old) {
+			return i
+		}
+		off = i + 1
+	}
+	return -1
+}
+
+// Pull the GR falcon firmware out of each gzipped netlist archive in
+// the kernel object, named after the chipset it's for if the quirks
+// say, or blobN if not.
+// A gzip stream in the kernel object, at start to end, and what it
+// inflates to
+type legacyGzip struct {
+	start, end int
+	data []byte
+}
+
+// Inflate every gzip stream in the kernel object. There's no telling
+// where one ends but by where the next starts.
+func legacyGzips(kernel []byte) []legacyGzip {
+	var starts []int
+	magic := []byte("\x1f\x8b\x08")
+	for off := 0; ; {
+		i := bytes.Index(kernel[off:], magic)
+		if i < 0 {
+			break
+		}
+		starts = append(starts, off + i)
+		off += i + 1
+	}
+	var gzips []legacyGzip
+	for n, start := range starts {
+		end := len(kernel)
+		if n + 1 < len(starts) {
+			end = starts[n + 1]
+		}
+		// Skip the gzip header, which has no name or extras here
+		if end - start <= 10 {
+			continue
+		}
+		data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(kernel[start + 10:end])))
+		if err != nil && len(data) == 0 {
+			continue
+		}
+		gzips = append(gzips, legacyGzip{start, end, data})
+	}
+	return gzips
+}
+
+// How far into a gzip stream's contents the zlib stream can start
+const legacyWrapPrefix = 64
+
+// Some drivers don't carry the VP3 and VP4 falcon firmware (the
+// nvXX_fuc084 and fuc086 nouveau asks for) as is, but in gzip streams
+// like the PGRAPH archives, as a word or two of header (the 0x2 or
+// 0x100c that isn't an archive's magic) before a zlib stream. Returns
+// what that unpacks to, or nil if it's something else.
+func legacyUnwrap(data []byte) []byte {
+	for i := 0; i <= legacyWrapPrefix && i + 2 <= len(data); i += 4 {
+		if data[i] != 0x78 || (int(data[i]) << 8 | int(data[i + 1])) % 31 != 0 {
+			continue
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data[i:]))
+		if err != nil {
+			continue
+		}
+		out, err := ioutil.ReadAll(r)
+		if err == nil && len(out) != 0 {
+			return out
+		}
+	}
+	return nil
+}
+
+// Look for blob b in what the gzip streams unwrap to. Returns the
+// stream, the unwrapped data and where b is in it, or -1.
+func legacyFindWrapped(gzips []legacyGzip, b legacyBlob, old bool) (*legacyGzip, []byte, int) {
+	for n := range gzips {
+		if len(gzips[n].data) < 4 || binary.LittleEndian.Uint32(gzips[n].data) == 0 {
+			continue
+		}
+		data := legacyUnwrap(gzips[n].data)
+		if data == nil {
+			continue
+		}
+		if i := legacyFind(data, b, old); i >= 0 {
+			return &gzips[n], data, i
+		}
+	}
+	return nil, nil, -1
+}
+
+func (p *Processor) legacyArchives(gzips []legacyGzip) {
+	var names []string
+	if q := LookupQuirk(p.Version); q != nil {
+		names = q.ArchiveOrder
+	}
+	idx := 0
+	unknown := false
+	for _, g := range gzips {
+		start, end, data := g.start, g.end, g.data
+		origin := Origin{Offset: int64(start), CompressedSize: end - start,
+			Codec: "gzip"}
+		if len(data) < 8 {
+			continue
+		}
+		if magic := binary.LittleEndian.Uint32(data); magic != 0 {
+			if legacyUnwrap(data) != nil {
+				p.diagnose(origin, "archive", "gzip blob at 0x%x holds video firmware, not an archive",
+					start)
+				continue
+			}
+			p.diagnose(origin, "archive", "Skipping gzip blob at 0x%x (%d bytes), wrong magic: 0x%x",
+				start, len(data), magic)
+			continue
+		}
+		// Each entry is id, length, offset
+		count := int(binary.LittleEndian.Uint32(data[4:]))
+		var entries []netlist.ArchiveEntry
+		for i := 0; i < count && 8 + (i + 1) * 12 <= len(data); i++ {
+			w := data[8 + i * 12:]
+			entries = append(entries, netlist.ArchiveEntry{
+				Id: int32(binary.LittleEndian.Uint32(w)),
+				Length: int32(binary.LittleEndian.Uint32(w[4:])),
+				Offset: int32(binary.LittleEndian.Uint32(w[8:]))})
+		}
+
+		order := ""
+		if idx < len(names) {
+			order = names[idx]
+		}
+		prefix := p.archiveName(data, entries, order)
+		if prefix == "" {
+			if !unknown {
+				p.warnf("Unknown PGRAPH archive order in this version.\n")
+				unknown = true
+			}
+			prefix = fmt.Sprintf("blob%d", idx)
+		}
+		idx++
+		for _, e := range entries {
+			file, ok := legacyArchiveFiles[e.Id]
+			if !ok {
+				continue
+			}
+			// Round code up to the nearest 0x200
+			if e.Offset < 0 || e.Length < 0 ||
+				int64(e.Offset) + int64(e.Length) > int64(len(data)) {
+				p.problem(origin, "archive", "%s_%s runs off the end of the archive",
+					prefix, file)
+				continue
+			}
+			contents := data[e.Offset:e.Offset + e.Length]
+			if strings.HasSuffix(file, "c") && len(contents) % 0x200 != 0 {
+				pad := make([]byte, 0x200 - len(contents) % 0x200)
+				contents = append(contents[:len(contents):len(contents)], pad...)
+			}
+			p.emit(prefix + "_" + file, contents, origin, "nouveau", "")
+		}
+	}
+	if names != nil && idx != len(names) {
+		p.warnf("Unexpected quantity of archives in blob, graph fw likely wrong.\n")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "archive/tar"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "time"
+
+// Where a Processor writes what it extracts. Names are slash
+// separated and relative to the top of the output, and any
+// directories in them are made along the way.
+type WriteFS interface {
+	// Write a file of size bytes from r
+	WriteFile(name string, r io.Reader, size int64) error
+	// Make name another name for the file first, as a hard link
+	Link(name, first string) error
+	// Make name a symbolic link to target, which is relative to
+	// name's directory
+	Symlink(name, target string) error
+}
+
+// The time from SOURCE_DATE_EPOCH, or zero if it isn't set. Tarballs
+// get it instead of the epoch, and with it set, files written into a
+// directory get it and a fixed mode as well, whatever the umask, so
+// that distros building packages of the firmware get the same bits
+// every time.
+var SourceDate = sourceDateEpoch()
+
+func sourceDateEpoch() time.Time {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(epoch, 0).UTC()
+}
+
+// The modes everything is written with when it's up to the scanner
+const (
+	fileMode = os.FileMode(0644)
+	dirMode = os.FileMode(0755)
+)
+
+// With SourceDate set, give a file or directory written to disk its
+// fixed mode and time
+func settle(fname string, mode os.FileMode) error {
+	if SourceDate.IsZero() {
+		return nil
+	}
+	if err := os.Chmod(fname, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(fname, SourceDate, SourceDate)
+}
+
+// Writes into a directory on disk
+type DirFS string
+
+func (d DirFS) create(name string) (string, error) {
+	fname := path.Join(string(d), name)
+	if err := os.MkdirAll(path.Dir(fname), os.FileMode(0777)); err != nil {
+		return "", err
+	}
+	if !SourceDate.IsZero() {
+		// Only the directories in name, not those of Destdir
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if err := os.Chmod(path.Join(string(d), dir), dirMode); err != nil {
+				return "", err
+			}
+		}
+	}
+	// Links can't replace what's left over from an earlier run
+	os.Remove(fname)
+	return fname, nil
+}
+
+func (d DirFS) WriteFile(name string, r io.Reader, size int64) error {
+	fname, err := d.create(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+		os.FileMode(0666))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return settle(fname, fileMode)
+}
+
+func (d DirFS) Link(name, first string) error {
+	fname, err := d.create(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(path.Join(string(d), first), fname); err != nil {
+		return err
+	}
+	return settle(fname, fileMode)
+}
+
+func (d DirFS) Symlink(name, target string) error {
+	fname, err := d.create(name)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, fname)
+}
+
+// Writes into a tarball. Everything gets the same owner (root, by
+// number), mode and time (SourceDate, or else the epoch), so that the
+// same extraction always makes the same tarball.
+type TarFS struct {
+	*tar.Writer
+}
+
+func (t TarFS) header(hdr *tar.Header) error {
+	hdr.Mode = int64(fileMode)
+	if hdr.Typeflag == tar.TypeSymlink {
+		hdr.Mode = 0777
+	}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.ModTime = time.Unix(0, 0)
+	if !SourceDate.IsZero() {
+		hdr.ModTime = SourceDate
+	}
+	hdr.Format = tar.FormatPAX
+	return t.WriteHeader(hdr)
+}
+
+func (t TarFS) WriteFile(name string, r io.Reader, size int64) error {
+	if err := t.header(&tar.Header{Name: name, Size: size}); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.Writer, r)
+	return err
+}
+
+func (t TarFS) Link(name, first string) error {
+	return t.header(&tar.Header{Name: name, Typeflag: tar.TypeLink,
+		Linkname: first})
+}
+
+func (t TarFS) Symlink(name, target string) error {
+	return t.header(&tar.Header{Name: name, Typeflag: tar.TypeSymlink,
+		Linkname: target})
+}
+
+// Writes into a tarball like TarFS, but in order of name rather than
+// the order the scan found things in. Nothing goes into the tarball
+// until Flush; file contents wait in a temporary file until then. Of
+// files hard linked together, the first by name is the one that holds
+// the contents.
+type SortedTarFS struct {
+	TarFS
+	spool *os.File
+	members map[string]*sortedMember
+}
+
+type sortedMember struct {
+	hdr tar.Header
+	// Where the contents are in the spool
+	offset int64
+}
+
+// Write a sorted tarball to tw, keeping file contents in a temporary
+// file in dir (or the default one, if it's empty) until Flush
+func NewSortedTarFS(tw *tar.Writer, dir string) (*SortedTarFS, error) {
+	spool, err := ioutil.TempFile(dir, "scanner-spool")
+	if err != nil {
+		return nil, err
+	}
+	return &SortedTarFS{TarFS{tw}, spool, make(map[string]*sortedMember)}, nil
+}
+
+func (t *SortedTarFS) WriteFile(name string, r io.Reader, size int64) error {
+	offset, err := t.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(t.spool, r, size); err != nil {
+		return err
+	}
+	t.members[name] = &sortedMember{tar.Header{Name: name, Size: size,
+		Typeflag: tar.TypeReg}, offset}
+	return nil
+}
+
+func (t *SortedTarFS) Link(name, first string) error {
+	t.members[name] = &sortedMember{hdr: tar.Header{Name: name,
+		Typeflag: tar.TypeLink, Linkname: first}}
+	return nil
+}
+
+func (t *SortedTarFS) Symlink(name, target string) error {
+	t.members[name] = &sortedMember{hdr: tar.Header{Name: name,
+		Typeflag: tar.TypeSymlink, Linkname: target}}
+	return nil
+}
+
+// Write everything out in order, and remove the temporary file. The
+// tar.Writer is left for the caller to close.
+func (t *SortedTarFS) Flush() error {
+	defer func() {
+		t.spool.Close()
+		os.Remove(t.spool.Name())
+	}()
+	var names []string
+	for name := range t.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// A link may sort ahead of the file it links to, so the first
+	// name of each file gets its contents, and the rest link to that
+	holder := make(map[string]string)
+	root := func(m *sortedMember) string {
+		if m.hdr.Typeflag == tar.TypeLink {
+			return m.hdr.Linkname
+		}
+		return m.hdr.Name
+	}
+	for _, name := range names {
+		m := t.members[name]
+		if m.hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if r := t.members[root(m)]; r == nil || r.hdr.Typeflag != tar.TypeReg {
+			return &os.PathError{Op: "link", Path: name, Err: os.ErrNotExist}
+		}
+		if _, ok := holder[root(m)]; !ok {
+			holder[root(m)] = name
+		}
+	}
+
+	for _, name := range names {
+		m := t.members[name]
+		hdr := m.hdr
+		if hdr.Typeflag != tar.TypeSymlink {
+			r := t.members[root(m)]
+			if first := holder[root(m)]; first == name {
+				hdr = tar.Header{Name: name, Typeflag: tar.TypeReg, Size: r.hdr.Size}
+			} else {
+				hdr = tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: first}
+			}
+			m = r
+		}
+		if err := t.header(&hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			r := io.NewSectionReader(t.spool, m.offset, hdr.Size)
+			if _, err := io.Copy(t.Writer, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Keeps everything in memory, by name. Links are kept as copies of
+// what they point to.
+type MemFS map[string][]byte
+
+func (m MemFS) WriteFile(name string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[name] = data
+	return nil
+}
+
+func (m MemFS) Link(name, first string) error {
+	m[name] = m[first]
+	return nil
+}
+
+func (m MemFS) Symlink(name, target string) error {
+	m[name] = m[filepath.ToSlash(path.Join(path.Dir(name), target))]
+	return nil
+}
+
+// Where p writes: Output, or else Destdir
+func (p *Processor) output() WriteFS {
+	if p.Output != nil {
+		return p.Output
+	}
+	return DirFS(p.Destdir)
+}
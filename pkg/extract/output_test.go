@@ -0,0 +1,134 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "archive/tar"
+import "bytes"
+import "io"
+import "io/ioutil"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+// A file, a hard link to it that sorts ahead of it, a symlink and
+// files in directories, to be written in any order
+var testTarWrites = []func(fs WriteFS) error{
+	func(fs WriteFS) error {
+		return fs.WriteFile("gr/fecs_inst", strings.NewReader("fecs"), 4)
+	},
+	func(fs WriteFS) error {
+		return fs.Link("gr/fecs_code", "gr/fecs_inst")
+	},
+	func(fs WriteFS) error {
+		return fs.Symlink("gr/fecs", "fecs_inst")
+	},
+	func(fs WriteFS) error {
+		return fs.WriteFile("manifest.json", strings.NewReader("[]\n"), 3)
+	},
+	func(fs WriteFS) error {
+		return fs.WriteFile("acr/bl", strings.NewReader("bootloader"), 10)
+	},
+}
+
+// Write testTarWrites into a sorted tarball in the order given
+func testSortedTar(t *testing.T, order []int) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	fs, err := NewSortedTarFS(tw, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range order {
+		if err := testTarWrites[i](fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSortedTarFS(t *testing.T) {
+	defer func(date time.Time) { SourceDate = date }(SourceDate)
+	SourceDate = time.Date(2018, 4, 3, 12, 0, 0, 0, time.UTC)
+
+	first := testSortedTar(t, []int{0, 1, 2, 3, 4})
+	second := testSortedTar(t, []int{4, 3, 2, 1, 0})
+	if !bytes.Equal(first, second) {
+		t.Fatalf("tarballs written in different orders differ")
+	}
+
+	// In order of name, with the hard link that sorts first holding
+	// the contents
+	want := []struct {
+		name string
+		typ byte
+		link, data string
+	}{
+		{"acr/bl", tar.TypeReg, "", "bootloader"},
+		{"gr/fecs", tar.TypeSymlink, "fecs_inst", ""},
+		{"gr/fecs_code", tar.TypeReg, "", "fecs"},
+		{"gr/fecs_inst", tar.TypeLink, "gr/fecs_code", ""},
+		{"manifest.json", tar.TypeReg, "", "[]\n"},
+	}
+	tr := tar.NewReader(bytes.NewReader(first))
+	for _, w := range want {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		if hdr.Name != w.name || hdr.Typeflag != w.typ || hdr.Linkname != w.link {
+			t.Errorf("got %s (type %c, link %q), want %s (type %c, link %q)",
+				hdr.Name, hdr.Typeflag, hdr.Linkname, w.name, w.typ, w.link)
+		}
+		if !hdr.ModTime.Equal(SourceDate) || hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Errorf("%s: time %v, owner %d:%d; want %v, 0:0", hdr.Name,
+				hdr.ModTime, hdr.Uid, hdr.Gid, SourceDate)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != w.data {
+			t.Errorf("%s: holds %q, want %q", hdr.Name, data, w.data)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("more in the tarball than was written: %v", err)
+	}
+}
+
+func TestSortedTarFSMissingLink(t *testing.T) {
+	fs, err := NewSortedTarFS(tar.NewWriter(ioutil.Discard), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Link("gr/fecs_code", "gr/fecs_inst")
+	if err := fs.Flush(); !os.IsNotExist(err) {
+		t.Errorf("link to nothing: got %v, want it not to exist", err)
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path"
+import "sort"
+import "strings"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/eluscan"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// How a Processor scans. Each has its own, so that scans running at
+// once, like those of a Server, don't share any settings. A Processor
+// without Options goes by DefaultOptions.
+type Options struct {
+	// How gaps are decoded, and what is taken for an archive
+	eluscan.Options
+	// Blobs smaller than MinBlobSize are passed over as likely
+	// garbage, and so are ones with less entropy than MinEntropy
+	// bits per byte, unless their hash is known. MinEntropy is 0,
+	// for no limit, by default.
+	MinBlobSize int
+	MinEntropy float64
+	// How much the Processor logs, LogError to LogDebug, and how:
+	// "text", or "json" for a JSON object per line. Besides the
+	// messages, what a scan goes through is then logged as events of
+	// their own: each file written, each archive parsed and, at
+	// debug level, each gap passed over and why. Warnings go to
+	// stderr, everything else to LogOut, or stdout if it's nil.
+	LogLevel int
+	LogFormat string
+	LogOut io.Writer
+	// The cache directory ScanDriver extracts packages into, laid
+	// out as for Fetch, or "" to extract them afresh each time
+	CacheDir string
+	// Where Fetch downloads drivers from, tried in order
+	Mirrors []string
+	// How many drivers BatchContext scans at once, and whether it
+	// scans again the ones the journal of an earlier run into the
+	// same output root says are done
+	Jobs int
+	Restart bool
+}
+
+func DefaultOptions() Options {
+	return Options{Options: eluscan.DefaultOptions(), MinBlobSize: 128,
+		LogLevel: LogInfo, LogFormat: "text", LogOut: os.Stdout,
+		Mirrors: append([]string(nil), defaultMirrors...), Jobs: 1}
+}
+
+var defaultOptions = DefaultOptions()
+
+func (o *Options) orDefault() *Options {
+	if o == nil {
+		return &defaultOptions
+	}
+	return o
+}
+
+func (p *Processor) opts() *Options {
+	return p.Options.orDefault()
+}
+
+// Write out the signatures of a HS image, and where in the image the
+// selected one gets patched in. kind goes in front of the signatures'
+// types, "hs" for hs_sig_prod and hs_sig_dbg.
+func (p *Processor) emitHSParts(name string, data []byte, origin Origin, kind string) {
+	_, hs, _, _ := classify.ParseHS(data)
+	if hs.SigProdSize != 0 {
+		p.emit(name + "_sig_prod",
+			data[hs.SigProdOffset:hs.SigProdOffset+hs.SigProdSize],
+			origin, kind + "_sig_prod", "")
+	}
+	if hs.SigDbgSize != 0 {
+		p.emit(name + "_sig_dbg",
+			data[hs.SigDbgOffset:hs.SigDbgOffset+hs.SigDbgSize],
+			origin, kind + "_sig_dbg", "")
+	}
+	patch := fmt.Sprintf("patch_loc: 0x%x\npatch_sig: 0x%x\n",
+		hs.PatchLoc, hs.PatchSig)
+	p.fail(p.writeFile(name + "_patch.txt", []byte(patch)))
+}
+
+func (p *Processor) processWhole(data []byte, origin Origin) {
+	// LS signatures are small, so look for them before throwing
+	// out small blobs.
+	if sig, ok := classify.ParseLSSignature(data); ok {
+		if !p.wanted("acr", origin) {
+			return
+		}
+		name := p.uniqueName(classify.FalconNames[sig.FalconId] + "_sig")
+		p.emit(name, data, origin, "ls_sig", "")
+		p.infof("%s: LS signature for %s (prod %v, dbg %v)\n", name,
+			classify.FalconNames[sig.FalconId], sig.ProdPresent == 1, sig.DbgPresent == 1)
+		return
+	}
+
+	// A lot of small seemingly compressed files that don't appear
+	// to mean much. Since there is no compression header, there's
+	// a lot of potential for garbage.
+	if len(data) < p.opts().MinBlobSize {
+		p.diagnose(origin, "blob", "only %d bytes, too small to tell from garbage",
+			len(data))
+		return
+	}
+
+	// Firmware that has been identified before gets the name it
+	// was given then.
+	if k, ok := classify.Lookup(classify.HashOf(data), len(data)); ok {
+		if !p.wanted(classify.Category(k.Engine), origin) {
+			return
+		}
+		name := p.uniqueName(k.Name)
+		p.emit(name, data, origin, k.Name, "")
+		p.infof("%s: known %s firmware, first seen in %s\n",
+			name, k.Engine, k.FirstSeen)
+		return
+	}
+
+	// Runs of the same few bytes decompress out of garbage as well
+	if min := p.opts().MinEntropy; min > 0 {
+		if e := classify.Entropy(data); e < min {
+			p.diagnose(origin, "blob", "entropy %.2f is below %.2f", e, min)
+			return
+		}
+	}
+
+	// Containers, such as ACR images, get split up into what they
+	// carry
+	if p.handle(data, origin) {
+		return
+	}
+
+	// Display falcon ucode looks like any other, and only what
+	// loads it says what it is
+	if p.processDisplay(data, origin) {
+		return
+	}
+
+	// Firmware we can recognize gets a name based on what it looks
+	// like, and a note about what it is.
+	if base, note := classify.Identify(data); base != "" {
+		if !p.wanted(classify.Category(base), origin) {
+			return
+		}
+		name := p.blobName(base, origin)
+		p.emit(name, data, origin, base, "")
+		p.infof("%s: %s\n", name, note)
+		if _, _, _, ok := classify.ParseHS(data); ok {
+			p.emitHSParts(name, data, origin, "hs")
+		}
+		return
+	}
+
+	// Falcon ucode whose descriptor isn't where Identify looks can
+	// still be split up along it
+	if p.processFalcon(data, origin) {
+		return
+	}
+
+	// Otherwise, what refers to it may say what engine uses it
+	if engine, where := classify.ContextEngine(origin.Context); engine != "" {
+		if !p.wanted(classify.Category(engine), origin) {
+			return
+		}
+		name := p.blobName(engine, origin)
+		p.emit(name, data, origin, engine, "")
+		p.infof("%s: likely %s firmware, referenced from %s\n",
+			name, engine, where)
+		return
+	}
+
+	// Dump out the file and continue. The numbering doesn't
+	// depend on whether they are wanted, only on whether a symbol
+	// named them.
+	if origin.Symbol != "" {
+		if p.wanted("unknown", origin) {
+			p.emit(p.blobName("", origin), data, origin, "unknown", "")
+		}
+		return
+	}
+	if p.wanted("unknown", origin) {
+		hash := classify.HashOf(data)
+		p.emit(p.fallbackName("whole", p.wholeCounter, 3, hash, origin), data,
+			origin, "unknown", "")
+	}
+
+	p.wholeCounter++
+}
+
+// Name a blob that was too big to keep in memory. Archives and HS
+// images are never this big, so only what the start of it or its
+// references say can name it.
+func (p *Processor) processStreamed(b eluscan.Blob, origin Origin) {
+	var name, typ, cat, note string
+	if k, ok := classify.Lookup(b.Hash, int(b.Size)); ok {
+		name, typ, cat = p.uniqueName(k.Name), k.Name, classify.Category(k.Engine)
+		note = fmt.Sprintf("known %s firmware, first seen in %s",
+			k.Engine, k.FirstSeen)
+	} else if base, n := classify.Engine(b.Data); base != "" {
+		name, typ, cat, note = p.blobName(base, origin), base, classify.Category(base), n
+	} else if engine, where := classify.ContextEngine(origin.Context); engine != "" {
+		name, typ, cat = p.blobName(engine, origin), engine, classify.Category(engine)
+		note = fmt.Sprintf("likely %s firmware, referenced from %s",
+			engine, where)
+	} else if origin.Symbol != "" {
+		name, typ, cat = p.blobName("", origin), "unknown", "unknown"
+	} else {
+		name, typ, cat = p.fallbackName("whole", p.wholeCounter, 3, b.Hash,
+			origin),
+			"unknown", "unknown"
+		p.wholeCounter++
+	}
+	if !p.wanted(cat, origin) {
+		os.Remove(b.File)
+		return
+	}
+	p.emitFile(name, b, origin, typ)
+	if note != "" {
+		p.infof("%s: %s\n", name, note)
+	}
+}
+
+// Make sure every entry of an archive lies within data, since version
+// 0 archives are taken even when they don't. An entry that runs off
+// the end is cut short to what there is of it, and one that starts
+// past the end is left empty. Entries that overlap are only warned
+// about.
+func (p *Processor) checkEntries(data []byte, entries []netlist.ArchiveEntry, origin Origin) {
+	size := int64(len(data))
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.Length < 0 || int64(e.Offset) > size:
+			p.problem(origin, "archive",
+				"entry %d at 0x%x with 0x%x bytes is out of range, leaving it empty",
+				e.Id, e.Offset, e.Length)
+			e.Offset, e.Length = int32(size), 0
+		case int64(e.Offset) + int64(e.Length) > size:
+			p.problem(origin, "archive",
+				"entry %d at 0x%x with 0x%x bytes runs 0x%x bytes past the end, cutting it short",
+				e.Id, e.Offset, e.Length,
+				int64(e.Offset) + int64(e.Length) - size)
+			e.Length = int32(size) - e.Offset
+		}
+	}
+
+	sorted := append([]netlist.ArchiveEntry(nil), entries...)
+	sort.Slice(sorted, func (a, b int) bool {
+		return sorted[a].Offset < sorted[b].Offset
+	})
+	var last netlist.ArchiveEntry
+	for i, e := range sorted {
+		if i > 0 && e.Length != 0 && e.Offset < last.Offset + last.Length {
+			p.problem(origin, "archive", "entries %d and %d overlap at 0x%x",
+				last.Id, e.Id, e.Offset)
+		}
+		if e.Offset + e.Length > last.Offset + last.Length {
+			last = e
+		}
+	}
+}
+
+// Flag the entries an archive had to leave out, if it had to. Returns
+// them, and any other error from ParseArchive.
+func (p *Processor) partialArchive(err error, origin Origin) ([]netlist.ArchiveEntry, error) {
+	var partial *netlist.PartialArchiveError
+	if !errors.As(err, &partial) {
+		return nil, err
+	}
+	for _, e := range partial.Broken {
+		p.problem(origin, "archive",
+			"entry %d at 0x%x with 0x%x bytes points into the entry table, leaving it out",
+			e.Id, e.Offset, e.Length)
+	}
+	return partial.Broken, nil
+}
+
+// Write out a blob that was found some other way, as whatever it
+// turns out to be
+func (p *Processor) Process(data []byte, origin Origin) {
+	p.process(data, origin)
+}
+
+func (p *Processor) process(data []byte, origin Origin) {
+	header, entries, wide, err := netlist.ParseArchive(data, &p.opts().Archives)
+	broken, err := p.partialArchive(err, origin)
+	if errors.Is(err, netlist.ErrBadEntries) {
+		p.problem(origin, "archive", "%v", err)
+		if p.Mode == "lenient" {
+			// Keep the data, even if it can't be split up
+			p.processWhole(data, origin)
+		}
+		return
+	}
+	if err != nil {
+		p.processWhole(data, origin)
+		return
+	}
+	if !p.wanted("gr", origin) {
+		p.archiveCounter++
+		return
+	}
+	p.checkEntries(data, entries, origin)
+	if p.err != nil {
+		return
+	}
+	p.Stats.Partial += len(broken)
+
+	// Create a directory for the archive, and put each entry into
+	// its own file. Use the known names when possible. The
+	// directory is named after the chipset the archive's signature
+	// says it's for, or else the netlist image number like
+	// NVIDIA's own NET_IMG_xx, so that it's the same across
+	// driver versions, falling back to the order found in. A
+	// symbol's name beats all of those.
+	var archbase, chipset string
+	if origin.Symbol != "" {
+		archbase = p.blobName("", origin)
+	} else if num, ok := netlist.ScalarEntry(data, entries, 18); ok {
+		if chipset = netlist.IdentifyChipset(data, entries); chipset != "" {
+			archbase = p.uniqueName(chipset)
+		} else {
+			archbase = p.uniqueName(fmt.Sprintf("NET_IMG_%02d", num))
+		}
+	} else if name := p.archiveName(data, entries, p.quirkArchiveName()); name != "" {
+		archbase, chipset = p.uniqueName(name), name
+	} else {
+		archbase = p.fallbackName("archive", p.archiveCounter, 2,
+			classify.HashOf(data), origin)
+	}
+	if chipset == "" {
+		chipset = netlist.IdentifyChipset(data, entries)
+	}
+	p.setArchiveChipset(archbase, chipset)
+	p.writeArchive(archbase, data, header, entries, broken, wide, origin)
+	p.archiveCounter++
+	p.Stats.Archives++
+}
+
+// Write out an archive that was extracted some other way straight
+// into Destdir, as unpack does. Fails if data can't be split up.
+func (p *Processor) ProcessArchive(data []byte, origin Origin) error {
+	header, entries, wide, err := netlist.ParseArchive(data, &p.opts().Archives)
+	broken, err := p.partialArchive(err, origin)
+	if err != nil {
+		return err
+	}
+	p.checkEntries(data, entries, origin)
+	p.writeArchive("", data, header, entries, broken, wide, origin)
+	return p.err
+}
+
+// Write out the entries of an archive into archbase, with an info.txt
+// about it.
+func (p *Processor) writeArchive(archbase string, data []byte, header netlist.ArchiveHeader, entries, broken []netlist.ArchiveEntry, wide bool, origin Origin) {
+	// Work out which GPU family this archive is likely for, which
+	// decides what its regions are called.
+	family, reason := netlist.IdentifyArchive(data, entries)
+	table := netlist.NameTable(p.NameTable, family)
+
+	var info bytes.Buffer
+	for _, entry := range entries {
+		name := netlist.RegionName(table, int(entry.Id))
+		// Single numbers are more useful decoded
+		if netlist.ScalarRegions[int(entry.Id)] && entry.Length == 4 {
+			fmt.Fprintf(&info, "%s: %d\n", name,
+				binary.LittleEndian.Uint32(data[entry.Offset:]))
+			if !p.RawScalars {
+				continue
+			}
+		}
+		contents := data[entry.Offset:entry.Offset+entry.Length]
+		p.emit(path.Join(archbase, name), contents, origin, name, archbase)
+		if format, ok := netlist.RegionFormats[int(entry.Id)]; ok {
+			switch p.Decode {
+			case "text":
+				p.fail(p.writeFile(path.Join(archbase, name + ".txt"),
+					format.Text(contents, p.RegNames)))
+			case "json":
+				p.fail(p.writeFile(path.Join(archbase, name + ".json"),
+					format.JSON(contents, p.RegNames)))
+			}
+		}
+	}
+	if p.Nouveau {
+		p.writeNouveau(archbase, data, entries, origin)
+	}
+
+	// Record the guess
+	guess := fmt.Sprintf("family: %s (guess, %s)\n", family, reason)
+	fields := map[string]interface{}{"archive": archbase, "offset": origin.Offset,
+		"version": header.Magic, "entries": len(entries), "broken": len(broken),
+		"family": family, "reason": reason}
+	if archbase != "" {
+		p.event(LogInfo, "archive", fields, "%s: %s", archbase, guess)
+	} else {
+		p.event(LogInfo, "archive", fields, "%s", guess)
+	}
+	info.WriteString(guess)
+	if c := p.archiveChipset(archbase); c != nil {
+		fmt.Fprintf(&info, "chipset: %s (%s)\n", c.Codename, c.Name())
+	}
+	if header.Magic != 0 {
+		fmt.Fprintf(&info, "version: %d\n", header.Magic)
+	}
+	if wide {
+		info.WriteString("entries: wide\n")
+	}
+	netlist.WriteLayout(&info, data, entries, wide, table)
+	for _, entry := range broken {
+		fmt.Fprintf(&info, "broken: %d %s 0x%x 0x%x\n", entry.Id,
+			netlist.RegionName(table, int(entry.Id)), entry.Offset, entry.Length)
+	}
+	p.fail(p.writeFile(path.Join(archbase, "info.txt"), info.Bytes()))
+
+	// What the ctxreg lists say about the context image, for sizing
+	// ctxsw buffers
+	if layout := netlist.Context(data, entries, table); len(layout.Units) != 0 {
+		p.fail(p.writeFile(path.Join(archbase, "context.txt"), layout.Text()))
+		if p.Decode == "json" {
+			out, err := json.MarshalIndent(layout, "", "  ")
+			must(err)
+			p.fail(p.writeFile(path.Join(archbase, "context.json"), append(out, '\n')))
+		}
+	}
+}
+
+func (p *Processor) writeNouveau(archbase string, data []byte, entries []netlist.ArchiveEntry, origin Origin) {
+	// The archive's own chipset, if it's known, or else the one
+	// the files are wanted for
+	chipset := p.archiveChipset(archbase)
+	if chipset == nil {
+		chipset = p.Chipset
+	}
+	for _, entry := range entries {
+		name := netlist.NouveauPath(chipset, int(entry.Id))
+		if name == "" {
+			continue
+		}
+
+		// nouveau expects its own fuc code to be a multiple of
+		// 0x200 bytes, so pad it out.
+		contents := data[entry.Offset:entry.Offset+entry.Length]
+		if strings.HasSuffix(name, "c") && len(contents) % 0x200 != 0 {
+			pad := make([]byte, 0x200 - len(contents) % 0x200)
+			contents = append(contents[:len(contents):len(contents)], pad...)
+		}
+		p.emit(path.Join(archbase, name), contents, origin,
+			"nouveau", archbase)
+	}
+}
+
+// How many hex digits of the hash -naming hash puts in names
+const hashNameLength = 12
+
+// Name something that nothing better is known about: prefix_NN, after
+// the order they were found in, or with -naming hash the start of the
+// hash of the contents, which won't change as long as they don't.
+// -naming offset uses the rodata offset instead, as blob_0x6954e4.bin
+// for blobs and archive_0x6954e4 for archives.
+func (p *Processor) fallbackName(prefix string, n, width int, hash string, origin Origin) string {
+	switch p.Naming {
+	case "hash":
+		return p.uniqueName(prefix + "_" + hash[:hashNameLength])
+	case "offset":
+		if prefix == "whole" {
+			return p.uniqueName(fmt.Sprintf("blob_0x%x.bin", origin.Offset))
+		}
+		return p.uniqueName(fmt.Sprintf("%s_0x%x", prefix, origin.Offset))
+	}
+	return fmt.Sprintf("%s_%0*d", prefix, width, n)
+}
+
+// Name a blob after the symbol it was found at, if there is one, or
+// base otherwise
+func (p *Processor) blobName(base string, origin Origin) string {
+	if origin.Symbol != "" {
+		base = origin.Symbol
+	}
+	return p.uniqueName(base)
+}
+
+// Returns name the first time it is seen, and name_N for each
+// subsequent request.
+func (p *Processor) uniqueName(name string) string {
+	if p.nameCounters == nil {
+		p.nameCounters = make(map[string]int)
+	}
+	if p.quirk != nil && p.quirk.Rename[name] != "" {
+		name = p.quirk.Rename[name]
+	}
+	n := p.nameCounters[name]
+	p.nameCounters[name]++
+	if n == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, n)
+}
+
+// With Flat, the name a file goes by in Destdir: its path with "_" in
+// place of each "/", and netlist images shortened, so that
+// NET_IMG_52/fecs_inst becomes net52_fecs_inst
+func (p *Processor) flatName(name string) string {
+	if !p.Flat || !strings.Contains(name, "/") {
+		return name
+	}
+	parts := strings.Split(name, "/")
+	if num := strings.TrimPrefix(parts[0], "NET_IMG_"); num != parts[0] {
+		parts[0] = "net" + num
+	}
+	return strings.Join(parts, "_")
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "reflect"
+import "strings"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// What differs about how a driver branch stores its firmware
+type Quirk struct {
+	// The driver version, or branch like "325", that this applies
+	// to. The longest match wins.
+	Version string
+	// Names for the archives that have no netlist_num, in the order
+	// they are found. Old drivers carry one PGRAPH archive per
+	// chipset without saying which is which.
+	ArchiveOrder []string
+	// Names for the PGRAPH context programs of drivers from before
+	// Fermi, in the order they are found
+	CtxprogOrder []string
+	// Only scan this part of rodata, unless -start or -end is given
+	Start, End int64
+	// Names to use instead of the ones the scan comes up with
+	Rename map[string]string
+}
+
+// Known quirks, mostly taken from what extract_firmware.py knew
+var Quirks = []Quirk{
+	{Version: "325.15", ArchiveOrder: []string{"nvc0", "nvc8", "nvc3",
+		"nvc4", "nvce", "nvcf", "nvc1", "nvd7", "nvd9", "nve4", "nve7",
+		"nve6", "nvf0", "nvf1", "nv108"}},
+}
+
+// Find the quirks for a driver version, if it has any
+func LookupQuirk(version string) *Quirk {
+	var found *Quirk
+	for i, q := range Quirks {
+		if version != q.Version && !strings.HasPrefix(version, q.Version + ".") {
+			continue
+		}
+		if found == nil || len(q.Version) > len(found.Version) {
+			found = &Quirks[i]
+		}
+	}
+	return found
+}
+
+// The quirk name for the next archive without a netlist_num, or ""
+func (p *Processor) quirkArchiveName() string {
+	n := p.unnumbered
+	p.unnumbered++
+	if p.quirk == nil || n >= len(p.quirk.ArchiveOrder) {
+		return ""
+	}
+	return p.quirk.ArchiveOrder[n]
+}
+
+// The name for an archive without a netlist_num: the chipset its
+// contents are known to be for, or else what the quirks have for its
+// place in the order. Archives that get a name either way are kept
+// for RecordArchiveSignatures.
+func (p *Processor) archiveName(data []byte, entries []netlist.ArchiveEntry, order string) string {
+	name := netlist.IdentifyChipset(data, entries)
+	if name != "" && order != "" && name != order {
+		p.warnf("The %s PGRAPH archive is where the quirks have %s\n", name, order)
+	}
+	if name == "" {
+		name = order
+	}
+	if name != "" {
+		s := netlist.SignatureOf(data, entries)
+		s.Chipset = name
+		p.signatures = append(p.signatures, s)
+	}
+	return name
+}
+
+func (p *Processor) setArchiveChipset(archive, chipset string) {
+	if p.archiveChipsets == nil {
+		p.archiveChipsets = make(map[string]string)
+	}
+	p.archiveChipsets[archive] = chipset
+}
+
+// The chipset an archive was found to be for, or nil if that couldn't
+// be told
+func (p *Processor) archiveChipset(archive string) *netlist.Chipset {
+	c, err := netlist.LookupChipset(p.archiveChipsets[archive])
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// Add the signatures of the archives this run named to a JSON file,
+// for -archive-signatures to tell them apart by in other drivers
+func (p *Processor) RecordArchiveSignatures(fname string) error {
+	var all []netlist.ArchiveSignature
+	if data, err := ioutil.ReadFile(fname); err == nil {
+		if err = json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+	for _, s := range p.signatures {
+		seen := false
+		for _, old := range all {
+			seen = seen || reflect.DeepEqual(old, s)
+		}
+		if !seen {
+			all = append(all, s)
+		}
+	}
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, append(data, '\n'), os.FileMode(0666))
+}
+
+// Warn if the archives didn't match the order the quirks have
+func (p *Processor) checkArchiveOrder() {
+	if p.quirk == nil || len(p.quirk.ArchiveOrder) == 0 {
+		return
+	}
+	if n := len(p.quirk.ArchiveOrder); p.unnumbered != n {
+		p.warnf("%d archives without a netlist_num found, but %s has %d; " +
+			"their names are likely wrong\n", p.unnumbered, p.Version, n)
+	}
+}
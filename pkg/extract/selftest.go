@@ -0,0 +1,293 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "bytes"
+import "compress/flate"
+import "context"
+import "debug/elf"
+import "encoding/binary"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "strings"
+import "github.com/envytools/firmware/pkg/classify"
+
+// The self-test scans an object made up on the spot, with a netlist
+// archive and a falcon image deflated into its .rodata the way the
+// driver has them, and checks that what comes out is what went in.
+// It needs nothing but the scanner, so it's a quick way to see that a
+// build works before pointing it at a real driver.
+
+// The driver version the test object carries
+const selfTestVersion = "390.48"
+
+// The regions of the test archive, by id. netlist_num 7 names it
+// NET_IMG_07, and ctxreg_pmrop makes it pascal's.
+var selfTestRegions = []struct {
+	Id int
+	Name string
+	Data []byte
+}{
+	{0, "fecs_data", selfTestPattern(0x100, 1)},
+	{1, "fecs_inst", selfTestPattern(0x200, 3)},
+	{5, "sw_ctx", selfTestWords(0x418000, 1, 0x418004, 2, 0x418008, 3)},
+	{8, "ctxreg_sys", selfTestWords(0x409800, 0, 4, 0x409804, 0, 8)},
+	{18, "netlist_num", selfTestWords(7)},
+	{31, "ctxreg_pmrop", selfTestWords(0x40e000, 0, 4)},
+}
+
+// Bytes that count up in steps, few enough different ones not to pass
+// for encrypted, which can't spell out an engine name for Engine to
+// find
+func selfTestPattern(n int, step byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i & 0x3f) * step
+	}
+	return data
+}
+
+func selfTestWords(words ...uint32) []byte {
+	data := make([]byte, 4 * len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(data[4*i:], w)
+	}
+	return data
+}
+
+// A version 0 archive of selfTestRegions, padded out to 32KiB
+func selfTestArchive() []byte {
+	data := make([]byte, 32768)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(selfTestRegions)))
+	off := 0x100
+	for i, r := range selfTestRegions {
+		entry := data[8 + 12 * i:]
+		binary.LittleEndian.PutUint32(entry, uint32(r.Id))
+		binary.LittleEndian.PutUint32(entry[4:], uint32(len(r.Data)))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(off))
+		copy(data[off:], r.Data)
+		off += (len(r.Data) + 0xff) &^ 0xff
+	}
+	return data
+}
+
+// A falcon image the way nvgpu ships them: a bin header that isn't a
+// HS one, pointing at a ucode descriptor, then the bootloader, code
+// and data the descriptor points at
+func selfTestFalcon() (image []byte, parts map[string][]byte) {
+	parts = map[string][]byte{
+		"bootloader": selfTestPattern(0x100, 5),
+		"code": selfTestPattern(0x400, 7),
+		"data": selfTestPattern(0x200, 9),
+	}
+	desc := classify.LSDesc{
+		DescriptorSize: 0xa0,
+		ImageSize: 0x700,
+		AppVersion: 1,
+		BootloaderStartOffset: 0,
+		BootloaderSize: 0x100,
+		AppStartOffset: 0x100,
+		AppSize: 0x600,
+		AppResidentCodeOffset: 0,
+		AppResidentCodeSize: 0x400,
+		AppResidentDataOffset: 0x400,
+		AppResidentDataSize: 0x200,
+	}
+	copy(desc.Date[:], "Jan 01 2018")
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, classify.BinHeader{Magic: 0x10de,
+		Version: 1, Size: 0x100 + 0x700, HeaderOffset: 0x20, DataOffset: 0x100,
+		DataSize: 0x700})
+	buf.Write(make([]byte, 0x20 - buf.Len()))
+	binary.Write(&buf, binary.LittleEndian, desc)
+	buf.Write(make([]byte, 0x100 - buf.Len()))
+	buf.Write(parts["bootloader"])
+	buf.Write(parts["code"])
+	buf.Write(parts["data"])
+	return buf.Bytes(), parts
+}
+
+func selfTestDeflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	must(err)
+	w.Write(data)
+	must(w.Close())
+	return buf.Bytes()
+}
+
+// Put together a relocatable x86_64 object whose .rodata has a table
+// of pointers to the streams, as the driver's does, and the relocations
+// for them against the .rodata section symbol
+func selfTestObject(streams ...[]byte) []byte {
+	var rodata bytes.Buffer
+	table := 32
+	rodata.Write(make([]byte, table))
+	var rela bytes.Buffer
+	for i, s := range streams {
+		binary.Write(&rela, binary.LittleEndian, elf.Rela64{Off: uint64(8 * i),
+			Info: elf.R_INFO(1, uint32(elf.R_X86_64_64)), Addend: int64(rodata.Len())})
+		rodata.Write(s)
+		rodata.Write(make([]byte, 64))
+	}
+	version := fmt.Sprintf("NVIDIA UNIX x86_64 Kernel Module  %s  self-test\x00",
+		selfTestVersion)
+	binary.Write(&rela, binary.LittleEndian, elf.Rela64{Off: uint64(8 * len(streams)),
+		Info: elf.R_INFO(1, uint32(elf.R_X86_64_64)), Addend: int64(rodata.Len())})
+	rodata.WriteString(version)
+	rodata.Write(make([]byte, 64))
+
+	strtab := []byte("\x00selftest_blobs\x00")
+	var symtab bytes.Buffer
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym64{})
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym64{
+		Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Shndx: 1})
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym64{Name: 1,
+		Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 1,
+		Size: uint64(table)})
+	shstrtab := []byte("\x00.rodata\x00.rela.rodata\x00.symtab\x00.strtab\x00.shstrtab\x00")
+
+	sections := []struct {
+		name uint32
+		typ elf.SectionType
+		data []byte
+		link, info uint32
+		entsize uint64
+	}{
+		{0, elf.SHT_NULL, nil, 0, 0, 0},
+		{1, elf.SHT_PROGBITS, rodata.Bytes(), 0, 0, 0},
+		{9, elf.SHT_RELA, rela.Bytes(), 3, 1, 24},
+		{22, elf.SHT_SYMTAB, symtab.Bytes(), 4, 2, 24},
+		{30, elf.SHT_STRTAB, strtab, 0, 0, 0},
+		{38, elf.SHT_STRTAB, shstrtab, 0, 0, 0},
+	}
+	var body bytes.Buffer
+	offsets := make([]int, len(sections))
+	for i, s := range sections {
+		for body.Len() % 8 != 0 {
+			body.WriteByte(0)
+		}
+		offsets[i] = 64 + body.Len()
+		body.Write(s.data)
+	}
+	for body.Len() % 8 != 0 {
+		body.WriteByte(0)
+	}
+
+	var obj bytes.Buffer
+	hdr := elf.Header64{Type: uint16(elf.ET_REL), Machine: uint16(elf.EM_X86_64),
+		Version: uint32(elf.EV_CURRENT), Shoff: uint64(64 + body.Len()),
+		Ehsize: 64, Shentsize: 64, Shnum: uint16(len(sections)),
+		Shstrndx: uint16(len(sections) - 1)}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&obj, binary.LittleEndian, hdr)
+	obj.Write(body.Bytes())
+	for i, s := range sections {
+		sh := elf.Section64{Name: s.name, Type: uint32(s.typ), Link: s.link,
+			Info: s.info, Entsize: s.entsize, Addralign: 1}
+		if s.typ != elf.SHT_NULL {
+			sh.Off, sh.Size = uint64(offsets[i]), uint64(len(s.data))
+		}
+		if s.typ == elf.SHT_PROGBITS {
+			sh.Flags = uint64(elf.SHF_ALLOC)
+		}
+		binary.Write(&obj, binary.LittleEndian, sh)
+	}
+	return obj.Bytes()
+}
+
+// Build the test object, scan it and check what came out, reporting
+// each check to w. Fails if any of them did.
+func SelfTest(ctx context.Context, w io.Writer, opts *Options) error {
+	archive := selfTestArchive()
+	falcon, parts := selfTestFalcon()
+	obj := selfTestObject(selfTestDeflate(archive), selfTestDeflate(falcon))
+
+	tmp, err := ioutil.TempDir("", "scanner-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	fname := path.Join(tmp, "nv-kernel.o_binary")
+	if err := ioutil.WriteFile(fname, obj, os.FileMode(0666)); err != nil {
+		return err
+	}
+	out := MemFS{}
+	p := &Processor{Destdir: tmp, Source: fname, Output: out, NoQuirks: true,
+		Options: opts}
+	if err := p.ScanObjectContext(ctx, fname); err != nil {
+		return err
+	}
+
+	failed := 0
+	check := func(ok bool, format string, args ...interface{}) {
+		status := "ok"
+		if !ok {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%-4s %s\n", status, fmt.Sprintf(format, args...))
+	}
+	check(p.Version == selfTestVersion, "driver version %q found", p.Version)
+	check(p.Stats.Archives == 1, "%d netlist archive found", p.Stats.Archives)
+	for _, r := range selfTestRegions {
+		name := path.Join("NET_IMG_07", r.Name)
+		if r.Id == 18 {
+			// Scalars only go in info.txt
+			continue
+		}
+		check(bytes.Equal(out[name], r.Data), "%s is %d bytes as packed", name, len(r.Data))
+	}
+	info := string(out["NET_IMG_07/info.txt"])
+	check(strings.Contains(info, "family: pascal"), "NET_IMG_07 taken for pascal")
+	check(strings.Contains(info, "netlist_num: 7"), "NET_IMG_07 has netlist_num 7")
+	check(bytes.Equal(out["falcon/image"], falcon), "falcon image is %d bytes as deflated",
+		len(falcon))
+	for _, name := range []string{"bootloader", "code", "data"} {
+		check(bytes.Equal(out["falcon/" + name], parts[name]),
+			"falcon %s is split out as described", name)
+	}
+	bad := 0
+	referenced := true
+	for _, e := range p.Manifest {
+		if classify.HashOf(out[e.Path]) != e.SHA256 || e.Codec != "deflate" {
+			bad++
+		}
+		// The pointers are at selftest_blobs, +0x8 and so on
+		referenced = referenced && len(e.ReferencedBy) != 0 &&
+			strings.HasPrefix(e.ReferencedBy[0], "selftest_blobs")
+	}
+	check(len(p.Manifest) != 0 && bad == 0, "%d manifest entries match what was written",
+		len(p.Manifest))
+	check(referenced, "manifest entries are referenced by selftest_blobs")
+
+	if failed != 0 {
+		return fmt.Errorf("%d of the self-test's checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package extract
+
+import "archive/tar"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "github.com/envytools/firmware/pkg/classify"
+
+// A Server runs scans for whoever asks over HTTP, for extraction farms
+// that would otherwise wrap the command in shell. A scan is asked for
+// at /scan, either with an object as the body of a POST, or with
+// ?path= naming an object or extracted driver under Root:
+//	$ curl --data-binary @nv-kernel.o_binary \
+//		'http://localhost:8080/scan?name=nv-kernel.o_binary' > fw.tar
+//	$ curl 'http://localhost:8080/scan?path=390.48/kernel&format=json'
+// Extracting a package means running it, or 7z on it, so uploaded
+// packages are never taken, and packages under Root only if Packages
+// is set.
+// The reply is a tarball of what scan -output-format tar writes,
+// manifest.json included, or with format=json the manifest and the
+// summary counts. driver-version, only and exclude are taken as scan
+// takes them. /health answers "ok".
+type Server struct {
+	// Where ?path= inputs are looked up, or "" to only take uploads
+	Root string
+	// Whether packages under Root are extracted and scanned
+	Packages bool
+	// The most an upload may be, or 0 for DefaultMaxUpload
+	MaxUpload int64
+	// How many scans to run at once. Requests past that wait their
+	// turn.
+	Jobs int
+	// What each scan goes by, or nil for DefaultOptions
+	Options *Options
+	slots chan struct{}
+	once sync.Once
+}
+
+// Big enough for any driver's kernel object or .sys file
+const DefaultMaxUpload = 512 << 20
+
+// What format=json replies with
+type ScanReply struct {
+	Version string `json:"version"`
+	Manifest []ManifestEntry `json:"manifest"`
+	Stats Stats `json:"stats"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/health":
+		fmt.Fprintf(w, "ok\n")
+	case "/scan":
+		// A scan that panics is answered like any other failed
+		// scan rather than by net/http dropping the connection
+		p := &Processor{Options: s.Options}
+		defer func() {
+			if v := recover(); v != nil {
+				err := httpError(w, http.StatusInternalServerError, "%v", v)
+				p.warnf("%s %s: %v\n", r.Method, r.URL, err)
+			}
+		}()
+		if err := s.scan(w, r); err != nil {
+			p.warnf("%s %s: %v\n", r.Method, r.URL, err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Reply with an error, and return it for the log
+func httpError(w http.ResponseWriter, code int, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	http.Error(w, err.Error(), code)
+	return err
+}
+
+func (s *Server) scan(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = "tar"
+	case "tar", "json":
+	default:
+		return httpError(w, http.StatusBadRequest, "unknown format %q", format)
+	}
+	only, err := classify.ParseCategories(q.Get("only"))
+	if err != nil {
+		return httpError(w, http.StatusBadRequest, "only: %v", err)
+	}
+	exclude, err := classify.ParseCategories(q.Get("exclude"))
+	if err != nil {
+		return httpError(w, http.StatusBadRequest, "exclude: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "scanner-serve")
+	if err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The input is either under Root, or an object uploaded into the
+	// temporary directory
+	var input, name string
+	switch {
+	case q.Get("path") != "" && s.Root == "":
+		return httpError(w, http.StatusForbidden, "no inputs by path on this server")
+	case q.Get("path") != "":
+		name = strings.TrimPrefix(path.Clean("/" + q.Get("path")), "/")
+		if name == "" {
+			return httpError(w, http.StatusBadRequest, "path names all of the root")
+		}
+		if input, err = s.underRoot(name); err != nil {
+			return httpError(w, http.StatusNotFound, "%s: not found", name)
+		}
+		if IsPackage(input) && !s.Packages {
+			return httpError(w, http.StatusForbidden,
+				"%s: packages aren't extracted on this server", name)
+		}
+	case r.Method != http.MethodPost:
+		return httpError(w, http.StatusMethodNotAllowed,
+			"POST an object, or give its path")
+	default:
+		name = path.Base(path.Clean("/" + q.Get("name")))
+		if name == "/" {
+			name = "nv-kernel.o_binary"
+		}
+		if IsPackage(name) {
+			return httpError(w, http.StatusForbidden,
+				"%s: uploaded packages aren't taken, only objects", name)
+		}
+		max := s.MaxUpload
+		if max <= 0 {
+			max = DefaultMaxUpload
+		}
+		input = filepath.Join(tmp, "upload")
+		f, err := os.Create(input)
+		if err != nil {
+			return httpError(w, http.StatusInternalServerError, "%v", err)
+		}
+		_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, max))
+		f.Close()
+		if err != nil {
+			return httpError(w, http.StatusRequestEntityTooLarge,
+				"reading the upload: %v", err)
+		}
+	}
+
+	// Wait for a slot, unless the client gives up first
+	s.once.Do(func() {
+		jobs := s.Jobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		s.slots = make(chan struct{}, jobs)
+	})
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	// The tarball goes into a file first, so that a scan that fails
+	// half way can still be answered with an error
+	blobs := filepath.Join(tmp, "blobs")
+	if err := os.Mkdir(blobs, os.FileMode(0777)); err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	out, err := ioutil.TempFile(tmp, "out")
+	if err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	sorted, err := NewSortedTarFS(tw, tmp)
+	if err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	p := &Processor{Destdir: blobs, Source: name, Version: q.Get("driver-version"),
+		Only: only, Exclude: exclude, Output: sorted, LogPrefix: name + ": ",
+		Options: s.Options}
+	info, err := os.Stat(input)
+	if err != nil {
+		return httpError(w, http.StatusNotFound, "%s: not found", name)
+	}
+	if IsPackage(input) || info.IsDir() {
+		p.Source = ""
+		err = p.ScanDriver(r.Context(), input)
+	} else {
+		err = p.ScanObjectContext(r.Context(), input)
+	}
+	if err != nil {
+		// Named the way the client named it, not where it is here
+		msg := err.Error()
+		if strings.Contains(msg, input) {
+			msg = strings.Replace(msg, input, name, -1)
+		} else {
+			msg = name + ": " + msg
+		}
+		return httpError(w, http.StatusUnprocessableEntity, "%s", msg)
+	}
+	if err := p.WriteManifest(); err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	if err := sorted.Flush(); err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	p.infof("%d files written\n", len(p.Manifest))
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		data, err := json.MarshalIndent(ScanReply{p.Version, p.Manifest, p.Stats}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return httpError(w, http.StatusInternalServerError, "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	_, err = io.Copy(w, out)
+	return err
+}
+
+// Where a path names under Root, with symlinks followed. Cleaning the
+// path keeps it from climbing out of Root with "..", but a symlink
+// under Root could still lead anywhere.
+func (s *Server) underRoot(name string) (string, error) {
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	input, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	if input, err = filepath.Abs(input); err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, input); err != nil || rel == ".." ||
+		strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", input, root)
+	}
+	return input, nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "archive/tar"
+import "compress/bzip2"
+import "compress/gzip"
+import "context"
+import "io"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+import "github.com/envytools/firmware/pkg/classify"
+import "github.com/envytools/firmware/pkg/netlist"
+
+// Jetson's Linux for Tegra ships the nvgpu firmware as files of their
+// own, in a directory per chip under /lib/firmware: netlist images
+// like gv11b/NETB_img.bin, and the PMU, ACR, FECS and GPCCS ucode.
+// Nothing is compressed, so each file only needs to be taken apart.
+
+// Scan a Tegra firmware tree, given as a directory or as a BSP tarball
+// (.tar, .tar.gz, .tgz, .tbz2 or .tar.bz2). Every .bin file in it is
+// written under the same path, with netlist images split up into a
+// directory named after the file. From a tarball only the files under
+// a firmware directory are taken.
+func (p *Processor) ScanTegra(ctx context.Context, input string) error {
+	source := p.Source
+	defer func() { p.Source = source }()
+
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return filepath.Walk(input, func(fname string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || path.Ext(fname) != ".bin" {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			rel, err := filepath.Rel(input, fname)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return err
+			}
+			p.Source = fname
+			return p.firmwareFile(filepath.ToSlash(rel), data)
+		})
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(input, ".gz"), strings.HasSuffix(input, ".tgz"):
+		if r, err = gzip.NewReader(f); err != nil {
+			return err
+		}
+	case strings.HasSuffix(input, ".bz2"), strings.HasSuffix(input, ".tbz2"):
+		r = bzip2.NewReader(f)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		name := path.Clean(hdr.Name)
+		i := strings.LastIndex(name, "firmware/")
+		if hdr.Typeflag != tar.TypeReg || path.Ext(name) != ".bin" || i < 0 {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		p.Source = input + ":" + name
+		if err := p.firmwareFile(name[i+len("firmware/"):], data); err != nil {
+			return err
+		}
+	}
+}
+
+// Write out a firmware file, from a Tegra firmware tree or a driver's,
+// under its own name, or split it up if it's a netlist image
+func (p *Processor) firmwareFile(name string, data []byte) error {
+	origin := Origin{CompressedSize: len(data), Codec: "stored"}
+	header, entries, wide, err := netlist.ParseArchive(data, &p.opts().Archives)
+	broken, err := p.partialArchive(err, origin)
+	if err == nil {
+		if !p.wanted("gr", origin) {
+			return nil
+		}
+		p.checkEntries(data, entries, origin)
+		p.Stats.Partial += len(broken)
+		p.writeArchive(strings.TrimSuffix(name, ".bin"), data, header, entries,
+			broken, wide, origin)
+		p.Stats.Archives++
+		return p.err
+	}
+
+	// Containers, such as GSP's booter ucode, get split up as they
+	// would be out of a driver
+	if p.handle(data, origin) {
+		return p.err
+	}
+
+	// The file names say what the ucode is for, e.g. pmu_bl.bin or
+	// fecs_sig.bin, when the contents don't
+	typ, note := classify.Identify(data)
+	if typ == "" {
+		typ = strings.TrimSuffix(path.Base(name), ".bin")
+	}
+	if !p.wanted(classify.Category(typ), origin) {
+		return nil
+	}
+	p.emit(name, data, origin, typ, "")
+	if note != "" {
+		p.infof("%s: %s\n", name, note)
+	}
+	if _, _, _, ok := classify.ParseHS(data); ok {
+		p.emitHSParts(strings.TrimSuffix(name, ".bin"), data, origin, "hs")
+	}
+	return p.err
+}
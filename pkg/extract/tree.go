@@ -0,0 +1,138 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "context"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// Which file in a driver matters depends on its era: the firmware is
+// in nv-kernel.o_binary for most of them, but nv-modeset-kernel.o_binary
+// has some of its own, and newer drivers ship firmware as .bin files
+// as well. ScanTree scans all of them, for when it isn't known which.
+
+// Whether a file in a driver tree is a kernel object worth scanning
+func isTreeObject(name string) bool {
+	if path.Ext(name) == ".o_binary" {
+		return true
+	}
+	for _, kernel := range kernelObjects {
+		if name == kernel {
+			return true
+		}
+	}
+	return false
+}
+
+// Find what there is to scan in an extracted driver: its kernel
+// objects, with the one findKernelObject picks first, and the .bin
+// files under a firmware directory. Both are in order otherwise.
+func FindScannable(dir string) (objects, firmware []string) {
+	filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		switch {
+		case isTreeObject(info.Name()):
+			objects = append(objects, fname)
+		case path.Ext(fname) == ".bin" &&
+			strings.Contains("/" + filepath.ToSlash(rel), "/firmware/"):
+			firmware = append(firmware, fname)
+		}
+		return nil
+	})
+	sort.Strings(objects)
+	sort.Strings(firmware)
+	kernel := findKernelObject(dir)
+	for i, fname := range objects {
+		if fname == kernel {
+			copy(objects[1:i+1], objects[:i])
+			objects[0] = kernel
+		}
+	}
+	return
+}
+
+// Scan every object and firmware file in an extracted driver, as found
+// by FindScannable, into the same output. Each file's manifest entries
+// have it as their source. The quirks for the driver version are only
+// for the kernel object, and left out for the rest.
+func (p *Processor) ScanTree(ctx context.Context, dir string) error {
+	objects, firmware := FindScannable(dir)
+	if len(objects) + len(firmware) == 0 {
+		return &NotDriverError{dir, "no objects or firmware files found"}
+	}
+	source, noQuirks := p.Source, p.NoQuirks
+	defer func() {
+		p.Source, p.NoQuirks = source, noQuirks
+	}()
+	if p.Version == "" {
+		p.Version = DriverVersion(dir, findKernelObject(dir))
+	}
+	if p.Variant == "" {
+		p.Variant = DriverVariant(dir)
+	}
+	p.infof("%s: %d objects and %d firmware files to scan\n", dir, len(objects),
+		len(firmware))
+
+	for i, fname := range objects {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.Source = fname
+		if i > 0 || findKernelObject(dir) == "" {
+			p.NoQuirks, p.quirk = true, nil
+		}
+		p.debugf("%s: scanning\n", fname)
+		if err := p.scanObject(ctx, fname); err != nil {
+			if p.Mode == "strict" || ctx.Err() != nil {
+				return err
+			}
+			p.warnf("%s: %v, skipping it\n", fname, err)
+		}
+	}
+	p.NoQuirks = noQuirks
+
+	for _, fname := range firmware {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		p.Source = fname
+		if ok, _ := path.Match("gsp*.bin", path.Base(fname)); ok {
+			p.gspFile(fname, data)
+		} else if err := p.firmwareFile(p.uniqueName(path.Base(fname)), data); err != nil {
+			return err
+		}
+	}
+	return p.err
+}
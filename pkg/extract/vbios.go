@@ -0,0 +1,96 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "path"
+import "github.com/envytools/firmware/pkg/vbios"
+
+func init() {
+	RegisterHandler("vbios", vbiosHandler{})
+}
+
+// A VBIOS gets split into its ROM images and the falcon ucode it
+// carries (FWSEC, devinit and preOS ucode), with what its BIT table
+// says in info.txt.
+type vbiosHandler struct{}
+
+func (vbiosHandler) Detect(data []byte) bool {
+	if len(vbios.Images(data)) == 0 {
+		return false
+	}
+	_, ok := vbios.ParseBIT(data)
+	return ok
+}
+
+func (vbiosHandler) Extract(data []byte, s *Sink) error {
+	images := vbios.Images(data)
+	tokens, _ := vbios.ParseBIT(data)
+	dir := s.UniqueName("vbios")
+	var info bytes.Buffer
+	for i, img := range images {
+		kind := vbios.CodeTypes[img.CodeType]
+		if kind == "" {
+			kind = fmt.Sprintf("type_0x%02x", img.CodeType)
+		}
+		s.Emit(path.Join(dir, fmt.Sprintf("image_%d_%s.rom", i, kind)),
+			data[img.Offset:img.Offset+img.Size], "vbios_image", dir)
+		fmt.Fprintf(&info, "image %d: 0x%x+0x%x %s\n", i, img.Offset, img.Size, kind)
+	}
+	for _, t := range tokens {
+		fmt.Fprintf(&info, "bit %q: version %d, 0x%x+0x%x\n", t.Id, t.Version,
+			t.Offset, t.Size)
+	}
+	for _, script := range vbios.InitScripts(data, tokens) {
+		fmt.Fprintf(&info, "devinit script: 0x%x\n", script)
+	}
+
+	space := vbios.UcodeSpace(data, images)
+	ucodes := vbios.Ucodes(data, tokens, space)
+	for _, u := range ucodes {
+		name := path.Join(dir, s.UniqueName(u.Name()))
+		s.Emit(name, space[u.Offset:u.Offset+u.Size], "vbios_ucode", dir)
+		desc := "pre-v2 descriptor"
+		if u.Version != 0 {
+			desc = fmt.Sprintf("v%d descriptor", u.Version)
+		}
+		fmt.Fprintf(&info, "ucode 0x%02x: %s, 0x%x+0x%x, %s\n",
+			u.Type, path.Base(name), u.Offset, u.Size, desc)
+	}
+	s.WriteFile(path.Join(dir, "info.txt"), info.Bytes())
+	s.Infof("%s: VBIOS with %d images and %d falcon ucodes\n", dir,
+		len(images), len(ucodes))
+	return nil
+}
+
+// Take a VBIOS image, as dumped from a card, apart
+func (p *Processor) ProcessVBIOS(data []byte) error {
+	h := vbiosHandler{}
+	if !h.Detect(data) {
+		return fmt.Errorf("no PCI ROM image with a BIT table")
+	}
+	origin := Origin{CompressedSize: len(data), Codec: "stored"}
+	if err := h.Extract(data, &Sink{p, origin}); err != nil {
+		return err
+	}
+	return p.err
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "github.com/envytools/firmware/pkg/classify"
+
+// Fingerprints of known-good extractions: for each driver version,
+// the sha256 of every file it should produce. None come with the
+// scanner; -fingerprints loads them from a JSON file of this shape,
+// and -record-fingerprints adds the current run to such a file.
+var fingerprints = make(map[string]map[string]string)
+
+func LoadFingerprints(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var extra map[string]map[string]string
+	if err = json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	for version, files := range extra {
+		fingerprints[version] = files
+	}
+	return nil
+}
+
+func (p *Processor) RecordFingerprints(fname string) error {
+	all := make(map[string]map[string]string)
+	if data, err := ioutil.ReadFile(fname); err == nil {
+		if err = json.Unmarshal(data, &all); err != nil {
+			return fmt.Errorf("%s: %v", fname, err)
+		}
+	}
+	files := make(map[string]string)
+	for _, e := range p.Manifest {
+		files[e.Path] = e.SHA256
+	}
+	all[p.Version] = files
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, append(data, '\n'), os.FileMode(0666))
+}
+
+// Check what was extracted against the fingerprints for the driver
+// version. Returns a line for each file that is missing, unexpected
+// or different.
+func (p *Processor) Verify() ([]string, error) {
+	files := make(map[string]string)
+	for _, e := range p.Manifest {
+		files[e.Path] = e.SHA256
+	}
+	return VerifyFiles(p.Version, files)
+}
+
+// Same as Verify, for a set of file names and their hashes
+func VerifyFiles(version string, files map[string]string) ([]string, error) {
+	expected, ok := fingerprints[version]
+	if !ok {
+		return nil, fmt.Errorf("No fingerprints for driver version %q; record them from a good run with -record-fingerprints",
+			version)
+	}
+	var problems []string
+	seen := make(map[string]bool)
+	for name, sum := range files {
+		seen[name] = true
+		hash, ok := expected[name]
+		switch {
+		case !ok:
+			problems = append(problems, "extra: " + name)
+		case hash != sum:
+			problems = append(problems, fmt.Sprintf(
+				"corrupt: %s (sha256 %s, expected %s)",
+				name, sum, hash))
+		}
+	}
+	for name := range expected {
+		if !seen[name] {
+			problems = append(problems, "missing: " + name)
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+type fileSum struct {
+	SHA256 string
+	Size int64
+}
+
+// Hash every extracted file in an output directory, leaving out the
+// files that describe the extraction rather than being part of it.
+func SumDir(dir string) (map[string]fileSum, error) {
+	sums := make(map[string]fileSum)
+	err := filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		switch {
+		case name == "manifest.json", name == "unknown.txt",
+			strings.HasSuffix(name, ".meta.json"):
+			return nil
+		}
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		sums[name] = fileSum{classify.HashOf(data), info.Size()}
+		return nil
+	})
+	return sums, err
+}
+
+// Get the extracted files for one side of a diff. Objects are scanned
+// into a temporary directory first.
+func diffSide(name string, opts *Options) (map[string]fileSum, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return SumDir(name)
+	}
+	tmp, err := ioutil.TempDir("", "scanner-diff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	p := &Processor{Destdir: tmp, Source: name, Options: opts}
+	if err := p.ScanObject(name); err != nil {
+		return nil, err
+	}
+	return SumDir(tmp)
+}
+
+// Compare two extractions, each either an output directory or an
+// object file to scan, writing a line to w for each file added,
+// removed or changed. Returns whether they differ.
+func Diff(w io.Writer, a, b string, opts *Options) (bool, error) {
+	old, err := diffSide(a, opts)
+	if err != nil {
+		return false, err
+	}
+	cur, err := diffSide(b, opts)
+	if err != nil {
+		return false, err
+	}
+
+	var lines []string
+	for name, o := range old {
+		c, ok := cur[name]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("removed %s %s %d",
+				name, o.SHA256, o.Size))
+		case c.SHA256 != o.SHA256:
+			lines = append(lines, fmt.Sprintf("changed %s %s -> %s %+d",
+				name, o.SHA256, c.SHA256, c.Size - o.Size))
+		}
+	}
+	for name, c := range cur {
+		if _, ok := old[name]; !ok {
+			lines = append(lines, fmt.Sprintf("added %s %s %d",
+				name, c.SHA256, c.Size))
+		}
+	}
+	sort.Slice(lines, func (i, j int) bool {
+		return strings.SplitN(lines[i], " ", 3)[1] <
+			strings.SplitN(lines[j], " ", 3)[1]
+	})
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return true, err
+		}
+	}
+	return len(lines) != 0, nil
+}
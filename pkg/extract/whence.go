@@ -0,0 +1,95 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package extract
+
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "sort"
+import "strings"
+
+// The licence linux-firmware carries NVIDIA's firmware under
+const whenceLicence = "Redistributable. See LICENCE.nvidia for details."
+
+// Where a nouveau file goes in the firmware directory, going by its
+// path in the output, or "" if it isn't one
+func firmwarePath(name string) string {
+	for _, top := range []string{"nvidia/", "nouveau/"} {
+		if strings.HasPrefix(name, top) {
+			return name
+		}
+		if i := strings.Index(name, "/" + top); i >= 0 {
+			return name[i+1:]
+		}
+	}
+	return ""
+}
+
+// Write the nouveau files of a scan up as a WHENCE entry, the way
+// linux-firmware lists where its files came from: a File: line for
+// each, the driver version and the licence, plus the sha256 of each
+// so that a submission can be checked against the extraction. Where
+// several archives have a file, the one named after Chipset is
+// listed.
+func (p *Processor) WriteWhence(fname string) error {
+	hashes := make(map[string]string)
+	own := make(map[string]bool)
+	for _, e := range p.Manifest {
+		name := firmwarePath(e.Path)
+		if e.Type != "nouveau" || name == "" {
+			continue
+		}
+		mine := p.Chipset != nil && (e.Archive == p.Chipset.Name() ||
+			e.Archive == p.Chipset.Codename)
+		if _, ok := hashes[name]; ok && (own[name] || !mine) {
+			continue
+		}
+		hashes[name], own[name] = e.SHA256, mine
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("no nouveau files to list in %s; -chipset names them", fname)
+	}
+	var names []string
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	version := p.Version
+	if version == "" {
+		version = "unknown"
+	}
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "--------------------------------------------------------------------------\n\n")
+	fmt.Fprintf(&w, "Driver: nouveau - NVIDIA GPU driver\n\n")
+	for _, name := range names {
+		fmt.Fprintf(&w, "File: %s\n", name)
+	}
+	fmt.Fprintf(&w, "\nVersion: extracted from the NVIDIA %s driver\n\n", version)
+	fmt.Fprintf(&w, "sha256:\n")
+	for _, name := range names {
+		fmt.Fprintf(&w, "  %s  %s\n", hashes[name], name)
+	}
+	fmt.Fprintf(&w, "\nLicence: %s\n\n", whenceLicence)
+	fmt.Fprintf(&w, "--------------------------------------------------------------------------\n")
+	return ioutil.WriteFile(fname, w.Bytes(), os.FileMode(0666))
+}
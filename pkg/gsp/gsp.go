@@ -0,0 +1,325 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package gsp parses the firmware GSP-RM is made of, as NVIDIA ships
+// it from 465.x on: the gsp*.bin images, ELF files holding the RISC-V
+// image GSP-RM runs as, its version and a signature for each chip
+// family; the RISC-V bootloader that starts it, with its monitor and
+// manifest; and the booter ucode that sets up WPR2 for it on Turing
+// and Ampere. This is what nouveau's r535 code reads of them.
+package gsp
+
+import "bytes"
+import "debug/elf"
+import "encoding/binary"
+import "strconv"
+import "strings"
+
+// A part of a file, as an offset into it and a size
+type Section struct {
+	Name string `json:"name"`
+	Offset int `json:"offset"`
+	Size int `json:"size"`
+}
+
+// The data of a section, out of the file it's in
+func (s Section) Data(data []byte) []byte {
+	return data[s.Offset:s.Offset+s.Size]
+}
+
+// A GSP-RM image, gsp_tu10x.bin and the like. Offsets are all into
+// the file, those of the sections of the RISC-V image included.
+type Image struct {
+	// Every section of the ELF file with contents, in file order
+	Sections []Section `json:"sections"`
+	// The RISC-V image (.fwimage) and the ELF sections in it, if it
+	// is an ELF file itself, as it is from 525.x on
+	RM Section `json:"rm"`
+	RMSections []Section `json:"rm_sections,omitempty"`
+	// From .fwversion
+	Version string `json:"version,omitempty"`
+	// The .fwsignature_* sections, named after the chip family each
+	// is for (tu10x, ga10x, ...)
+	Signatures []Section `json:"signatures,omitempty"`
+	// How the RISC-V image gets mapped for GSP to load it
+	Radix3 Radix3 `json:"radix3"`
+}
+
+// The driver maps the RISC-V image for GSP through a three level page
+// table of 4K pages, each level holding the 64-bit addresses of the
+// pages of the next one. How many pages each level takes only depends
+// on the size of the image.
+type Radix3 struct {
+	PageSize int `json:"page_size"`
+	Pages [3]int `json:"pages"`
+}
+
+const gspPageSize = 0x1000
+
+func radix3(size int) Radix3 {
+	r := Radix3{PageSize: gspPageSize}
+	r.Pages[2] = (size + gspPageSize - 1) / gspPageSize
+	r.Pages[1] = (r.Pages[2] * 8 + gspPageSize - 1) / gspPageSize
+	r.Pages[0] = (r.Pages[1] * 8 + gspPageSize - 1) / gspPageSize
+	return r
+}
+
+// The sections of an ELF file with contents. Those that don't fit in
+// the data make it not one.
+func elfSections(data []byte) ([]Section, bool) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	var sections []Section
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NULL || s.Type == elf.SHT_NOBITS || s.Size == 0 {
+			continue
+		}
+		if s.Offset + s.Size > uint64(len(data)) || s.Offset + s.Size < s.Offset {
+			return nil, false
+		}
+		sections = append(sections, Section{s.Name, int(s.Offset), int(s.Size)})
+	}
+	return sections, true
+}
+
+// Parse a GSP-RM image: an ELF file with a .fwimage section
+func ParseImage(data []byte) (*Image, bool) {
+	if !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		return nil, false
+	}
+	sections, ok := elfSections(data)
+	if !ok {
+		return nil, false
+	}
+	img := &Image{Sections: sections}
+	found := false
+	for _, s := range sections {
+		switch {
+		case s.Name == ".fwimage":
+			img.RM, found = s, true
+		case s.Name == ".fwversion":
+			img.Version = strings.TrimRight(string(s.Data(data)), "\x00\n")
+		case strings.HasPrefix(s.Name, ".fwsignature_"):
+			sig := s
+			sig.Name = strings.TrimPrefix(s.Name, ".fwsignature_")
+			img.Signatures = append(img.Signatures, sig)
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	if inner, ok := elfSections(img.RM.Data(data)); ok {
+		for _, s := range inner {
+			s.Offset += img.RM.Offset
+			img.RMSections = append(img.RMSections, s)
+		}
+	}
+	img.Radix3 = radix3(img.RM.Size)
+	return img, true
+}
+
+// The bin header that starts the bootloader and booter images, as for
+// HS ucode: the NVIDIA vendor id, then where the descriptor and the
+// ucode are
+type binHeader struct {
+	Magic, Version, Size, HeaderOffset, DataOffset, DataSize uint32
+}
+
+func parseBinHeader(data []byte) (binHeader, bool) {
+	var bin binHeader
+	if binary.Read(bytes.NewReader(data), binary.LittleEndian, &bin) != nil ||
+		bin.Magic != 0x10de || !fits(bin.DataOffset, bin.DataSize, len(data)) ||
+		!fits(bin.HeaderOffset, 0, len(data)) {
+		return bin, false
+	}
+	return bin, true
+}
+
+// Whether off+size is within length, without wrapping around
+func fits(off, size uint32, length int) bool {
+	return uint64(off) + uint64(size) <= uint64(length)
+}
+
+// The descriptor of the RISC-V bootloader, RM_RISCV_UCODE_DESC in
+// NVIDIA's headers. Offsets are into the ucode after the bin header.
+type RiscvDesc struct {
+	Version uint32 `json:"version"`
+	BootloaderOffset uint32 `json:"bootloader_offset"`
+	BootloaderSize uint32 `json:"bootloader_size"`
+	BootloaderParamOffset uint32 `json:"bootloader_param_offset"`
+	BootloaderParamSize uint32 `json:"bootloader_param_size"`
+	RiscvElfOffset uint32 `json:"riscv_elf_offset"`
+	RiscvElfSize uint32 `json:"riscv_elf_size"`
+	AppVersion uint32 `json:"app_version"`
+	ManifestOffset uint32 `json:"manifest_offset"`
+	ManifestSize uint32 `json:"manifest_size"`
+	MonitorDataOffset uint32 `json:"monitor_data_offset"`
+	MonitorDataSize uint32 `json:"monitor_data_size"`
+	MonitorCodeOffset uint32 `json:"monitor_code_offset"`
+	MonitorCodeSize uint32 `json:"monitor_code_size"`
+	IsMonitorEnabled uint32 `json:"is_monitor_enabled"`
+	SwbromCodeOffset uint32 `json:"swbrom_code_offset"`
+	SwbromCodeSize uint32 `json:"swbrom_code_size"`
+	SwbromDataOffset uint32 `json:"swbrom_data_offset"`
+	SwbromDataSize uint32 `json:"swbrom_data_size"`
+	FbReservedSize uint32 `json:"fb_reserved_size"`
+	SignedAsCode uint32 `json:"signed_as_code"`
+}
+
+// A RISC-V bootloader image, bootloader-535.113.01.bin in
+// linux-firmware and kgspBinArchiveGspRmBoot in the driver
+type Bootloader struct {
+	Desc RiscvDesc `json:"desc"`
+	// The ucode after the bin header, and its parts, with offsets
+	// into the file
+	Ucode Section `json:"ucode"`
+	Parts []Section `json:"parts"`
+}
+
+// Parse a RISC-V bootloader image: a bin header pointing at a
+// descriptor whose monitor code and manifest are in the ucode
+func ParseBootloader(data []byte) (*Bootloader, bool) {
+	bin, ok := parseBinHeader(data)
+	if !ok || !fits(bin.HeaderOffset, 84, len(data)) {
+		return nil, false
+	}
+	b := &Bootloader{Ucode: Section{"ucode", int(bin.DataOffset), int(bin.DataSize)}}
+	binary.Read(bytes.NewReader(data[bin.HeaderOffset:]), binary.LittleEndian, &b.Desc)
+	d := b.Desc
+	if d.Version == 0 || d.Version > 0xff || d.MonitorCodeSize == 0 || d.ManifestSize == 0 {
+		return nil, false
+	}
+	for _, part := range []struct {
+		name string
+		off, size uint32
+	}{
+		{"monitor_code", d.MonitorCodeOffset, d.MonitorCodeSize},
+		{"monitor_data", d.MonitorDataOffset, d.MonitorDataSize},
+		{"manifest", d.ManifestOffset, d.ManifestSize},
+		{"swbrom_code", d.SwbromCodeOffset, d.SwbromCodeSize},
+		{"swbrom_data", d.SwbromDataOffset, d.SwbromDataSize},
+		{"riscv_elf", d.RiscvElfOffset, d.RiscvElfSize},
+	} {
+		if !fits(part.off, part.size, int(bin.DataSize)) {
+			return nil, false
+		}
+		if part.size != 0 {
+			b.Parts = append(b.Parts, Section{part.name,
+				int(bin.DataOffset) + int(part.off), int(part.size)})
+		}
+	}
+	return b, true
+}
+
+// The HS header of the booter ucode, nvfw_hs_header_v2 in nouveau.
+// Unlike the older HS header, the patch location, patch signature
+// index and signature count are offsets of the words that hold them.
+type booterHeader struct {
+	SigProdOffset, SigProdSize uint32
+	PatchLoc, PatchSig uint32
+	MetaDataOffset, MetaDataSize uint32
+	NumSig uint32
+	HeaderOffset, HeaderSize uint32
+}
+
+// The booter load or unload ucode, which runs on SEC2 to set up WPR2
+// for GSP-RM and start its bootloader, or tear it down again
+type Booter struct {
+	// The production signatures, one after another, and how many
+	// there are
+	Signatures Section `json:"signatures"`
+	NumSig int `json:"num_sig"`
+	// Where in the OS code the signature goes, and which one
+	PatchLoc uint32 `json:"patch_loc"`
+	PatchSig uint32 `json:"patch_sig"`
+	// What the signatures are checked against
+	FuseVer uint32 `json:"fuse_ver"`
+	EngineId uint32 `json:"engine_id"`
+	UcodeId uint32 `json:"ucode_id"`
+	// The non-secure OS code and data and the secure apps, with
+	// offsets into the file
+	Parts []Section `json:"parts"`
+}
+
+// Parse a booter image: a bin header pointing at a v2 HS header, whose
+// load header lays out the ucode after the bin header
+func ParseBooter(data []byte) (*Booter, bool) {
+	bin, ok := parseBinHeader(data)
+	if !ok || !fits(bin.HeaderOffset, 36, len(data)) {
+		return nil, false
+	}
+	var hs booterHeader
+	binary.Read(bytes.NewReader(data[bin.HeaderOffset:]), binary.LittleEndian, &hs)
+	word := func(off uint32) (uint32, bool) {
+		if !fits(off, 4, len(data)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data[off:]), true
+	}
+	numSig, ok1 := word(hs.NumSig)
+	patchLoc, ok2 := word(hs.PatchLoc)
+	patchSig, ok3 := word(hs.PatchSig)
+	numApps, ok4 := word(hs.HeaderOffset + 16)
+	if !ok1 || !ok2 || !ok3 || !ok4 || numSig == 0 || numSig > 16 ||
+		hs.SigProdSize == 0 || hs.SigProdSize % numSig != 0 || patchSig >= numSig ||
+		!fits(hs.SigProdOffset, hs.SigProdSize, len(data)) ||
+		hs.MetaDataSize < 12 || !fits(hs.MetaDataOffset, hs.MetaDataSize, len(data)) ||
+		numApps == 0 || numApps > 16 || hs.HeaderSize < 20 + 8 * numApps ||
+		!fits(hs.HeaderOffset, hs.HeaderSize, len(data)) {
+		return nil, false
+	}
+	b := &Booter{
+		Signatures: Section{"sig_prod", int(hs.SigProdOffset), int(hs.SigProdSize)},
+		NumSig: int(numSig),
+		PatchLoc: patchLoc,
+		PatchSig: patchSig,
+	}
+	meta := data[hs.MetaDataOffset:]
+	b.FuseVer = binary.LittleEndian.Uint32(meta)
+	b.EngineId = binary.LittleEndian.Uint32(meta[4:])
+	b.UcodeId = binary.LittleEndian.Uint32(meta[8:])
+
+	load := data[hs.HeaderOffset:]
+	add := func(name string, off, size uint32) bool {
+		if !fits(off, size, int(bin.DataSize)) {
+			return false
+		}
+		if size != 0 {
+			b.Parts = append(b.Parts, Section{name,
+				int(bin.DataOffset) + int(off), int(size)})
+		}
+		return true
+	}
+	if !add("os_code", binary.LittleEndian.Uint32(load), binary.LittleEndian.Uint32(load[4:])) ||
+		!add("os_data", binary.LittleEndian.Uint32(load[8:]), binary.LittleEndian.Uint32(load[12:])) ||
+		uint64(patchLoc) + 4 > uint64(bin.DataSize) {
+		return nil, false
+	}
+	for i := uint32(0); i < numApps; i++ {
+		app := load[20 + 8 * i:]
+		if !add("app_" + strconv.Itoa(int(i)), binary.LittleEndian.Uint32(app),
+			binary.LittleEndian.Uint32(app[4:])) {
+			return nil, false
+		}
+	}
+	return b, true
+}
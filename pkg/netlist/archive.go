@@ -0,0 +1,315 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package netlist
+
+import "bytes"
+import "encoding/binary"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "math"
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+type ArchiveHeader struct {
+	Magic, Count int32
+}
+type ArchiveEntry struct {
+	Id, Length, Offset int32
+}
+
+// Some newer archives have entries with 64-bit length and offset
+type WideArchiveEntry struct {
+	Id, Reserved int32
+	Length, Offset int64
+}
+
+// The first word of a netlist archive is the image format version.
+// It was 0 in the blobs this was written against, and newer branches
+// bump it. Archives with a nonzero version are only believed if all of
+// their entries fit in the data, since the word could be anything.
+const maxArchiveVersion = 15
+
+// What is taken for an archive. Archives are padded out to 32KiB,
+// and have no more than 64 entries; data that doesn't fit is not
+// taken for one. Drivers that pack their archives tighter need these
+// lowered. A nil *Limits stands for DefaultLimits.
+type Limits struct {
+	MinSize int
+	MaxEntries int
+}
+
+func DefaultLimits() Limits {
+	return Limits{MinSize: 32768, MaxEntries: 64}
+}
+
+var defaultLimits = DefaultLimits()
+
+func (l *Limits) orDefault() *Limits {
+	if l == nil {
+		return &defaultLimits
+	}
+	return l
+}
+
+// Read the entry table of an archive. With strict set, also check
+// that every entry lies within the data. Otherwise entries that point
+// back into the table are left out, and returned as broken.
+func parseEntries(data []byte, header ArchiveHeader, strict bool) (entries, broken []ArchiveEntry, ok bool) {
+	dataReader := bytes.NewReader(data[8:])
+	minOffset := int32(8 + 12 * int(header.Count))
+	for i := 0; i < int(header.Count); i++ {
+		var entry ArchiveEntry
+		err := binary.Read(dataReader, binary.LittleEndian, &entry)
+		bad := err != nil || entry.Offset < minOffset
+		if strict && (bad || entry.Length < 0 ||
+			int64(entry.Offset) + int64(entry.Length) > int64(len(data))) {
+			return nil, nil, false
+		}
+		if bad {
+			broken = append(broken, entry)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, broken, len(entries) != 0
+}
+
+// Same as parseEntries, for archives with wide entries. These are
+// always checked strictly, so that a regular entry table can't be
+// mistaken for a wide one.
+func parseWideEntries(data []byte, header ArchiveHeader) ([]ArchiveEntry, bool) {
+	dataReader := bytes.NewReader(data[8:])
+	entries := make([]ArchiveEntry, header.Count)
+	minOffset := int64(8 + 24 * len(entries))
+	for i, _ := range entries {
+		var wide WideArchiveEntry
+		err := binary.Read(dataReader, binary.LittleEndian, &wide)
+		// Offset is checked first, so that the end can't wrap
+		if err != nil || wide.Offset < minOffset || wide.Length < 0 ||
+			wide.Length > int64(len(data)) - wide.Offset ||
+			wide.Offset + wide.Length > math.MaxInt32 {
+			return nil, false
+		}
+		entries[i] = ArchiveEntry{wide.Id, int32(wide.Length), int32(wide.Offset)}
+	}
+	return entries, len(entries) != 0
+}
+
+var ErrNotArchive = errors.New("not a netlist archive")
+var ErrBadEntries = errors.New("netlist archive entries make no sense")
+
+// A version 0 archive where only some of the entries make sense. The
+// rest are still returned by ParseArchive, and may run past the end of
+// the data. Broken is empty if that's all that's wrong.
+type PartialArchiveError struct {
+	Broken []ArchiveEntry
+}
+
+func (e *PartialArchiveError) Error() string {
+	if len(e.Broken) == 0 {
+		return "netlist archive entries run past the end"
+	}
+	return fmt.Sprintf("%d netlist archive entries make no sense", len(e.Broken))
+}
+
+// Whether data starts with something that passes for an archive
+// header and a sane entry table, strictly checked. Used to pick out
+// archives that were stored without compression.
+func LooksLikeArchive(data []byte, lim *Limits) bool {
+	lim = lim.orDefault()
+	var header ArchiveHeader
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if err != nil || header.Count < 0 || int(header.Count) > lim.MaxEntries ||
+		header.Magic < 0 || header.Magic > maxArchiveVersion {
+		return false
+	}
+	if _, _, ok := parseEntries(data, header, true); ok {
+		return true
+	}
+	_, ok := parseWideEntries(data, header)
+	return ok
+}
+
+// Parse a netlist archive: the header, then 12-byte or wide entries.
+// Fails with ErrNotArchive if data doesn't even look like one, or
+// ErrBadEntries for a version 0 archive whose entries are nonsense.
+// If only a few of them are, or some run past the end of data, the
+// error is a *PartialArchiveError, and the entries returned need
+// checking before use. With no error they all fit in data.
+func ParseArchive(data []byte, lim *Limits) (header ArchiveHeader, entries []ArchiveEntry, wide bool, err error) {
+	lim = lim.orDefault()
+	// If the data starts with a known version (and is large enough
+	// and has few enough entries to make sense), assume it's an
+	// archive, and try to parse it that way.
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%w: %v", ErrNotArchive, err)
+		return
+	case len(data) < lim.MinSize:
+		err = fmt.Errorf("%w: only %d bytes", ErrNotArchive, len(data))
+		return
+	case header.Count < 0 || int(header.Count) > lim.MaxEntries:
+		err = fmt.Errorf("%w: %d entries", ErrNotArchive, header.Count)
+		return
+	case header.Magic < 0 || header.Magic > maxArchiveVersion:
+		err = fmt.Errorf("%w: version %d", ErrNotArchive, header.Magic)
+		return
+	}
+
+	// Parse all the entries. Bail if any of them don't make
+	// sense, e.g. have offsets that are in the entry descriptions
+	// section.
+	entries, _, ok := parseEntries(data, header, true)
+	if !ok {
+		entries, wide = parseWideEntries(data, header)
+		ok = wide
+	}
+	if !ok && header.Magic == 0 {
+		// Keep what can be used, as long as most of it can. Any
+		// less and it was likely never an archive.
+		var broken []ArchiveEntry
+		entries, broken, ok = parseEntries(data, header, false)
+		switch {
+		case !ok || len(broken) > len(entries):
+			entries, err = nil, ErrBadEntries
+		default:
+			// The strict parse failed, so even with nothing
+			// broken something doesn't fit
+			err = &PartialArchiveError{broken}
+		}
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("%w: entries out of range", ErrNotArchive)
+	}
+	return
+}
+
+// Record where everything is in an archive, so that pack can put it
+// back together exactly: the size, each entry in table order, and any
+// bytes outside the header and entries that aren't zero.
+func WriteLayout(info *bytes.Buffer, data []byte, entries []ArchiveEntry, wide bool, table map[int]string) {
+	fmt.Fprintf(info, "size: %d\n", len(data))
+	for _, entry := range entries {
+		fmt.Fprintf(info, "entry: %d %s 0x%x 0x%x\n", entry.Id,
+			RegionName(table, int(entry.Id)), entry.Offset, entry.Length)
+	}
+
+	used := make([]bool, len(data))
+	headerSize := 8 + EntrySize(wide) * len(entries)
+	for i := 0; i < headerSize && i < len(data); i++ {
+		used[i] = true
+	}
+	for _, entry := range entries {
+		// Entries that were never checked against the data only
+		// count for what of them is in it
+		start, end := int64(entry.Offset), int64(entry.Offset) + int64(entry.Length)
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		for i := start; i < end; i++ {
+			used[i] = true
+		}
+	}
+	for i := 0; i < len(data); {
+		if used[i] || data[i] == 0 {
+			i++
+			continue
+		}
+		start := i
+		for i < len(data) && !used[i] {
+			i++
+		}
+		fill := bytes.TrimRight(data[start:i], "\x00")
+		fmt.Fprintf(info, "fill: 0x%x %s\n", start, hex.EncodeToString(fill))
+	}
+}
+
+func EntrySize(wide bool) int {
+	if wide {
+		return 24
+	}
+	return 12
+}
+
+// Regions that were added to the netlist format along with a new GPU
+// family. An archive is at least as new as the newest region it has.
+var familyRegions = []struct {
+	Id int
+	Family string
+}{
+	{36, "ampere"},		// sw_non_ctx_local_compute_load
+	{34, "turing"},		// sw_bundle64_init
+	{28, "volta"},		// swveidbundleinit
+	{33, "volta"},		// ctxreg_etpc
+	{31, "pascal"},		// ctxreg_pmrop
+	{32, "pascal"},		// ctxreg_pmucgpc
+	{26, "maxwell"},	// ctxreg_pmltc
+	{27, "maxwell"},	// ctxreg_pmfbpa
+	{19, "kepler"},		// ctxreg_ppc
+}
+
+// Returns the 32-bit value of a scalar archive entry, e.g. netlist_num
+func ScalarEntry(data []byte, entries []ArchiveEntry, id int) (uint32, bool) {
+	for _, entry := range entries {
+		if int(entry.Id) == id && entry.Length == 4 && entry.Offset >= 0 &&
+			int64(entry.Offset) + 4 <= int64(len(data)) {
+			return binary.LittleEndian.Uint32(data[entry.Offset:]), true
+		}
+	}
+	return 0, false
+}
+
+// Guess which GPU family a netlist archive is for, based on which
+// regions it has. Also says what the guess was based on.
+func IdentifyArchive(data []byte, entries []ArchiveEntry) (family, reason string) {
+	family, reason = "fermi", "no regions newer than fermi"
+	present := make(map[int]bool)
+	for _, entry := range entries {
+		present[int(entry.Id)] = true
+	}
+	for _, hint := range familyRegions {
+		if present[hint.Id] {
+			family = hint.Family
+			reason = "has " + RegionName(NameTables["ga10b"], hint.Id)
+			break
+		}
+	}
+
+	// The netlist number and register base index tell apart
+	// archives in the same family.
+	if num, ok := ScalarEntry(data, entries, 18); ok {
+		reason += fmt.Sprintf(", netlist_num %d", num)
+	}
+	if base, ok := ScalarEntry(data, entries, 17); ok {
+		reason += fmt.Sprintf(", ctxsw_reg_base_index 0x%x", base)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package netlist
+
+import "encoding/binary"
+import "errors"
+import "testing"
+
+func TestParseArchive(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		wide bool
+	}{
+		{"version 0", testArchive(0, false, testRegions), false},
+		{"version 2", testArchive(2, false, testRegions), false},
+		{"wide", testArchive(3, true, testRegions), true},
+	} {
+		_, entries, wide, err := ParseArchive(tt.data, nil)
+		if err != nil || wide != tt.wide || len(entries) != len(testRegions) {
+			t.Errorf("%s: %d entries, wide %v, %v", tt.name, len(entries), wide, err)
+		}
+		if !LooksLikeArchive(tt.data, nil) {
+			t.Errorf("%s: doesn't look like an archive", tt.name)
+		}
+	}
+}
+
+// Set the length and offset of entry i in a narrow table
+func testEntry(data []byte, i int, length, offset uint32) []byte {
+	binary.LittleEndian.PutUint32(data[8 + 12 * i + 4:], length)
+	binary.LittleEndian.PutUint32(data[8 + 12 * i + 8:], offset)
+	return data
+}
+
+// The same, in a wide table
+func testWideEntry(data []byte, i int, length, offset uint64) []byte {
+	binary.LittleEndian.PutUint64(data[8 + 24 * i + 8:], length)
+	binary.LittleEndian.PutUint64(data[8 + 24 * i + 16:], offset)
+	return data
+}
+
+func testHeader(data []byte, version, count uint32) []byte {
+	binary.LittleEndian.PutUint32(data[0:], version)
+	binary.LittleEndian.PutUint32(data[4:], count)
+	return data
+}
+
+// Archives that have to be turned away, or only partly taken, without
+// a panic
+func TestParseArchiveRejects(t *testing.T) {
+	archive := func() []byte {
+		return testArchive(0, false, testRegions)
+	}
+	wide := func() []byte {
+		return testArchive(3, true, testRegions)
+	}
+	many := make([]testRegion, 65)
+	for i := range many {
+		many[i] = testRegion{i, testWords(uint32(i))}
+	}
+	intoTable := archive()
+	for i := 0; i < 5; i++ {
+		testEntry(intoTable, i, 4, 8)
+	}
+	// Small enough for the entry table to be cut off
+	tiny := &Limits{MinSize: 0, MaxEntries: 64}
+	tests := []struct {
+		name string
+		data []byte
+		lim *Limits
+		// nil for a *PartialArchiveError
+		want error
+	}{
+		{"empty", nil, nil, ErrNotArchive},
+		{"truncated header", []byte{0, 0, 0, 0, 1, 0}, tiny, ErrNotArchive},
+		{"too short", archive()[:0x800], nil, ErrNotArchive},
+		{"truncated table", archive()[:8 + 12 * 3], tiny, ErrBadEntries},
+		{"truncated wide table", wide()[:8 + 24 * 3], tiny, ErrNotArchive},
+		{"truncated entry", archive()[:8 + 12 * len(testRegions) - 4], tiny, nil},
+		{"truncated region", archive()[:0x480], tiny, nil},
+		{"too many entries", testArchive(0, false, many), nil, ErrNotArchive},
+		{"over the limit", archive(), &Limits{MinSize: 32768, MaxEntries: 4},
+			ErrNotArchive},
+		{"negative count", testHeader(archive(), 0, 0xffffffff), nil, ErrNotArchive},
+		{"unknown version", testHeader(archive(), 16, 8), nil, ErrNotArchive},
+		{"negative version", testHeader(archive(), 0xffffffff, 8), nil, ErrNotArchive},
+		{"no entries", testHeader(archive(), 0, 0), nil, ErrBadEntries},
+		{"some into the table", testEntry(testEntry(archive(), 0, 4, 8), 1, 4, 0x10),
+			nil, nil},
+		{"most into the table", intoTable, nil, ErrBadEntries},
+		{"past the end", testEntry(archive(), 0, 0x100, 0x7f80), nil, nil},
+		{"negative length", testEntry(archive(), 0, 0x80000000, 0x400), nil, nil},
+		{"offset and size overflow", testEntry(archive(), 0, 0x7fffffff, 0x7fffff00),
+			nil, nil},
+		{"past the end, versioned", testEntry(testHeader(archive(), 2, 8), 0, 0x100, 0x7f80),
+			nil, ErrNotArchive},
+		{"wide past the end", testWideEntry(wide(), 0, 0x100, 0x7f80), nil, ErrNotArchive},
+		{"wide negative length", testWideEntry(wide(), 0, 1 << 63, 0x400), nil,
+			ErrNotArchive},
+		{"wide offset and size overflow",
+			testWideEntry(wide(), 0, 0x100, 0x7fffffffffffff00),
+			nil, ErrNotArchive},
+		{"wide past 32 bits", testWideEntry(wide(), 0, 0x100, 1 << 32), nil,
+			ErrNotArchive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panic: %v", r)
+				}
+			}()
+			if LooksLikeArchive(tt.data, tt.lim) {
+				t.Error("looks like an archive")
+			}
+			_, entries, _, err := ParseArchive(tt.data, tt.lim)
+			var partial *PartialArchiveError
+			switch {
+			case err == nil:
+				t.Fatalf("no error, with %d entries", len(entries))
+			case tt.want == nil && !errors.As(err, &partial):
+				t.Errorf("%v, want a *PartialArchiveError", err)
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("%v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package netlist
+
+import "bytes"
+import "fmt"
+import "strings"
+import "text/tabwriter"
+
+// The GR context image is laid out by the ctxreg lists: each register
+// in a list takes a word of the image for every instance of its unit,
+// so a list's length says how much room the unit needs, and how many
+// of each unit there are the rest. buffer_size is what the driver
+// allocates for the image, which nouveau has to size its own ctxsw
+// buffers to as well. The pm lists are for the perfmon context, which
+// is a buffer of its own.
+
+type ContextUnit struct {
+	// The ctxreg list's name without the ctxreg_, e.g. "gpc"
+	Unit string `json:"unit"`
+	Region string `json:"region"`
+	Registers int `json:"registers"`
+	// Room the registers take in the image for each instance of
+	// the unit
+	Bytes int `json:"bytes"`
+	// Whether it's part of the perfmon context
+	PM bool `json:"pm,omitempty"`
+}
+
+type ContextLayout struct {
+	// 0 if the archive doesn't have a buffer_size
+	BufferSize uint32 `json:"buffer_size,omitempty"`
+	Units []ContextUnit `json:"units"`
+}
+
+// Work out the context image layout from an archive's ctxreg lists,
+// named by table
+func Context(data []byte, entries []ArchiveEntry, table map[int]string) ContextLayout {
+	var layout ContextLayout
+	layout.BufferSize, _ = ScalarEntry(data, entries, 16)
+	size := 4 * len(aivFormat.Fields)
+	for _, entry := range entries {
+		name := RegionName(table, int(entry.Id))
+		if !strings.HasPrefix(name, "ctxreg_") {
+			continue
+		}
+		unit := strings.TrimPrefix(name, "ctxreg_")
+		n := int(entry.Length) / size
+		layout.Units = append(layout.Units, ContextUnit{unit, name, n, 4 * n,
+			strings.HasPrefix(unit, "pm")})
+	}
+	return layout
+}
+
+// The layout as a table, a unit per line
+func (c ContextLayout) Text() []byte {
+	var buf bytes.Buffer
+	if c.BufferSize != 0 {
+		fmt.Fprintf(&buf, "buffer_size: 0x%x (%d bytes)\n", c.BufferSize, c.BufferSize)
+	}
+	w := tabwriter.NewWriter(&buf, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "# unit\tregisters\tbytes per instance\tcontext\n")
+	for _, u := range c.Units {
+		ctx := "main"
+		if u.PM {
+			ctx = "pm"
+		}
+		fmt.Fprintf(w, "%s\t%d\t0x%x\t%s\n", u.Unit, u.Registers, u.Bytes, ctx)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
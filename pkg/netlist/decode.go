@@ -0,0 +1,270 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package netlist
+
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "encoding/xml"
+import "fmt"
+import "io/ioutil"
+import "path"
+import "strconv"
+import "strings"
+
+// Many regions are lists of fixed-size records of 32-bit words, e.g.
+// the bundle and method init lists are (address, value) pairs.
+type RecordFormat struct {
+	Fields []string
+}
+
+var avFormat = RecordFormat{[]string{"addr", "value"}}
+var av64Format = RecordFormat{[]string{"addr", "value_lo", "value_hi"}}
+var aivFormat = RecordFormat{[]string{"addr", "index", "value"}}
+
+// Regions that -decode writes out as text or JSON too
+var RegionFormats = map[int]RecordFormat{
+	4: avFormat,	// sw_bundle_init
+	5: avFormat,	// sw_ctx
+	6: avFormat,	// sw_nonctx
+	7: avFormat,	// sw_method_init
+	34: av64Format,	// sw_bundle64_init
+
+	// The context register lists
+	8: aivFormat,	// ctxreg_sys
+	9: aivFormat,	// ctxreg_gpc
+	10: aivFormat,	// ctxreg_tpc
+	11: aivFormat,	// ctxreg_zcull_gpc
+	12: aivFormat,	// ctxreg_pm_sys
+	13: aivFormat,	// ctxreg_pm_gpc
+	14: aivFormat,	// ctxreg_pm_tpc
+	19: aivFormat,	// ctxreg_ppc
+	20: aivFormat,	// ctxreg_pmppc
+	26: aivFormat,	// ctxreg_pmltc
+	27: aivFormat,	// ctxreg_pmfbpa
+	31: aivFormat,	// ctxreg_pmrop
+	32: aivFormat,	// ctxreg_pmucgpc
+	33: aivFormat,	// ctxreg_etpc
+}
+
+// Split a region into its records. Any partial record at the end is
+// left out.
+func (f RecordFormat) Records(data []byte) [][]uint32 {
+	size := 4 * len(f.Fields)
+	records := make([][]uint32, 0, len(data) / size)
+	for off := 0; off + size <= len(data); off += size {
+		record := make([]uint32, len(f.Fields))
+		for i := range record {
+			record[i] = binary.LittleEndian.Uint32(data[off + 4*i:])
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// One record per line, with the register name after it when the
+// address is in regs.
+func (f RecordFormat) Text(data []byte, regs map[uint32]string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n", strings.Join(f.Fields, " "))
+	for _, record := range f.Records(data) {
+		for i, v := range record {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			fmt.Fprintf(&buf, "0x%08x", v)
+		}
+		if name, ok := regs[record[0]]; ok && f.Fields[0] == "addr" {
+			buf.WriteString(" " + name)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// The records as a JSON list of objects, with a "name" for addresses
+// that are in regs.
+func (f RecordFormat) JSON(data []byte, regs map[uint32]string) []byte {
+	var list []map[string]interface{}
+	for _, record := range f.Records(data) {
+		obj := make(map[string]interface{})
+		for i, v := range record {
+			obj[f.Fields[i]] = v
+		}
+		if name, ok := regs[record[0]]; ok && f.Fields[0] == "addr" {
+			obj["name"] = name
+		}
+		list = append(list, obj)
+	}
+	out, err := json.MarshalIndent(list, "", "  ")
+	must(err)
+	return append(out, '\n')
+}
+
+// Read register names from a file with lines of "0xaddress NAME".
+// Blank lines and lines starting with # are skipped.
+func LoadRegNames(fname string) (map[uint32]string, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	regs := make(map[uint32]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 0, 32)
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected address and name", fname, i+1)
+		}
+		regs[uint32(addr)] = fields[1]
+	}
+	return regs, nil
+}
+
+// A node of an envytools rules-ng register database
+type rnnNode struct {
+	XMLName xml.Name
+	Attrs []xml.Attr `xml:",any,attr"`
+	Nodes []rnnNode `xml:",any"`
+}
+
+func (n *rnnNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *rnnNode) number(name string, def uint64) uint64 {
+	v, err := strconv.ParseUint(n.attr(name), 0, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Arrays with more elements than this only get their first few named,
+// since the per-unit copies of registers mostly aren't what the lists
+// refer to.
+const rnnMaxArray = 64
+
+type rnnDB struct {
+	groups map[string]*rnnNode
+	domains []*rnnNode
+	loaded map[string]bool
+	regs map[uint32]string
+}
+
+// Load a database file and everything it imports
+func (db *rnnDB) load(fname string) error {
+	if db.loaded[fname] {
+		return nil
+	}
+	db.loaded[fname] = true
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var root rnnNode
+	if err = xml.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	for i := range root.Nodes {
+		n := &root.Nodes[i]
+		switch n.XMLName.Local {
+		case "import":
+			err = db.load(path.Join(path.Dir(fname), n.attr("file")))
+			if err != nil {
+				return err
+			}
+		case "group":
+			db.groups[n.attr("name")] = n
+		case "domain":
+			db.domains = append(db.domains, n)
+		}
+	}
+	return nil
+}
+
+func joinName(prefix, name string) string {
+	if prefix == "" || name == "" {
+		return prefix + name
+	}
+	return prefix + "." + name
+}
+
+// Name every register under a node, at the given base address
+func (db *rnnDB) walk(n *rnnNode, base uint64, prefix string) {
+	for i := range n.Nodes {
+		c := &n.Nodes[i]
+		offset := base + c.number("offset", 0)
+		switch c.XMLName.Local {
+		case "reg8", "reg16", "reg32", "reg64":
+			length := c.number("length", 1)
+			stride := c.number("stride", 4)
+			for j := uint64(0); j < length && j < rnnMaxArray; j++ {
+				name := joinName(prefix, c.attr("name"))
+				if length > 1 {
+					name += fmt.Sprintf("[%d]", j)
+				}
+				addr := uint32(offset + j * stride)
+				if _, ok := db.regs[addr]; !ok {
+					db.regs[addr] = name
+				}
+			}
+		case "array", "stripe":
+			length := c.number("length", 1)
+			stride := c.number("stride", 0)
+			for j := uint64(0); j < length && j < rnnMaxArray; j++ {
+				name := joinName(prefix, c.attr("name"))
+				if length > 1 && c.attr("name") != "" {
+					name += fmt.Sprintf("[%d]", j)
+				}
+				db.walk(c, offset + j * stride, name)
+			}
+		case "use-group":
+			if g := db.groups[c.attr("name")]; g != nil {
+				db.walk(g, base, prefix)
+			}
+		}
+	}
+}
+
+// Build a map of MMIO register names from an envytools rnndb, e.g.
+// rnndb/root.xml. Names are the path through the database, like
+// PGRAPH.FECS.FALCON_IRQSTAT.
+func LoadRnnDB(fname string) (map[uint32]string, error) {
+	db := &rnnDB{groups: make(map[string]*rnnNode),
+		loaded: make(map[string]bool), regs: make(map[uint32]string)}
+	if err := db.load(fname); err != nil {
+		return nil, err
+	}
+	for _, d := range db.domains {
+		if d.attr("name") == "NV_MMIO" {
+			db.walk(d, 0, "")
+		}
+	}
+	return db.regs, nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package netlist
+
+import "bytes"
+import "encoding/binary"
+import "testing"
+
+type testRegion struct {
+	Id int
+	Data []byte
+}
+
+func testWords(words ...uint32) []byte {
+	data := make([]byte, 4 * len(words))
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(data[4*i:], w)
+	}
+	return data
+}
+
+// The regions of a small gm20b-like archive: the fecs and gpccs ucode,
+// a few register lists and netlist_num
+var testRegions = []testRegion{
+	{0, bytes.Repeat([]byte{0x11, 0x22}, 0x80)},
+	{1, bytes.Repeat([]byte{0xf1, 0x07, 0x00, 0x42}, 0x80)},
+	{2, bytes.Repeat([]byte{0x33}, 0x40)},
+	{3, bytes.Repeat([]byte{0xf7, 0x42}, 0x100)},
+	{5, testWords(0x418000, 1, 0x418004, 2, 0x418008, 3)},
+	{8, testWords(0x409800, 0, 4, 0x409804, 0, 8)},
+	{18, testWords(7)},
+	{26, testWords(0x40e000, 0, 4)},
+}
+
+// Lay regions out the way the driver does: the header and entry table,
+// then each region on a 256 byte boundary, padded out to 32KiB
+func testArchive(version int32, wide bool, regions []testRegion) []byte {
+	data := make([]byte, 32768)
+	binary.LittleEndian.PutUint32(data[0:], uint32(version))
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(regions)))
+	off := 0x400
+	for i, r := range regions {
+		if wide {
+			entry := data[8 + 24 * i:]
+			binary.LittleEndian.PutUint32(entry, uint32(r.Id))
+			binary.LittleEndian.PutUint64(entry[8:], uint64(len(r.Data)))
+			binary.LittleEndian.PutUint64(entry[16:], uint64(off))
+		} else {
+			entry := data[8 + 12 * i:]
+			binary.LittleEndian.PutUint32(entry, uint32(r.Id))
+			binary.LittleEndian.PutUint32(entry[4:], uint32(len(r.Data)))
+			binary.LittleEndian.PutUint32(entry[8:], uint32(off))
+		}
+		copy(data[off:], r.Data)
+		off += (len(r.Data) + 0xff) &^ 0xff
+	}
+	return data
+}
+
+// Archives as hostile as anything found in a binary can be:
+// $ go test -fuzz=FuzzParseArchive -fuzzminimizetime=1s ./pkg/netlist
+// (minimizing every new input for the default minute stalls it).
+// Whatever ParseArchive returns has to be safe to lay out and name,
+// and with no error every entry has to fit and decode.
+func FuzzParseArchive(f *testing.F) {
+	// Without their padding, which is put back below: the fuzzer
+	// takes far too long over inputs of 32KiB
+	seed := func(data []byte) {
+		f.Add(bytes.TrimRight(data, "\x00"))
+	}
+	seed(testArchive(0, false, testRegions))
+	seed(testArchive(2, false, testRegions))
+	seed(testArchive(3, true, testRegions))
+	seed(testArchive(0, false, testRegions[:1]))
+	// One entry running past the end, for a *PartialArchiveError
+	partial := testArchive(0, false, testRegions)
+	binary.LittleEndian.PutUint32(partial[8 + 4:], 0x10000)
+	seed(partial)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Anything shorter is turned away before the entries are
+		// looked at
+		if min := defaultLimits.MinSize; len(data) < min {
+			data = append(data, make([]byte, min - len(data))...)
+		}
+		_, entries, wide, err := ParseArchive(data, nil)
+		var info bytes.Buffer
+		WriteLayout(&info, data, entries, wide, nil)
+		IdentifyArchive(data, entries)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.Offset < 0 || e.Length < 0 ||
+				int64(e.Offset) + int64(e.Length) > int64(len(data)) {
+				t.Fatalf("entry %d at 0x%x with 0x%x bytes is out of range",
+					e.Id, e.Offset, e.Length)
+			}
+			if format, ok := RegionFormats[int(e.Id)]; ok {
+				contents := data[e.Offset:e.Offset+e.Length]
+				format.Text(contents, nil)
+				format.JSON(contents, nil)
+			}
+		}
+	})
+}
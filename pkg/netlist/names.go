@@ -0,0 +1,252 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package netlist reads and writes the netlist archives (NET_IMG_*) the
+// driver stores its context-switch and register-init lists in, and
+// decodes the register lists inside them.
+package netlist
+
+import "fmt"
+import "path"
+import "strings"
+
+// from https://nv-tegra.nvidia.com/gitweb/?p=linux-nvgpu.git;a=blob;f=drivers/gpu/nvgpu/gk20a/gr_ctx_gk20a.h;hb=refs/tags/tegra-l4t-r31.0.2#l73
+var names = map[int]string{
+	0: "fecs_data",
+	1: "fecs_inst",
+	2: "gpccs_data",
+	3: "gpccs_inst",
+	4: "sw_bundle_init",
+	5: "sw_ctx",
+	6: "sw_nonctx",
+	7: "sw_method_init",
+	8: "ctxreg_sys",
+	9: "ctxreg_gpc",
+	10: "ctxreg_tpc",
+	11: "ctxreg_zcull_gpc",
+	12: "ctxreg_pm_sys",
+	13: "ctxreg_pm_gpc",
+	14: "ctxreg_pm_tpc",
+	15: "majorv",
+	16: "buffer_size",
+	17: "ctxsw_reg_base_index",
+	18: "netlist_num",
+	19: "ctxreg_ppc",
+	20: "ctxreg_pmppc",
+	21: "nvperf_ctxreg_sys",
+	22: "nvperf_fbp_ctxregs",
+	23: "nvperf_ctxreg_gpc",
+	24: "nvperf_fbp_router",
+	25: "nvperf_gpc_router",
+	26: "ctxreg_pmltc",
+	27: "ctxreg_pmfbpa",
+	28: "swveidbundleinit",
+	29: "nvperf_sys_router",
+	30: "nvperf_pma",
+	31: "ctxreg_pmrop",
+	32: "ctxreg_pmucgpc",
+	33: "ctxreg_etpc",
+	34: "sw_bundle64_init",
+	35: "nvperf_pmcau",
+}
+
+// Regions added for Ampere, from ga10b's netlist_priv.h in the same
+// tree. Everything before these kept its number.
+var ga10bRegions = map[int]string{
+	36: "sw_non_ctx_local_compute_load",
+	37: "sw_non_ctx_global_compute_load",
+	38: "sw_non_ctx_local_gfx_load",
+	39: "sw_non_ctx_global_gfx_load",
+	40: "ctxreg_sys_compute",
+	41: "ctxreg_gpc_compute",
+	42: "ctxreg_tpc_compute",
+	43: "ctxreg_ppc_compute",
+	44: "ctxreg_etpc_compute",
+	45: "ctxreg_lts_bc",
+	46: "ctxreg_lts_uc",
+	47: "ctxreg_sys_gfx",
+	48: "ctxreg_gpc_gfx",
+	49: "ctxreg_tpc_gfx",
+	50: "ctxreg_ppc_gfx",
+	51: "ctxreg_etpc_gfx",
+}
+
+// Regions that hold a single 32-bit number
+var ScalarRegions = map[int]bool{
+	15: true,	// majorv
+	16: true,	// buffer_size
+	17: true,	// ctxsw_reg_base_index
+	18: true,	// netlist_num
+}
+
+// Region names by architecture, for -names
+var NameTables = map[string]map[int]string{
+	"gk20a": names,
+	"ga10b": mergeNames(names, ga10bRegions),
+}
+
+func mergeNames(tables ...map[int]string) map[int]string {
+	merged := make(map[int]string)
+	for _, table := range tables {
+		for id, name := range table {
+			merged[id] = name
+		}
+	}
+	return merged
+}
+
+// Pick the name table for an archive: the one asked for, or else the
+// one for its family.
+func NameTable(override, family string) map[int]string {
+	if override != "" {
+		return NameTables[override]
+	}
+	switch family {
+	case "ampere", "ada":
+		return NameTables["ga10b"]
+	}
+	return NameTables["gk20a"]
+}
+
+func RegionName(table map[int]string, id int) string {
+	if name := table[id]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("unk%d", id)
+}
+
+// Known chipsets. GR falcon addresses are those of FECS and GPCCS.
+// Chipsets from GM200 on have their GR firmware signed, and nouveau
+// loads it, signatures and all, from linux-firmware's
+// nvidia/<codename>/gr/ directory rather than its own nvXX_fucXXXX
+// files.
+type Chipset struct {
+	Id int
+	Codename, Family string
+	FECS, GPCCS uint32
+}
+
+func (c *Chipset) Name() string {
+	return fmt.Sprintf("nv%x", c.Id)
+}
+
+func (c *Chipset) Signed() bool {
+	return c.Id >= 0x120
+}
+
+var chipsets = []Chipset{
+	{0xc0, "gf100", "fermi", 0x409000, 0x41a000},
+	{0xc1, "gf108", "fermi", 0x409000, 0x41a000},
+	{0xc3, "gf106", "fermi", 0x409000, 0x41a000},
+	{0xc4, "gf104", "fermi", 0x409000, 0x41a000},
+	{0xc8, "gf110", "fermi", 0x409000, 0x41a000},
+	{0xce, "gf114", "fermi", 0x409000, 0x41a000},
+	{0xcf, "gf116", "fermi", 0x409000, 0x41a000},
+	{0xd7, "gf117", "fermi", 0x409000, 0x41a000},
+	{0xd9, "gf119", "fermi", 0x409000, 0x41a000},
+	{0xe4, "gk104", "kepler", 0x409000, 0x41a000},
+	{0xe6, "gk106", "kepler", 0x409000, 0x41a000},
+	{0xe7, "gk107", "kepler", 0x409000, 0x41a000},
+	{0xea, "gk20a", "kepler", 0x409000, 0x41a000},
+	{0xf0, "gk110", "kepler", 0x409000, 0x41a000},
+	{0xf1, "gk110b", "kepler", 0x409000, 0x41a000},
+	{0x106, "gk208b", "kepler", 0x409000, 0x41a000},
+	{0x108, "gk208", "kepler", 0x409000, 0x41a000},
+	{0x117, "gm107", "maxwell", 0x409000, 0x41a000},
+	{0x118, "gm108", "maxwell", 0x409000, 0x41a000},
+	{0x120, "gm200", "maxwell", 0x409000, 0x41a000},
+	{0x124, "gm204", "maxwell", 0x409000, 0x41a000},
+	{0x126, "gm206", "maxwell", 0x409000, 0x41a000},
+	{0x12b, "gm20b", "maxwell", 0x409000, 0x41a000},
+	{0x130, "gp100", "pascal", 0x409000, 0x41a000},
+	{0x132, "gp102", "pascal", 0x409000, 0x41a000},
+	{0x134, "gp104", "pascal", 0x409000, 0x41a000},
+	{0x136, "gp106", "pascal", 0x409000, 0x41a000},
+	{0x137, "gp107", "pascal", 0x409000, 0x41a000},
+	{0x138, "gp108", "pascal", 0x409000, 0x41a000},
+	{0x13b, "gp10b", "pascal", 0x409000, 0x41a000},
+	{0x140, "gv100", "volta", 0x409000, 0x41a000},
+	{0x162, "tu102", "turing", 0x409000, 0x41a000},
+	{0x164, "tu104", "turing", 0x409000, 0x41a000},
+	{0x166, "tu106", "turing", 0x409000, 0x41a000},
+	{0x167, "tu117", "turing", 0x409000, 0x41a000},
+	{0x168, "tu116", "turing", 0x409000, 0x41a000},
+	{0x170, "ga100", "ampere", 0x409000, 0x41a000},
+	{0x172, "ga102", "ampere", 0x409000, 0x41a000},
+	{0x173, "ga103", "ampere", 0x409000, 0x41a000},
+	{0x174, "ga104", "ampere", 0x409000, 0x41a000},
+	{0x176, "ga106", "ampere", 0x409000, 0x41a000},
+	{0x177, "ga107", "ampere", 0x409000, 0x41a000},
+	{0x192, "ad102", "ada", 0x409000, 0x41a000},
+	{0x193, "ad103", "ada", 0x409000, 0x41a000},
+	{0x194, "ad104", "ada", 0x409000, 0x41a000},
+	{0x196, "ad106", "ada", 0x409000, 0x41a000},
+	{0x197, "ad107", "ada", 0x409000, 0x41a000},
+}
+
+// Look up a chipset by codename (gp107), nouveau name (nv137) or
+// plain id (0x137).
+func LookupChipset(name string) (*Chipset, error) {
+	name = strings.ToLower(name)
+	for i := range chipsets {
+		c := &chipsets[i]
+		if name == c.Codename || name == c.Name() ||
+			name == fmt.Sprintf("0x%x", c.Id) ||
+			name == fmt.Sprintf("%x", c.Id) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown chipset %q", name)
+}
+
+// Returns the path nouveau loads an archive entry from, relative to
+// the firmware directory, or "" if it doesn't use it. Without a
+// chipset, the unprefixed fucXXXX names are used. Signed chipsets'
+// GR firmware comes from NVIDIA's signed linux-firmware files, which
+// raw archive entries are no substitute for, so they get nothing.
+func NouveauPath(c *Chipset, id int) string {
+	if c != nil && c.Signed() {
+		return ""
+	}
+
+	// Older chipsets' files are named after the falcon's base
+	// address, e.g. fuc409c for the FECS code at 0x409000.
+	fecs, gpccs := uint32(0x409000), uint32(0x41a000)
+	if c != nil {
+		fecs, gpccs = c.FECS, c.GPCCS
+	}
+	var name string
+	switch id {
+	case 0:
+		name = fmt.Sprintf("fuc%xd", fecs >> 12)
+	case 1:
+		name = fmt.Sprintf("fuc%xc", fecs >> 12)
+	case 2:
+		name = fmt.Sprintf("fuc%xd", gpccs >> 12)
+	case 3:
+		name = fmt.Sprintf("fuc%xc", gpccs >> 12)
+	default:
+		return ""
+	}
+	if c != nil {
+		return path.Join("nouveau", c.Name() + "_" + name)
+	}
+	return name
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package netlist
+
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path"
+import "sort"
+import "strconv"
+import "strings"
+
+// What pack needs to know about an entry
+type packEntry struct {
+	Id int32
+	Name string
+	Offset, Length int64
+}
+
+// Put a netlist archive back together from a directory written by
+// unpack or a scan. With the layout in its info.txt the result is the
+// same as the original byte for byte. Without it, the entries go in
+// id order, each aligned to 4 bytes, padded out to 32KiB.
+func Pack(dir string) ([]byte, error) {
+	info, err := ioutil.ReadFile(path.Join(dir, "info.txt"))
+	if err != nil {
+		return nil, err
+	}
+	var version int32
+	var wide bool
+	size := int64(-1)
+	var entries []packEntry
+	values := make(map[string]uint32)
+	type fill struct {
+		offset int64
+		data []byte
+	}
+	var fills []fill
+	family := ""
+	for _, line := range strings.Split(string(info), "\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields := strings.Fields(kv[1])
+		switch kv[0] {
+		case "version":
+			v, err := strconv.ParseInt(kv[1], 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("info.txt: bad version %q", kv[1])
+			}
+			version = int32(v)
+		case "entries":
+			wide = kv[1] == "wide"
+		case "size":
+			if size, err = strconv.ParseInt(kv[1], 0, 64); err != nil {
+				return nil, fmt.Errorf("info.txt: bad size %q", kv[1])
+			}
+		case "family":
+			if len(fields) > 0 {
+				family = fields[0]
+			}
+		case "entry":
+			var e packEntry
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("info.txt: bad entry %q", kv[1])
+			}
+			id, err1 := strconv.ParseInt(fields[0], 0, 32)
+			off, err2 := strconv.ParseInt(fields[2], 0, 64)
+			length, err3 := strconv.ParseInt(fields[3], 0, 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, fmt.Errorf("info.txt: bad entry %q", kv[1])
+			}
+			e.Id, e.Name, e.Offset, e.Length = int32(id), fields[1], off, length
+			entries = append(entries, e)
+		case "fill":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("info.txt: bad fill %q", kv[1])
+			}
+			off, err1 := strconv.ParseInt(fields[0], 0, 64)
+			data, err2 := hex.DecodeString(fields[1])
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("info.txt: bad fill %q", kv[1])
+			}
+			fills = append(fills, fill{off, data})
+		default:
+			// Scalar regions only have their value in info.txt
+			if v, err := strconv.ParseUint(kv[1], 10, 32); err == nil {
+				values[kv[0]] = uint32(v)
+			}
+		}
+	}
+
+	contents := func(name string) ([]byte, error) {
+		data, err := ioutil.ReadFile(path.Join(dir, name))
+		if os.IsNotExist(err) {
+			if v, ok := values[name]; ok {
+				data = make([]byte, 4)
+				binary.LittleEndian.PutUint32(data, v)
+				return data, nil
+			}
+		}
+		return data, err
+	}
+
+	if len(entries) == 0 {
+		var err error
+		if entries, err = guessLayout(dir, family, values, wide); err != nil {
+			return nil, err
+		}
+	}
+
+	headerSize := int64(8 + EntrySize(wide) * len(entries))
+	if size < 0 {
+		// At least as big as the scan wants archives to be
+		size = 32768
+		for _, e := range entries {
+			if e.Offset + e.Length > size {
+				size = e.Offset + e.Length
+			}
+		}
+	}
+	out := make([]byte, size)
+	binary.LittleEndian.PutUint32(out[0:], uint32(version))
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(entries)))
+	for i, e := range entries {
+		if e.Offset < headerSize || e.Length < 0 || e.Offset + e.Length > size {
+			return nil, fmt.Errorf("%s: 0x%x+0x%x doesn't fit in the archive",
+				e.Name, e.Offset, e.Length)
+		}
+		data, err := contents(e.Name)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != e.Length {
+			return nil, fmt.Errorf("%s: %d bytes, the layout says %d",
+				e.Name, len(data), e.Length)
+		}
+		copy(out[e.Offset:], data)
+		if wide {
+			w := out[8 + 24 * i:]
+			binary.LittleEndian.PutUint32(w[0:], uint32(e.Id))
+			binary.LittleEndian.PutUint64(w[8:], uint64(e.Length))
+			binary.LittleEndian.PutUint64(w[16:], uint64(e.Offset))
+		} else {
+			w := out[8 + 12 * i:]
+			binary.LittleEndian.PutUint32(w[0:], uint32(e.Id))
+			binary.LittleEndian.PutUint32(w[4:], uint32(e.Length))
+			binary.LittleEndian.PutUint32(w[8:], uint32(e.Offset))
+		}
+	}
+	for _, f := range fills {
+		if f.offset < 0 || f.offset + int64(len(f.data)) > size {
+			return nil, fmt.Errorf("fill at 0x%x doesn't fit in the archive", f.offset)
+		}
+		copy(out[f.offset:], f.data)
+	}
+	return out, nil
+}
+
+// Lay out the region files in a directory that has no recorded layout,
+// in id order.
+func guessLayout(dir, family string, values map[string]uint32, wide bool) ([]packEntry, error) {
+	ids := make(map[string]int)
+	for id := range mergeNames(names, ga10bRegions) {
+		ids[RegionName(NameTable("", family), id)] = id
+	}
+	dirents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []packEntry
+	seen := make(map[string]bool)
+	for _, dirent := range dirents {
+		name := dirent.Name()
+		id, ok := ids[name]
+		if !ok {
+			if _, err := fmt.Sscanf(name, "unk%d", &id); err != nil ||
+				name != fmt.Sprintf("unk%d", id) {
+				continue
+			}
+		}
+		seen[name] = true
+		entries = append(entries, packEntry{int32(id), name, 0, dirent.Size()})
+	}
+	for name := range values {
+		if id, ok := ids[name]; ok && !seen[name] && ScalarRegions[id] {
+			entries = append(entries, packEntry{int32(id), name, 0, 4})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no netlist regions found", dir)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	off := int64(8 + EntrySize(wide) * len(entries))
+	for i := range entries {
+		entries[i].Offset = off
+		off += (entries[i].Length + 3) &^ 3
+	}
+	return entries, nil
+}
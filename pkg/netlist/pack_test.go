@@ -0,0 +1,246 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+
+package netlist
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "testing"
+
+// Write an archive out the way unpack does: each region in a file of
+// its own, except scalars, whose values go in info.txt with the layout
+func testUnpack(t *testing.T, data []byte) string {
+	header, entries, wide, err := ParseArchive(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	family, reason := IdentifyArchive(data, entries)
+	table := NameTable("", family)
+	var info bytes.Buffer
+	for _, e := range entries {
+		name := RegionName(table, int(e.Id))
+		if ScalarRegions[int(e.Id)] && e.Length == 4 {
+			fmt.Fprintf(&info, "%s: %d\n", name,
+				binary.LittleEndian.Uint32(data[e.Offset:]))
+			continue
+		}
+		testWrite(t, dir, name, data[e.Offset:e.Offset+e.Length])
+	}
+	fmt.Fprintf(&info, "family: %s (guess, %s)\n", family, reason)
+	if header.Magic != 0 {
+		fmt.Fprintf(&info, "version: %d\n", header.Magic)
+	}
+	if wide {
+		info.WriteString("entries: wide\n")
+	}
+	WriteLayout(&info, data, entries, wide, table)
+	testWrite(t, dir, "info.txt", info.Bytes())
+	return dir
+}
+
+func testWrite(t *testing.T, dir, name string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	// Bytes outside the table and the regions, which only the
+	// layout's fills can put back
+	filled := testArchive(0, false, testRegions)
+	copy(filled[0x7ff0:], "padding")
+	ampere := append(testRegions[:len(testRegions):len(testRegions)],
+		testRegion{36, testWords(0x419000, 0, 4)},
+		testRegion{45, testWords(0x41a000, 0, 8)})
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"version 0", testArchive(0, false, testRegions)},
+		{"version 2", testArchive(2, false, testRegions)},
+		{"wide", testArchive(3, true, testRegions)},
+		{"fill", filled},
+		{"unknown region", testArchive(0, false, []testRegion{{99, testWords(1, 2)}})},
+		{"ampere", testArchive(0, false, ampere)},
+		{"scalar only", testArchive(0, false, []testRegion{{18, testWords(7)}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Pack(testUnpack(t, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, tt.data) {
+				t.Errorf("packed %d bytes differ from the %d unpacked",
+					len(out), len(tt.data))
+			}
+		})
+	}
+}
+
+// Without a layout in info.txt, Pack lays the regions out itself
+func TestPackLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		files map[string][]byte
+		wide bool
+		// Region ids in table order, and each one's offset
+		ids []int32
+		offsets []int32
+	}{
+		{
+			name: "id order",
+			info: "family: maxwell\n",
+			files: map[string][]byte{
+				"sw_ctx": testWords(1, 2, 3),
+				"fecs_data": {1, 2, 3, 4, 5},
+				"fecs_inst": testWords(4),
+			},
+			ids: []int32{0, 1, 5},
+			// Each aligned to 4 bytes, after 8 + 3 * 12
+			offsets: []int32{44, 52, 56},
+		},
+		{
+			name: "wide",
+			info: "version: 3\nentries: wide\n",
+			files: map[string][]byte{
+				"fecs_data": testWords(1),
+				"gpccs_data": testWords(2),
+			},
+			wide: true,
+			ids: []int32{0, 2},
+			offsets: []int32{56, 60},
+		},
+		{
+			name: "scalar",
+			info: "netlist_num: 7\n",
+			files: map[string][]byte{
+				"fecs_data": testWords(1),
+			},
+			ids: []int32{0, 18},
+			offsets: []int32{32, 36},
+		},
+		{
+			name: "unknown region",
+			info: "",
+			files: map[string][]byte{
+				"unk99": testWords(1, 2),
+				"unk7x": testWords(3),
+				"ctxreg_sys": testWords(4),
+			},
+			ids: []int32{8, 99},
+			offsets: []int32{32, 36},
+		},
+		{
+			name: "ampere",
+			info: "family: ampere\n",
+			files: map[string][]byte{
+				"sw_non_ctx_local_compute_load": testWords(1),
+				"ctxreg_lts_bc": testWords(2, 3),
+			},
+			ids: []int32{36, 45},
+			offsets: []int32{32, 36},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			testWrite(t, dir, "info.txt", []byte(tt.info))
+			for name, data := range tt.files {
+				testWrite(t, dir, name, data)
+			}
+			out, err := Pack(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != 32768 {
+				t.Errorf("%d bytes, not padded out to 32KiB", len(out))
+			}
+			_, entries, wide, err := ParseArchive(out, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wide != tt.wide {
+				t.Errorf("wide entries %v, want %v", wide, tt.wide)
+			}
+			if len(entries) != len(tt.ids) {
+				t.Fatalf("%d entries, want %d", len(entries), len(tt.ids))
+			}
+			table := NameTable("", "ampere")
+			for i, e := range entries {
+				if e.Id != tt.ids[i] || e.Offset != tt.offsets[i] {
+					t.Errorf("entry %d: id %d at %d, want id %d at %d",
+						i, e.Id, e.Offset, tt.ids[i], tt.offsets[i])
+					continue
+				}
+				want, ok := tt.files[RegionName(table, int(e.Id))]
+				if !ok {
+					// netlist_num, from its value in info.txt
+					want = testWords(7)
+				}
+				if got := out[e.Offset:e.Offset+e.Length]; !bytes.Equal(got, want) {
+					t.Errorf("entry %d: %x, want %x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPackErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		files map[string][]byte
+	}{
+		{"no info", "", nil},
+		{"bad entry", "entry: 0 fecs_data 0x100\n", nil},
+		{"bad version", "version: x\n", nil},
+		{"bad fill", "size: 32768\nfill: 0x100 zz\n", nil},
+		{"overlaps table", "size: 32768\nentry: 0 fecs_data 0x8 0x4\n",
+			map[string][]byte{"fecs_data": testWords(1)}},
+		{"past the end", "size: 32768\nentry: 0 fecs_data 0x7ffe 0x4\n",
+			map[string][]byte{"fecs_data": testWords(1)}},
+		{"wrong length", "size: 32768\nentry: 0 fecs_data 0x100 0x8\n",
+			map[string][]byte{"fecs_data": testWords(1)}},
+		{"missing file", "size: 32768\nentry: 0 fecs_data 0x100 0x4\n", nil},
+		{"fill past the end", "size: 32768\nfill: 0x7fff 0102\n", nil},
+		{"no regions", "family: maxwell\n", map[string][]byte{"notes": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.name != "no info" {
+				testWrite(t, dir, "info.txt", []byte(tt.info))
+			}
+			for name, data := range tt.files {
+				testWrite(t, dir, name, data)
+			}
+			if _, err := Pack(dir); err == nil {
+				t.Error("packed without an error")
+			}
+		})
+	}
+}
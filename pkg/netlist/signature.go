@@ -0,0 +1,166 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+package netlist
+
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "math"
+import "sort"
+
+// What tells apart the PGRAPH archives of one chipset from those of
+// another, for old drivers that carry one archive per chipset without
+// a netlist_num saying which. NetlistNum and Majorv are only compared
+// if they're not 0. Ids is the set of entries an archive has, all of
+// them and no others, and Family stands for the set that family's
+// archives have. Sizes has the lengths of entries by id, which only
+// have to be within SizeTolerance of them, since they grow a little
+// from one driver to the next.
+type ArchiveSignature struct {
+	Chipset string `json:"chipset"`
+	NetlistNum uint32 `json:"netlist_num,omitempty"`
+	Majorv uint32 `json:"majorv,omitempty"`
+	Family string `json:"family,omitempty"`
+	Ids []int `json:"ids,omitempty"`
+	Sizes map[int]int32 `json:"sizes,omitempty"`
+}
+
+// How far, as a fraction of it, an entry's length may be from the one
+// a signature has
+var SizeTolerance = 0.25
+
+// Signatures of archives whose chipset is known. A family that only
+// one chipset in the table belongs to says which chipset it is by
+// itself. Signatures recorded with -record-archive-signatures from
+// drivers whose archive order is known are loaded with
+// -archive-signatures, and are tried along with these.
+var ArchiveSignatures = familySignatures()
+
+func familySignatures() []ArchiveSignature {
+	count := make(map[string]int)
+	for _, c := range chipsets {
+		count[c.Family]++
+	}
+	var sigs []ArchiveSignature
+	for _, c := range chipsets {
+		if count[c.Family] == 1 {
+			sigs = append(sigs, ArchiveSignature{Chipset: c.Codename, Family: c.Family})
+		}
+	}
+	return sigs
+}
+
+// The signature of an archive, with no chipset
+func SignatureOf(data []byte, entries []ArchiveEntry) ArchiveSignature {
+	var s ArchiveSignature
+	s.NetlistNum, _ = ScalarEntry(data, entries, 18)
+	s.Majorv, _ = ScalarEntry(data, entries, 15)
+	s.Family, _ = IdentifyArchive(data, entries)
+	s.Sizes = make(map[int]int32)
+	for _, entry := range entries {
+		s.Sizes[int(entry.Id)] = entry.Length
+		s.Ids = append(s.Ids, int(entry.Id))
+	}
+	sort.Ints(s.Ids)
+	return s
+}
+
+// Whether an archive's signature fits s, on how many things, and how
+// far its entry sizes are off, all told
+func (s *ArchiveSignature) match(of ArchiveSignature) (int, float64, bool) {
+	n, off := 0, 0.0
+	if s.NetlistNum != 0 {
+		if s.NetlistNum != of.NetlistNum {
+			return 0, 0, false
+		}
+		n++
+	}
+	if s.Majorv != 0 {
+		if s.Majorv != of.Majorv {
+			return 0, 0, false
+		}
+		n++
+	}
+	if s.Family != "" {
+		if s.Family != of.Family {
+			return 0, 0, false
+		}
+		n++
+	}
+	if s.Ids != nil {
+		if len(s.Ids) != len(of.Ids) {
+			return 0, 0, false
+		}
+		for i := range s.Ids {
+			if s.Ids[i] != of.Ids[i] {
+				return 0, 0, false
+			}
+		}
+		n++
+	}
+	for id, length := range s.Sizes {
+		l, ok := of.Sizes[id]
+		if !ok {
+			return 0, 0, false
+		}
+		d := math.Abs(float64(l - length)) / math.Max(float64(length), 1)
+		if d > SizeTolerance {
+			return 0, 0, false
+		}
+		off += d
+		n++
+	}
+	return n, off, n != 0
+}
+
+// Work out which chipset an archive is for from its contents, going
+// by the signature that fits it on the most things, and then the one
+// whose sizes are closest. Returns "" if none fits, or two chipsets
+// fit as well.
+func IdentifyChipset(data []byte, entries []ArchiveEntry) string {
+	of := SignatureOf(data, entries)
+	chipset, best, closest := "", 0, 0.0
+	for i := range ArchiveSignatures {
+		s := &ArchiveSignatures[i]
+		n, off, ok := s.match(of)
+		switch {
+		case !ok || n < best || (n == best && off > closest):
+		case n > best || off < closest:
+			chipset, best, closest = s.Chipset, n, off
+		case s.Chipset != chipset:
+			chipset = ""
+		}
+	}
+	return chipset
+}
+
+func LoadArchiveSignatures(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	var extra []ArchiveSignature
+	if err = json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	ArchiveSignatures = append(ArchiveSignatures, extra...)
+	return nil
+}
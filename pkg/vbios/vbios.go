@@ -0,0 +1,239 @@
+// Copyright (c) 2018 Ilia Mirkin.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.  IN NO EVENT SHALL
+// THE COPYRIGHT HOLDER(S) OR AUTHOR(S) BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// Package vbios parses NVIDIA video BIOS images, as dumped from a
+// card or taken from a firmware update: the PCI expansion ROM images
+// they are made of, the BIT table that points at everything else, and
+// the falcon ucode table in it, which is what nouveau's bios code reads
+// too.
+package vbios
+
+import "bytes"
+import "encoding/binary"
+import "fmt"
+
+// One of the PCI expansion ROM images of a VBIOS: the x86 one (code
+// type 0), the UEFI one (3), and on newer cards the ones holding the
+// falcon ucode (0xe0)
+type Image struct {
+	Offset, Size int
+	CodeType byte
+}
+
+// The names of the code types, for the images' file names
+var CodeTypes = map[byte]string{
+	0x00: "pcat",
+	0x03: "efi",
+	0x70: "nbsi",
+	0xe0: "ucode",
+}
+
+// Split a ROM into its images: each starts with 55 aa and points at a
+// PCIR structure with its length in 512 byte units, and the last one
+// is marked as such. NVIDIA's NPDE extension, right after the PCIR
+// structure, may give a different length.
+func Images(rom []byte) []Image {
+	var images []Image
+	for off := 0; off + 0x1a <= len(rom); {
+		if rom[off] != 0x55 || rom[off+1] != 0xaa {
+			break
+		}
+		pcir := off + int(binary.LittleEndian.Uint16(rom[off+0x18:]))
+		if pcir + 0x18 > len(rom) || string(rom[pcir:pcir+4]) != "PCIR" {
+			break
+		}
+		size := int(binary.LittleEndian.Uint16(rom[pcir+0x10:])) * 512
+		last := rom[pcir+0x15] & 0x80 != 0
+		pcirLen := int(binary.LittleEndian.Uint16(rom[pcir+0x0a:]))
+		npde := pcir + ((pcirLen + 0xf) &^ 0xf)
+		if npde + 0x0c <= len(rom) && string(rom[npde:npde+4]) == "NPDE" {
+			size = int(binary.LittleEndian.Uint16(rom[npde+0x08:])) * 512
+			last = last || rom[npde+0x0a] & 0x80 != 0
+		}
+		if size == 0 || off + size > len(rom) {
+			size = len(rom) - off
+		}
+		images = append(images, Image{off, size, rom[pcir+0x14]})
+		if last {
+			break
+		}
+		off += size
+	}
+	return images
+}
+
+// An entry of the BIT table
+type BITToken struct {
+	Id, Version byte
+	Size, Offset uint16
+}
+
+var bitSignature = []byte("\xff\xb8BIT\x00")
+
+// Find the BIT table: its signature, a header that says how big the
+// tokens are and how many there are, and the tokens
+func ParseBIT(rom []byte) ([]BITToken, bool) {
+	off := bytes.Index(rom, bitSignature)
+	if off < 0 || off + 12 > len(rom) {
+		return nil, false
+	}
+	hdrSize, tokenSize, count := int(rom[off+8]), int(rom[off+9]), int(rom[off+10])
+	if tokenSize < 6 || off + hdrSize + tokenSize * count > len(rom) {
+		return nil, false
+	}
+	var tokens []BITToken
+	for i := 0; i < count; i++ {
+		t := rom[off + hdrSize + tokenSize * i:]
+		tokens = append(tokens, BITToken{t[0], t[1],
+			binary.LittleEndian.Uint16(t[2:]), binary.LittleEndian.Uint16(t[4:])})
+	}
+	return tokens, true
+}
+
+func findToken(tokens []BITToken, id byte) (BITToken, bool) {
+	for _, t := range tokens {
+		if t.Id == id {
+			return t, true
+		}
+	}
+	return BITToken{}, false
+}
+
+// The offsets of the devinit scripts, from the table the 'I' token
+// points at. The scripts are byte code, and only end where their last
+// opcode does, so only where they start is known here.
+func InitScripts(rom []byte, tokens []BITToken) []int {
+	t, ok := findToken(tokens, 'I')
+	if !ok || t.Size < 2 || int(t.Offset) + 2 > len(rom) {
+		return nil
+	}
+	var scripts []int
+	table := int(binary.LittleEndian.Uint16(rom[t.Offset:]))
+	for off := table; off + 2 <= len(rom) && len(scripts) < 256; off += 2 {
+		script := int(binary.LittleEndian.Uint16(rom[off:]))
+		if script == 0 {
+			break
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts
+}
+
+// A falcon ucode the VBIOS carries, from the table the 'p' token
+// points at
+type Ucode struct {
+	// The application id: what the ucode is for
+	Type byte
+	// Where the ucode and its descriptor are, in the data returned by
+	// UcodeSpace, and how long they are
+	Offset, Size int
+	// The descriptor version: 2 or 3, or 0 for the older layout
+	// nouveau parses as nvbios_pmuR
+	Version int
+}
+
+// What the application ids of the ucode table stand for, as far as
+// nouveau and nova know them
+var UcodeNames = map[byte]string{
+	0x01: "preos",
+	0x04: "devinit",
+	0x05: "sec_lic",
+	0x45: "fwsec_dbg",
+	0x85: "fwsec_prod",
+}
+
+// The name of a ucode, after its application id
+func (u Ucode) Name() string {
+	if name := UcodeNames[u.Type]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("ucode_0x%02x", u.Type)
+}
+
+// The offsets in the ucode table are into the x86 image followed by
+// the ucode images, leaving out any UEFI image in between. Without
+// ucode images, they are into the ROM as it is.
+func UcodeSpace(rom []byte, images []Image) []byte {
+	var space []byte
+	for i, img := range images {
+		if i == 0 || img.CodeType == 0xe0 {
+			space = append(space, rom[img.Offset:img.Offset+img.Size]...)
+		}
+	}
+	if len(images) < 2 || len(space) == images[0].Size {
+		return rom
+	}
+	return space
+}
+
+// Find the falcon ucode in a VBIOS, going through the 'p' token's
+// table. Entries whose descriptors don't fit in space are left out.
+func Ucodes(rom []byte, tokens []BITToken, space []byte) []Ucode {
+	t, ok := findToken(tokens, 'p')
+	if !ok || t.Version != 2 || t.Size < 4 || int(t.Offset) + 4 > len(rom) {
+		return nil
+	}
+	table := int(binary.LittleEndian.Uint32(rom[t.Offset:]))
+	if table == 0 || table + 4 > len(space) {
+		return nil
+	}
+	hdr, size, count := int(space[table+1]), int(space[table+2]), int(space[table+3])
+	if size < 6 || table + hdr + size * count > len(space) {
+		return nil
+	}
+	var ucodes []Ucode
+	for i := 0; i < count; i++ {
+		e := space[table + hdr + size * i:]
+		u := Ucode{Type: e[0], Offset: int(binary.LittleEndian.Uint32(e[2:]))}
+		if parseUcode(space, &u) {
+			ucodes = append(ucodes, u)
+		}
+	}
+	return ucodes
+}
+
+// Work out how long a ucode is from its descriptor. The v2 and v3
+// descriptors start with a word of flags, version and header size,
+// and the size of what follows; the older one has the sizes of the
+// boot loader, code and data after a 0x30 byte header.
+func parseUcode(space []byte, u *Ucode) bool {
+	if u.Offset <= 0 || u.Offset + 0x30 > len(space) {
+		return false
+	}
+	d := space[u.Offset:]
+	word := binary.LittleEndian.Uint32(d)
+	if version := int(word >> 8 & 0xff); word & 1 != 0 && (version == 2 || version == 3) {
+		hdrSize := int(word >> 16)
+		stored := int(binary.LittleEndian.Uint32(d[4:]))
+		if hdrSize >= 0x2c && stored > 0 && u.Offset + hdrSize + stored <= len(space) {
+			u.Size, u.Version = hdrSize + stored, version
+			return true
+		}
+	}
+	boot := uint64(binary.LittleEndian.Uint32(d[0x10:]))
+	code := uint64(binary.LittleEndian.Uint32(d[0x1c:]))
+	data := uint64(binary.LittleEndian.Uint32(d[0x2c:]))
+	total := 0x30 + boot + code + data
+	if boot + code == 0 || uint64(u.Offset) + total > uint64(len(space)) {
+		return false
+	}
+	u.Size = int(total)
+	return true
+}